@@ -0,0 +1,86 @@
+// main.go - Katzenpost consensus archive export tool.
+// Copyright (C) 2022  David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/katzenpost/katzenpost/client/config"
+	"github.com/katzenpost/katzenpost/core/crypto/rand"
+	"github.com/katzenpost/katzenpost/core/epochtime"
+	"github.com/katzenpost/katzenpost/core/log"
+	"github.com/katzenpost/katzenpost/core/pki"
+	"github.com/katzenpost/katzenpost/core/wire"
+)
+
+const archiveFilePrefix = "consensus-"
+
+func main() {
+	now, _, _ := epochtime.Now()
+	cfgFile := flag.String("c", "", "Path to the client config file.")
+	first := flag.Uint64("first", 0, "First epoch of the range to export.")
+	last := flag.Uint64("last", now, "Last epoch of the range to export.")
+	outDir := flag.String("o", ".", "Directory to write the documents to.")
+	timeout := flag.Duration("t", 5*time.Minute, "Timeout of the export.")
+	flag.Parse()
+
+	cfg, err := config.LoadFile(*cfgFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load config file '%v': %v\n", *cfgFile, err)
+		os.Exit(-1)
+	}
+	logBackend, err := log.New(cfg.Logging.File, cfg.Logging.Level, cfg.Logging.Disable)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to initialize logging: %v\n", err)
+		os.Exit(-1)
+	}
+
+	linkKey, _ := wire.DefaultScheme.GenerateKeypair(rand.Reader)
+	pkiClient, err := cfg.NewPKIClient(logBackend, cfg.UpstreamProxyConfig(), linkKey)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to create PKI client: %v\n", err)
+		os.Exit(-1)
+	}
+	archiveClient, ok := pkiClient.(pki.ArchiveClient)
+	if !ok {
+		fmt.Fprintf(os.Stderr, "PKI client can't fetch archived documents\n")
+		os.Exit(-1)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	docs, rawDocs, err := archiveClient.GetRange(ctx, *first, *last)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to fetch documents for epochs %v-%v: %v\n", *first, *last, err)
+		os.Exit(-1)
+	}
+
+	// Write the signed documents as they were published, one per epoch.
+	for i, doc := range docs {
+		f := filepath.Join(*outDir, fmt.Sprintf("%s%d", archiveFilePrefix, doc.Epoch))
+		if err := os.WriteFile(f, rawDocs[i], 0644); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to write document for epoch %v: %v\n", doc.Epoch, err)
+			os.Exit(-1)
+		}
+	}
+	fmt.Printf("Exported %d documents for epochs %v-%v.\n", len(docs), *first, *last)
+}
@@ -30,6 +30,7 @@ import (
 func main() {
 	cfgFile := flag.String("f", "katzenpost-authority.toml", "Path to the authority config file.")
 	genOnly := flag.Bool("g", false, "Generate the keys and exit immediately.")
+	rotateKeys := flag.Bool("rotate_keys", false, "Rotate the identity and link keys and exit immediately.")
 	flag.Parse()
 
 	// Set the umask to something "paranoid".
@@ -41,6 +42,14 @@ func main() {
 		os.Exit(-1)
 	}
 
+	if *rotateKeys {
+		if err := server.RotateKeys(cfg); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to rotate keys: %v\n", err)
+			os.Exit(-1)
+		}
+		os.Exit(0)
+	}
+
 	// Setup the signal handling.
 	ch := make(chan os.Signal)
 	signal.Notify(ch, os.Interrupt, syscall.SIGTERM)
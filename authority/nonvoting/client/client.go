@@ -20,8 +20,10 @@ package client
 import (
 	"context"
 	"crypto/hmac"
+	"errors"
 	"fmt"
 	"net"
+	"sync"
 
 	"github.com/katzenpost/katzenpost/core/crypto/cert"
 	"github.com/katzenpost/katzenpost/core/crypto/rand"
@@ -58,6 +60,10 @@ type Config struct {
 	// DialContextFn is the optional alternative Dialer.DialContext function
 	// to be used when creating outgoing network connections.
 	DialContextFn func(ctx context.Context, network, address string) (net.Conn, error)
+
+	// SphinxGeometry is the Sphinx geometry of the wire sessions with the
+	// authority, which defaults to sphinx.DefaultGeometry().
+	SphinxGeometry *sphinx.Geometry
 }
 
 func (cfg *Config) validate() error {
@@ -67,14 +73,95 @@ func (cfg *Config) validate() error {
 	if cfg.AuthorityIdentityKey == nil {
 		return fmt.Errorf("nonvoting/client: AuthorityIdentityKeyPublicKey is mandatory")
 	}
+	if cfg.SphinxGeometry == nil {
+		cfg.SphinxGeometry = sphinx.DefaultGeometry()
+	}
 	return nil
 }
 
+// authorityKeys are the keys the authority is authenticated by.
+type authorityKeys struct {
+	identityKey sign.PublicKey
+	linkKey     wire.PublicKey
+}
+
 type client struct {
+	sync.RWMutex
+
 	cfg *Config
 	log *logging.Logger
 
-	serverLinkKey wire.PublicKey
+	// keys are the current keys of the authority, followed by the ones
+	// succeeding them through its key rotations.
+	keys []*authorityKeys
+
+	// retiredKeys are the identity keys retired by the authority.
+	retiredKeys []sign.PublicKey
+}
+
+func (c *client) getKeys() []*authorityKeys {
+	c.RLock()
+	defer c.RUnlock()
+	return c.keys
+}
+
+// identityKeys returns the current identity key of the authority, along
+// with the ones succeeding it and the ones it retired.
+func (c *client) identityKeys() []cert.Verifier {
+	c.RLock()
+	defer c.RUnlock()
+	keys := []cert.Verifier{}
+	for _, k := range c.keys {
+		keys = append(keys, k.identityKey)
+	}
+	for _, k := range c.retiredKeys {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// followKeyRotations adds the keys succeeding the ones of the authority
+// through the key rotation statements, and returns the number of rotations
+// followed.  The authority keeps being authenticated by its current keys
+// until it uses the new ones.
+func (c *client) followKeyRotations(rotations []*pki.AuthorityKeyRotation) int {
+	c.Lock()
+	defer c.Unlock()
+	followed := 0
+	for _, r := range rotations {
+		known, from := false, false
+		for _, k := range c.keys {
+			known = known || k.identityKey.Equal(r.NewIdentityKey)
+			from = from || k.identityKey.Equal(r.OldIdentityKey)
+		}
+		if known || !from {
+			continue
+		}
+		keys := append([]*authorityKeys{}, c.keys...)
+		c.keys = append(keys, &authorityKeys{identityKey: r.NewIdentityKey, linkKey: r.NewLinkKey})
+		c.log.Noticef("Following the key rotation of the authority to %x", r.NewIdentityKey.Sum256())
+		followed++
+	}
+	return followed
+}
+
+// promoteKeys retires the keys of the authority preceding the ones it uses.
+func (c *client) promoteKeys(identityKey sign.PublicKey) {
+	c.Lock()
+	defer c.Unlock()
+	for i, k := range c.keys {
+		if !k.identityKey.Equal(identityKey) {
+			continue
+		}
+		for _, retired := range c.keys[:i] {
+			c.retiredKeys = append(c.retiredKeys, retired.identityKey)
+		}
+		c.keys = c.keys[i:]
+		if i > 0 {
+			c.log.Noticef("The authority switched to the identity key %x", identityKey.Sum256())
+		}
+		return
+	}
 }
 
 func (c *client) Post(ctx context.Context, epoch uint64, signingPrivateKey sign.PrivateKey, signingPublicKey sign.PublicKey, d *pki.MixDescriptor) error {
@@ -172,7 +259,7 @@ func (c *client) Get(ctx context.Context, epoch uint64) (*pki.Document, []byte,
 	}
 
 	// Validate the document.
-	doc, err := pki.VerifyAndParseDocument(r.Payload, []cert.Verifier{c.cfg.AuthorityIdentityKey})
+	doc, err := c.verifyDocument(r.Payload)
 	if err != nil {
 		return nil, nil, err
 	} else if doc.Epoch != epoch {
@@ -184,8 +271,112 @@ func (c *client) Get(ctx context.Context, epoch uint64) (*pki.Document, []byte,
 	return doc, r.Payload, nil
 }
 
+// GetRange returns the archived PKI documents along with their raw
+// serialized form, for the epochs from first to last included which have
+// one.  The authority must be configured to archive its documents to serve
+// them, and refuses the ranges which start before its retention.
+func (c *client) GetRange(ctx context.Context, first, last uint64) ([]*pki.Document, [][]byte, error) {
+	c.log.Debugf("GetRange(ctx, %d, %d)", first, last)
+	if first > last {
+		return nil, nil, fmt.Errorf("nonvoting/client: GetRange() invalid epoch range: %d-%d", first, last)
+	}
+
+	// Generate a random wire keypair to use for the link authentication.
+	scheme := wire.DefaultScheme
+	linkKey, _ := scheme.GenerateKeypair(rand.Reader)
+	defer linkKey.Reset()
+
+	doneCh := make(chan interface{})
+	defer close(doneCh)
+
+	docs := []*pki.Document{}
+	rawDocs := [][]byte{}
+	for {
+		conn, s, err := c.initSession(ctx, doneCh, nil, linkKey)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		// Dispatch the get_consensus_range command.
+		cmd := &commands.GetConsensusRange{FirstEpoch: first, LastEpoch: last}
+		resp, err := c.doRoundTrip(ctx, s, cmd)
+		s.Close()
+		conn.Close()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		// Parse the consensus_range command.
+		r, ok := resp.(*commands.ConsensusRange)
+		if !ok {
+			return nil, nil, fmt.Errorf("nonvoting/client: GetRange() unexpected reply: %T", resp)
+		}
+		if r.ErrorCode != commands.ConsensusOk {
+			return nil, nil, fmt.Errorf("nonvoting/Client: GetRange() rejected by authority: %v", getErrorToString(r.ErrorCode))
+		}
+		if len(r.Epochs) != len(r.Documents) || (r.NextEpoch != 0 && (r.NextEpoch <= first || r.NextEpoch > last)) {
+			return nil, nil, errors.New("nonvoting/client: GetRange() invalid reply")
+		}
+
+		// Validate the documents.
+		for i, raw := range r.Documents {
+			if r.Epochs[i] < first || r.Epochs[i] > last {
+				c.log.Warningf("nonvoting/Client: GetRange() authority returned document for wrong epoch: %v", r.Epochs[i])
+				return nil, nil, pki.ErrInvalidEpoch
+			}
+			doc, err := pki.VerifyAndParseArchivedDocument(raw, [][]cert.Verifier{c.identityKeys()}, 1, r.Epochs[i])
+			if err != nil {
+				return nil, nil, err
+			}
+			docs = append(docs, doc)
+			rawDocs = append(rawDocs, raw)
+		}
+		if r.NextEpoch == 0 {
+			return docs, rawDocs, nil
+		}
+		first = r.NextEpoch
+	}
+}
+
 func (c *client) Deserialize(raw []byte) (*pki.Document, error) {
-	return pki.VerifyAndParseDocument(raw, []cert.Verifier{c.cfg.AuthorityIdentityKey})
+	return c.verifyDocument(raw)
+}
+
+// verifyDocument verifies and parses the document, and follows the key
+// rotation of the authority it carries.  A document signed by a key which
+// is not known yet is verified again after following the rotation to it,
+// which is certified by the key being retired.
+func (c *client) verifyDocument(raw []byte) (*pki.Document, error) {
+	doc, err := c.verifyAndParseDocument(raw)
+	if err != nil {
+		unverified := new(pki.Document)
+		if uerr := unverified.UnmarshalBinary(raw); uerr != nil || c.followKeyRotations(unverified.AuthorityKeyRotations()) == 0 {
+			return nil, err
+		}
+		if doc, err = c.verifyAndParseDocument(raw); err != nil {
+			return nil, err
+		}
+	}
+	c.followKeyRotations(doc.AuthorityKeyRotations())
+	return doc, nil
+}
+
+// verifyAndParseDocument verifies that the document is signed by the
+// current identity key of the authority, or one succeeding it which then
+// becomes the current one, and parses it.
+func (c *client) verifyAndParseDocument(raw []byte) (*pki.Document, error) {
+	var firstErr error
+	for _, k := range c.getKeys() {
+		doc, err := pki.VerifyAndParseDocument(raw, []cert.Verifier{k.identityKey})
+		if err == nil {
+			c.promoteKeys(k.identityKey)
+			return doc, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	return nil, firstErr
 }
 
 func (c *client) initSession(ctx context.Context, doneCh <-chan interface{}, signingKey sign.PublicKey, linkKey wire.PrivateKey) (net.Conn, *wire.Session, error) {
@@ -214,7 +405,7 @@ func (c *client) initSession(ctx context.Context, doneCh <-chan interface{}, sig
 
 	// Initialize the wire protocol session.
 	cfg := &wire.SessionConfig{
-		Geometry:          sphinx.DefaultGeometry(),
+		Geometry:          c.cfg.SphinxGeometry,
 		Authenticator:     c,
 		AdditionalData:    ad,
 		AuthenticationKey: linkKey,
@@ -243,16 +434,19 @@ func (c *client) initSession(ctx context.Context, doneCh <-chan interface{}, sig
 }
 
 func (c *client) IsPeerValid(creds *wire.PeerCredentials) bool {
-	keyHash := c.cfg.AuthorityIdentityKey.Sum256()
-	if !hmac.Equal(keyHash[:], creds.AdditionalData[:sign.PublicKeyHashSize]) {
-		c.log.Warningf("nonvoting/Client: IsPeerValid(): AD mismatch: got %x != want %x", creds.AdditionalData, keyHash[:])
-		return false
-	}
-	if !c.serverLinkKey.Equal(creds.PublicKey) {
-		c.log.Warningf("nonvoting/Client: IsPeerValid(): Public Key mismatch: %v", creds.PublicKey)
-		return false
+	for _, k := range c.getKeys() {
+		keyHash := k.identityKey.Sum256()
+		if !hmac.Equal(keyHash[:], creds.AdditionalData[:sign.PublicKeyHashSize]) {
+			continue
+		}
+		if !k.linkKey.Equal(creds.PublicKey) {
+			c.log.Warningf("nonvoting/Client: IsPeerValid(): Public Key mismatch: %v", creds.PublicKey)
+			return false
+		}
+		return true
 	}
-	return true
+	c.log.Warningf("nonvoting/Client: IsPeerValid(): AD mismatch: got %x", creds.AdditionalData)
+	return false
 }
 
 func (c *client) doRoundTrip(ctx context.Context, s *wire.Session, cmd commands.Command) (commands.Command, error) {
@@ -274,7 +468,7 @@ func New(cfg *Config) (pki.Client, error) {
 	c := new(client)
 	c.cfg = cfg
 	c.log = cfg.LogBackend.GetLogger("pki/nonvoting/client")
-	c.serverLinkKey = cfg.AuthorityLinkKey
+	c.keys = []*authorityKeys{{identityKey: cfg.AuthorityIdentityKey, linkKey: cfg.AuthorityLinkKey}}
 
 	return c, nil
 }
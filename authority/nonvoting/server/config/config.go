@@ -31,6 +31,8 @@ import (
 	"github.com/katzenpost/katzenpost/core/crypto/cert"
 	"github.com/katzenpost/katzenpost/core/crypto/pem"
 	"github.com/katzenpost/katzenpost/core/crypto/rand"
+	"github.com/katzenpost/katzenpost/core/pki"
+	"github.com/katzenpost/katzenpost/core/sphinx"
 	"github.com/katzenpost/katzenpost/core/utils"
 )
 
@@ -58,6 +60,8 @@ const (
 	defaultLambdaM              = 0.00025
 	defaultLambdaMMaxPercentile = 0.99999
 
+	defaultManagementSocket = "management_sock"
+
 	publicKeyHashSize = 32 // blake2b.Sum256
 )
 
@@ -75,6 +79,16 @@ type Server struct {
 
 	// DataDir is the absolute path to the authority's state files.
 	DataDir string
+
+	// Archive serves the consensus documents of past epochs kept in the
+	// database, so that the history of the network can be fetched with the
+	// GetConsensusRange command.
+	Archive bool
+
+	// ArchiveRetention is the number of past epochs the documents of which
+	// the archive keeps.  The documents archived while it is set are deleted
+	// once older, and if 0, every document is kept.
+	ArchiveRetention uint64
 }
 
 func (sCfg *Server) validate() error {
@@ -97,6 +111,9 @@ func (sCfg *Server) validate() error {
 	if !filepath.IsAbs(sCfg.DataDir) {
 		return fmt.Errorf("config: Authority: DataDir '%v' is not an absolute path", sCfg.DataDir)
 	}
+	if sCfg.ArchiveRetention != 0 && !sCfg.Archive {
+		return fmt.Errorf("config: Authority: ArchiveRetention is set without Archive")
+	}
 	return nil
 }
 
@@ -259,10 +276,6 @@ type Debug struct {
 }
 
 func (dCfg *Debug) validate() error {
-	if dCfg.Layers > defaultLayers {
-		// This is a limitation of the Sphinx implementation.
-		return fmt.Errorf("config: Debug: Layers %v exceeds maximum", dCfg.Layers)
-	}
 	return nil
 }
 
@@ -283,6 +296,11 @@ type Node struct {
 
 	// IdentityKeyPem is the node's identity signing key pem file path.
 	IdentityKeyPem string
+
+	// LoadWeight is the load balancing weight assigned to the mix, or 0
+	// to assign none, the mix then being given the median weight of its
+	// layer.  The weight declared in its descriptor is not used.
+	LoadWeight uint8
 }
 
 func (n *Node) validate(isProvider bool) error {
@@ -292,6 +310,9 @@ func (n *Node) validate(isProvider bool) error {
 		if n.Identifier == "" {
 			return fmt.Errorf("config: %v: Node is missing Identifier", section)
 		}
+		if n.LoadWeight != 0 {
+			return fmt.Errorf("config: %v: Node has LoadWeight set", section)
+		}
 		var err error
 		n.Identifier, err = idna.Lookup.ToASCII(n.Identifier)
 		if err != nil {
@@ -306,12 +327,40 @@ func (n *Node) validate(isProvider bool) error {
 	return nil
 }
 
+// Management is the authority management interface configuration.
+type Management struct {
+	// Enable enables the management interface.
+	Enable bool
+
+	// Path specifies the path to the management interface socket.  If left
+	// empty it will use `management_sock` under the DataDir.
+	Path string
+}
+
+func (mCfg *Management) applyDefaults(sCfg *Server) {
+	if mCfg.Path == "" {
+		mCfg.Path = filepath.Join(sCfg.DataDir, defaultManagementSocket)
+	}
+}
+
+func (mCfg *Management) validate() error {
+	if !mCfg.Enable {
+		return nil
+	}
+	if !filepath.IsAbs(mCfg.Path) {
+		return fmt.Errorf("config: Management: Path '%v' is not an absolute path", mCfg.Path)
+	}
+	return nil
+}
+
 // Config is the top level authority configuration.
 type Config struct {
-	Server     *Server
-	Logging    *Logging
-	Parameters *Parameters
-	Debug      *Debug
+	Server         *Server
+	Logging        *Logging
+	Parameters     *Parameters
+	SphinxGeometry *sphinx.Geometry
+	Management     *Management
+	Debug          *Debug
 
 	Mixes     []*Node
 	Providers []*Node
@@ -331,6 +380,12 @@ func (cfg *Config) FixupAndValidate() error {
 	if cfg.Parameters == nil {
 		cfg.Parameters = &Parameters{}
 	}
+	if cfg.SphinxGeometry == nil {
+		cfg.SphinxGeometry = sphinx.DefaultGeometry()
+	}
+	if cfg.Management == nil {
+		cfg.Management = &Management{}
+	}
 	if cfg.Debug == nil {
 		cfg.Debug = &Debug{}
 	}
@@ -348,8 +403,21 @@ func (cfg *Config) FixupAndValidate() error {
 	if err := cfg.Debug.validate(); err != nil {
 		return err
 	}
+	cfg.Management.applyDefaults(cfg.Server)
+	if err := cfg.Management.validate(); err != nil {
+		return err
+	}
 	cfg.Parameters.applyDefaults()
 	cfg.Debug.applyDefaults()
+	geo, err := sphinx.FixupGeometry(cfg.SphinxGeometry)
+	if err != nil {
+		return fmt.Errorf("config: SphinxGeometry: %v", err)
+	}
+	cfg.SphinxGeometry = geo
+
+	if err := pki.IsTopologyGeometryCompatible(cfg.Debug.Layers, cfg.SphinxGeometry); err != nil {
+		return fmt.Errorf("config: Debug: %v", err)
+	}
 
 	allNodes := make([]*Node, 0, len(cfg.Mixes)+len(cfg.Providers))
 	for _, v := range cfg.Mixes {
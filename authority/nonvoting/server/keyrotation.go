@@ -0,0 +1,239 @@
+// keyrotation.go - Katzenpost non-voting authority key rotation.
+// Copyright (C) 2022  David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/katzenpost/katzenpost/authority/nonvoting/server/config"
+	"github.com/katzenpost/katzenpost/core/crypto/cert"
+	"github.com/katzenpost/katzenpost/core/crypto/pem"
+	"github.com/katzenpost/katzenpost/core/crypto/rand"
+	"github.com/katzenpost/katzenpost/core/crypto/sign"
+	"github.com/katzenpost/katzenpost/core/epochtime"
+	"github.com/katzenpost/katzenpost/core/pki"
+	"github.com/katzenpost/katzenpost/core/utils"
+	"github.com/katzenpost/katzenpost/core/wire"
+)
+
+const (
+	identityPrivateKeyFile = "identity.private.pem"
+	identityPublicKeyFile  = "identity.public.pem"
+	linkPrivateKeyFile     = "link.private.pem"
+	linkPublicKeyFile      = "link.public.pem"
+	keyRotationFile        = "key_rotation.cbor"
+
+	// KeyRotationNotice is how long the authority announces its key
+	// rotation in its documents before switching to its new keys, for the
+	// clients to follow it.
+	KeyRotationNotice = 24 * time.Hour
+)
+
+var keyFiles = []string{
+	identityPrivateKeyFile,
+	identityPublicKeyFile,
+	linkPrivateKeyFile,
+	linkPublicKeyFile,
+}
+
+// authorityKeys are the keys an authority rotates to.
+type authorityKeys struct {
+	identityPrivateKey sign.PrivateKey
+	identityPublicKey  sign.PublicKey
+	linkKey            wire.PrivateKey
+}
+
+// RotateKeys generates new identity and link keys for the authority, which
+// are written aside in its data directory with the ".new" suffix, along
+// with the key rotation statement from the old identity key to the new
+// one.  The authority must not be running.
+//
+// The authority announces the statement in its documents, and switches to
+// the new keys after KeyRotationNotice, keeping the old ones with the
+// ".old" suffix, while the clients follow the rotation from the documents.
+// A new rotation is refused as long as the statement of the previous one
+// is valid or the old keys of the previous one are kept.
+func RotateKeys(cfg *config.Config) error {
+	path := func(f string) string {
+		return filepath.Join(cfg.Server.DataDir, f)
+	}
+
+	if statement, err := os.ReadFile(path(keyRotationFile)); err == nil {
+		switch _, err := pki.VerifyAuthorityKeyRotation(statement); err {
+		case nil:
+			return errors.New("authority: the previous key rotation statement is still valid, rotate the keys again once it expired")
+		case cert.ErrCertificateExpired:
+		default:
+			return fmt.Errorf("authority: invalid key rotation statement: %v", err)
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	for _, f := range keyFiles {
+		if pem.Exists(path(f + ".old")) {
+			return errors.New("authority: the keys of a previous rotation exist, remove the .old keys once the peers and the clients have followed the rotation")
+		}
+	}
+
+	oldPrivateKey, oldPublicKey := cert.Scheme.NewKeypair()
+	if !pem.BothExists(path(identityPrivateKeyFile), path(identityPublicKeyFile)) {
+		return errors.New("authority: no identity key to rotate")
+	}
+	if err := pem.FromFile(path(identityPrivateKeyFile), oldPrivateKey); err != nil {
+		return err
+	}
+	if err := pem.FromFile(path(identityPublicKeyFile), oldPublicKey); err != nil {
+		return err
+	}
+
+	newPrivateKey, newPublicKey := cert.Scheme.NewKeypair()
+	linkPrivateKey, linkPublicKey := wire.DefaultScheme.GenerateKeypair(rand.Reader)
+	statement, err := pki.SignAuthorityKeyRotation(oldPrivateKey, oldPublicKey, newPrivateKey, newPublicKey, linkPublicKey)
+	if err != nil {
+		return err
+	}
+
+	// Write the new keys aside, then the statement, so that the authority
+	// only announces the rotation once the new keys are persisted.
+	newKeys := map[string]pem.KeyMaterial{
+		identityPrivateKeyFile: newPrivateKey,
+		identityPublicKeyFile:  newPublicKey,
+		linkPrivateKeyFile:     linkPrivateKey,
+		linkPublicKeyFile:      linkPublicKey,
+	}
+	for _, f := range keyFiles {
+		os.Remove(path(f + ".new"))
+		if err := pem.ToFile(path(f+".new"), newKeys[f]); err != nil {
+			return err
+		}
+	}
+	return utils.WriteFileSync(path(keyRotationFile), statement)
+}
+
+// completeKeySwitch completes the switch to the new keys of a rotation,
+// which was interrupted if both new and old keys are present.
+func completeKeySwitch(dataDir string) error {
+	hasNew, hasOld := false, false
+	for _, f := range keyFiles {
+		hasNew = hasNew || pem.Exists(filepath.Join(dataDir, f+".new"))
+		hasOld = hasOld || pem.Exists(filepath.Join(dataDir, f+".old"))
+	}
+	if hasNew && hasOld {
+		return utils.SwapFiles(dataDir, keyFiles)
+	}
+	return nil
+}
+
+// loadKeyRotation loads the key rotation statement of the authority from
+// its data directory, unless it has expired, along with the new keys if
+// the authority has not switched to them yet.
+func (s *Server) loadKeyRotation() error {
+	path := func(f string) string {
+		return filepath.Join(s.cfg.Server.DataDir, f)
+	}
+
+	statement, err := os.ReadFile(path(keyRotationFile))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	r, err := pki.VerifyAuthorityKeyRotation(statement)
+	if err == cert.ErrCertificateExpired {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("authority: invalid key rotation statement: %v", err)
+	}
+	if r.NewIdentityKey.Equal(s.identityPublicKey) {
+		s.keyRotation = r
+		return nil
+	}
+	if !r.OldIdentityKey.Equal(s.identityPublicKey) {
+		return errors.New("authority: key rotation statement is not from or to the identity key")
+	}
+
+	next := new(authorityKeys)
+	next.identityPrivateKey, next.identityPublicKey = cert.Scheme.NewKeypair()
+	if err := pem.FromFile(path(identityPrivateKeyFile+".new"), next.identityPrivateKey); err != nil {
+		return err
+	}
+	if err := pem.FromFile(path(identityPublicKeyFile+".new"), next.identityPublicKey); err != nil {
+		return err
+	}
+	linkPrivateKey, linkPublicKey := wire.DefaultScheme.GenerateKeypair(rand.Reader)
+	if err := pem.FromFile(path(linkPrivateKeyFile+".new"), linkPrivateKey); err != nil {
+		return err
+	}
+	if err := pem.FromFile(path(linkPublicKeyFile+".new"), linkPublicKey); err != nil {
+		return err
+	}
+	if !next.identityPublicKey.Equal(r.NewIdentityKey) || !linkPublicKey.Equal(r.NewLinkKey) {
+		return errors.New("authority: the new keys are not the ones of the key rotation statement")
+	}
+	next.linkKey = linkPrivateKey
+	s.keyRotation, s.nextKeys = r, next
+	return nil
+}
+
+// switchKeys switches the authority to the new keys of its key rotation,
+// in its data directory and in memory.
+func (s *Server) switchKeys(r *pki.AuthorityKeyRotation) error {
+	next := s.nextKeys
+	if next == nil || !next.identityPublicKey.Equal(r.NewIdentityKey) {
+		return errors.New("authority: no new keys to switch to")
+	}
+	if err := utils.SwapFiles(s.cfg.Server.DataDir, keyFiles); err != nil {
+		return err
+	}
+
+	s.keysLock.Lock()
+	s.identityPrivateKey = next.identityPrivateKey
+	s.identityPublicKey = next.identityPublicKey
+	s.linkKey = next.linkKey
+	s.nextKeys = nil
+	s.keysLock.Unlock()
+
+	s.log.Noticef("Authority switched to the identity key %x", r.NewIdentityKey.Sum256())
+	return nil
+}
+
+// announceKeyRotation adds the key rotation statement of the authority to
+// the document, and switches the authority to its new keys once it was
+// announced for KeyRotationNotice.
+func (s *state) announceKeyRotation(doc *pki.Document) error {
+	// Lock is held (called from the onWakeup hook).
+	r := s.s.keyRotation
+	if r == nil {
+		return nil
+	}
+	if _, err := pki.VerifyAuthorityKeyRotation(r.Raw); err != nil {
+		if s.s.nextKeys != nil {
+			s.log.Errorf("The key rotation statement expired before the switch to the new keys, rotate the keys again")
+		}
+		s.s.keyRotation, s.s.nextKeys = nil, nil
+		return nil
+	}
+	doc.KeyRotations = [][]byte{r.Raw}
+	if s.s.nextKeys != nil && doc.Epoch >= r.Epoch+uint64(KeyRotationNotice/epochtime.Period) {
+		return s.s.switchKeys(r)
+	}
+	return nil
+}
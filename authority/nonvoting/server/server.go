@@ -37,6 +37,8 @@ import (
 	"github.com/katzenpost/katzenpost/core/crypto/rand"
 	"github.com/katzenpost/katzenpost/core/crypto/sign"
 	"github.com/katzenpost/katzenpost/core/log"
+	"github.com/katzenpost/katzenpost/core/pki"
+	"github.com/katzenpost/katzenpost/core/thwack"
 	"github.com/katzenpost/katzenpost/core/wire"
 )
 
@@ -50,15 +52,20 @@ type Server struct {
 
 	cfg *config.Config
 
+	keysLock           sync.RWMutex
 	identityPrivateKey sign.PrivateKey
 	identityPublicKey  sign.PublicKey
 	linkKey            wire.PrivateKey
 
+	keyRotation *pki.AuthorityKeyRotation
+	nextKeys    *authorityKeys
+
 	logBackend *log.Backend
 	log        *logging.Logger
 
-	state     *state
-	listeners []net.Listener
+	state      *state
+	listeners  []net.Listener
+	management *thwack.Server
 
 	fatalErrCh chan error
 	haltedCh   chan interface{}
@@ -109,9 +116,19 @@ func (s *Server) initLogging() error {
 
 // IdentityKey returns the running Server's identity public key.
 func (s *Server) IdentityKey() sign.PublicKey {
+	s.keysLock.RLock()
+	defer s.keysLock.RUnlock()
 	return s.identityPublicKey
 }
 
+// sessionKeys returns the identity key hash and the link key which the
+// wire sessions of the Server are authenticated with.
+func (s *Server) sessionKeys() ([sign.PublicKeyHashSize]byte, wire.PrivateKey) {
+	s.keysLock.RLock()
+	defer s.keysLock.RUnlock()
+	return s.identityPublicKey.Sum256(), s.linkKey
+}
+
 // RotateLog rotates the log file
 // if logging to a file is enabled.
 func (s *Server) RotateLog() {
@@ -160,6 +177,12 @@ func (s *Server) listenWorker(l net.Listener) {
 func (s *Server) halt() {
 	s.log.Notice("Starting graceful shutdown.")
 
+	// Halt the management interface.
+	if s.management != nil {
+		s.management.Halt()
+		s.management = nil
+	}
+
 	// Halt the listeners.
 	for idx, l := range s.listeners {
 		if l != nil {
@@ -207,6 +230,12 @@ func New(cfg *config.Config) (*Server, error) {
 		s.log.Warning("Unsafe Debug logging is enabled.")
 	}
 
+	// Complete a switch to the new keys of a key rotation, which was
+	// interrupted.
+	if err := completeKeySwitch(s.cfg.Server.DataDir); err != nil {
+		return nil, err
+	}
+
 	// Initialize the authority identity key.
 	var err error
 	identityPrivateKeyFile := filepath.Join(s.cfg.Server.DataDir, "identity.private.pem")
@@ -292,17 +321,27 @@ func New(cfg *config.Config) (*Server, error) {
 	idKeyHash := s.identityPublicKey.Sum256()
 	s.log.Noticef("Authority identity public key is: %x", idKeyHash[:])
 
+	if err := s.loadKeyRotation(); err != nil {
+		return nil, err
+	}
+	if s.nextKeys != nil {
+		s.log.Noticef("Authority rotates its identity key to %x", s.nextKeys.identityPublicKey.Sum256())
+	}
+
 	if s.cfg.Debug.GenerateOnly {
 		return nil, ErrGenerateOnly
 	}
 
 	// Ensure that there are enough mixes and providers whitelisted to form
-	// a topology, assuming all of them post a descriptor.
-	if len(cfg.Providers) < 1 {
-		return nil, fmt.Errorf("server: No Providers specified in the config")
-	}
-	if len(cfg.Mixes) < cfg.Debug.Layers*cfg.Debug.MinNodesPerLayer {
-		return nil, fmt.Errorf("server: Insufficient nodes whitelisted, got %v , need %v", len(cfg.Mixes), cfg.Debug.Layers*cfg.Debug.MinNodesPerLayer)
+	// a topology, assuming all of them post a descriptor, unless they may
+	// be whitelisted through the management interface.
+	if !cfg.Management.Enable {
+		if len(cfg.Providers) < 1 {
+			return nil, fmt.Errorf("server: No Providers specified in the config")
+		}
+		if len(cfg.Mixes) < cfg.Debug.Layers*cfg.Debug.MinNodesPerLayer {
+			return nil, fmt.Errorf("server: Insufficient nodes whitelisted, got %v , need %v", len(cfg.Mixes), cfg.Debug.Layers*cfg.Debug.MinNodesPerLayer)
+		}
 	}
 
 	// Past this point, failures need to call s.Shutdown() to do cleanup.
@@ -328,6 +367,14 @@ func New(cfg *config.Config) (*Server, error) {
 		return nil, err
 	}
 
+	// Start up the management interface.
+	if s.cfg.Management.Enable {
+		if err := s.initManagement(); err != nil {
+			s.log.Errorf("Failed to initialize management interface: %v", err)
+			return nil, err
+		}
+	}
+
 	// Start up the listeners.
 	for _, v := range s.cfg.Server.Addresses {
 		l, err := net.Listen("tcp", v)
@@ -24,9 +24,11 @@ import (
 	"fmt"
 	"io"
 	"path/filepath"
+	"sort"
 	"sync"
 	"time"
 
+	"github.com/fxamacker/cbor/v2"
 	"golang.org/x/crypto/sha3"
 
 	"github.com/katzenpost/katzenpost/core/crypto/cert"
@@ -42,14 +44,18 @@ import (
 )
 
 const (
-	descriptorsBucket = "descriptors"
-	documentsBucket   = "documents"
+	descriptorsBucket    = "descriptors"
+	documentsBucket      = "documents"
+	keyRotationsBucket   = "keyRotations"
+	authorizationsBucket = "authorizations"
+	retentionBucket      = "retention"
 )
 
 var (
 	MixPublishDeadline = epochtime.Period / 4
 	errGone            = errors.New("authority: Requested epoch will never get a Document")
 	errNotYet          = errors.New("authority: Document is not ready yet")
+	errForbidden       = errors.New("authority: Node is not authorized")
 	weekOfEpochs       = uint64(time.Duration(time.Hour*24*7) / epochtime.Period)
 	WarpedEpoch        string
 )
@@ -64,6 +70,27 @@ type document struct {
 	raw []byte
 }
 
+// authorization is the authorization, or deauthorization, of a node made
+// through the management interface.  It is persisted, and overrides the
+// configuration.
+type authorization struct {
+	// Authorized is false if the node is deauthorized.
+	Authorized bool
+
+	// IdentityKey is the serialized identity key of the node.
+	IdentityKey []byte
+
+	// Provider is true if the node is a Provider.
+	Provider bool
+
+	// Identifier is the identifier of a Provider.
+	Identifier string
+
+	// LoadWeight is the load weight assigned to a mix, or 0 to assign
+	// none.
+	LoadWeight uint8
+}
+
 type state struct {
 	sync.RWMutex
 	worker.Worker
@@ -75,7 +102,9 @@ type state struct {
 
 	reverseHash         map[[sign.PublicKeyHashSize]byte]sign.PublicKey
 	authorizedMixes     map[[sign.PublicKeyHashSize]byte]bool
+	assignedLoadWeights map[[sign.PublicKeyHashSize]byte]uint8
 	authorizedProviders map[[sign.PublicKeyHashSize]byte]string
+	keyRotations        map[[sign.PublicKeyHashSize]byte][sign.PublicKeyHashSize]byte
 
 	documents   map[uint64]*document
 	descriptors map[uint64]map[[sign.PublicKeyHashSize]byte]*descriptor
@@ -175,13 +204,18 @@ func (s *state) hasEnoughDescriptors(m map[[sign.PublicKeyHashSize]byte]*descrip
 	//  * One provider.
 	//
 	// Otherwise, it's pointless to generate a unusable document.
-	nrProviders := 0
+	nrProviders, nrNodes := 0, 0
 	for _, v := range m {
+		// The nodes deauthorized since their upload don't count.
+		if !s.isDescriptorAuthorized(v.desc) {
+			continue
+		}
 		if v.desc.Provider {
 			nrProviders++
+		} else {
+			nrNodes++
 		}
 	}
-	nrNodes := len(m) - nrProviders
 
 	minNodes := s.s.cfg.Debug.Layers * s.s.cfg.Debug.MinNodesPerLayer
 	return nrProviders > 0 && nrNodes >= minNodes
@@ -196,6 +230,10 @@ func (s *state) generateDocument(epoch uint64) {
 	var providers []*pki.MixDescriptor
 	var nodes []*descriptor
 	for _, v := range s.descriptors[epoch] {
+		if !s.isDescriptorAuthorized(v.desc) {
+			// The node was deauthorized since its upload.
+			continue
+		}
 		if v.desc.Provider {
 			providers = append(providers, v.desc)
 		} else {
@@ -226,8 +264,19 @@ func (s *state) generateDocument(epoch uint64) {
 		LambdaDMaxDelay:   s.s.cfg.Parameters.LambdaDMaxDelay,
 		LambdaM:           s.s.cfg.Parameters.LambdaM,
 		LambdaMMaxDelay:   s.s.cfg.Parameters.LambdaMMaxDelay,
+		SphinxGeometry:    s.s.cfg.SphinxGeometry,
 		Topology:          topology,
 		Providers:         providers,
+		LoadWeights:       make(map[[sign.PublicKeyHashSize]byte]uint8),
+	}
+	// Override the declared load weights with the configured ones.
+	for _, l := range topology {
+		for _, desc := range l {
+			pk := desc.IdentityKey.Sum256()
+			if w, ok := s.assignedLoadWeights[pk]; ok {
+				doc.LoadWeights[pk] = w
+			}
+		}
 	}
 	// For compatibility with shared implementation between voting
 	// and non-voting authority, add SharedRandomValue.
@@ -277,6 +326,13 @@ func (s *state) generateDocument(epoch uint64) {
 	}
 	doc.PriorSharedRandom = s.priorSRV
 
+	// Announce the key rotation of the authority.
+	if err := s.announceKeyRotation(doc); err != nil {
+		s.log.Errorf("Failed to switch to the new keys: %v", err)
+		s.s.fatalErrCh <- err
+		return
+	}
+
 	// Serialize and sign the Document.
 	signed, err := pki.SignDocument(s.s.identityPrivateKey, s.s.identityPublicKey, doc)
 	if err != nil {
@@ -307,7 +363,7 @@ func (s *state) generateDocument(epoch uint64) {
 	if err := s.db.Update(func(tx *bolt.Tx) error {
 		bkt := tx.Bucket([]byte(documentsBucket))
 		bkt.Put(epochToBytes(epoch), []byte(signed))
-		return nil
+		return s.retainDocument(tx, epoch)
 	}); err != nil {
 		// Persistence failures are FATAL.
 		s.s.fatalErrCh <- err
@@ -407,20 +463,28 @@ func (s *state) generateRandomTopology(nodes []*descriptor) [][]*pki.MixDescript
 	return topology
 }
 
+// preserveForPastEpochs is the number of past epochs the documents of which
+// are kept.  Looking a bit into the past is probably ok, if more past
+// documents need to be accessible, then the authority can archive them.
+const preserveForPastEpochs = 3
+
 func (s *state) pruneDocuments() {
 	// Lock is held (called from the onWakeup hook).
 
-	// Looking a bit into the past is probably ok, if more past documents
-	// need to be accessible, then methods that query the DB could always
-	// be added.
-	const preserveForPastEpochs = 3
-
 	now, _, _ := epochtime.Now()
 	cmpEpoch := now - preserveForPastEpochs
 
+	pruned := false
 	for e := range s.documents {
 		if e < cmpEpoch {
 			delete(s.documents, e)
+			pruned = true
+		}
+	}
+	if pruned && s.retentionEpoch() != 0 {
+		if err := s.db.Update(s.pruneArchive); err != nil {
+			// Persistence failures are FATAL.
+			s.s.fatalErrCh <- err
 		}
 	}
 	for e := range s.descriptors {
@@ -430,16 +494,233 @@ func (s *state) pruneDocuments() {
 	}
 }
 
+// authorizations returns the authorized nodes, which share the maps of
+// the state.
+func (s *state) authorizations() *pki.NodeAuthorizations {
+	return &pki.NodeAuthorizations{
+		Mixes:       s.authorizedMixes,
+		LoadWeights: s.assignedLoadWeights,
+		Providers:   s.authorizedProviders,
+		Rotations:   s.keyRotations,
+	}
+}
+
 func (s *state) isDescriptorAuthorized(desc *pki.MixDescriptor) bool {
-	pk := desc.IdentityKey.Sum256()
-	if !desc.Provider {
-		return s.authorizedMixes[pk]
+	return s.authorizations().IsDescriptorAuthorized(desc)
+}
+
+// authorizeDescriptor returns if the descriptor is from an authorized node,
+// after following the key rotation it carries, if any.
+func (s *state) authorizeDescriptor(desc *pki.MixDescriptor) bool {
+	s.Lock()
+	defer s.Unlock()
+
+	return s.authorize(desc)
+}
+
+func (s *state) authorize(desc *pki.MixDescriptor) bool {
+	// Lock is held.
+	if err := s.acceptKeyRotation(desc); err != nil {
+		s.log.Errorf("Node %s: Rejected key rotation: %v", desc.Name, err)
 	}
-	name, ok := s.authorizedProviders[pk]
-	if !ok {
-		return false
+	return s.isDescriptorAuthorized(desc)
+}
+
+// acceptKeyRotation follows the key rotation statement carried by the
+// descriptor, if any, when its node is not authorized yet: the
+// authorization of the old identity key is transferred to the new one,
+// and the rotation is persisted.
+func (s *state) acceptKeyRotation(desc *pki.MixDescriptor) error {
+	// Lock is held.
+	oldKey, err := s.authorizations().AcceptKeyRotation(desc)
+	if err != nil || oldKey == nil {
+		return err
+	}
+	oldPk, pk := oldKey.Sum256(), desc.IdentityKey.Sum256()
+	s.reverseHash[pk] = desc.IdentityKey
+
+	if err := s.db.Update(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket([]byte(keyRotationsBucket))
+		return bkt.Put(oldPk[:], desc.IdentityKey.Bytes())
+	}); err != nil {
+		// Persistence failures are FATAL.
+		s.s.fatalErrCh <- err
+	}
+	s.log.Noticef("Node %s: Identity key %x rotated to %x", desc.Name, oldPk, pk)
+	return nil
+}
+
+// restoreKeyRotations follows the persisted key rotations.
+func (s *state) restoreKeyRotations(bkt *bolt.Bucket) error {
+	newKeys := make(map[[sign.PublicKeyHashSize]byte]sign.PublicKey)
+	rotations := make(map[[sign.PublicKeyHashSize]byte][sign.PublicKeyHashSize]byte)
+	if err := bkt.ForEach(func(k, v []byte) error {
+		if len(k) != sign.PublicKeyHashSize {
+			return errors.New("state: invalid persisted key rotation")
+		}
+		newKey := cert.Scheme.NewEmptyPublicKey()
+		if err := newKey.FromBytes(v); err != nil {
+			return err
+		}
+		var oldPk [sign.PublicKeyHashSize]byte
+		copy(oldPk[:], k)
+		newKeys[newKey.Sum256()] = newKey
+		rotations[oldPk] = newKey.Sum256()
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	if err := s.authorizations().RestoreKeyRotations(rotations); err != nil {
+		return err
+	}
+	for pk, newKey := range newKeys {
+		if s.isNodeAuthorized(pk) {
+			s.reverseHash[pk] = newKey
+		}
+	}
+	return nil
+}
+
+func (s *state) isNodeAuthorized(pk [sign.PublicKeyHashSize]byte) bool {
+	return s.authorizations().IsAuthorized(pk)
+}
+
+func (s *state) deauthorizeKey(pk [sign.PublicKeyHashSize]byte) {
+	s.authorizations().Deauthorize(pk)
+}
+
+// authorizeNode authorizes a node, or updates its authorization, and
+// persists it.  The change is taken into account from the next Document.
+func (s *state) authorizeNode(identityKey sign.PublicKey, a *authorization) error {
+	s.Lock()
+	defer s.Unlock()
+
+	pk := identityKey.Sum256()
+	if next, ok := s.keyRotations[pk]; ok {
+		return fmt.Errorf("key %x was rotated to %x", pk, next)
+	}
+	if _, ok := s.authorizedProviders[pk]; ok && !a.Provider || s.authorizedMixes[pk] && a.Provider {
+		return fmt.Errorf("node %x is authorized as another kind of node", pk)
+	}
+	if err := s.persistAuthorizations(map[[sign.PublicKeyHashSize]byte]*authorization{pk: a}); err != nil {
+		return err
+	}
+	s.applyAuthorization(pk, identityKey, a)
+	return nil
+}
+
+// deauthorizeNode deauthorizes a node, and persists it.  The change is
+// taken into account from the next Document.
+func (s *state) deauthorizeNode(pk [sign.PublicKeyHashSize]byte) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if !s.isNodeAuthorized(pk) {
+		return fmt.Errorf("node %x is not authorized", pk)
+	}
+
+	// The keys the node rotated from are deauthorized too, lest the
+	// authorization of a configured key be restored and rotated again.
+	deauthorized := map[[sign.PublicKeyHashSize]byte]*authorization{pk: {}}
+	for found := true; found; {
+		found = false
+		for oldPk, newPk := range s.keyRotations {
+			if _, ok := deauthorized[oldPk]; !ok && deauthorized[newPk] != nil {
+				deauthorized[oldPk] = &authorization{}
+				found = true
+			}
+		}
+	}
+	if err := s.persistAuthorizations(deauthorized); err != nil {
+		return err
+	}
+	s.deauthorizeKey(pk)
+	return nil
+}
+
+// listNodes returns the authorized nodes, in the syntax of the
+// management interface.
+func (s *state) listNodes() []string {
+	s.RLock()
+	defer s.RUnlock()
+
+	nodes := []string{}
+	for pk := range s.authorizedProviders {
+		nodes = append(nodes, fmt.Sprintf("%v %x %v", nodeProvider, pk, s.authorizedProviders[pk]))
+	}
+	for pk := range s.authorizedMixes {
+		if w, ok := s.assignedLoadWeights[pk]; ok {
+			nodes = append(nodes, fmt.Sprintf("%v %x %v", nodeMix, pk, w))
+		} else {
+			nodes = append(nodes, fmt.Sprintf("%v %x", nodeMix, pk))
+		}
+	}
+	sort.Strings(nodes)
+	return nodes
+}
+
+func (s *state) applyAuthorization(pk [sign.PublicKeyHashSize]byte, identityKey sign.PublicKey, a *authorization) {
+	// Lock is held.
+	s.deauthorizeKey(pk)
+	if !a.Authorized {
+		return
 	}
-	return name == desc.Name
+	if a.Provider {
+		s.authorizedProviders[pk] = a.Identifier
+	} else {
+		s.authorizedMixes[pk] = true
+		if a.LoadWeight != 0 {
+			s.assignedLoadWeights[pk] = a.LoadWeight
+		}
+	}
+	s.reverseHash[pk] = identityKey
+}
+
+func (s *state) persistAuthorizations(m map[[sign.PublicKeyHashSize]byte]*authorization) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket([]byte(authorizationsBucket))
+		for pk, a := range m {
+			b, err := cbor.Marshal(a)
+			if err != nil {
+				return err
+			}
+			if err := bkt.Put(pk[:], b); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// restoreAuthorizations applies the persisted authorizations over the
+// configured ones.
+func (s *state) restoreAuthorizations(bkt *bolt.Bucket) error {
+	return bkt.ForEach(func(k, v []byte) error {
+		if len(k) != sign.PublicKeyHashSize {
+			return errors.New("state: invalid persisted authorization")
+		}
+		var pk [sign.PublicKeyHashSize]byte
+		copy(pk[:], k)
+		a := new(authorization)
+		if err := cbor.Unmarshal(v, a); err != nil {
+			return err
+		}
+		var identityKey sign.PublicKey
+		if a.Authorized {
+			identityKey = cert.Scheme.NewEmptyPublicKey()
+			if err := identityKey.FromBytes(a.IdentityKey); err != nil {
+				return err
+			}
+			if identityKey.Sum256() != pk {
+				return errors.New("state: invalid persisted authorization")
+			}
+		}
+		s.applyAuthorization(pk, identityKey, a)
+		return nil
+	})
 }
 
 func (s *state) onDescriptorUpload(rawDesc []byte, desc *pki.MixDescriptor, epoch uint64) error {
@@ -449,6 +730,12 @@ func (s *state) onDescriptorUpload(rawDesc []byte, desc *pki.MixDescriptor, epoc
 	s.Lock()
 	defer s.Unlock()
 
+	// Nodes which are not authorized may only become so by way of a key
+	// rotation, which is followed once the descriptor is accepted.
+	if desc.KeyRotation == nil && !s.isDescriptorAuthorized(desc) {
+		return errForbidden
+	}
+
 	// Get the public key -> descriptor map for the epoch.
 	m, ok := s.descriptors[epoch]
 	if !ok {
@@ -475,6 +762,12 @@ func (s *state) onDescriptorUpload(rawDesc []byte, desc *pki.MixDescriptor, epoc
 		return fmt.Errorf("state: Node %v: Late descriptor upload for for epoch %v", desc.IdentityKey, epoch)
 	}
 
+	// Ensure that the descriptor is from an allowed peer, possibly by way
+	// of the key rotation it carries.
+	if !s.authorize(desc) {
+		return errForbidden
+	}
+
 	// Persist the raw descriptor to disk.
 	if err := s.db.Update(func(tx *bolt.Tx) error {
 		bkt := tx.Bucket([]byte(descriptorsBucket))
@@ -553,6 +846,87 @@ func (s *state) documentForEpoch(epoch uint64) ([]byte, error) {
 	// NOTREACHED
 }
 
+// maxRangeDocumentsLength is the total length of the documents past which
+// documentsForEpochs stops, so that its reply fits in a wire command.
+const maxRangeDocumentsLength = 1 << 20
+
+// documentsForEpochs returns the persisted documents of the epochs from first
+// to last included, in order, and the first epoch of the range it stopped
+// short of, or 0 if it covers the whole range.  It returns at least one
+// document if there is any in the range.
+func (s *state) documentsForEpochs(first, last uint64) ([]uint64, [][]byte, uint64, error) {
+	var epochs []uint64
+	var docs [][]byte
+	var next uint64
+	err := s.db.View(func(tx *bolt.Tx) error {
+		length := 0
+		c := tx.Bucket([]byte(documentsBucket)).Cursor()
+		for k, rawDoc := c.Seek(epochToBytes(first)); k != nil; k, rawDoc = c.Next() {
+			epoch := binary.BigEndian.Uint64(k)
+			if epoch > last {
+				break
+			}
+			if len(docs) > 0 && length+len(rawDoc) > maxRangeDocumentsLength {
+				next = epoch
+				break
+			}
+			length += len(rawDoc)
+			epochs = append(epochs, epoch)
+			docs = append(docs, append([]byte{}, rawDoc...))
+		}
+		return nil
+	})
+	return epochs, docs, next, err
+}
+
+// retentionEpoch returns the epoch the archive keeps the documents from,
+// or 0 if it keeps every document.
+func (s *state) retentionEpoch() uint64 {
+	cfg := s.s.cfg.Server
+	if !cfg.Archive || cfg.ArchiveRetention == 0 {
+		return 0
+	}
+	retention := cfg.ArchiveRetention
+	if retention < preserveForPastEpochs {
+		retention = preserveForPastEpochs
+	}
+	now, _, _ := epochtime.Now()
+	if now <= retention {
+		return 0
+	}
+	return now - retention
+}
+
+// retainDocument records that the document of the epoch was persisted under
+// the retention policy of the archive, if there is one.
+func (s *state) retainDocument(tx *bolt.Tx, epoch uint64) error {
+	if s.retentionEpoch() == 0 {
+		return nil
+	}
+	return tx.Bucket([]byte(retentionBucket)).Put(epochToBytes(epoch), []byte{})
+}
+
+// pruneArchive deletes the documents persisted under the retention policy
+// of the archive which are older than it retains.  The documents persisted
+// without one are always kept.
+func (s *state) pruneArchive(tx *bolt.Tx) error {
+	epoch := s.retentionEpoch()
+	if epoch == 0 {
+		return nil
+	}
+	docsBkt := tx.Bucket([]byte(documentsBucket))
+	c := tx.Bucket([]byte(retentionBucket)).Cursor()
+	for k, _ := c.First(); k != nil && binary.BigEndian.Uint64(k) < epoch; k, _ = c.First() {
+		if err := docsBkt.Delete(k); err != nil {
+			return err
+		}
+		if err := c.Delete(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (s *state) restorePersistence() error {
 	const (
 		metadataBucket = "metadata"
@@ -573,6 +947,31 @@ func (s *state) restorePersistence() error {
 		if err != nil {
 			return err
 		}
+		rotationsBkt, err := tx.CreateBucketIfNotExists([]byte(keyRotationsBucket))
+		if err != nil {
+			return err
+		}
+		authorizationsBkt, err := tx.CreateBucketIfNotExists([]byte(authorizationsBucket))
+		if err != nil {
+			return err
+		}
+
+		// Apply the authorizations made through the management interface,
+		// and follow the key rotations, before restoring the descriptors of
+		// the nodes.
+		if err := s.restoreAuthorizations(authorizationsBkt); err != nil {
+			return err
+		}
+		if err := s.restoreKeyRotations(rotationsBkt); err != nil {
+			return err
+		}
+
+		if _, err := tx.CreateBucketIfNotExists([]byte(retentionBucket)); err != nil {
+			return err
+		}
+		if err := s.pruneArchive(tx); err != nil {
+			return err
+		}
 
 		if b := bkt.Get([]byte(versionKey)); b != nil {
 			// Well it looks like we loaded as opposed to created.
@@ -584,11 +983,18 @@ func (s *state) restorePersistence() error {
 			now, _, _ := epochtime.Now()
 			epochs := []uint64{now - 1, now, now + 1}
 
+			// The documents may be signed by the identity key retired
+			// through the key rotation of the authority.
+			verifiers := []cert.Verifier{s.s.identityPublicKey}
+			if r := s.s.keyRotation; r != nil && r.NewIdentityKey.Equal(s.s.identityPublicKey) {
+				verifiers = append(verifiers, r.OldIdentityKey)
+			}
+
 			// Restore the documents and descriptors.
 			for _, epoch := range epochs {
 				k := epochToBytes(epoch)
 				if rawDoc := docsBkt.Get(k); rawDoc != nil {
-					if doc, err := pki.VerifyAndParseDocument(rawDoc, []cert.Verifier{s.s.identityPublicKey}); err != nil {
+					if doc, err := pki.VerifyAndParseDocument(rawDoc, verifiers); err != nil {
 						// This continues because there's no reason not to load
 						// the descriptors as long as they validate, even if
 						// the document fails to load.
@@ -673,6 +1079,7 @@ func newState(s *Server) (*state, error) {
 	// Initialize the authorized peer tables.
 	st.reverseHash = make(map[[sign.PublicKeyHashSize]byte]sign.PublicKey)
 	st.authorizedMixes = make(map[[sign.PublicKeyHashSize]byte]bool)
+	st.assignedLoadWeights = make(map[[sign.PublicKeyHashSize]byte]uint8)
 	for _, v := range st.s.cfg.Mixes {
 		_, idKey := cert.Scheme.NewKeypair()
 		err := pem.FromFile(filepath.Join(s.cfg.Server.DataDir, v.IdentityKeyPem), idKey)
@@ -681,6 +1088,9 @@ func newState(s *Server) (*state, error) {
 		}
 		pk := idKey.Sum256()
 		st.authorizedMixes[pk] = true
+		if v.LoadWeight != 0 {
+			st.assignedLoadWeights[pk] = v.LoadWeight
+		}
 		st.reverseHash[pk] = idKey
 	}
 	st.authorizedProviders = make(map[[sign.PublicKeyHashSize]byte]string)
@@ -695,6 +1105,8 @@ func newState(s *Server) (*state, error) {
 		st.reverseHash[pk] = idKey
 	}
 
+	st.keyRotations = make(map[[sign.PublicKeyHashSize]byte][sign.PublicKeyHashSize]byte)
+
 	st.documents = make(map[uint64]*document)
 	st.descriptors = make(map[uint64]map[[sign.PublicKeyHashSize]byte]*descriptor)
 
@@ -23,6 +23,7 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"sync"
 
 	"gopkg.in/op/go-logging.v1"
 
@@ -76,12 +77,19 @@ type Config struct {
 	// DialContextFn is the optional alternative Dialer.DialContext function
 	// to be used when creating outgoing network connections.
 	DialContextFn func(ctx context.Context, network, address string) (net.Conn, error)
+
+	// SphinxGeometry is the Sphinx geometry of the wire sessions with the
+	// authorities, which defaults to sphinx.DefaultGeometry().
+	SphinxGeometry *sphinx.Geometry
 }
 
 func (cfg *Config) validate() error {
 	if cfg.LogBackend == nil {
 		return fmt.Errorf("voting/client: LogBackend is mandatory")
 	}
+	if cfg.SphinxGeometry == nil {
+		cfg.SphinxGeometry = sphinx.DefaultGeometry()
+	}
 	for _, v := range cfg.Authorities {
 		for _, a := range v.Addresses {
 			if len(a) == 0 {
@@ -105,19 +113,91 @@ type connection struct {
 
 // connector is used to make connections.
 type connector struct {
+	sync.RWMutex
+
 	cfg *Config
 	log *logging.Logger
+
+	// authorities are the Directory Authorities, with the keys they
+	// rotated to.
+	authorities []*config.Authority
+
+	// retiredKeys are the identity keys retired by the authorities, by
+	// their Identifier.
+	retiredKeys map[string][]retiredKey
+}
+
+// retiredKey is an identity key retired by an authority, which only
+// verifies the documents of the epochs up to the one of its rotation
+// statement, so that whoever holds a compromised key can't sign the later
+// ones.
+type retiredKey struct {
+	key   sign.PublicKey
+	epoch uint64
 }
 
 // newConnector returns a connector initialized from a Config.
 func newConnector(cfg *Config) *connector {
 	p := &connector{
-		cfg: cfg,
-		log: cfg.LogBackend.GetLogger("pki/voting/client/connector"),
+		cfg:         cfg,
+		log:         cfg.LogBackend.GetLogger("pki/voting/client/connector"),
+		authorities: append([]*config.Authority{}, cfg.Authorities...),
+		retiredKeys: make(map[string][]retiredKey),
 	}
 	return p
 }
 
+// getAuthorities returns the Directory Authorities.
+func (p *connector) getAuthorities() []*config.Authority {
+	p.RLock()
+	defer p.RUnlock()
+	return append([]*config.Authority{}, p.authorities...)
+}
+
+// identityKeys returns the identity keys of each Directory Authority
+// which verify the documents of the epoch, its current one followed by the
+// ones it retired in that epoch or later.
+func (p *connector) identityKeys(epoch uint64) [][]cert.Verifier {
+	p.RLock()
+	defer p.RUnlock()
+	keys := make([][]cert.Verifier, 0, len(p.authorities))
+	for _, auth := range p.authorities {
+		authKeys := []cert.Verifier{auth.IdentityPublicKey}
+		for _, k := range p.retiredKeys[auth.Identifier] {
+			if epoch <= k.epoch {
+				authKeys = append(authKeys, k.key)
+			}
+		}
+		keys = append(keys, authKeys)
+	}
+	return keys
+}
+
+// followKeyRotations replaces the keys of the Directory Authorities by the
+// ones succeeding them through the key rotation statements, and returns
+// the number of rotations followed.
+func (p *connector) followKeyRotations(rotations []*pki.AuthorityKeyRotation) int {
+	p.Lock()
+	defer p.Unlock()
+	followed := 0
+	for _, r := range rotations {
+		for i, auth := range p.authorities {
+			if !auth.IdentityPublicKey.Equal(r.OldIdentityKey) {
+				continue
+			}
+			rotated := *auth
+			rotated.IdentityPublicKey = r.NewIdentityKey
+			rotated.LinkPublicKey = r.NewLinkKey
+			p.authorities[i] = &rotated
+			p.retiredKeys[auth.Identifier] = append(p.retiredKeys[auth.Identifier], retiredKey{key: r.OldIdentityKey, epoch: r.Epoch})
+			p.log.Noticef("Following the key rotation of Authority %s to %x", auth.Identifier, r.NewIdentityKey.Sum256())
+			followed++
+			break
+		}
+	}
+	return followed
+}
+
 func (p *connector) initSession(ctx context.Context, doneCh <-chan interface{}, linkKey wire.PrivateKey, signingKey sign.PublicKey, peer *config.Authority) (*connection, error) {
 	var conn net.Conn
 	var err error
@@ -163,7 +243,7 @@ func (p *connector) initSession(ctx context.Context, doneCh <-chan interface{},
 		ad = keyHash[:]
 	}
 	cfg := &wire.SessionConfig{
-		Geometry:          sphinx.DefaultGeometry(),
+		Geometry:          p.cfg.SphinxGeometry,
 		Authenticator:     peerAuthenticator,
 		AdditionalData:    ad,
 		AuthenticationKey: linkKey,
@@ -206,7 +286,7 @@ func (p *connector) allPeersRoundTrip(ctx context.Context, linkKey wire.PrivateK
 	doneCh := make(chan interface{})
 	defer close(doneCh)
 	responses := []commands.Command{}
-	for _, peer := range p.cfg.Authorities {
+	for _, peer := range p.getAuthorities() {
 		conn, err := p.initSession(ctx, doneCh, linkKey, signingKey, peer)
 		if err != nil {
 			p.log.Noticef("pki/voting/client: failure to connect to Authority %s (%x)\n", peer.Identifier, peer.IdentityPublicKey.Sum256())
@@ -229,17 +309,18 @@ func (p *connector) fetchConsensus(ctx context.Context, linkKey wire.PrivateKey,
 	doneCh := make(chan interface{})
 	defer close(doneCh)
 
-	if len(p.cfg.Authorities) == 0 {
+	authorities := p.getAuthorities()
+	if len(authorities) == 0 {
 		return nil, errors.New("error: zero Authorities specified in configuration")
 	}
 
 	r := rand.NewMath()
-	peerIndex := r.Intn(len(p.cfg.Authorities))
+	peerIndex := r.Intn(len(authorities))
 
 	// check for a document from threshold authorities
 
-	for i := 0; i < len(p.cfg.Authorities)/2; i++ {
-		auth := p.cfg.Authorities[peerIndex+i%len(p.cfg.Authorities)]
+	for i := 0; i < len(authorities)/2; i++ {
+		auth := authorities[peerIndex+i%len(authorities)]
 		conn, err := p.initSession(ctx, doneCh, linkKey, nil, auth)
 		if err != nil {
 			return nil, err
@@ -267,7 +348,6 @@ type Client struct {
 	cfg       *Config
 	log       *logging.Logger
 	pool      *connector
-	verifiers []cert.Verifier
 	threshold int
 }
 
@@ -346,29 +426,10 @@ func (c *Client) Get(ctx context.Context, epoch uint64) (*pki.Document, []byte,
 	}
 
 	// Verify document signatures.
-	doc := &pki.Document{}
-	_, good, bad, err := cert.VerifyThreshold(c.verifiers, c.threshold, r.Payload)
-	if err != nil {
-		c.log.Errorf("VerifyThreshold failure: %d good signatures, %d bad signatures: %v", len(good), len(bad), err)
-		return nil, nil, fmt.Errorf("voting/Client: Get() invalid consensus document: %s", err)
-	}
-	if len(good) == len(c.cfg.Authorities) {
-		c.log.Notice("OK, received fully signed consensus document.")
-	} else {
-		c.log.Noticef("OK, received consensus document with %d of %d signatures)", len(good), len(c.cfg.Authorities))
-		for _, auth := range c.cfg.Authorities {
-			for _, badauth := range bad {
-				if badauth == auth.IdentityPublicKey {
-					c.log.Noticef("missing or invalid signature from %s", auth.Identifier)
-					break
-				}
-			}
-		}
-	}
-	doc, err = pki.VerifyAndParseDocument(r.Payload, c.verifiers)
+	doc, err := c.verifyDocument(r.Payload)
 	if err != nil {
 		c.log.Errorf("voting/Client: Get() invalid consensus document: %s", err)
-		return nil, nil, err
+		return nil, nil, fmt.Errorf("voting/Client: Get() invalid consensus document: %s", err)
 	}
 	if doc.Epoch != epoch {
 		return nil, nil, fmt.Errorf("voting/Client: Get() consensus document for WRONG epoch: %v", doc.Epoch)
@@ -377,17 +438,159 @@ func (c *Client) Get(ctx context.Context, epoch uint64) (*pki.Document, []byte,
 	return doc, r.Payload, nil
 }
 
-// Deserialize returns PKI document given the raw bytes.
-func (c *Client) Deserialize(raw []byte) (*pki.Document, error) {
-	_, _, _, err := cert.VerifyThreshold(c.verifiers, c.threshold, raw)
-	if err != nil {
+// verifyDocument verifies and parses the consensus document, then follows
+// the key rotations of the authorities it carries.  A document signed by
+// keys we don't know yet, because we missed the one which first carried
+// their rotation statements, is verified again after following the
+// statements it carries, which are certified by the keys they retire.
+func (c *Client) verifyDocument(raw []byte) (*pki.Document, error) {
+	unverified := new(pki.Document)
+	if err := unverified.UnmarshalBinary(raw); err != nil {
 		return nil, err
 	}
-	doc, err := pki.VerifyAndParseDocument(raw, c.verifiers)
+	doc, err := c.verifyAndParseDocument(raw, unverified.Epoch)
 	if err != nil {
-		fmt.Errorf("Deserialize failure: %s", err)
+		if c.pool.followKeyRotations(unverified.AuthorityKeyRotations()) == 0 {
+			return nil, err
+		}
+		if doc, err = c.verifyAndParseDocument(raw, unverified.Epoch); err != nil {
+			return nil, err
+		}
 	}
-	return doc, err
+	c.pool.followKeyRotations(doc.AuthorityKeyRotations())
+	return doc, nil
+}
+
+// verifyAndParseDocument verifies that the document of the epoch is signed
+// by a threshold of the authorities, each by its current identity key or
+// one it retired in that epoch or later, and parses it.
+func (c *Client) verifyAndParseDocument(raw []byte, epoch uint64) (*pki.Document, error) {
+	authorities := c.pool.getAuthorities()
+	keys := c.pool.identityKeys(epoch)
+	verifiers := []cert.Verifier{}
+	good := 0
+	for i, authKeys := range keys {
+		verifiers = append(verifiers, authKeys...)
+		signed := false
+		for _, k := range authKeys {
+			if _, err := cert.Verify(k, raw); err == nil {
+				signed = true
+				break
+			}
+		}
+		if signed {
+			good++
+		} else {
+			c.log.Noticef("missing or invalid signature from %s", authorities[i].Identifier)
+		}
+	}
+	if good < c.threshold {
+		c.log.Errorf("VerifyThreshold failure: %d good signatures, %d bad signatures: %v", good, len(keys)-good, cert.ErrThresholdNotMet)
+		return nil, cert.ErrThresholdNotMet
+	}
+	if good == len(keys) {
+		c.log.Notice("OK, received fully signed consensus document.")
+	} else {
+		c.log.Noticef("OK, received consensus document with %d of %d signatures)", good, len(keys))
+	}
+	return pki.VerifyAndParseDocument(raw, verifiers)
+}
+
+// GetRange returns the archived PKI documents along with their raw
+// serialized form, for the epochs from first to last included which have
+// one.  The documents are fetched from the authorities in turn, each one
+// continuing from the first epoch the replies of the previous ones didn't
+// cover, as only the authorities configured to archive serve old documents.
+func (c *Client) GetRange(ctx context.Context, first, last uint64) ([]*pki.Document, [][]byte, error) {
+	c.log.Debugf("GetRange(ctx, %d, %d)", first, last)
+	if first > last {
+		return nil, nil, fmt.Errorf("voting/Client: GetRange() invalid epoch range: %d-%d", first, last)
+	}
+
+	// Generate a random keypair to use for the link authentication.
+	scheme := wire.DefaultScheme
+	linkKey, _ := scheme.GenerateKeypair(rand.Reader)
+	defer linkKey.Reset()
+
+	var err error
+	docs := []*pki.Document{}
+	rawDocs := [][]byte{}
+	for _, auth := range c.pool.getAuthorities() {
+		var authDocs []*pki.Document
+		var authRawDocs [][]byte
+		authDocs, authRawDocs, first, err = c.getRangeFrom(ctx, linkKey, auth, first, last)
+		docs = append(docs, authDocs...)
+		rawDocs = append(rawDocs, authRawDocs...)
+		if err != nil {
+			c.log.Noticef("voting/Client: GetRange() failed with Authority %s from epoch %d: %v", auth.Identifier, first, err)
+			continue
+		}
+		return docs, rawDocs, nil
+	}
+	if err == nil {
+		err = errors.New("error: zero Authorities specified in configuration")
+	}
+	return nil, nil, err
+}
+
+// getRangeFrom returns the documents of the epochs from first to last
+// included served by the authority, and on failure, the ones of the replies
+// received before, along with the first epoch they don't cover.
+func (c *Client) getRangeFrom(ctx context.Context, linkKey wire.PrivateKey, auth *config.Authority, first, last uint64) ([]*pki.Document, [][]byte, uint64, error) {
+	doneCh := make(chan interface{})
+	defer close(doneCh)
+
+	docs := []*pki.Document{}
+	rawDocs := [][]byte{}
+	for {
+		conn, err := c.pool.initSession(ctx, doneCh, linkKey, nil, auth)
+		if err != nil {
+			return docs, rawDocs, first, err
+		}
+
+		// Dispatch the get_consensus_range command.
+		cmd := &commands.GetConsensusRange{FirstEpoch: first, LastEpoch: last}
+		resp, err := c.pool.roundTrip(conn.session, cmd)
+		conn.session.Close()
+		if err != nil {
+			return docs, rawDocs, first, err
+		}
+
+		// Parse the consensus_range command, and only accept the documents
+		// of a reply which is valid as a whole.
+		r, ok := resp.(*commands.ConsensusRange)
+		if !ok {
+			return docs, rawDocs, first, fmt.Errorf("voting/Client: GetRange() unexpected reply: %T", resp)
+		}
+		if r.ErrorCode != commands.ConsensusOk {
+			return docs, rawDocs, first, fmt.Errorf("voting/Client: GetRange() rejected by authority: %v", getErrorToString(r.ErrorCode))
+		}
+		if len(r.Epochs) != len(r.Documents) || (r.NextEpoch != 0 && (r.NextEpoch <= first || r.NextEpoch > last)) {
+			return docs, rawDocs, first, errors.New("voting/Client: GetRange() invalid reply")
+		}
+		replyDocs := make([]*pki.Document, 0, len(r.Documents))
+		for i, raw := range r.Documents {
+			if r.Epochs[i] < first || r.Epochs[i] > last || (i > 0 && r.Epochs[i] <= r.Epochs[i-1]) || (r.NextEpoch != 0 && r.Epochs[i] >= r.NextEpoch) {
+				return docs, rawDocs, first, fmt.Errorf("voting/Client: GetRange() document for WRONG epoch: %v", r.Epochs[i])
+			}
+			doc, err := pki.VerifyAndParseArchivedDocument(raw, c.pool.identityKeys(r.Epochs[i]), c.threshold, r.Epochs[i])
+			if err != nil {
+				return docs, rawDocs, first, fmt.Errorf("voting/Client: GetRange() invalid consensus document for epoch %v: %s", r.Epochs[i], err)
+			}
+			replyDocs = append(replyDocs, doc)
+		}
+		docs = append(docs, replyDocs...)
+		rawDocs = append(rawDocs, r.Documents...)
+		if r.NextEpoch == 0 {
+			return docs, rawDocs, 0, nil
+		}
+		first = r.NextEpoch
+	}
+}
+
+// Deserialize returns PKI document given the raw bytes.
+func (c *Client) Deserialize(raw []byte) (*pki.Document, error) {
+	return c.verifyDocument(raw)
 }
 
 // New constructs a new pki.Client instance.
@@ -403,11 +606,7 @@ func New(cfg *Config) (pki.Client, error) {
 	c.cfg = cfg
 	c.log = cfg.LogBackend.GetLogger("pki/voting/Client")
 	c.pool = newConnector(cfg)
-	c.verifiers = make([]cert.Verifier, len(c.cfg.Authorities))
-	for i, auth := range c.cfg.Authorities {
-		c.verifiers[i] = auth.IdentityPublicKey
-	}
-	c.threshold = len(c.verifiers)/2 + 1
+	c.threshold = len(c.cfg.Authorities)/2 + 1
 	return c, nil
 }
 
@@ -60,14 +60,14 @@ func generateRandomTopology(nodes []*descriptor, layers int) [][]*pki.MixDescrip
 	return topology
 }
 
-func generateMixKeys(epoch uint64) (map[uint64]*ecdh.PublicKey, error) {
-	m := make(map[uint64]*ecdh.PublicKey)
+func generateMixKeys(epoch uint64) (map[uint64][]byte, error) {
+	m := make(map[uint64][]byte)
 	for i := epoch; i < epoch+3; i++ {
 		privatekey, err := ecdh.NewKeypair(rand.Reader)
 		if err != nil {
 			return nil, err
 		}
-		m[uint64(i)] = privatekey.PublicKey()
+		m[uint64(i)] = privatekey.PublicKey().Bytes()
 	}
 	return m, nil
 }
@@ -144,6 +144,7 @@ func generateMixnet(numMixes, numProviders int, epoch uint64) (*pki.Document, er
 		Providers:          pdescs,
 		SharedRandomCommit: sharedRandomCommit,
 		SharedRandomValue:  make([]byte, pki.SharedRandomValueLength),
+		SphinxGeometry:     sphinx.DefaultGeometry(),
 	}
 	return doc, nil
 }
@@ -363,3 +364,88 @@ func TestClient(t *testing.T) {
 	require.Equal(epoch, doc.Epoch)
 	t.Logf("rawDoc size is %d", len(rawDoc))
 }
+
+func TestFollowKeyRotation(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	logBackend, err := log.New("", "DEBUG", false)
+	require.NoError(err)
+	peers := []*config.Authority{}
+	idKeys := []sign.PrivateKey{}
+	idPubKeys := []sign.PublicKey{}
+	for i := 0; i < 3; i++ {
+		peer, idPrivKey, idPubKey, _, err := generatePeer(i)
+		require.NoError(err)
+		peer.Identifier = fmt.Sprintf("authority-%d", i)
+		peers = append(peers, peer)
+		idKeys = append(idKeys, idPrivKey)
+		idPubKeys = append(idPubKeys, idPubKey)
+	}
+	c, err := New(&Config{LogBackend: logBackend, Authorities: peers})
+	require.NoError(err)
+
+	// The first authority rotates its keys.
+	newIdKey, newIdPubKey := cert.Scheme.NewKeypair()
+	_, newLinkPubKey := wire.DefaultScheme.GenerateKeypair(rand.Reader)
+	statement, err := pki.SignAuthorityKeyRotation(idKeys[0], idPubKeys[0], newIdKey, newIdPubKey, newLinkPubKey)
+	require.NoError(err)
+
+	// A consensus signed by the new key and carrying the statement is
+	// verified after following the rotation.
+	epoch, _, _ := epochtime.Now()
+	doc, err := generateMixnet(3, 2, epoch)
+	require.NoError(err)
+	doc.KeyRotations = [][]byte{statement}
+	raw, err := multiSignTestDocument([]sign.PrivateKey{newIdKey, idKeys[1], idKeys[2]}, []sign.PublicKey{newIdPubKey, idPubKeys[1], idPubKeys[2]}, doc)
+	require.NoError(err)
+	_, err = c.Deserialize(raw)
+	require.NoError(err)
+
+	cl := c.(*Client)
+	authorities := cl.pool.getAuthorities()
+	require.True(authorities[0].IdentityPublicKey.Equal(newIdPubKey))
+	require.True(authorities[0].LinkPublicKey.Equal(newLinkPubKey))
+	require.True(peers[0].IdentityPublicKey.Equal(idPubKeys[0]))
+
+	// The consensus without the statement is verified by the new key, and
+	// the archived ones by the retired key.
+	doc.KeyRotations = nil
+	raw, err = multiSignTestDocument([]sign.PrivateKey{newIdKey, idKeys[1]}, []sign.PublicKey{newIdPubKey, idPubKeys[1]}, doc)
+	require.NoError(err)
+	_, err = c.Deserialize(raw)
+	require.NoError(err)
+	raw, err = multiSignTestDocument([]sign.PrivateKey{idKeys[0], idKeys[1]}, []sign.PublicKey{idPubKeys[0], idPubKeys[1]}, doc)
+	require.NoError(err)
+	_, err = pki.VerifyAndParseArchivedDocument(raw, cl.pool.identityKeys(epoch), cl.threshold, epoch)
+	require.NoError(err)
+
+	// The retired key no longer counts toward the threshold for the
+	// documents of the epochs after its rotation.
+	laterDoc, err := generateMixnet(3, 2, epoch+1)
+	require.NoError(err)
+	raw, err = multiSignTestDocument([]sign.PrivateKey{newIdKey, idKeys[1]}, []sign.PublicKey{newIdPubKey, idPubKeys[1]}, laterDoc)
+	require.NoError(err)
+	_, err = c.Deserialize(raw)
+	require.NoError(err)
+	raw, err = multiSignTestDocument([]sign.PrivateKey{idKeys[0], idKeys[1]}, []sign.PublicKey{idPubKeys[0], idPubKeys[1]}, laterDoc)
+	require.NoError(err)
+	_, err = c.Deserialize(raw)
+	require.Error(err)
+	_, err = pki.VerifyAndParseArchivedDocument(raw, cl.pool.identityKeys(epoch+1), cl.threshold, epoch+1)
+	require.Error(err)
+
+	// A statement from a key which is not the one of an authority is not
+	// followed.
+	_, otherLinkPubKey := wire.DefaultScheme.GenerateKeypair(rand.Reader)
+	otherKey, otherPubKey := cert.Scheme.NewKeypair()
+	forgedKey, forgedPubKey := cert.Scheme.NewKeypair()
+	statement, err = pki.SignAuthorityKeyRotation(forgedKey, forgedPubKey, otherKey, otherPubKey, otherLinkPubKey)
+	require.NoError(err)
+	doc.KeyRotations = [][]byte{statement}
+	raw, err = multiSignTestDocument([]sign.PrivateKey{otherKey, idKeys[1]}, []sign.PublicKey{otherPubKey, idPubKeys[1]}, doc)
+	require.NoError(err)
+	_, err = c.Deserialize(raw)
+	require.Error(err)
+	require.True(cl.pool.getAuthorities()[0].IdentityPublicKey.Equal(newIdPubKey))
+}
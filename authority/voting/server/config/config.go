@@ -32,6 +32,8 @@ import (
 	"github.com/katzenpost/katzenpost/core/crypto/pem"
 	"github.com/katzenpost/katzenpost/core/crypto/rand"
 	"github.com/katzenpost/katzenpost/core/crypto/sign"
+	"github.com/katzenpost/katzenpost/core/pki"
+	"github.com/katzenpost/katzenpost/core/sphinx"
 	"github.com/katzenpost/katzenpost/core/utils"
 	"github.com/katzenpost/katzenpost/core/wire"
 )
@@ -60,6 +62,8 @@ const (
 	defaultLambdaM              = 0.00025
 	defaultLambdaMMaxPercentile = 0.99999
 
+	defaultManagementSocket = "management_sock"
+
 	publicKeyHashSize = 32
 )
 
@@ -228,10 +232,6 @@ type Debug struct {
 }
 
 func (dCfg *Debug) validate() error {
-	if dCfg.Layers > defaultLayers {
-		// This is a limitation of the Sphinx implementation.
-		return fmt.Errorf("config: Debug: Layers %v exceeds maximum", dCfg.Layers)
-	}
 	return nil
 }
 
@@ -311,6 +311,12 @@ type Node struct {
 	// IdentityPublicKeyPem is the node's public signing key also known
 	// as the identity key.
 	IdentityPublicKeyPem string
+
+	// LoadWeight is the load balancing weight this authority votes for
+	// the mix, or 0 to vote for none, the mix then being given the median
+	// weight of its layer.  The weight declared in its descriptor is not
+	// used.
+	LoadWeight uint8
 }
 
 func (n *Node) validate(isProvider bool) error {
@@ -320,6 +326,9 @@ func (n *Node) validate(isProvider bool) error {
 		if n.Identifier == "" {
 			return fmt.Errorf("config: %v: Node is missing Identifier", section)
 		}
+		if n.LoadWeight != 0 {
+			return fmt.Errorf("config: %v: Node has LoadWeight set", section)
+		}
 		var err error
 		n.Identifier, err = idna.Lookup.ToASCII(n.Identifier)
 		if err != nil {
@@ -344,6 +353,16 @@ type Server struct {
 
 	// DataDir is the absolute path to the server's state files.
 	DataDir string
+
+	// Archive serves the consensus documents of past epochs kept in the
+	// database, so that the history of the network can be fetched with the
+	// GetConsensusRange command.
+	Archive bool
+
+	// ArchiveRetention is the number of past epochs the documents of which
+	// the archive keeps.  The documents archived while it is set are deleted
+	// once older, and if 0, every document is kept.
+	ArchiveRetention uint64
 }
 
 // Validate parses and checks the Server configuration.
@@ -367,16 +386,47 @@ func (sCfg *Server) validate() error {
 	if !filepath.IsAbs(sCfg.DataDir) {
 		return fmt.Errorf("config: Authority: DataDir '%v' is not an absolute path", sCfg.DataDir)
 	}
+	if sCfg.ArchiveRetention != 0 && !sCfg.Archive {
+		return fmt.Errorf("config: Authority: ArchiveRetention is set without Archive")
+	}
+	return nil
+}
+
+// Management is the authority management interface configuration.
+type Management struct {
+	// Enable enables the management interface.
+	Enable bool
+
+	// Path specifies the path to the management interface socket.  If left
+	// empty it will use `management_sock` under the DataDir.
+	Path string
+}
+
+func (mCfg *Management) applyDefaults(sCfg *Server) {
+	if mCfg.Path == "" {
+		mCfg.Path = filepath.Join(sCfg.DataDir, defaultManagementSocket)
+	}
+}
+
+func (mCfg *Management) validate() error {
+	if !mCfg.Enable {
+		return nil
+	}
+	if !filepath.IsAbs(mCfg.Path) {
+		return fmt.Errorf("config: Management: Path '%v' is not an absolute path", mCfg.Path)
+	}
 	return nil
 }
 
 // Config is the top level authority configuration.
 type Config struct {
-	Server      *Server
-	Authorities []*Authority
-	Logging     *Logging
-	Parameters  *Parameters
-	Debug       *Debug
+	Server         *Server
+	Authorities    []*Authority
+	Logging        *Logging
+	Parameters     *Parameters
+	SphinxGeometry *sphinx.Geometry
+	Management     *Management
+	Debug          *Debug
 
 	Mixes     []*Node
 	Providers []*Node
@@ -408,6 +458,12 @@ func (cfg *Config) FixupAndValidate() error {
 	if cfg.Parameters == nil {
 		cfg.Parameters = &Parameters{}
 	}
+	if cfg.SphinxGeometry == nil {
+		cfg.SphinxGeometry = sphinx.DefaultGeometry()
+	}
+	if cfg.Management == nil {
+		cfg.Management = &Management{}
+	}
 	if cfg.Debug == nil {
 		cfg.Debug = &Debug{}
 	}
@@ -425,8 +481,21 @@ func (cfg *Config) FixupAndValidate() error {
 	if err := cfg.Debug.validate(); err != nil {
 		return err
 	}
+	cfg.Management.applyDefaults(cfg.Server)
+	if err := cfg.Management.validate(); err != nil {
+		return err
+	}
 	cfg.Parameters.applyDefaults()
 	cfg.Debug.applyDefaults()
+	geo, err := sphinx.FixupGeometry(cfg.SphinxGeometry)
+	if err != nil {
+		return fmt.Errorf("config: SphinxGeometry: %v", err)
+	}
+	cfg.SphinxGeometry = geo
+
+	if err := pki.IsTopologyGeometryCompatible(cfg.Debug.Layers, cfg.SphinxGeometry); err != nil {
+		return fmt.Errorf("config: Debug: %v", err)
+	}
 
 	allNodes := make([]*Node, 0, len(cfg.Mixes)+len(cfg.Providers))
 	for _, v := range cfg.Mixes {
@@ -0,0 +1,418 @@
+// keyrotation.go - Katzenpost voting authority key rotation.
+// Copyright (C) 2022  David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/fxamacker/cbor/v2"
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/katzenpost/katzenpost/authority/voting/server/config"
+	"github.com/katzenpost/katzenpost/core/crypto/cert"
+	"github.com/katzenpost/katzenpost/core/crypto/pem"
+	"github.com/katzenpost/katzenpost/core/crypto/rand"
+	"github.com/katzenpost/katzenpost/core/crypto/sign"
+	"github.com/katzenpost/katzenpost/core/pki"
+	"github.com/katzenpost/katzenpost/core/utils"
+	"github.com/katzenpost/katzenpost/core/wire"
+)
+
+const (
+	identityPrivateKeyFile = "identity.private.pem"
+	identityPublicKeyFile  = "identity.public.pem"
+	linkPrivateKeyFile     = "link.private.pem"
+	linkPublicKeyFile      = "link.public.pem"
+	keyRotationFile        = "key_rotation.cbor"
+)
+
+var keyFiles = []string{
+	identityPrivateKeyFile,
+	identityPublicKeyFile,
+	linkPrivateKeyFile,
+	linkPublicKeyFile,
+}
+
+// authorityKeys are the keys an authority rotates to.
+type authorityKeys struct {
+	identityPrivateKey sign.PrivateKey
+	identityPublicKey  sign.PublicKey
+	linkKey            wire.PrivateKey
+}
+
+// authorityRotation is a key rotation of an authority which was followed.
+// It is persisted so that it is followed again after a restart, once its
+// statement has expired.
+type authorityRotation struct {
+	Epoch          uint64
+	OldIdentityKey []byte
+	NewIdentityKey []byte
+	NewLinkKey     []byte
+	Statement      []byte
+}
+
+// RotateKeys generates new identity and link keys for the authority, which
+// are written aside in its data directory with the ".new" suffix, along
+// with the key rotation statement from the old identity key to the new
+// one.  The authority must not be running.
+//
+// The authority announces the statement to its peers in its votes, and
+// the consensus carries it once a threshold of them announce it too.  The
+// authority then switches to the new keys, keeping the old ones with the
+// ".old" suffix, while its peers and the clients follow the rotation from
+// the consensus.  A new rotation is refused as long as the statement of
+// the previous one is valid or the old keys of the previous one are kept.
+func RotateKeys(cfg *config.Config) error {
+	path := func(f string) string {
+		return filepath.Join(cfg.Server.DataDir, f)
+	}
+
+	if statement, err := os.ReadFile(path(keyRotationFile)); err == nil {
+		switch _, err := pki.VerifyAuthorityKeyRotation(statement); err {
+		case nil:
+			return errors.New("authority: the previous key rotation statement is still valid, rotate the keys again once it expired")
+		case cert.ErrCertificateExpired:
+		default:
+			return fmt.Errorf("authority: invalid key rotation statement: %v", err)
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	for _, f := range keyFiles {
+		if pem.Exists(path(f + ".old")) {
+			return errors.New("authority: the keys of a previous rotation exist, remove the .old keys once the peers and the clients have followed the rotation")
+		}
+	}
+
+	oldPrivateKey, oldPublicKey := cert.Scheme.NewKeypair()
+	if !pem.BothExists(path(identityPrivateKeyFile), path(identityPublicKeyFile)) {
+		return errors.New("authority: no identity key to rotate")
+	}
+	if err := pem.FromFile(path(identityPrivateKeyFile), oldPrivateKey); err != nil {
+		return err
+	}
+	if err := pem.FromFile(path(identityPublicKeyFile), oldPublicKey); err != nil {
+		return err
+	}
+
+	newPrivateKey, newPublicKey := cert.Scheme.NewKeypair()
+	linkPrivateKey, linkPublicKey := wire.DefaultScheme.GenerateKeypair(rand.Reader)
+	statement, err := pki.SignAuthorityKeyRotation(oldPrivateKey, oldPublicKey, newPrivateKey, newPublicKey, linkPublicKey)
+	if err != nil {
+		return err
+	}
+
+	// Write the new keys aside, then the statement, so that the authority
+	// only announces the rotation once the new keys are persisted.
+	newKeys := map[string]pem.KeyMaterial{
+		identityPrivateKeyFile: newPrivateKey,
+		identityPublicKeyFile:  newPublicKey,
+		linkPrivateKeyFile:     linkPrivateKey,
+		linkPublicKeyFile:      linkPublicKey,
+	}
+	for _, f := range keyFiles {
+		os.Remove(path(f + ".new"))
+		if err := pem.ToFile(path(f+".new"), newKeys[f]); err != nil {
+			return err
+		}
+	}
+	return utils.WriteFileSync(path(keyRotationFile), statement)
+}
+
+// completeKeySwitch completes the switch to the new keys of a rotation,
+// which was interrupted if both new and old keys are present.
+func completeKeySwitch(dataDir string) error {
+	hasNew, hasOld := false, false
+	for _, f := range keyFiles {
+		hasNew = hasNew || pem.Exists(filepath.Join(dataDir, f+".new"))
+		hasOld = hasOld || pem.Exists(filepath.Join(dataDir, f+".old"))
+	}
+	if hasNew && hasOld {
+		return utils.SwapFiles(dataDir, keyFiles)
+	}
+	return nil
+}
+
+// loadKeyRotation loads the key rotation statement of the authority from
+// its data directory, unless it has expired, along with the new keys if
+// the authority has not switched to them yet.
+func (s *Server) loadKeyRotation() error {
+	path := func(f string) string {
+		return filepath.Join(s.cfg.Server.DataDir, f)
+	}
+
+	statement, err := os.ReadFile(path(keyRotationFile))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	r, err := pki.VerifyAuthorityKeyRotation(statement)
+	if err == cert.ErrCertificateExpired {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("authority: invalid key rotation statement: %v", err)
+	}
+	if r.NewIdentityKey.Equal(s.identityPublicKey) {
+		s.keyRotation = r
+		return nil
+	}
+	if !r.OldIdentityKey.Equal(s.identityPublicKey) {
+		return errors.New("authority: key rotation statement is not from or to the identity key")
+	}
+
+	next := new(authorityKeys)
+	next.identityPrivateKey, next.identityPublicKey = cert.Scheme.NewKeypair()
+	if err := pem.FromFile(path(identityPrivateKeyFile+".new"), next.identityPrivateKey); err != nil {
+		return err
+	}
+	if err := pem.FromFile(path(identityPublicKeyFile+".new"), next.identityPublicKey); err != nil {
+		return err
+	}
+	linkPrivateKey, linkPublicKey := wire.DefaultScheme.GenerateKeypair(rand.Reader)
+	if err := pem.FromFile(path(linkPrivateKeyFile+".new"), linkPrivateKey); err != nil {
+		return err
+	}
+	if err := pem.FromFile(path(linkPublicKeyFile+".new"), linkPublicKey); err != nil {
+		return err
+	}
+	if !next.identityPublicKey.Equal(r.NewIdentityKey) || !linkPublicKey.Equal(r.NewLinkKey) {
+		return errors.New("authority: the new keys are not the ones of the key rotation statement")
+	}
+	next.linkKey = linkPrivateKey
+	s.keyRotation, s.nextKeys = r, next
+	return nil
+}
+
+// switchKeys switches the authority to the new keys of its key rotation,
+// in its data directory and in memory.
+func (s *Server) switchKeys(r *pki.AuthorityKeyRotation) error {
+	next := s.nextKeys
+	if next == nil || !next.identityPublicKey.Equal(r.NewIdentityKey) {
+		return errors.New("authority: no new keys to switch to")
+	}
+	if err := utils.SwapFiles(s.cfg.Server.DataDir, keyFiles); err != nil {
+		return err
+	}
+
+	s.keysLock.Lock()
+	s.identityPrivateKey = next.identityPrivateKey
+	s.identityPublicKey = next.identityPublicKey
+	s.linkKey = next.linkKey
+	s.nextKeys = nil
+	s.keysLock.Unlock()
+
+	s.log.Noticef("Authority switched to the identity key %x", r.NewIdentityKey.Sum256())
+	return nil
+}
+
+// announcedKeyRotations returns the key rotation statements of the
+// authorities announced in our votes, until they expire.
+func (s *state) announcedKeyRotations() [][]byte {
+	// Lock is held.
+	rotations := [][]byte{}
+	for oldPk, raw := range s.authorityRotations {
+		if _, err := pki.VerifyAuthorityKeyRotation(raw); err != nil {
+			delete(s.authorityRotations, oldPk)
+			continue
+		}
+		rotations = append(rotations, raw)
+	}
+	sortKeyRotations(rotations)
+	return rotations
+}
+
+// learnKeyRotations adds the key rotation statements of the authorities
+// carried by the vote of a peer to the ones announced in our votes.
+func (s *state) learnKeyRotations(vote *pki.Document) {
+	// Lock is held.
+	for _, r := range vote.AuthorityKeyRotations() {
+		oldPk := r.OldIdentityKey.Sum256()
+		if _, ok := s.verifiers[oldPk]; !ok {
+			continue
+		}
+		if _, ok := s.authorityRotations[oldPk]; !ok {
+			s.log.Noticef("Learned the key rotation of authority %x to %x", oldPk, r.NewIdentityKey.Sum256())
+			s.authorityRotations[oldPk] = r.Raw
+		}
+	}
+}
+
+// tallyKeyRotations returns the key rotation statements of the authorities
+// announced by a threshold of the votes.
+func (s *state) tallyKeyRotations(epoch uint64) [][]byte {
+	// Lock is held.
+	votes := make(map[string]int)
+	for _, vote := range s.votes[epoch] {
+		seen := make(map[string]bool)
+		for _, raw := range vote.KeyRotations {
+			if !seen[string(raw)] {
+				seen[string(raw)] = true
+				votes[string(raw)]++
+			}
+		}
+	}
+	rotations := [][]byte{}
+	for raw, n := range votes {
+		if n < s.threshold {
+			continue
+		}
+		if _, err := pki.VerifyAuthorityKeyRotation([]byte(raw)); err == nil {
+			rotations = append(rotations, []byte(raw))
+		}
+	}
+	sortKeyRotations(rotations)
+	if len(rotations) == 0 {
+		return nil
+	}
+	return rotations
+}
+
+func sortKeyRotations(rotations [][]byte) {
+	sort.Slice(rotations, func(i, j int) bool {
+		return bytes.Compare(rotations[i], rotations[j]) < 0
+	})
+}
+
+// followKeyRotations follows the key rotations of the authorities carried
+// by the consensus: the keys of the peers are replaced by the new ones,
+// and the authority switches to its new keys if it rotated them.
+func (s *state) followKeyRotations(doc *pki.Document) {
+	// Lock is held.
+	for _, r := range doc.AuthorityKeyRotations() {
+		oldPk := r.OldIdentityKey.Sum256()
+		if _, ok := s.verifiers[oldPk]; !ok {
+			continue
+		}
+		a := &authorityRotation{
+			Epoch:          r.Epoch,
+			OldIdentityKey: r.OldIdentityKey.Bytes(),
+			NewIdentityKey: r.NewIdentityKey.Bytes(),
+			NewLinkKey:     r.NewLinkKey.Bytes(),
+			Statement:      r.Raw,
+		}
+		if err := s.db.Update(func(tx *bolt.Tx) error {
+			b, err := cbor.Marshal(a)
+			if err != nil {
+				return err
+			}
+			bkt := tx.Bucket([]byte(authorityRotationsBucket))
+			return bkt.Put(oldPk[:], b)
+		}); err != nil {
+			// Persistence failures are FATAL.
+			s.s.fatalErrCh <- err
+			return
+		}
+		if err := s.rotateAuthority(r); err != nil {
+			s.s.fatalErrCh <- err
+			return
+		}
+	}
+}
+
+// rotateAuthority replaces the keys of an authority by the ones succeeding
+// them through its key rotation.
+func (s *state) rotateAuthority(r *pki.AuthorityKeyRotation) error {
+	// Lock is held.
+	oldPk, pk := r.OldIdentityKey.Sum256(), r.NewIdentityKey.Sum256()
+	if oldPk == s.identityPubKeyHash() {
+		if err := s.s.switchKeys(r); err != nil {
+			return err
+		}
+	}
+
+	delete(s.verifiers, oldPk)
+	s.verifiers[pk] = r.NewIdentityKey
+	s.reverseHash[pk] = r.NewIdentityKey
+	if _, ok := s.authorizedAuthorities[oldPk]; ok {
+		delete(s.authorizedAuthorities, oldPk)
+		s.authorizedAuthorities[pk] = true
+	}
+	if _, ok := s.authorityLinkKeys[oldPk]; ok {
+		delete(s.authorityLinkKeys, oldPk)
+		s.authorityLinkKeys[pk] = r.NewLinkKey
+	}
+	for i, auth := range s.s.cfg.Authorities {
+		if auth.IdentityPublicKey.Sum256() == oldPk {
+			rotated := *auth
+			rotated.IdentityPublicKey = r.NewIdentityKey
+			rotated.LinkPublicKey = r.NewLinkKey
+			s.s.cfg.Authorities[i] = &rotated
+		}
+	}
+	s.authorityRotations[oldPk] = r.Raw
+	s.log.Noticef("Authority identity key %x rotated to %x", oldPk, pk)
+	return nil
+}
+
+// restoreAuthorityRotations follows the persisted key rotations of the
+// authorities again, in the order they were made.
+func (s *state) restoreAuthorityRotations(bkt *bolt.Bucket) error {
+	rotations := []*pki.AuthorityKeyRotation{}
+	if err := bkt.ForEach(func(k, v []byte) error {
+		a := new(authorityRotation)
+		if err := cbor.Unmarshal(v, a); err != nil {
+			return err
+		}
+		r := &pki.AuthorityKeyRotation{
+			Epoch:          a.Epoch,
+			OldIdentityKey: cert.Scheme.NewEmptyPublicKey(),
+			NewIdentityKey: cert.Scheme.NewEmptyPublicKey(),
+			Raw:            a.Statement,
+		}
+		if err := r.OldIdentityKey.FromBytes(a.OldIdentityKey); err != nil {
+			return err
+		}
+		if err := r.NewIdentityKey.FromBytes(a.NewIdentityKey); err != nil {
+			return err
+		}
+		linkKey, err := wire.DefaultScheme.PublicKeyFromBytes(a.NewLinkKey)
+		if err != nil {
+			return err
+		}
+		r.NewLinkKey = linkKey
+		oldPk := r.OldIdentityKey.Sum256()
+		if !bytes.Equal(k, oldPk[:]) {
+			return errors.New("state: invalid persisted authority key rotation")
+		}
+		rotations = append(rotations, r)
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	sort.SliceStable(rotations, func(i, j int) bool {
+		return rotations[i].Epoch < rotations[j].Epoch
+	})
+	for _, r := range rotations {
+		if _, ok := s.verifiers[r.OldIdentityKey.Sum256()]; !ok {
+			continue
+		}
+		if err := s.rotateAuthority(r); err != nil {
+			return err
+		}
+	}
+
+	// The configuration may name the retired key of the authority itself.
+	s.threshold = len(s.verifiers)/2 + 1
+	return nil
+}
@@ -0,0 +1,109 @@
+// keyrotation_test.go - Katzenpost voting authority key rotation tests.
+// Copyright (C) 2022  David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/katzenpost/katzenpost/authority/voting/server/config"
+	"github.com/katzenpost/katzenpost/core/crypto/cert"
+	"github.com/katzenpost/katzenpost/core/crypto/pem"
+	"github.com/katzenpost/katzenpost/core/crypto/rand"
+	"github.com/katzenpost/katzenpost/core/log"
+	"github.com/katzenpost/katzenpost/core/wire"
+)
+
+func TestRotateAuthorityKeys(t *testing.T) {
+	require := require.New(t)
+
+	cfg := &config.Config{Server: &config.Server{DataDir: t.TempDir()}}
+	path := func(f string) string {
+		return filepath.Join(cfg.Server.DataDir, f)
+	}
+	require.Error(RotateKeys(cfg))
+
+	oldKey, oldPub := cert.Scheme.NewKeypair()
+	linkKey, linkPub := wire.DefaultScheme.GenerateKeypair(rand.Reader)
+	require.NoError(pem.ToFile(path(identityPrivateKeyFile), oldKey))
+	require.NoError(pem.ToFile(path(identityPublicKeyFile), oldPub))
+	require.NoError(pem.ToFile(path(linkPrivateKeyFile), linkKey))
+	require.NoError(pem.ToFile(path(linkPublicKeyFile), linkPub))
+
+	logBackend, err := log.New("", "DEBUG", false)
+	require.NoError(err)
+	s := &Server{
+		cfg:                cfg,
+		log:                logBackend.GetLogger("authority"),
+		identityPrivateKey: oldKey,
+		identityPublicKey:  oldPub,
+		linkKey:            linkKey,
+	}
+	require.NoError(s.loadKeyRotation())
+	require.Nil(s.keyRotation)
+	require.Nil(s.nextKeys)
+
+	// The new keys are written aside until the rotation is followed.
+	require.NoError(RotateKeys(cfg))
+	_, currentPub := cert.Scheme.NewKeypair()
+	require.NoError(pem.FromFile(path(identityPublicKeyFile), currentPub))
+	require.True(currentPub.Equal(oldPub))
+	require.NoError(s.loadKeyRotation())
+	require.NotNil(s.keyRotation)
+	require.True(s.keyRotation.OldIdentityKey.Equal(oldPub))
+	require.NotNil(s.nextKeys)
+	require.True(s.nextKeys.identityPublicKey.Equal(s.keyRotation.NewIdentityKey))
+	require.True(s.nextKeys.linkKey.PublicKey().Equal(s.keyRotation.NewLinkKey))
+
+	// A new rotation waits for the statement to expire.
+	require.Error(RotateKeys(cfg))
+
+	// Following the rotation switches the keys, keeping the old ones.
+	require.NoError(s.switchKeys(s.keyRotation))
+	require.Nil(s.nextKeys)
+	require.True(s.IdentityKey().Equal(s.keyRotation.NewIdentityKey))
+	_, retiredPub := cert.Scheme.NewKeypair()
+	require.NoError(pem.FromFile(path(identityPublicKeyFile+".old"), retiredPub))
+	require.True(retiredPub.Equal(oldPub))
+	_, newPub := cert.Scheme.NewKeypair()
+	require.NoError(pem.FromFile(path(identityPublicKeyFile), newPub))
+	require.True(newPub.Equal(s.keyRotation.NewIdentityKey))
+	require.Error(s.switchKeys(s.keyRotation))
+
+	// After a restart the statement is to the current identity key.
+	r := s.keyRotation
+	s.keyRotation = nil
+	require.NoError(completeKeySwitch(cfg.Server.DataDir))
+	require.NoError(s.loadKeyRotation())
+	require.Equal(r.Raw, s.keyRotation.Raw)
+	require.Nil(s.nextKeys)
+
+	// The statement must be from or to the identity key.
+	_, s.identityPublicKey = cert.Scheme.NewKeypair()
+	require.Error(s.loadKeyRotation())
+
+	// A new rotation waits for the old keys to be removed.
+	require.NoError(os.Remove(path(keyRotationFile)))
+	require.Error(RotateKeys(cfg))
+	for _, f := range keyFiles {
+		require.NoError(os.Remove(path(f + ".old")))
+	}
+	require.NoError(RotateKeys(cfg))
+}
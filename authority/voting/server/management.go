@@ -0,0 +1,157 @@
+// management.go - Katzenpost voting authority management interface.
+// Copyright (C) 2022  David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/idna"
+
+	"github.com/katzenpost/katzenpost/core/crypto/cert"
+	"github.com/katzenpost/katzenpost/core/crypto/pem"
+	"github.com/katzenpost/katzenpost/core/thwack"
+)
+
+const (
+	authorizeNodeCmd   = "AUTHORIZE_NODE"
+	deauthorizeNodeCmd = "DEAUTHORIZE_NODE"
+	listNodesCmd       = "LIST_NODES"
+
+	nodeMix      = "MIX"
+	nodeProvider = "PROVIDER"
+)
+
+// initManagement starts the management interface, which allows the nodes
+// to be authorized and deauthorized at run-time with the commands:
+//
+//	AUTHORIZE_NODE MIX <IdentityPublicKeyPem> [<LoadWeight>]
+//	AUTHORIZE_NODE PROVIDER <IdentityPublicKeyPem> <Identifier>
+//	DEAUTHORIZE_NODE <identity key hash>
+//	LIST_NODES
+func (s *Server) initManagement() error {
+	if _, err := os.Stat(s.cfg.Management.Path); !os.IsNotExist(err) {
+		s.log.Warningf("Warning: management socket file '%s' already exists, deleting it.", s.cfg.Management.Path)
+		if err := os.Remove(s.cfg.Management.Path); err != nil {
+			return fmt.Errorf("failed to delete mgmt socket file: %v", err)
+		}
+	}
+	mgmtCfg := &thwack.Config{
+		Net:         "unix",
+		Addr:        s.cfg.Management.Path,
+		ServiceName: s.cfg.Server.Identifier + " Katzenpost Authority Management Interface",
+		LogModule:   "mgmt",
+		NewLoggerFn: s.logBackend.GetLogger,
+	}
+	var err error
+	if s.management, err = thwack.New(mgmtCfg); err != nil {
+		return err
+	}
+	s.management.RegisterCommand(authorizeNodeCmd, s.onAuthorizeNode)
+	s.management.RegisterCommand(deauthorizeNodeCmd, s.onDeauthorizeNode)
+	s.management.RegisterCommand(listNodesCmd, s.onListNodes)
+	return s.management.Start()
+}
+
+func (s *Server) onAuthorizeNode(c *thwack.Conn, l string) error {
+	sp := strings.Split(l, " ")
+	if len(sp) < 3 || len(sp) > 4 {
+		c.Log().Debugf("AUTHORIZE_NODE invalid syntax: '%v'", l)
+		return c.WriteReply(thwack.StatusSyntaxError)
+	}
+
+	a := &authorization{Authorized: true}
+	switch strings.ToUpper(sp[1]) {
+	case nodeMix:
+		if len(sp) == 4 {
+			w, err := strconv.ParseUint(sp[3], 10, 8)
+			if err != nil || w == 0 {
+				c.Log().Debugf("AUTHORIZE_NODE invalid load weight: '%v'", sp[3])
+				return c.WriteReply(thwack.StatusSyntaxError)
+			}
+			a.LoadWeight = uint8(w)
+		}
+	case nodeProvider:
+		if len(sp) != 4 {
+			c.Log().Debugf("AUTHORIZE_NODE missing Provider identifier: '%v'", l)
+			return c.WriteReply(thwack.StatusSyntaxError)
+		}
+		var err error
+		if a.Identifier, err = idna.Lookup.ToASCII(sp[3]); err != nil {
+			c.Log().Debugf("AUTHORIZE_NODE invalid Provider identifier: %v", err)
+			return c.WriteReply(thwack.StatusSyntaxError)
+		}
+		a.Provider = true
+	default:
+		c.Log().Debugf("AUTHORIZE_NODE invalid node kind: '%v'", sp[1])
+		return c.WriteReply(thwack.StatusSyntaxError)
+	}
+
+	// The identity key is read like the ones of the configuration.
+	pemFile := sp[2]
+	if !filepath.IsAbs(pemFile) {
+		pemFile = filepath.Join(s.cfg.Server.DataDir, pemFile)
+	}
+	_, identityKey := cert.Scheme.NewKeypair()
+	if err := pem.FromFile(pemFile, identityKey); err != nil {
+		c.Log().Errorf("AUTHORIZE_NODE invalid identity key: %v", err)
+		return c.WriteReply(thwack.StatusSyntaxError)
+	}
+	a.IdentityKey = identityKey.Bytes()
+
+	if err := s.state.authorizeNode(identityKey, a); err != nil {
+		c.Log().Errorf("Failed to authorize node: %v", err)
+		return c.WriteReply(thwack.StatusTransactionFailed)
+	}
+	s.log.Noticef("Node %x authorized through the management interface.", identityKey.Sum256())
+	return c.WriteReply(thwack.StatusOk)
+}
+
+func (s *Server) onDeauthorizeNode(c *thwack.Conn, l string) error {
+	sp := strings.Split(l, " ")
+	if len(sp) != 2 {
+		c.Log().Debugf("DEAUTHORIZE_NODE invalid syntax: '%v'", l)
+		return c.WriteReply(thwack.StatusSyntaxError)
+	}
+	b, err := hex.DecodeString(sp[1])
+	if err != nil || len(b) != publicKeyHashSize {
+		c.Log().Debugf("DEAUTHORIZE_NODE invalid identity key hash: '%v'", sp[1])
+		return c.WriteReply(thwack.StatusSyntaxError)
+	}
+	var pk [publicKeyHashSize]byte
+	copy(pk[:], b)
+
+	if err := s.state.deauthorizeNode(pk); err != nil {
+		c.Log().Errorf("Failed to deauthorize node: %v", err)
+		return c.WriteReply(thwack.StatusTransactionFailed)
+	}
+	s.log.Noticef("Node %x deauthorized through the management interface.", pk)
+	return c.WriteReply(thwack.StatusOk)
+}
+
+func (s *Server) onListNodes(c *thwack.Conn, l string) error {
+	for _, v := range s.state.listNodes() {
+		if err := c.Writer().PrintfLine("%v-%v", thwack.StatusOk, v); err != nil {
+			return err
+		}
+	}
+	return c.WriteReply(thwack.StatusOk)
+}
@@ -0,0 +1,150 @@
+// management_test.go - Katzenpost voting authority management interface tests.
+// Copyright (C) 2022  David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"fmt"
+	"net/textproto"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/katzenpost/katzenpost/authority/voting/server/config"
+	"github.com/katzenpost/katzenpost/core/crypto/cert"
+	"github.com/katzenpost/katzenpost/core/crypto/pem"
+	"github.com/katzenpost/katzenpost/core/crypto/sign"
+	"github.com/katzenpost/katzenpost/core/log"
+	"github.com/katzenpost/katzenpost/core/pki"
+	"github.com/katzenpost/katzenpost/core/thwack"
+)
+
+func TestAuthorizeNode(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	logBackend, err := log.New("", "DEBUG", false)
+	require.NoError(err)
+	dataDir := t.TempDir()
+	dbPath := filepath.Join(dataDir, "persistance.db")
+
+	keyA, pubA := cert.Scheme.NewKeypair()
+	_, pubB := cert.Scheme.NewKeypair()
+	keyC, pubC := cert.Scheme.NewKeypair()
+	_, pubP := cert.Scheme.NewKeypair()
+	require.NoError(pem.ToFile(filepath.Join(dataDir, "b.pem"), pubB))
+	require.NoError(pem.ToFile(filepath.Join(dataDir, "p.pem"), pubP))
+
+	srv := &Server{
+		cfg: &config.Config{
+			Server: &config.Server{Identifier: "authority", DataDir: dataDir},
+			Management: &config.Management{
+				Enable: true,
+				Path:   filepath.Join(dataDir, "management_sock"),
+			},
+		},
+		fatalErrCh: make(chan error),
+		logBackend: logBackend,
+		log:        logBackend.GetLogger("authority"),
+	}
+
+	// newTestState returns a state with the mix A configured, restored
+	// from the database.
+	newTestState := func() *state {
+		st := &state{
+			s:                   srv,
+			log:                 logBackend.GetLogger("state"),
+			reverseHash:         make(map[[publicKeyHashSize]byte]sign.PublicKey),
+			authorizedMixes:     map[[publicKeyHashSize]byte]bool{pubA.Sum256(): true},
+			assignedLoadWeights: make(map[[publicKeyHashSize]byte]uint8),
+			authorizedProviders: make(map[[publicKeyHashSize]byte]string),
+			keyRotations:        make(map[[publicKeyHashSize]byte][publicKeyHashSize]byte),
+			documents:           make(map[uint64]*pki.Document),
+			descriptors:         make(map[uint64]map[[publicKeyHashSize]byte]*pki.MixDescriptor),
+			verifiers:           make(map[[publicKeyHashSize]byte]cert.Verifier),
+		}
+		st.db, err = bolt.Open(dbPath, 0600, nil)
+		require.NoError(err)
+		require.NoError(st.restorePersistence())
+		return st
+	}
+	srv.state = newTestState()
+	require.NoError(srv.initManagement())
+	defer srv.management.Halt()
+
+	conn, err := textproto.Dial("unix", srv.cfg.Management.Path)
+	require.NoError(err)
+	defer conn.Close()
+	_, _, err = conn.ReadResponse(int(thwack.StatusServiceReady))
+	require.NoError(err)
+	cmd := func(status thwack.StatusCode, format string, args ...interface{}) string {
+		id, err := conn.Cmd(format, args...)
+		require.NoError(err)
+		conn.StartResponse(id)
+		defer conn.EndResponse(id)
+		_, msg, err := conn.ReadResponse(int(status))
+		require.NoError(err, fmt.Sprintf(format, args...))
+		return msg
+	}
+
+	cmd(thwack.StatusOk, "AUTHORIZE_NODE MIX b.pem 7")
+	cmd(thwack.StatusOk, "AUTHORIZE_NODE PROVIDER %v provider", filepath.Join(dataDir, "p.pem"))
+	require.True(srv.state.authorizedMixes[pubB.Sum256()])
+	require.Equal(uint8(7), srv.state.assignedLoadWeights[pubB.Sum256()])
+	require.Equal("provider", srv.state.authorizedProviders[pubP.Sum256()])
+
+	cmd(thwack.StatusTransactionFailed, "AUTHORIZE_NODE MIX p.pem")
+	cmd(thwack.StatusSyntaxError, "AUTHORIZE_NODE BRIDGE b.pem")
+	cmd(thwack.StatusSyntaxError, "AUTHORIZE_NODE MIX b.pem 0")
+	cmd(thwack.StatusSyntaxError, "AUTHORIZE_NODE PROVIDER p.pem")
+	cmd(thwack.StatusSyntaxError, "AUTHORIZE_NODE MIX missing.pem")
+	cmd(thwack.StatusSyntaxError, "DEAUTHORIZE_NODE b.pem")
+
+	nodes := cmd(thwack.StatusOk, "LIST_NODES")
+	require.Contains(nodes, fmt.Sprintf("MIX %x\n", pubA.Sum256()))
+	require.Contains(nodes, fmt.Sprintf("MIX %x 7\n", pubB.Sum256()))
+	require.Contains(nodes, fmt.Sprintf("PROVIDER %x provider\n", pubP.Sum256()))
+
+	// Deauthorizing a node which rotated its key deauthorizes the keys it
+	// rotated from, lest the configured one be authorized again.
+	statement, err := pki.SignKeyRotation(keyA, pubA, keyC, pubC)
+	require.NoError(err)
+	descC := &pki.MixDescriptor{Name: "mix", IdentityKey: pubC, KeyRotation: statement}
+	require.True(srv.state.authorizeDescriptor(descC))
+	cmd(thwack.StatusOk, "DEAUTHORIZE_NODE %x", pubC.Sum256())
+	cmd(thwack.StatusTransactionFailed, "DEAUTHORIZE_NODE %x", pubC.Sum256())
+	require.False(srv.state.authorizeDescriptor(descC))
+	require.NoError(srv.state.db.Close())
+
+	srv.state = newTestState()
+	require.False(srv.state.authorizeDescriptor(&pki.MixDescriptor{Name: "mix", IdentityKey: pubA}))
+	require.False(srv.state.authorizeDescriptor(descC))
+	require.True(srv.state.authorizeDescriptor(&pki.MixDescriptor{Name: "mix", IdentityKey: pubB}))
+	require.Equal(uint8(7), srv.state.assignedLoadWeights[pubB.Sum256()])
+	require.True(srv.state.authorizeDescriptor(&pki.MixDescriptor{Name: "provider", IdentityKey: pubP, Provider: true}))
+
+	// A retired key can't be authorized again, but its successor can.
+	require.Error(srv.state.authorizeNode(pubA, &authorization{Authorized: true, IdentityKey: pubA.Bytes()}))
+	require.NoError(srv.state.authorizeNode(pubC, &authorization{Authorized: true, IdentityKey: pubC.Bytes()}))
+	require.NoError(srv.state.db.Close())
+
+	srv.state = newTestState()
+	defer srv.state.db.Close()
+	require.False(srv.state.authorizeDescriptor(&pki.MixDescriptor{Name: "mix", IdentityKey: pubA}))
+	require.True(srv.state.authorizeDescriptor(descC))
+}
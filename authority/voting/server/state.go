@@ -32,6 +32,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/fxamacker/cbor/v2"
 	bolt "go.etcd.io/bbolt"
 	"golang.org/x/crypto/sha3"
 	"gopkg.in/op/go-logging.v1"
@@ -45,7 +46,6 @@ import (
 	"github.com/katzenpost/katzenpost/core/epochtime"
 	"github.com/katzenpost/katzenpost/core/monotime"
 	"github.com/katzenpost/katzenpost/core/pki"
-	"github.com/katzenpost/katzenpost/core/sphinx"
 	"github.com/katzenpost/katzenpost/core/sphinx/constants"
 	"github.com/katzenpost/katzenpost/core/wire"
 	"github.com/katzenpost/katzenpost/core/wire/commands"
@@ -53,14 +53,18 @@ import (
 )
 
 const (
-	descriptorsBucket     = "descriptors"
-	documentsBucket       = "documents"
-	stateAcceptDescriptor = "accept_desc"
-	stateAcceptVote       = "accept_vote"
-	stateAcceptReveal     = "accept_reveal"
-	stateAcceptCert       = "accept_cert"
-	stateAcceptSignature  = "accept_signature"
-	stateBootstrap        = "bootstrap"
+	descriptorsBucket        = "descriptors"
+	documentsBucket          = "documents"
+	keyRotationsBucket       = "keyRotations"
+	authorityRotationsBucket = "authorityRotations"
+	authorizationsBucket     = "authorizations"
+	retentionBucket          = "retention"
+	stateAcceptDescriptor    = "accept_desc"
+	stateAcceptVote          = "accept_vote"
+	stateAcceptReveal        = "accept_reveal"
+	stateAcceptCert          = "accept_cert"
+	stateAcceptSignature     = "accept_signature"
+	stateBootstrap           = "bootstrap"
 
 	publicKeyHashSize = 32
 )
@@ -74,6 +78,7 @@ var (
 	errGone                  = errors.New("authority: Requested epoch will never get a Document")
 	errNotYet                = errors.New("authority: Document is not ready yet")
 	errInvalidTopology       = errors.New("authority: Invalid Topology")
+	errForbidden             = errors.New("authority: Node is not authorized")
 	weekOfEpochs             = uint64(time.Duration(time.Hour*24*7) / epochtime.Period)
 )
 
@@ -87,6 +92,27 @@ type document struct {
 	raw []byte
 }
 
+// authorization is the authorization, or deauthorization, of a node made
+// through the management interface.  It is persisted, and overrides the
+// configuration.
+type authorization struct {
+	// Authorized is false if the node is deauthorized.
+	Authorized bool
+
+	// IdentityKey is the serialized identity key of the node.
+	IdentityKey []byte
+
+	// Provider is true if the node is a Provider.
+	Provider bool
+
+	// Identifier is the identifier of a Provider.
+	Identifier string
+
+	// LoadWeight is the load weight assigned to a mix, or 0 to assign
+	// none.
+	LoadWeight uint8
+}
+
 type state struct {
 	sync.RWMutex
 	worker.Worker
@@ -98,9 +124,13 @@ type state struct {
 
 	reverseHash           map[[publicKeyHashSize]byte]sign.PublicKey
 	authorizedMixes       map[[publicKeyHashSize]byte]bool
+	assignedLoadWeights   map[[publicKeyHashSize]byte]uint8
+	reputations           map[uint64]map[[publicKeyHashSize]byte]float64
 	authorizedProviders   map[[publicKeyHashSize]byte]string
 	authorizedAuthorities map[[publicKeyHashSize]byte]bool
 	authorityLinkKeys     map[[publicKeyHashSize]byte]wire.PublicKey
+	keyRotations          map[[publicKeyHashSize]byte][publicKeyHashSize]byte
+	authorityRotations    map[[publicKeyHashSize]byte][]byte
 
 	documents    map[uint64]*pki.Document
 	myconsensus  map[uint64]*pki.Document
@@ -271,7 +301,7 @@ func (s *state) persistDocument(epoch uint64, doc []byte) {
 	if err := s.db.Update(func(tx *bolt.Tx) error {
 		bkt := tx.Bucket([]byte(documentsBucket))
 		bkt.Put(epochToBytes(epoch), doc)
-		return nil
+		return s.retainDocument(tx, epoch)
 	}); err != nil {
 		// Persistence failures are FATAL.
 		s.s.fatalErrCh <- err
@@ -292,12 +322,17 @@ func (s *state) getVote(epoch uint64) (*pki.Document, error) {
 
 	descriptors := []*pki.MixDescriptor{}
 	for _, desc := range s.descriptors[epoch] {
-		descriptors = append(descriptors, desc)
+		// Skip the nodes deauthorized since their upload.
+		if s.isDescriptorAuthorized(desc) {
+			descriptors = append(descriptors, desc)
+		}
 	}
 
 	// vote topology is irrelevent.
 	var zeros [32]byte
 	vote := s.getDocument(descriptors, s.s.cfg.Parameters, zeros[:])
+	vote.LoadWeights = s.voteLoadWeights(vote)
+	vote.KeyRotations = s.announcedKeyRotations()
 
 	// create our SharedRandom Commit
 	signedCommit, err := s.doCommit(epoch)
@@ -353,6 +388,8 @@ func (s *state) getCertificate(epoch uint64) (*pki.Document, error) {
 	var zeros [32]byte
 	srv := zeros[:]
 	certificate := s.getDocument(mixes, params, srv)
+	certificate.LoadWeights = s.tallyLoadWeights(epoch, certificate)
+	certificate.KeyRotations = s.tallyKeyRotations(epoch)
 	// add the SharedRandomCommit and SharedRandomReveal that we have seen
 	certificate.SharedRandomCommit = s.commits[epoch]
 	certificate.SharedRandomReveal = s.reveals[epoch]
@@ -418,6 +455,8 @@ func (s *state) getMyConsensus(epoch uint64) (*pki.Document, error) {
 	}
 	mixes, params, err := s.tallyVotes(epoch)
 	consensusOfOne := s.getDocument(mixes, params, srv)
+	consensusOfOne.LoadWeights = s.tallyLoadWeights(epoch, consensusOfOne)
+	consensusOfOne.KeyRotations = s.tallyKeyRotations(epoch)
 	_, err = s.doSignDocument(s.s.identityPrivateKey, s.s.identityPublicKey, consensusOfOne)
 	if err != nil {
 		return nil, err
@@ -460,6 +499,7 @@ func (s *state) getThresholdConsensus(epoch uint64) (*pki.Document, error) {
 		// Persist the document to disk.
 		s.persistDocument(epoch, signedConsensus)
 		s.documents[epoch] = ourConsensus
+		s.followKeyRotations(ourConsensus)
 		return ourConsensus, nil
 	} else {
 		s.log.Errorf("VerifyThreshold failed!: %s", err)
@@ -526,6 +566,7 @@ func (s *state) getDocument(descriptors []*pki.MixDescriptor, params *config.Par
 		LambdaDMaxDelay:   params.LambdaDMaxDelay,
 		LambdaM:           params.LambdaM,
 		LambdaMMaxDelay:   params.LambdaMMaxDelay,
+		SphinxGeometry:    s.s.cfg.SphinxGeometry,
 		Topology:          topology,
 		Providers:         providers,
 		SharedRandomValue: srv,
@@ -541,13 +582,18 @@ func (s *state) hasEnoughDescriptors(m map[[publicKeyHashSize]byte]*pki.MixDescr
 	//  * One provider.
 	//
 	// Otherwise, it's pointless to generate a unusable document.
-	nrProviders := 0
+	nrProviders, nrNodes := 0, 0
 	for _, v := range m {
+		// The nodes deauthorized since their upload don't count.
+		if !s.isDescriptorAuthorized(v) {
+			continue
+		}
 		if v.Provider {
 			nrProviders++
+		} else {
+			nrNodes++
 		}
 	}
-	nrNodes := len(m) - nrProviders
 
 	minNodes := s.s.cfg.Debug.Layers * s.s.cfg.Debug.MinNodesPerLayer
 	return nrProviders > 0 && nrNodes >= minNodes
@@ -661,6 +707,8 @@ func (s *state) verifyCommits(epoch uint64) (map[[publicKeyHashSize]byte][]byte,
 func (s *state) IsPeerValid(creds *wire.PeerCredentials) bool {
 	var ad [publicKeyHashSize]byte
 	copy(ad[:], creds.AdditionalData[:publicKeyHashSize])
+	s.RLock()
+	defer s.RUnlock()
 	_, ok := s.authorizedAuthorities[ad]
 	if ok {
 		return true
@@ -683,12 +731,12 @@ func (s *state) sendCommandToPeer(peer *config.Authority, cmd commands.Command)
 	defer conn.Close()
 	s.s.Add(1)
 	defer s.s.Done()
-	identityHash := s.s.identityPublicKey.Sum256()
+	identityHash, linkKey := s.s.sessionKeys()
 	cfg := &wire.SessionConfig{
-		Geometry:          sphinx.DefaultGeometry(),
+		Geometry:          s.s.cfg.SphinxGeometry,
 		Authenticator:     s,
 		AdditionalData:    identityHash[:],
-		AuthenticationKey: s.s.linkKey,
+		AuthenticationKey: linkKey,
 		RandomReader:      rand.Reader,
 	}
 	session, err := wire.NewSession(cfg, true)
@@ -958,12 +1006,18 @@ func (s *state) tallyVotes(epoch uint64) ([]*pki.MixDescriptor, *config.Paramete
 			if err != nil {
 				return nil, nil, err
 			}
-			// only add nodes we have authorized
+			// only add nodes we have authorized, following the key
+			// rotations we might have missed the upload of
+			if err := s.acceptKeyRotation(desc); err != nil {
+				s.log.Errorf("Node %s: Rejected key rotation: %v", desc.Name, err)
+			}
 			if s.isDescriptorAuthorized(desc) {
 				nodes = append(nodes, desc)
 			}
 		}
 	}
+	// exclude the mixes with a bad reputation
+	nodes = s.tallyReputations(epoch, nodes)
 	// include parameters that have a threshold of votes
 	for bs, votes := range mixParams {
 		if len(votes) >= s.threshold {
@@ -982,6 +1036,141 @@ func (s *state) tallyVotes(epoch uint64) ([]*pki.MixDescriptor, *config.Paramete
 	return nil, nil, errors.New("consensus failure")
 }
 
+// voteLoadWeights returns the load weights this authority votes for the
+// mixes of the document, which are the weights assigned in our
+// configuration.  The weights the mixes declare are not voted for, as a
+// mix could otherwise draw most of the traffic of its layer.
+func (s *state) voteLoadWeights(doc *pki.Document) map[[publicKeyHashSize]byte]uint8 {
+	weights := make(map[[publicKeyHashSize]byte]uint8)
+	for _, l := range doc.Topology {
+		for _, desc := range l {
+			pk := desc.IdentityKey.Sum256()
+			if w, ok := s.assignedLoadWeights[pk]; ok {
+				weights[pk] = w
+			}
+		}
+	}
+	return weights
+}
+
+// tallyLoadWeights returns the median of the load weights voted for each
+// mix of the document by the authorities whose vote includes the mix.
+func (s *state) tallyLoadWeights(epoch uint64, doc *pki.Document) map[[publicKeyHashSize]byte]uint8 {
+	// Lock is held (called from the onWakeup hook).
+	weights := make(map[[publicKeyHashSize]byte]uint8)
+	for _, l := range doc.Topology {
+		for _, desc := range l {
+			pk := desc.IdentityKey.Sum256()
+			votes := make([]int, 0, len(s.votes[epoch]))
+			for _, vote := range s.votes[epoch] {
+				if _, err := vote.GetMixByKeyHash(&pk); err != nil {
+					continue
+				}
+				votes = append(votes, int(vote.LoadWeights[pk]))
+			}
+			if len(votes) == 0 {
+				continue
+			}
+			sort.Ints(votes)
+			if w := votes[len(votes)/2]; w != 0 {
+				weights[pk] = uint8(w)
+			}
+		}
+		s.penalizeLoadWeights(epoch, l, weights)
+	}
+	return weights
+}
+
+// tallyReputations computes the reputations of the tallied nodes from
+// their loop reports, following the rule of pki.Reputations, and returns
+// the nodes without the mixes whose reputation is under
+// pki.ReputationExcludeRatio.  The mixes are excluded from the worst
+// reputation up, and only as long as enough mixes remain to make a
+// Document.  Providers are never excluded.
+func (s *state) tallyReputations(epoch uint64, nodes []*pki.MixDescriptor) []*pki.MixDescriptor {
+	// Lock is held (called from the onWakeup hook).
+	reputations := pki.Reputations(nodes, epoch)
+	s.reputations[epoch] = reputations
+
+	nrNodes := 0
+	excluded := []*pki.MixDescriptor{}
+	for _, desc := range nodes {
+		if desc.Provider {
+			continue
+		}
+		nrNodes++
+		if r, ok := reputations[desc.IdentityKey.Sum256()]; ok && r < pki.ReputationExcludeRatio {
+			excluded = append(excluded, desc)
+		}
+	}
+	if len(excluded) == 0 {
+		return nodes
+	}
+	sort.Slice(excluded, func(i, j int) bool {
+		ri, rj := reputations[excluded[i].IdentityKey.Sum256()], reputations[excluded[j].IdentityKey.Sum256()]
+		if ri != rj {
+			return ri < rj
+		}
+		ki, kj := excluded[i].IdentityKey.Sum256(), excluded[j].IdentityKey.Sum256()
+		return bytes.Compare(ki[:], kj[:]) < 0
+	})
+	minNodes := s.s.cfg.Debug.Layers * s.s.cfg.Debug.MinNodesPerLayer
+	if n := nrNodes - minNodes; n < len(excluded) {
+		if n < 0 {
+			n = 0
+		}
+		excluded = excluded[:n]
+	}
+
+	isExcluded := make(map[[publicKeyHashSize]byte]bool)
+	for _, desc := range excluded {
+		pk := desc.IdentityKey.Sum256()
+		s.log.Noticef("Excluding node %s (%x) with reputation %.2f for epoch %v", desc.Name, pk, reputations[pk], epoch)
+		isExcluded[pk] = true
+	}
+	kept := make([]*pki.MixDescriptor, 0, len(nodes)-len(excluded))
+	for _, desc := range nodes {
+		if !isExcluded[desc.IdentityKey.Sum256()] {
+			kept = append(kept, desc)
+		}
+	}
+	return kept
+}
+
+// penalizeLoadWeights scales down the load weights of the mixes of the
+// layer whose reputation is under pki.ReputationPenaltyRatio, following
+// pki.ReputationWeight.  The mixes are first given their weights in the
+// layer, following pki.LayerLoadWeights, or if no mix of the layer has a
+// load weight, pki.ReputationBaseWeight, so that the others keep being
+// selected uniformly.
+func (s *state) penalizeLoadWeights(epoch uint64, layer []*pki.MixDescriptor, weights map[[publicKeyHashSize]byte]uint8) {
+	// Lock is held (called from the onWakeup hook).
+	reputations := s.reputations[epoch]
+	penalized := false
+	for _, desc := range layer {
+		if r, ok := reputations[desc.IdentityKey.Sum256()]; ok && r < pki.ReputationPenaltyRatio {
+			penalized = true
+		}
+	}
+	if !penalized {
+		return
+	}
+	layerWeights := pki.LayerLoadWeights(layer, weights)
+	for i, desc := range layer {
+		pk := desc.IdentityKey.Sum256()
+		w := layerWeights[i]
+		if w == 0 {
+			w = pki.ReputationBaseWeight
+		}
+		if r, ok := reputations[pk]; ok {
+			w = pki.ReputationWeight(w, r)
+		}
+		if w != 0 {
+			weights[pk] = w
+		}
+	}
+}
+
 func (s *state) computeSharedRandom(epoch uint64, commits map[[publicKeyHashSize]byte][]byte, reveals map[[publicKeyHashSize]byte][]byte) ([]byte, error) {
 	if len(commits) < s.threshold {
 		s.log.Errorf("Insufficient commits for epoch %d to make consensus", epoch)
@@ -1134,7 +1323,7 @@ func (s *state) generateFixedTopology(nodes []*pki.MixDescriptor, srv []byte) []
 				}
 			}
 
-			id := identityPublicKey.Sum256()
+			id := s.currentKey(identityPublicKey.Sum256())
 
 			// if the listed node is in the current descriptor set, place it in the layer
 			if n, ok := nodeMap[id]; ok {
@@ -1175,20 +1364,28 @@ func (s *state) generateRandomTopology(nodes []*pki.MixDescriptor, srv []byte) [
 	return topology
 }
 
+// preserveForPastEpochs is the number of past epochs the documents of which
+// are kept.  Looking a bit into the past is probably ok, if more past
+// documents need to be accessible, then the authority can archive them.
+const preserveForPastEpochs = 3
+
 func (s *state) pruneDocuments() {
 	// Lock is held (called from the onWakeup hook).
 
-	// Looking a bit into the past is probably ok, if more past documents
-	// need to be accessible, then methods that query the DB could always
-	// be added.
-	const preserveForPastEpochs = 3
-
 	now, _, _ := epochtime.Now()
 	cmpEpoch := now - preserveForPastEpochs
 
+	pruned := false
 	for e := range s.documents {
 		if e < cmpEpoch {
 			delete(s.documents, e)
+			pruned = true
+		}
+	}
+	if pruned && s.retentionEpoch() != 0 {
+		if err := s.db.Update(s.pruneArchive); err != nil {
+			// Persistence failures are FATAL.
+			s.s.fatalErrCh <- err
 		}
 	}
 	for e := range s.descriptors {
@@ -1211,18 +1408,244 @@ func (s *state) pruneDocuments() {
 			delete(s.myconsensus, e)
 		}
 	}
+	for e := range s.reputations {
+		if e < cmpEpoch {
+			delete(s.reputations, e)
+		}
+	}
+}
+
+// authorizations returns the authorized nodes, which share the maps of
+// the state.
+func (s *state) authorizations() *pki.NodeAuthorizations {
+	return &pki.NodeAuthorizations{
+		Mixes:       s.authorizedMixes,
+		LoadWeights: s.assignedLoadWeights,
+		Providers:   s.authorizedProviders,
+		Rotations:   s.keyRotations,
+	}
 }
 
 func (s *state) isDescriptorAuthorized(desc *pki.MixDescriptor) bool {
-	pk := desc.IdentityKey.Sum256()
-	if !desc.Provider {
-		return s.authorizedMixes[pk]
+	return s.authorizations().IsDescriptorAuthorized(desc)
+}
+
+// authorizeDescriptor returns if the descriptor is from an authorized node,
+// after following the key rotation it carries, if any.
+func (s *state) authorizeDescriptor(desc *pki.MixDescriptor) bool {
+	s.Lock()
+	defer s.Unlock()
+
+	return s.authorize(desc)
+}
+
+func (s *state) authorize(desc *pki.MixDescriptor) bool {
+	// Lock is held.
+	if err := s.acceptKeyRotation(desc); err != nil {
+		s.log.Errorf("Node %s: Rejected key rotation: %v", desc.Name, err)
 	}
-	name, ok := s.authorizedProviders[pk]
-	if !ok {
-		return false
+	return s.isDescriptorAuthorized(desc)
+}
+
+// acceptKeyRotation follows the key rotation statement carried by the
+// descriptor, if any, when its node is not authorized yet: the
+// authorization of the old identity key is transferred to the new one,
+// and the rotation is persisted.
+func (s *state) acceptKeyRotation(desc *pki.MixDescriptor) error {
+	// Lock is held.
+	oldKey, err := s.authorizations().AcceptKeyRotation(desc)
+	if err != nil || oldKey == nil {
+		return err
 	}
-	return name == desc.Name
+	oldPk, pk := oldKey.Sum256(), desc.IdentityKey.Sum256()
+	s.reverseHash[pk] = desc.IdentityKey
+
+	if err := s.db.Update(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket([]byte(keyRotationsBucket))
+		return bkt.Put(oldPk[:], desc.IdentityKey.Bytes())
+	}); err != nil {
+		// Persistence failures are FATAL.
+		s.s.fatalErrCh <- err
+	}
+	s.log.Noticef("Node %s: Identity key %x rotated to %x", desc.Name, oldPk, pk)
+	return nil
+}
+
+// currentKey returns the identity key hash which succeeded the given one
+// through key rotations, or the given one if it was never rotated.
+func (s *state) currentKey(pk [publicKeyHashSize]byte) [publicKeyHashSize]byte {
+	return s.authorizations().CurrentKey(pk)
+}
+
+// restoreKeyRotations follows the persisted key rotations.
+func (s *state) restoreKeyRotations(bkt *bolt.Bucket) error {
+	newKeys := make(map[[publicKeyHashSize]byte]sign.PublicKey)
+	rotations := make(map[[publicKeyHashSize]byte][publicKeyHashSize]byte)
+	if err := bkt.ForEach(func(k, v []byte) error {
+		if len(k) != publicKeyHashSize {
+			return errors.New("state: invalid persisted key rotation")
+		}
+		newKey := cert.Scheme.NewEmptyPublicKey()
+		if err := newKey.FromBytes(v); err != nil {
+			return err
+		}
+		var oldPk [publicKeyHashSize]byte
+		copy(oldPk[:], k)
+		newKeys[newKey.Sum256()] = newKey
+		rotations[oldPk] = newKey.Sum256()
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	if err := s.authorizations().RestoreKeyRotations(rotations); err != nil {
+		return err
+	}
+	for pk, newKey := range newKeys {
+		if s.isNodeAuthorized(pk) {
+			s.reverseHash[pk] = newKey
+		}
+	}
+	return nil
+}
+
+func (s *state) isNodeAuthorized(pk [publicKeyHashSize]byte) bool {
+	return s.authorizations().IsAuthorized(pk)
+}
+
+func (s *state) deauthorizeKey(pk [publicKeyHashSize]byte) {
+	s.authorizations().Deauthorize(pk)
+}
+
+// authorizeNode authorizes a node, or updates its authorization, and
+// persists it.  The change is taken into account from the next Document.
+func (s *state) authorizeNode(identityKey sign.PublicKey, a *authorization) error {
+	s.Lock()
+	defer s.Unlock()
+
+	pk := identityKey.Sum256()
+	if next, ok := s.keyRotations[pk]; ok {
+		return fmt.Errorf("key %x was rotated to %x", pk, next)
+	}
+	if _, ok := s.authorizedProviders[pk]; ok && !a.Provider || s.authorizedMixes[pk] && a.Provider {
+		return fmt.Errorf("node %x is authorized as another kind of node", pk)
+	}
+	if err := s.persistAuthorizations(map[[publicKeyHashSize]byte]*authorization{pk: a}); err != nil {
+		return err
+	}
+	s.applyAuthorization(pk, identityKey, a)
+	return nil
+}
+
+// deauthorizeNode deauthorizes a node, and persists it.  The change is
+// taken into account from the next Document.
+func (s *state) deauthorizeNode(pk [publicKeyHashSize]byte) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if !s.isNodeAuthorized(pk) {
+		return fmt.Errorf("node %x is not authorized", pk)
+	}
+
+	// The keys the node rotated from are deauthorized too, lest the
+	// authorization of a configured key be restored and rotated again.
+	deauthorized := map[[publicKeyHashSize]byte]*authorization{pk: {}}
+	for found := true; found; {
+		found = false
+		for oldPk, newPk := range s.keyRotations {
+			if _, ok := deauthorized[oldPk]; !ok && deauthorized[newPk] != nil {
+				deauthorized[oldPk] = &authorization{}
+				found = true
+			}
+		}
+	}
+	if err := s.persistAuthorizations(deauthorized); err != nil {
+		return err
+	}
+	s.deauthorizeKey(pk)
+	return nil
+}
+
+// listNodes returns the authorized nodes, in the syntax of the
+// management interface.
+func (s *state) listNodes() []string {
+	s.RLock()
+	defer s.RUnlock()
+
+	nodes := []string{}
+	for pk := range s.authorizedProviders {
+		nodes = append(nodes, fmt.Sprintf("%v %x %v", nodeProvider, pk, s.authorizedProviders[pk]))
+	}
+	for pk := range s.authorizedMixes {
+		if w, ok := s.assignedLoadWeights[pk]; ok {
+			nodes = append(nodes, fmt.Sprintf("%v %x %v", nodeMix, pk, w))
+		} else {
+			nodes = append(nodes, fmt.Sprintf("%v %x", nodeMix, pk))
+		}
+	}
+	sort.Strings(nodes)
+	return nodes
+}
+
+func (s *state) applyAuthorization(pk [publicKeyHashSize]byte, identityKey sign.PublicKey, a *authorization) {
+	// Lock is held.
+	s.deauthorizeKey(pk)
+	if !a.Authorized {
+		return
+	}
+	if a.Provider {
+		s.authorizedProviders[pk] = a.Identifier
+	} else {
+		s.authorizedMixes[pk] = true
+		if a.LoadWeight != 0 {
+			s.assignedLoadWeights[pk] = a.LoadWeight
+		}
+	}
+	s.reverseHash[pk] = identityKey
+}
+
+func (s *state) persistAuthorizations(m map[[publicKeyHashSize]byte]*authorization) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket([]byte(authorizationsBucket))
+		for pk, a := range m {
+			b, err := cbor.Marshal(a)
+			if err != nil {
+				return err
+			}
+			if err := bkt.Put(pk[:], b); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// restoreAuthorizations applies the persisted authorizations over the
+// configured ones.
+func (s *state) restoreAuthorizations(bkt *bolt.Bucket) error {
+	return bkt.ForEach(func(k, v []byte) error {
+		if len(k) != publicKeyHashSize {
+			return errors.New("state: invalid persisted authorization")
+		}
+		var pk [publicKeyHashSize]byte
+		copy(pk[:], k)
+		a := new(authorization)
+		if err := cbor.Unmarshal(v, a); err != nil {
+			return err
+		}
+		var identityKey sign.PublicKey
+		if a.Authorized {
+			identityKey = cert.Scheme.NewEmptyPublicKey()
+			if err := identityKey.FromBytes(a.IdentityKey); err != nil {
+				return err
+			}
+			if identityKey.Sum256() != pk {
+				return errors.New("state: invalid persisted authorization")
+			}
+		}
+		s.applyAuthorization(pk, identityKey, a)
+		return nil
+	})
 }
 
 func (s *state) dupSig(sig commands.Sig) bool {
@@ -1441,6 +1864,14 @@ func (s *state) onVoteUpload(vote *commands.Vote) commands.Command {
 		return &resp
 	}
 
+	// Check that the vote is for the same Sphinx geometry as ours, as the
+	// network can not function with mismatched packet formats.
+	if !doc.SphinxGeometry.Equal(s.s.cfg.SphinxGeometry) {
+		s.log.Errorf("Vote from %x has a mismatched SphinxGeometry", vote.PublicKey.Sum256())
+		resp.ErrorCode = commands.VoteMalformed
+		return &resp
+	}
+
 	// extract commit from document and verify that it was signed by this peer
 	// IsDocumentWellFormed has already verified that any commit is for
 	// this Epoch and is signed by a known verifier
@@ -1456,6 +1887,8 @@ func (s *state) onVoteUpload(vote *commands.Vote) commands.Command {
 	s.votes[s.votingEpoch][vote.PublicKey.Sum256()] = doc
 	// save the commit
 	s.commits[s.votingEpoch][vote.PublicKey.Sum256()] = commit
+	// announce the key rotations of the authorities it carries in our votes
+	s.learnKeyRotations(doc)
 	s.log.Debugf("Vote OK from: %x\n%s", vote.PublicKey.Sum256(), doc)
 	resp.ErrorCode = commands.VoteOk
 	return &resp
@@ -1524,6 +1957,12 @@ func (s *state) onDescriptorUpload(rawDesc []byte, desc *pki.MixDescriptor, epoc
 	// Note: Caller ensures that the epoch is the current epoch +- 1.
 	pk := desc.IdentityKey.Sum256()
 
+	// Nodes which are not authorized may only become so by way of a key
+	// rotation, which is followed once the descriptor is accepted.
+	if desc.KeyRotation == nil && !s.isDescriptorAuthorized(desc) {
+		return errForbidden
+	}
+
 	// Get the public key -> descriptor map for the epoch.
 	_, ok := s.descriptors[epoch]
 	if !ok {
@@ -1554,6 +1993,12 @@ func (s *state) onDescriptorUpload(rawDesc []byte, desc *pki.MixDescriptor, epoc
 		return fmt.Errorf("state: Node %v: Late descriptor upload for for epoch %v", desc.IdentityKey, epoch)
 	}
 
+	// Ensure that the descriptor is from an allowed peer, possibly by way
+	// of the key rotation it carries.
+	if !s.authorize(desc) {
+		return errForbidden
+	}
+
 	// Persist the raw descriptor to disk.
 	if err := s.db.Update(func(tx *bolt.Tx) error {
 		bkt := tx.Bucket([]byte(descriptorsBucket))
@@ -1617,6 +2062,87 @@ func (s *state) documentForEpoch(epoch uint64) ([]byte, error) {
 	// NOTREACHED
 }
 
+// maxRangeDocumentsLength is the total length of the documents past which
+// documentsForEpochs stops, so that its reply fits in a wire command.
+const maxRangeDocumentsLength = 1 << 20
+
+// documentsForEpochs returns the persisted documents of the epochs from first
+// to last included, in order, and the first epoch of the range it stopped
+// short of, or 0 if it covers the whole range.  It returns at least one
+// document if there is any in the range.
+func (s *state) documentsForEpochs(first, last uint64) ([]uint64, [][]byte, uint64, error) {
+	var epochs []uint64
+	var docs [][]byte
+	var next uint64
+	err := s.db.View(func(tx *bolt.Tx) error {
+		length := 0
+		c := tx.Bucket([]byte(documentsBucket)).Cursor()
+		for k, rawDoc := c.Seek(epochToBytes(first)); k != nil; k, rawDoc = c.Next() {
+			epoch := binary.BigEndian.Uint64(k)
+			if epoch > last {
+				break
+			}
+			if len(docs) > 0 && length+len(rawDoc) > maxRangeDocumentsLength {
+				next = epoch
+				break
+			}
+			length += len(rawDoc)
+			epochs = append(epochs, epoch)
+			docs = append(docs, append([]byte{}, rawDoc...))
+		}
+		return nil
+	})
+	return epochs, docs, next, err
+}
+
+// retentionEpoch returns the epoch the archive keeps the documents from,
+// or 0 if it keeps every document.
+func (s *state) retentionEpoch() uint64 {
+	cfg := s.s.cfg.Server
+	if !cfg.Archive || cfg.ArchiveRetention == 0 {
+		return 0
+	}
+	retention := cfg.ArchiveRetention
+	if retention < preserveForPastEpochs {
+		retention = preserveForPastEpochs
+	}
+	now, _, _ := epochtime.Now()
+	if now <= retention {
+		return 0
+	}
+	return now - retention
+}
+
+// retainDocument records that the document of the epoch was persisted under
+// the retention policy of the archive, if there is one.
+func (s *state) retainDocument(tx *bolt.Tx, epoch uint64) error {
+	if s.retentionEpoch() == 0 {
+		return nil
+	}
+	return tx.Bucket([]byte(retentionBucket)).Put(epochToBytes(epoch), []byte{})
+}
+
+// pruneArchive deletes the documents persisted under the retention policy
+// of the archive which are older than it retains.  The documents persisted
+// without one are always kept.
+func (s *state) pruneArchive(tx *bolt.Tx) error {
+	epoch := s.retentionEpoch()
+	if epoch == 0 {
+		return nil
+	}
+	docsBkt := tx.Bucket([]byte(documentsBucket))
+	c := tx.Bucket([]byte(retentionBucket)).Cursor()
+	for k, _ := c.First(); k != nil && binary.BigEndian.Uint64(k) < epoch; k, _ = c.First() {
+		if err := docsBkt.Delete(k); err != nil {
+			return err
+		}
+		if err := c.Delete(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (s *state) restorePersistence() error {
 	const (
 		metadataBucket = "metadata"
@@ -1637,6 +2163,41 @@ func (s *state) restorePersistence() error {
 		if err != nil {
 			return err
 		}
+		rotationsBkt, err := tx.CreateBucketIfNotExists([]byte(keyRotationsBucket))
+		if err != nil {
+			return err
+		}
+		authorityRotationsBkt, err := tx.CreateBucketIfNotExists([]byte(authorityRotationsBucket))
+		if err != nil {
+			return err
+		}
+		authorizationsBkt, err := tx.CreateBucketIfNotExists([]byte(authorizationsBucket))
+		if err != nil {
+			return err
+		}
+
+		// Apply the authorizations made through the management interface,
+		// and follow the key rotations, before restoring the descriptors of
+		// the nodes.
+		if err := s.restoreAuthorizations(authorizationsBkt); err != nil {
+			return err
+		}
+		if err := s.restoreKeyRotations(rotationsBkt); err != nil {
+			return err
+		}
+
+		// Follow the key rotations of the authorities before restoring
+		// the documents they signed.
+		if err := s.restoreAuthorityRotations(authorityRotationsBkt); err != nil {
+			return err
+		}
+
+		if _, err := tx.CreateBucketIfNotExists([]byte(retentionBucket)); err != nil {
+			return err
+		}
+		if err := s.pruneArchive(tx); err != nil {
+			return err
+		}
 
 		if b := bkt.Get([]byte(versionKey)); b != nil {
 			// Well it looks like we loaded as opposed to created.
@@ -1741,6 +2302,7 @@ func newState(s *Server) (*state, error) {
 	// Initialize the authorized peer tables.
 	st.reverseHash = make(map[[publicKeyHashSize]byte]sign.PublicKey)
 	st.authorizedMixes = make(map[[publicKeyHashSize]byte]bool)
+	st.assignedLoadWeights = make(map[[publicKeyHashSize]byte]uint8)
 	for _, v := range st.s.cfg.Mixes {
 		_, identityPublicKey := cert.Scheme.NewKeypair()
 		if filepath.IsAbs(v.IdentityPublicKeyPem) {
@@ -1758,6 +2320,9 @@ func newState(s *Server) (*state, error) {
 
 		pk := identityPublicKey.Sum256()
 		st.authorizedMixes[pk] = true
+		if v.LoadWeight != 0 {
+			st.assignedLoadWeights[pk] = v.LoadWeight
+		}
 		st.reverseHash[pk] = identityPublicKey
 	}
 	st.authorizedProviders = make(map[[publicKeyHashSize]byte]string)
@@ -1789,6 +2354,11 @@ func newState(s *Server) (*state, error) {
 	}
 	st.reverseHash[st.s.identityPublicKey.Sum256()] = st.s.identityPublicKey
 
+	st.keyRotations = make(map[[publicKeyHashSize]byte][publicKeyHashSize]byte)
+	st.authorityRotations = make(map[[publicKeyHashSize]byte][]byte)
+	if r := s.keyRotation; r != nil {
+		st.authorityRotations[r.OldIdentityKey.Sum256()] = r.Raw
+	}
 	st.authorityLinkKeys = make(map[[publicKeyHashSize]byte]wire.PublicKey)
 	for _, v := range st.s.cfg.Authorities {
 		pk := v.IdentityPublicKey.Sum256()
@@ -1803,6 +2373,7 @@ func newState(s *Server) (*state, error) {
 	st.reveals = make(map[uint64]map[[publicKeyHashSize]byte][]byte)
 	st.signatures = make(map[uint64]map[[publicKeyHashSize]byte]*cert.Signature)
 	st.commits = make(map[uint64]map[[publicKeyHashSize]byte][]byte)
+	st.reputations = make(map[uint64]map[[publicKeyHashSize]byte]float64)
 	st.priorSRV = make([][]byte, 0)
 
 	// Initialize the persistence store and restore state.
@@ -1827,12 +2398,15 @@ func (s *state) backgroundFetchConsensus(epoch uint64) {
 	// authorities for a consensus.
 	_, ok := s.documents[epoch]
 	if !ok {
+		linkKey := s.s.linkKey
+		authorities := append([]*config.Authority{}, s.s.cfg.Authorities...)
 		go func() {
 			cfg := &client.Config{
-				LinkKey:       s.s.linkKey,
-				LogBackend:    s.s.logBackend,
-				Authorities:   s.s.cfg.Authorities,
-				DialContextFn: nil,
+				LinkKey:        linkKey,
+				LogBackend:     s.s.logBackend,
+				Authorities:    authorities,
+				DialContextFn:  nil,
+				SphinxGeometry: s.s.cfg.SphinxGeometry,
 			}
 			c, err := client.New(cfg)
 			if err != nil {
@@ -1852,6 +2426,7 @@ func (s *state) backgroundFetchConsensus(epoch uint64) {
 			// multiple times during bootstrapping
 			if _, ok := s.documents[epoch]; !ok {
 				s.documents[epoch] = doc
+				s.followKeyRotations(doc)
 			}
 		}()
 	}
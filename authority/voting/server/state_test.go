@@ -38,7 +38,9 @@ import (
 	"github.com/katzenpost/katzenpost/core/epochtime"
 	"github.com/katzenpost/katzenpost/core/log"
 	"github.com/katzenpost/katzenpost/core/pki"
+	"github.com/katzenpost/katzenpost/core/sphinx"
 	"github.com/katzenpost/katzenpost/core/wire"
+	"github.com/katzenpost/katzenpost/core/wire/commands"
 	sConfig "github.com/katzenpost/katzenpost/server/config"
 )
 
@@ -117,6 +119,15 @@ func TestVote(t *testing.T) {
 		st.signatures[st.votingEpoch] = make(map[[sign.PublicKeyHashSize]byte]*cert.Signature)
 		st.reveals[st.votingEpoch] = make(map[[sign.PublicKeyHashSize]byte][]byte)
 		st.reverseHash = make(map[[publicKeyHashSize]byte]sign.PublicKey)
+		st.reputations = make(map[uint64]map[[publicKeyHashSize]byte]float64)
+		st.keyRotations = make(map[[publicKeyHashSize]byte][publicKeyHashSize]byte)
+		st.authorityRotations = make(map[[publicKeyHashSize]byte][]byte)
+		st.authorizedAuthorities = make(map[[publicKeyHashSize]byte]bool)
+		st.authorityLinkKeys = make(map[[publicKeyHashSize]byte]wire.PublicKey)
+		for _, auth := range cfg.Authorities {
+			st.authorizedAuthorities[auth.IdentityPublicKey.Sum256()] = true
+			st.authorityLinkKeys[auth.IdentityPublicKey.Sum256()] = auth.LinkPublicKey
+		}
 		stateAuthority[i] = st
 		tmpDir, err := os.MkdirTemp("", cfg.Server.Identifier)
 		require.NoError(err)
@@ -205,6 +216,31 @@ func TestVote(t *testing.T) {
 			Provider:    mixCfgs[i].Server.IsProvider,
 			Addresses:   addr,
 		}
+		if i == 1 {
+			// node-1 declares an outsized load weight
+			desc.LoadWeight = 255
+		}
+		if !desc.Provider {
+			// the mixes report that node-5 loses most loops, and
+			// node-3 some of them
+			desc.LoopReport = &pki.LoopReport{
+				Epoch: votingEpoch - 2,
+				Peers: make(map[[sign.PublicKeyHashSize]byte]*pki.LoopCounts),
+			}
+			for j := 0; j < n; j++ {
+				if j == i {
+					continue
+				}
+				returned := uint64(80)
+				switch j {
+				case 3:
+					returned = 70
+				case 5:
+					returned = 10
+				}
+				desc.LoopReport.Peers[idKeys[j].pubKey.Sum256()] = &pki.LoopCounts{Sent: 100, Returned: returned}
+			}
+		}
 
 		err = pki.IsDescriptorWellFormed(desc, votingEpoch)
 		require.NoError(err)
@@ -244,9 +280,14 @@ func TestVote(t *testing.T) {
 	}
 
 	// populate the authorities with the descriptors
-	for _, s := range stateAuthority {
+	for i, s := range stateAuthority {
 		s.descriptors[votingEpoch] = make(map[[sign.PublicKeyHashSize]byte]*pki.MixDescriptor)
 		s.authorizedMixes = make(map[[sign.PublicKeyHashSize]byte]bool)
+		// all but one authority assign a load weight to the first mix
+		s.assignedLoadWeights = make(map[[sign.PublicKeyHashSize]byte]uint8)
+		if i != 0 {
+			s.assignedLoadWeights[mixDescs[0].IdentityKey.Sum256()] = 7
+		}
 		s.authorizedProviders = make(map[[sign.PublicKeyHashSize]byte]string)
 		for _, d := range mixDescs {
 			s.descriptors[votingEpoch][d.IdentityKey.Sum256()] = d
@@ -258,6 +299,21 @@ func TestVote(t *testing.T) {
 		}
 	}
 
+	// the first authority rotates its keys
+	nextIdKey, nextIdPubKey := cert.Scheme.NewKeypair()
+	nextLinkKey, nextLinkPubKey := wire.DefaultScheme.GenerateKeypair(rand.Reader)
+	statement, err := pki.SignAuthorityKeyRotation(peerKeys[0].idKey, peerKeys[0].idPubKey, nextIdKey, nextIdPubKey, nextLinkPubKey)
+	require.NoError(err)
+	rotation, err := pki.VerifyAuthorityKeyRotation(statement)
+	require.NoError(err)
+	stateAuthority[0].s.keyRotation = rotation
+	stateAuthority[0].s.nextKeys = &authorityKeys{
+		identityPrivateKey: nextIdKey,
+		identityPublicKey:  nextIdPubKey,
+		linkKey:            nextLinkKey,
+	}
+	stateAuthority[0].authorityRotations[peerKeys[0].idPubKey.Sum256()] = statement
+
 	// exchange votes
 	for i, s := range stateAuthority {
 		s.votingEpoch = votingEpoch
@@ -276,6 +332,7 @@ func TestVote(t *testing.T) {
 				continue
 			}
 			a.votes[s.votingEpoch][s.s.identityPublicKey.Sum256()] = myVote
+			a.learnKeyRotations(myVote)
 		}
 	}
 
@@ -333,13 +390,256 @@ func TestVote(t *testing.T) {
 	for _, s := range stateAuthority {
 		doc, err := s.getThresholdConsensus(s.votingEpoch)
 		require.NoError(err)
+		require.Equal(uint8(7), doc.LoadWeight(mixDescs[0]))
+		require.NotEqual(mixDescs[1].LoadWeight, doc.LoadWeight(mixDescs[1]))
+		require.NotContains(s.voteLoadWeights(doc), mixDescs[1].IdentityKey.Sum256())
+		// node-3 is down-weighted, and node-5 excluded
+		require.Equal(uint8(pki.ReputationBaseWeight), doc.LoadWeight(mixDescs[2]))
+		require.Equal(uint8(87), doc.LoadWeight(mixDescs[3]))
+		kept, excluded := mixDescs[4].IdentityKey.Sum256(), mixDescs[5].IdentityKey.Sum256()
+		_, err = doc.GetMixByKeyHash(&kept)
+		require.NoError(err)
+		_, err = doc.GetMixByKeyHash(&excluded)
+		require.Error(err)
 		hash := doc.Sum256()
 		if consensusHash == "" {
 			consensusHash = string(hash[:])
 		} else {
 			require.Equal(consensusHash, string(hash[:]))
 		}
+		require.Equal([][]byte{statement}, doc.KeyRotations)
+	}
+
+	// the authorities followed the key rotation of the first one, which
+	// switched to its new keys
+	oldPk, newPk := peerKeys[0].idPubKey.Sum256(), nextIdPubKey.Sum256()
+	require.True(stateAuthority[0].s.IdentityKey().Equal(nextIdPubKey))
+	require.Nil(stateAuthority[0].s.nextKeys)
+	for i, s := range stateAuthority {
+		require.NotContains(s.verifiers, oldPk)
+		require.Contains(s.verifiers, newPk)
+		require.Len(s.verifiers, authNum)
+		if i == 0 {
+			continue
+		}
+		require.NotContains(s.authorizedAuthorities, oldPk)
+		require.True(s.authorizedAuthorities[newPk])
+		require.True(s.authorityLinkKeys[newPk].Equal(nextLinkPubKey))
+		found := false
+		for _, auth := range s.s.cfg.Authorities {
+			require.NotEqual(oldPk, auth.IdentityPublicKey.Sum256())
+			if auth.IdentityPublicKey.Equal(nextIdPubKey) {
+				require.True(auth.LinkPublicKey.Equal(nextLinkPubKey))
+				found = true
+			}
+		}
+		require.True(found)
+
+		// the rotation is followed again after a restart
+		s.verifiers[oldPk] = peerKeys[0].idPubKey
+		delete(s.verifiers, newPk)
+		require.NoError(s.restorePersistence())
+		require.NotContains(s.verifiers, oldPk)
+		require.Contains(s.verifiers, newPk)
+		require.Equal(authNum/2+1, s.threshold)
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	logBackend, err := log.New("", "DEBUG", false)
+	require.NoError(err)
+	dbPath := filepath.Join(t.TempDir(), "persistance.db")
+
+	keyA, pubA := cert.Scheme.NewKeypair()
+	keyB, pubB := cert.Scheme.NewKeypair()
+	keyC, pubC := cert.Scheme.NewKeypair()
+	keyP, pubP := cert.Scheme.NewKeypair()
+	keyQ, pubQ := cert.Scheme.NewKeypair()
+
+	// newTestState returns a state authorizing the mix A and the provider
+	// P, restored from the database.
+	newTestState := func() *state {
+		st := &state{
+			s:                   &Server{cfg: &config.Config{Server: &config.Server{}}, fatalErrCh: make(chan error)},
+			log:                 logBackend.GetLogger("state"),
+			reverseHash:         make(map[[publicKeyHashSize]byte]sign.PublicKey),
+			authorizedMixes:     map[[publicKeyHashSize]byte]bool{pubA.Sum256(): true},
+			assignedLoadWeights: map[[publicKeyHashSize]byte]uint8{pubA.Sum256(): 5},
+			authorizedProviders: map[[publicKeyHashSize]byte]string{pubP.Sum256(): "provider"},
+			keyRotations:        make(map[[publicKeyHashSize]byte][publicKeyHashSize]byte),
+			documents:           make(map[uint64]*pki.Document),
+			descriptors:         make(map[uint64]map[[publicKeyHashSize]byte]*pki.MixDescriptor),
+			verifiers:           make(map[[publicKeyHashSize]byte]cert.Verifier),
+		}
+		st.db, err = bolt.Open(dbPath, 0600, nil)
+		require.NoError(err)
+		require.NoError(st.restorePersistence())
+		return st
+	}
+	rotation := func(oldKey sign.PrivateKey, oldPub sign.PublicKey, newKey sign.PrivateKey, newPub sign.PublicKey, provider bool) *pki.MixDescriptor {
+		statement, err := pki.SignKeyRotation(oldKey, oldPub, newKey, newPub)
+		require.NoError(err)
+		name := "mix"
+		if provider {
+			name = "provider"
+		}
+		return &pki.MixDescriptor{Name: name, IdentityKey: newPub, Provider: provider, KeyRotation: statement}
+	}
+
+	st := newTestState()
+	descA := &pki.MixDescriptor{Name: "mix", IdentityKey: pubA}
+	require.True(st.authorizeDescriptor(descA))
+
+	// The authorization of A, and its load weight, is transferred to B.
+	require.True(st.authorizeDescriptor(rotation(keyA, pubA, keyB, pubB, false)))
+	require.False(st.authorizeDescriptor(descA))
+	require.Equal(uint8(5), st.assignedLoadWeights[pubB.Sum256()])
+	require.Equal(pubB.Sum256(), st.currentKey(pubA.Sum256()))
+
+	// A retired key can't be rotated to, nor a provider to a mix.
+	require.False(st.authorizeDescriptor(rotation(keyB, pubB, keyA, pubA, false)))
+	require.False(st.authorizeDescriptor(rotation(keyP, pubP, keyQ, pubQ, false)))
+
+	// Rotations are chained, and persisted.
+	require.True(st.authorizeDescriptor(rotation(keyB, pubB, keyC, pubC, false)))
+	require.True(st.authorizeDescriptor(rotation(keyP, pubP, keyQ, pubQ, true)))
+	require.Equal(pubC.Sum256(), st.currentKey(pubA.Sum256()))
+	require.NoError(st.db.Close())
+
+	st = newTestState()
+	defer st.db.Close()
+	require.False(st.authorizeDescriptor(descA))
+	require.True(st.authorizeDescriptor(&pki.MixDescriptor{Name: "mix", IdentityKey: pubC}))
+	require.True(st.authorizeDescriptor(&pki.MixDescriptor{Name: "provider", IdentityKey: pubQ, Provider: true}))
+	require.Equal(uint8(5), st.assignedLoadWeights[pubC.Sum256()])
+
+	// Uploaded rotations are only followed for descriptors which are
+	// accepted, so a late descriptor doesn't rotate the key.
+	keyD, pubD := cert.Scheme.NewKeypair()
+	const epoch = 1
+	st.documents[epoch] = &pki.Document{}
+	descD := rotation(keyC, pubC, keyD, pubD, false)
+	err = st.onDescriptorUpload([]byte("descD"), descD, epoch)
+	require.Error(err)
+	require.NotEqual(errForbidden, err)
+	require.Equal(pubC.Sum256(), st.currentKey(pubA.Sum256()))
+	require.NoError(st.onDescriptorUpload([]byte("descD"), descD, epoch+1))
+	require.Equal(pubD.Sum256(), st.currentKey(pubA.Sum256()))
+
+	// Nodes which are not authorized are forbidden.
+	require.Equal(errForbidden, st.onDescriptorUpload([]byte("descA"), descA, epoch+1))
+	require.Equal(errForbidden, st.onDescriptorUpload([]byte("descA"), rotation(keyB, pubB, keyA, pubA, false), epoch+1))
+}
+
+func TestArchive(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	logBackend, err := log.New("", "DEBUG", false)
+	require.NoError(err)
+	dbPath := filepath.Join(t.TempDir(), "persistance.db")
+
+	// newTestState returns a state restored from the database, which
+	// archives the documents or not, and retains them for some epochs.
+	newTestState := func(archive bool, retention uint64) *state {
+		st := &state{
+			s: &Server{
+				cfg:        &config.Config{Server: &config.Server{Archive: archive, ArchiveRetention: retention}},
+				fatalErrCh: make(chan error),
+			},
+			log:         logBackend.GetLogger("state"),
+			reverseHash: make(map[[publicKeyHashSize]byte]sign.PublicKey),
+			documents:   make(map[uint64]*pki.Document),
+			descriptors: make(map[uint64]map[[publicKeyHashSize]byte]*pki.MixDescriptor),
+			verifiers:   make(map[[publicKeyHashSize]byte]cert.Verifier),
+		}
+		st.db, err = bolt.Open(dbPath, 0600, nil)
+		require.NoError(err)
+		require.NoError(st.restorePersistence())
+		return st
+	}
+
+	// Every other epoch of the past has a document, and the largest of
+	// them only fit one in a reply.
+	now, _, _ := epochtime.Now()
+	first := now - 20
+	st := newTestState(true, 0)
+	for e := first; e < now; e += 2 {
+		size := 1000
+		if e == first+10 {
+			size = maxRangeDocumentsLength
+		}
+		st.persistDocument(e, bytes.Repeat([]byte{byte(e)}, size))
+	}
+	require.NoError(st.db.Close())
+
+	st = newTestState(true, 0)
+	epochs, docs, next, err := st.documentsForEpochs(first+1, now)
+	require.NoError(err)
+	require.Equal([]uint64{first + 2, first + 4, first + 6, first + 8}, epochs)
+	require.Equal(first+10, next)
+	require.Equal(bytes.Repeat([]byte{byte(first + 2)}, 1000), docs[0])
+	epochs, docs, next, err = st.documentsForEpochs(next, now)
+	require.NoError(err)
+	require.Equal([]uint64{first + 10}, epochs)
+	require.Len(docs[0], maxRangeDocumentsLength)
+	require.Equal(first+12, next)
+	epochs, _, next, err = st.documentsForEpochs(next, first+14)
+	require.NoError(err)
+	require.Equal([]uint64{first + 12, first + 14}, epochs)
+	require.Zero(next)
+	epochs, _, next, err = st.documentsForEpochs(now, now+1)
+	require.NoError(err)
+	require.Empty(epochs)
+	require.Zero(next)
+	require.NoError(st.db.Close())
+
+	// Without the archive, the old documents are kept all the same.
+	st = newTestState(false, 0)
+	epochs, _, next, err = st.documentsForEpochs(0, now)
+	require.NoError(err)
+	require.Equal([]uint64{first, first + 2, first + 4, first + 6, first + 8}, epochs)
+	require.Equal(first+10, next)
+	require.NoError(st.db.Close())
+
+	// Under a retention policy, the documents persisted since are deleted
+	// once older than it retains, and the ones persisted before are kept.
+	st = newTestState(true, 6)
+	for _, e := range []uint64{first + 1, first + 3, now - 5, now - 1} {
+		st.persistDocument(e, []byte{byte(e)})
+	}
+	require.NoError(st.db.Close())
+	st = newTestState(true, 6)
+	defer st.db.Close()
+	require.Equal(now-6, st.retentionEpoch())
+	epochs, _, _, err = st.documentsForEpochs(0, first+3)
+	require.NoError(err)
+	require.Equal([]uint64{first, first + 2}, epochs)
+	epochs, _, _, err = st.documentsForEpochs(now-6, now)
+	require.NoError(err)
+	require.Equal([]uint64{now - 6, now - 5, now - 4, now - 2, now - 1}, epochs)
+
+	// The ranges past the retention aren't served, nor any without the
+	// archive.
+	getRange := func(st *state, first uint64) *commands.ConsensusRange {
+		st.s.state = st
+		st.s.log = logBackend.GetLogger("server")
+		resp := st.s.onGetConsensusRange(nil, &commands.GetConsensusRange{FirstEpoch: first, LastEpoch: now})
+		return resp.(*commands.ConsensusRange)
 	}
+	resp := getRange(st, now-7)
+	require.Equal(uint8(commands.ConsensusNotFound), resp.ErrorCode)
+	require.Empty(resp.Epochs)
+	resp = getRange(st, now-6)
+	require.Equal(uint8(commands.ConsensusOk), resp.ErrorCode)
+	require.Equal([]uint64{now - 6, now - 5, now - 4, now - 2, now - 1}, resp.Epochs)
+	st.s.cfg.Server = &config.Server{}
+	resp = getRange(st, now-6)
+	require.Equal(uint8(commands.ConsensusNotFound), resp.ErrorCode)
+	require.Empty(resp.Epochs)
 }
 
 type peerKeys struct {
@@ -362,6 +662,7 @@ func genVotingAuthoritiesCfg(parameters *config.Parameters, numAuthorities int)
 		cfg := new(config.Config)
 		cfg.Logging = &config.Logging{Disable: false, File: "", Level: "DEBUG"}
 		cfg.Parameters = parameters
+		cfg.SphinxGeometry = sphinx.DefaultGeometry()
 
 		datadir, err := os.MkdirTemp("", fmt.Sprintf("auth_%d", i))
 		if err != nil {
@@ -574,11 +875,11 @@ func genMixConfig(name string, pki *sConfig.PKI, port uint16) (*identityKey, *sC
 }
 
 // create epoch keys
-func genMixKeys(votingEpoch uint64) map[uint64]*ecdh.PublicKey {
-	mixKeys := make(map[uint64]*ecdh.PublicKey)
+func genMixKeys(votingEpoch uint64) map[uint64][]byte {
+	mixKeys := make(map[uint64][]byte)
 	for i := votingEpoch; i < votingEpoch+2; i++ {
 		idKey, _ := ecdh.NewKeypair(rand.Reader)
-		mixKeys[i] = idKey.PublicKey()
+		mixKeys[i] = idKey.PublicKey().Bytes()
 	}
 	return mixKeys
 }
@@ -26,7 +26,6 @@ import (
 	"github.com/katzenpost/katzenpost/core/crypto/sign"
 	"github.com/katzenpost/katzenpost/core/epochtime"
 	"github.com/katzenpost/katzenpost/core/pki"
-	"github.com/katzenpost/katzenpost/core/sphinx"
 	"github.com/katzenpost/katzenpost/core/wire"
 	"github.com/katzenpost/katzenpost/core/wire/commands"
 )
@@ -47,12 +46,12 @@ func (s *Server) onConn(conn net.Conn) {
 
 	// Initialize the wire protocol session.
 	auth := &wireAuthenticator{s: s}
-	keyHash := s.identityPublicKey.Sum256()
+	keyHash, linkKey := s.sessionKeys()
 	cfg := &wire.SessionConfig{
-		Geometry:          sphinx.DefaultGeometry(),
+		Geometry:          s.cfg.SphinxGeometry,
 		Authenticator:     auth,
 		AdditionalData:    keyHash[:],
-		AuthenticationKey: s.linkKey,
+		AuthenticationKey: linkKey,
 		RandomReader:      rand.Reader,
 	}
 	wireConn, err := wire.NewSession(cfg, false)
@@ -104,6 +103,8 @@ func (s *Server) onClient(rAddr net.Addr, cmd commands.Command) commands.Command
 	switch c := cmd.(type) {
 	case *commands.GetConsensus:
 		resp = s.onGetConsensus(rAddr, c)
+	case *commands.GetConsensusRange:
+		resp = s.onGetConsensusRange(rAddr, c)
 	default:
 		s.log.Debugf("Peer %v: Invalid request: %T", rAddr, c)
 		return nil
@@ -117,6 +118,8 @@ func (s *Server) onMix(rAddr net.Addr, cmd commands.Command, peerIdentityKeyHash
 	switch c := cmd.(type) {
 	case *commands.GetConsensus:
 		resp = s.onGetConsensus(rAddr, c)
+	case *commands.GetConsensusRange:
+		resp = s.onGetConsensusRange(rAddr, c)
 	case *commands.PostDescriptor:
 		resp = s.onPostDescriptor(rAddr, c, peerIdentityKeyHash)
 	default:
@@ -131,6 +134,8 @@ func (s *Server) onAuthority(rAddr net.Addr, cmd commands.Command) commands.Comm
 	switch c := cmd.(type) {
 	case *commands.GetConsensus:
 		resp = s.onGetConsensus(rAddr, c)
+	case *commands.GetConsensusRange:
+		resp = s.onGetConsensusRange(rAddr, c)
 	case *commands.Vote:
 		resp = s.state.onVoteUpload(c)
 	case *commands.Cert:
@@ -165,6 +170,33 @@ func (s *Server) onGetConsensus(rAddr net.Addr, cmd *commands.GetConsensus) comm
 	return resp
 }
 
+func (s *Server) onGetConsensusRange(rAddr net.Addr, cmd *commands.GetConsensusRange) commands.Command {
+	resp := &commands.ConsensusRange{ErrorCode: commands.ConsensusNotFound}
+	if cmd.FirstEpoch > cmd.LastEpoch {
+		s.log.Errorf("Peer %v: Invalid epoch range '%v-%v'", rAddr, cmd.FirstEpoch, cmd.LastEpoch)
+		return resp
+	}
+	if !s.cfg.Server.Archive {
+		s.log.Debugf("Peer %v: Not serving epochs '%v-%v': Not archiving", rAddr, cmd.FirstEpoch, cmd.LastEpoch)
+		return resp
+	}
+	if cmd.FirstEpoch < s.state.retentionEpoch() {
+		s.log.Debugf("Peer %v: Not serving epochs '%v-%v': Past retention", rAddr, cmd.FirstEpoch, cmd.LastEpoch)
+		return resp
+	}
+	epochs, docs, next, err := s.state.documentsForEpochs(cmd.FirstEpoch, cmd.LastEpoch)
+	if err != nil {
+		s.log.Errorf("Peer %v: Failed to retrieve documents for epochs '%v-%v': %v", rAddr, cmd.FirstEpoch, cmd.LastEpoch, err)
+		return resp
+	}
+	s.log.Debugf("Peer: %v: Serving %v documents for epochs %v-%v.", rAddr, len(docs), cmd.FirstEpoch, cmd.LastEpoch)
+	resp.ErrorCode = commands.ConsensusOk
+	resp.NextEpoch = next
+	resp.Epochs = epochs
+	resp.Documents = docs
+	return resp
+}
+
 func (s *Server) onPostDescriptor(rAddr net.Addr, cmd *commands.PostDescriptor, pubKeyHash []byte) commands.Command {
 	resp := &commands.PostDescriptorStatus{
 		ErrorCode: commands.DescriptorInvalid,
@@ -199,16 +231,29 @@ func (s *Server) onPostDescriptor(rAddr net.Addr, cmd *commands.PostDescriptor,
 		return resp
 	}
 
-	// Ensure that the descriptor is from an allowed peer.
-	if !s.state.isDescriptorAuthorized(desc) {
-		s.log.Errorf("Peer %v: Identity key hash '%x' not authorized", rAddr, desc.IdentityKey.Sum256)
-		resp.ErrorCode = commands.DescriptorForbidden
+	// Ensure that the descriptor, including its loop report, is well
+	// formed, so that it can not poison the document.
+	if err = pki.IsDescriptorWellFormed(desc, cmd.Epoch); err != nil {
+		s.log.Errorf("Peer %v: Malformed descriptor: %v", rAddr, err)
 		return resp
 	}
 
-	// Hand the descriptor off to the state worker.  As long as this returns
-	// a nil, the authority "accepts" the descriptor.
+	// Ensure that the descriptor's mix keys match the network's Sphinx
+	// geometry, so that it can not poison the document.
+	if err = pki.IsDescriptorGeometryCompatible(desc, s.cfg.SphinxGeometry); err != nil {
+		s.log.Errorf("Peer %v: Incompatible descriptor: %v", rAddr, err)
+		return resp
+	}
+
+	// Hand the descriptor off to the state worker, which ensures that it
+	// is from an allowed peer, possibly by way of a key rotation.  As long
+	// as this returns a nil, the authority "accepts" the descriptor.
 	err = s.state.onDescriptorUpload(cmd.Payload, desc, cmd.Epoch)
+	if err == errForbidden {
+		s.log.Errorf("Peer %v: Identity key hash '%x' not authorized", rAddr, identityKeyHash[:])
+		resp.ErrorCode = commands.DescriptorForbidden
+		return resp
+	}
 	if err != nil {
 		// This is either a internal server error or the peer is trying to
 		// retroactively modify their descriptor.  This should disambituate
@@ -249,6 +294,8 @@ func (a *wireAuthenticator) IsPeerValid(creds *wire.PeerCredentials) bool {
 	pk := [sign.PublicKeyHashSize]byte{}
 	copy(pk[:], creds.AdditionalData[:sign.PublicKeyHashSize])
 
+	a.s.state.RLock()
+	defer a.s.state.RUnlock()
 	_, isMix := a.s.state.authorizedMixes[pk]
 	_, isProvider := a.s.state.authorizedProviders[pk]
 	_, isAuthority := a.s.state.authorizedAuthorities[pk]
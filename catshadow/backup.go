@@ -0,0 +1,197 @@
+// backup.go - State export, import and migration.
+// Copyright (C) 2022  David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package catshadow
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+const (
+	// StateVersion is the current version of the State schema.
+	StateVersion = 1
+
+	// BackupVersion is the current version of the backup bundle format.
+	BackupVersion = 1
+)
+
+var (
+	ErrStateTooNew        = errors.New("State version is newer than supported")
+	ErrBackupVersion      = errors.New("Unsupported backup version")
+	ErrBackupDecryptError = errors.New("Failed to decrypt backup, wrong passphrase?")
+)
+
+// stateMigrations are the migrations from each State version to the next.
+var stateMigrations = map[uint32]func(*State) error{
+	0: migrateStateV0,
+}
+
+// migrateStateV0 migrates unversioned states, which may predate the Blob map
+// and have nil maps, to version 1.
+func migrateStateV0(state *State) error {
+	if state.Contacts == nil {
+		state.Contacts = make([]*Contact, 0)
+	}
+	if state.Conversations == nil {
+		state.Conversations = make(map[string]map[MessageID]*Message)
+	}
+	if state.Blob == nil {
+		state.Blob = make(map[string][]byte)
+	}
+	return nil
+}
+
+// migrateState applies the migrations required to bring the State up to
+// StateVersion.
+func migrateState(state *State) error {
+	if state.Version > StateVersion {
+		return ErrStateTooNew
+	}
+	for state.Version < StateVersion {
+		migrate, ok := stateMigrations[state.Version]
+		if !ok {
+			return fmt.Errorf("No migration from state version %d", state.Version)
+		}
+		if err := migrate(state); err != nil {
+			return fmt.Errorf("Failed to migrate state version %d: %s", state.Version, err)
+		}
+		state.Version++
+	}
+	return nil
+}
+
+// marshalState serializes the State.
+func marshalState(state *State) ([]byte, error) {
+	em, err := cbor.EncOptions{Time: cbor.TimeUnixDynamic}.EncMode()
+	if err != nil {
+		return nil, err
+	}
+	return em.Marshal(state)
+}
+
+// backupBundle is the serialized form of a backup.
+type backupBundle struct {
+	// Version is the backup format version.
+	Version uint32
+
+	// KDF are the parameters used to derive the key from the passphrase.
+	KDF *KDFParams
+
+	// Ciphertext is the encrypted serialized State.
+	Ciphertext []byte
+}
+
+// ExportState returns a portable backup of the State, encrypted with a key
+// derived from the passphrase. The conversation history is only included
+// if includeConversations is set.
+func ExportState(state *State, passphrase []byte, includeConversations bool) ([]byte, error) {
+	s := *state
+	s.Version = StateVersion
+	if !includeConversations {
+		s.Conversations = make(map[string]map[MessageID]*Message)
+		s.PartialMessages = nil
+		s.Groups = make(map[GroupID]*Group)
+		for id, g := range state.Groups {
+			group := *g
+			group.Conversation = make(map[MessageID]*Message)
+			group.LastMessage = nil
+			s.Groups[id] = &group
+		}
+	}
+	serialized, err := marshalState(&s)
+	if err != nil {
+		return nil, err
+	}
+	kdf, err := DefaultKDFParams()
+	if err != nil {
+		return nil, err
+	}
+	ciphertext, err := encryptState(serialized, kdf.deriveKey(passphrase))
+	if err != nil {
+		return nil, err
+	}
+	return cbor.Marshal(&backupBundle{
+		Version:    BackupVersion,
+		KDF:        kdf,
+		Ciphertext: ciphertext,
+	})
+}
+
+// ImportState decrypts a backup created by ExportState and returns the
+// State, migrated to the current StateVersion.
+func ImportState(bundle []byte, passphrase []byte) (*State, error) {
+	b := new(backupBundle)
+	if err := cbor.Unmarshal(bundle, b); err != nil {
+		return nil, err
+	}
+	if b.Version != BackupVersion || b.KDF == nil || b.KDF.validate() != nil {
+		return nil, ErrBackupVersion
+	}
+	if len(b.Ciphertext) < nonceSize {
+		return nil, ErrBackupDecryptError
+	}
+	plaintext, err := decryptState(b.Ciphertext, b.KDF.deriveKey(passphrase))
+	if err != nil {
+		return nil, ErrBackupDecryptError
+	}
+	state := new(State)
+	if err := cbor.Unmarshal(plaintext, state); err != nil {
+		return nil, err
+	}
+	if err := migrateState(state); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+// ExportState returns a portable backup of the Client's current State.
+func (c *Client) ExportState(passphrase []byte, includeConversations bool) ([]byte, error) {
+	serialized, err := c.marshal()
+	if err != nil {
+		return nil, err
+	}
+	defer serialized.Destroy()
+	state := new(State)
+	if err := cbor.Unmarshal(serialized.Bytes(), state); err != nil {
+		return nil, err
+	}
+	return ExportState(state, passphrase, includeConversations)
+}
+
+// WriteStateFile encrypts the State with the passphrase and writes it to the
+// statefile, replacing any existing statefile, which must not be in use.
+func WriteStateFile(stateFile string, state *State, passphrase []byte) error {
+	state.Version = StateVersion
+	serialized, err := marshalState(state)
+	if err != nil {
+		return err
+	}
+	kdf, err := DefaultKDFParams()
+	if err != nil {
+		return err
+	}
+	return rekeyStateFile(stateFile, serialized, kdf.deriveKey(passphrase), kdf)
+}
+
+// ReadStateFile decrypts the statefile and returns its State, migrated to
+// the current StateVersion, without ever writing to the statefile.
+func ReadStateFile(stateFile string, passphrase []byte) (*State, error) {
+	state, _, _, err := readStateFile(stateFile, passphrase)
+	return state, err
+}
@@ -0,0 +1,153 @@
+// backup_test.go - State export and import tests.
+// Copyright (C) 2022  David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package catshadow
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/stretchr/testify/require"
+
+	"github.com/katzenpost/katzenpost/core/log"
+)
+
+func newTestState(t *testing.T) *State {
+	contact, err := NewContact("alice", 1, []byte("secret"))
+	require.NoError(t, err)
+	return &State{
+		Contacts: []*Contact{contact},
+		Conversations: map[string]map[MessageID]*Message{
+			"alice": {MessageID{1}: &Message{Plaintext: []byte("hello"), Timestamp: time.Now()}},
+		},
+		Groups: map[GroupID]*Group{
+			{1}: {ID: GroupID{1}, Name: "group", Conversation: map[MessageID]*Message{
+				{2}: {Plaintext: []byte("hello group"), Timestamp: time.Now()},
+			}},
+		},
+		Blob: map[string][]byte{"foo": {1, 2, 3}},
+	}
+}
+
+func TestExportImportState(t *testing.T) {
+	require := require.New(t)
+	state := newTestState(t)
+
+	bundle, err := ExportState(state, []byte("passphrase"), true)
+	require.NoError(err)
+	_, err = ImportState(bundle, []byte("wrong"))
+	require.Equal(ErrBackupDecryptError, err)
+
+	imported, err := ImportState(bundle, []byte("passphrase"))
+	require.NoError(err)
+	require.Equal(uint32(StateVersion), imported.Version)
+	require.Len(imported.Contacts, 1)
+	require.Equal("alice", imported.Contacts[0].Nickname)
+	require.Equal([]byte("hello"), imported.Conversations["alice"][MessageID{1}].Plaintext)
+	require.Len(imported.Groups[GroupID{1}].Conversation, 1)
+	require.Equal(state.Blob, imported.Blob)
+
+	// without the conversation history
+	bundle, err = ExportState(state, []byte("passphrase"), false)
+	require.NoError(err)
+	imported, err = ImportState(bundle, []byte("passphrase"))
+	require.NoError(err)
+	require.Len(imported.Contacts, 1)
+	require.Len(imported.Conversations, 0)
+	require.Equal("group", imported.Groups[GroupID{1}].Name)
+	require.Len(imported.Groups[GroupID{1}].Conversation, 0)
+
+	// the exported State is not modified
+	require.Len(state.Conversations, 1)
+	require.Len(state.Groups[GroupID{1}].Conversation, 1)
+}
+
+func TestImportStateInvalidKDF(t *testing.T) {
+	require := require.New(t)
+
+	bundle, err := ExportState(newTestState(t), []byte("passphrase"), true)
+	require.NoError(err)
+	b := new(backupBundle)
+	require.NoError(cbor.Unmarshal(bundle, b))
+	salt := b.KDF.Salt
+	for _, kdf := range []*KDFParams{
+		{Salt: salt},
+		{Salt: salt, Time: 1, Memory: 1024},
+		{Salt: salt, Time: 1, Memory: maxKDFMemory + 1, Threads: 1},
+		{Salt: salt, Time: maxKDFTime + 1, Memory: 1024, Threads: 1},
+		{Salt: salt, Time: 1, Memory: 1024, Threads: maxKDFThreads + 1},
+	} {
+		b.KDF = kdf
+		crafted, err := cbor.Marshal(b)
+		require.NoError(err)
+		_, err = ImportState(crafted, []byte("passphrase"))
+		require.Equal(ErrBackupVersion, err)
+	}
+}
+
+func TestStateMigration(t *testing.T) {
+	require := require.New(t)
+
+	state := &State{}
+	require.NoError(migrateState(state))
+	require.Equal(uint32(StateVersion), state.Version)
+	require.NotNil(state.Contacts)
+	require.NotNil(state.Conversations)
+	require.NotNil(state.Blob)
+
+	state.Version = StateVersion + 1
+	require.Equal(ErrStateTooNew, migrateState(state))
+}
+
+func TestWriteStateFile(t *testing.T) {
+	require := require.New(t)
+	stateFile := filepath.Join(t.TempDir(), "catshadow_statefile")
+
+	state := newTestState(t)
+	require.NoError(WriteStateFile(stateFile, state, []byte("passphrase")))
+
+	logBackend, err := log.New("", "ERROR", true)
+	require.NoError(err)
+	_, loaded, err := LoadStateWriter(logBackend.GetLogger("state"), stateFile, []byte("passphrase"))
+	require.NoError(err)
+	require.Equal(uint32(StateVersion), loaded.Version)
+	require.Equal("alice", loaded.Contacts[0].Nickname)
+}
+
+func TestReadStateFile(t *testing.T) {
+	require := require.New(t)
+	stateFile := filepath.Join(t.TempDir(), "catshadow_statefile")
+
+	// a legacy statefile is read without being migrated on disk
+	serialized, err := marshalState(newTestState(t))
+	require.NoError(err)
+	ciphertext, err := encryptState(serialized, stretchKey([]byte("passphrase")))
+	require.NoError(err)
+	require.NoError(os.WriteFile(stateFile, ciphertext, 0600))
+
+	_, err = ReadStateFile(stateFile, []byte("wrong"))
+	require.Error(err)
+	state, err := ReadStateFile(stateFile, []byte("passphrase"))
+	require.NoError(err)
+	require.Equal(uint32(StateVersion), state.Version)
+	require.Equal("alice", state.Contacts[0].Nickname)
+	rawFile, err := os.ReadFile(stateFile)
+	require.NoError(err)
+	require.Equal(ciphertext, rawFile)
+}
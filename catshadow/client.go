@@ -39,6 +39,7 @@ import (
 	"github.com/katzenpost/katzenpost/core/crypto/rand"
 	"github.com/katzenpost/katzenpost/core/log"
 	"github.com/katzenpost/katzenpost/core/pki"
+	"github.com/katzenpost/katzenpost/core/sphinx"
 	"github.com/katzenpost/katzenpost/core/utils"
 	"github.com/katzenpost/katzenpost/core/worker"
 	memspoolclient "github.com/katzenpost/katzenpost/memspool/client"
@@ -85,6 +86,8 @@ type Client struct {
 	contactNicknames    map[string]*Contact
 	spoolReadDescriptor *memspoolclient.SpoolReadDescriptor
 	conversations       map[string]map[MessageID]*Message
+	partialMessages     map[uint64]map[MessageID]*PartialMessage
+	groups              map[GroupID]*Group
 	conversationsMutex  *sync.Mutex
 	blobMutex           *sync.Mutex
 	connMutex           *sync.RWMutex
@@ -107,6 +110,25 @@ type queuedSpoolCommand struct {
 	Receiver string
 	Command  []byte
 	ID       MessageID
+
+	// GroupID is the Group of a group message, or nil.
+	GroupID *GroupID
+
+	// Control is set for protocol messages, such as read receipts, which
+	// are not part of a conversation and do not emit message events.
+	Control bool
+
+	// Fragments are the spool commands of the remaining fragments of a
+	// fragmented message, which are sent in order after Command.
+	Fragments [][]byte
+
+	// FragmentCount is the total number of fragments of the message.
+	FragmentCount int
+
+	// Serialized is the serialized message, queued without its spool
+	// commands while the Sphinx geometry was unknown, which are computed
+	// when it is sent.
+	Serialized []byte
 }
 
 // NewClientAndRemoteSpool creates and connects a new Client and creates a new
@@ -151,6 +173,12 @@ func New(logBackend *log.Backend, mixnetClient *client.Client, stateWorker *Stat
 	if state.Blob == nil {
 		state.Blob = make(map[string][]byte)
 	}
+	if state.Groups == nil {
+		state.Groups = make(map[GroupID]*Group)
+	}
+	if state.PartialMessages == nil {
+		state.PartialMessages = make(map[uint64]map[MessageID]*PartialMessage)
+	}
 	c := &Client{
 		eventCh:             channels.NewInfiniteChannel(),
 		EventSink:           make(chan interface{}),
@@ -163,6 +191,8 @@ func New(logBackend *log.Backend, mixnetClient *client.Client, stateWorker *Stat
 		contactNicknames:    make(map[string]*Contact),
 		spoolReadDescriptor: state.SpoolReadDescriptor,
 		conversations:       state.Conversations,
+		partialMessages:     state.PartialMessages,
+		groups:              state.Groups,
 		blob:                state.Blob,
 		blobMutex:           new(sync.Mutex),
 		conversationsMutex:  new(sync.Mutex),
@@ -174,11 +204,24 @@ func New(logBackend *log.Backend, mixnetClient *client.Client, stateWorker *Stat
 	}
 	for _, contact := range state.Contacts {
 		c.contacts[contact.id] = contact
-		c.contactNicknames[contact.Nickname] = contact
+		if contact.deviceOf == 0 {
+			c.contactNicknames[contact.Nickname] = contact
+		}
 	}
 	return c, nil
 }
 
+// sphinxGeometry returns the Sphinx geometry of the current PKI document,
+// or nil while the client is offline or has no document.
+func (c *Client) sphinxGeometry() *sphinx.Geometry {
+	c.connMutex.RLock()
+	defer c.connMutex.RUnlock()
+	if c.session != nil {
+		return c.session.SphinxGeometry()
+	}
+	return nil
+}
+
 // sessionEvents() is called by the worker routine. It returns
 // events from the established session or nil, if the client is in offline mode
 func (c *Client) sessionEvents() chan client.Event {
@@ -261,7 +304,8 @@ func (c *Client) restartKeyExchanges() {
 // restart PANDA exchanges
 func (c *Client) restartPANDAExchanges() {
 	for _, contact := range c.contacts {
-		if contact.IsPending {
+		// introductions are made through the linked device
+		if contact.IsPending && contact.introducer == 0 {
 			err := c.initKeyExchange(contact)
 			if err != ErrAlreadyHaveKeyExchange && err != nil {
 				// skip if a ratchet keyexchange cannot be found or created
@@ -330,6 +374,17 @@ func (c *Client) garbageCollectConversations() {
 			}
 		}
 	}
+	for _, g := range c.groups {
+		for mesgID, message := range g.Conversation {
+			if time.Now().After(message.Timestamp.Add(MessageExpirationDuration)) {
+				if g.LastMessage == message {
+					g.LastMessage = nil
+				}
+				delete(g.Conversation, mesgID)
+			}
+		}
+	}
+	c.garbageCollectPartialMessages()
 }
 
 // GetPKIDocument() returns the current pki.Document or error
@@ -550,7 +605,7 @@ func (c *Client) randID() uint64 {
 }
 
 // called by worker upon opAddContact
-func (c *Client) createContact(nickname string, sharedSecret []byte) error {
+func (c *Client) createContact(nickname string, sharedSecret []byte, isDevice bool) error {
 	if _, ok := c.contactNicknames[nickname]; ok {
 		return fmt.Errorf("Contact with nickname %s, already exists.", nickname)
 	}
@@ -558,6 +613,7 @@ func (c *Client) createContact(nickname string, sharedSecret []byte) error {
 	if err != nil {
 		return err
 	}
+	contact.IsDevice = isDevice
 	c.contacts[contact.ID()] = contact
 	c.contactNicknames[contact.Nickname] = contact
 	// FIXME: #157
@@ -676,7 +732,15 @@ func (c *Client) doContactRemoval(nickname string) error {
 	contact.haltKeyExchanges()
 	delete(c.contactNicknames, nickname)
 	delete(c.contacts, contact.id)
+	for _, device := range c.contactDevices(contact) {
+		delete(c.contacts, device.id)
+		device.Destroy()
+	}
+	c.conversationsMutex.Lock()
+	delete(c.partialMessages, contact.id)
+	c.conversationsMutex.Unlock()
 	c.doWipeConversation(nickname) // calls c.save()
+	c.syncContactsToDevices()
 	return nil
 }
 
@@ -706,6 +770,7 @@ func (c *Client) doContactRename(oldname, newname string) error {
 
 	delete(c.conversations, oldname)
 	delete(c.contactNicknames, oldname)
+	c.syncContactsToDevices()
 	return nil
 }
 
@@ -804,9 +869,12 @@ func (c *Client) marshal() (*memguard.LockedBuffer, error) {
 	}
 	c.conversationsMutex.Lock()
 	s := &State{
+		Version:             StateVersion,
 		SpoolReadDescriptor: c.spoolReadDescriptor,
 		Contacts:            contacts,
 		Conversations:       c.conversations,
+		PartialMessages:     c.partialMessages,
+		Groups:              c.groups,
 		Providers:           c.providers,
 		Blob:                c.blob,
 	}
@@ -835,7 +903,7 @@ func (c *Client) Shutdown() {
 
 // SendMessage sends a message to the Client contact with the given nickname.
 func (c *Client) SendMessage(nickname string, message []byte) MessageID {
-	if len(message)+4 > DoubleRatchetPayloadLength {
+	if len(message) > MaxMessageSize {
 		return MessageID{}
 	}
 	convoMesgID := MessageID{}
@@ -868,6 +936,12 @@ func (c *Client) doSendMessage(convoMesgID MessageID, nickname string, message [
 		return
 	}
 	if contact.IsPending {
+		// messages are relayed through the linked device which
+		// introduces us to the contact until the introduction completes
+		if device, ok := c.contacts[contact.introducer]; ok && !device.IsPending {
+			c.relayMessage(device, contact, convoMesgID, message)
+			return
+		}
 		c.log.Errorf("cannot send message, contact %s is pending a key exchange", nickname)
 		c.eventCh.In() <- &MessageNotSentEvent{
 			Nickname:  nickname,
@@ -876,10 +950,19 @@ func (c *Client) doSendMessage(convoMesgID MessageID, nickname string, message [
 		}
 		return
 	}
+	if contact.IsDevice {
+		c.eventCh.In() <- &MessageNotSentEvent{
+			Nickname:  nickname,
+			MessageID: convoMesgID,
+			Err:       ErrIsDevice,
+		}
+		return
+	}
 	outMessage := Message{
 		Plaintext: message,
 		Timestamp: time.Now(),
 		Outbound:  true,
+		ID:        convoMesgID,
 	}
 
 	serialized, err := cbor.Marshal(outMessage)
@@ -891,11 +974,8 @@ func (c *Client) doSendMessage(convoMesgID MessageID, nickname string, message [
 		}
 		return
 	}
-	contact.ratchetMutex.Lock()
-	ciphertext, err := contact.ratchet.Encrypt(nil, serialized)
-	if err != nil {
-		c.log.Errorf("failed to encrypt: %s", err)
-		contact.ratchetMutex.Unlock()
+
+	if err := c.enqueueMessage(contact, convoMesgID, nil, false, serialized); err != nil {
 		c.eventCh.In() <- &MessageNotSentEvent{
 			Nickname:  nickname,
 			MessageID: convoMesgID,
@@ -903,23 +983,55 @@ func (c *Client) doSendMessage(convoMesgID MessageID, nickname string, message [
 		}
 		return
 	}
-	contact.ratchetMutex.Unlock()
 
-	appendCmd, err := common.AppendToSpool(contact.spoolWriteDescriptor.ID, ciphertext)
-	if err != nil {
-		c.log.Errorf("failed to compute spool append command: %s", err)
-		c.eventCh.In() <- &MessageNotSentEvent{
-			Nickname:  nickname,
-			MessageID: convoMesgID,
-			Err:       err,
+	// update the conversation history
+	c.conversationsMutex.Lock()
+	_, ok = c.conversations[nickname]
+	if !ok {
+		c.conversations[nickname] = make(map[MessageID]*Message)
+	}
+	c.conversations[nickname][convoMesgID] = &outMessage
+	c.contactNicknames[nickname].LastMessage = &outMessage
+	c.conversationsMutex.Unlock()
+	c.syncMessageToDevices(contact, &outMessage, nil)
+	c.save()
+}
+
+// enqueueMessage enqueues the serialized message for sending to the contact,
+// and to each of the contact's linked devices which were introduced to us.
+func (c *Client) enqueueMessage(contact *Contact, convoMesgID MessageID, groupID *GroupID, control bool, serialized []byte) error {
+	if err := c.enqueueSpoolAppend(contact, convoMesgID, groupID, control, serialized); err != nil {
+		return err
+	}
+	for _, device := range c.contactDevices(contact) {
+		// message events are emitted for the contact only
+		if err := c.enqueueSpoolAppend(device, convoMesgID, groupID, true, serialized); err != nil {
+			c.log.Errorf("failed to send message to a linked device of %s: %s", contact.Nickname, err)
 		}
-		return
 	}
+	return nil
+}
 
-	// enqueue the message for sending
+// enqueueSpoolAppend encrypts the serialized message for the contact,
+// fragmenting it if it does not fit in a single spool append, and enqueues
+// it for sending. While the Sphinx geometry is unknown the message is
+// queued unencrypted, and encrypted for the geometry of the PKI document
+// when it is sent.
+func (c *Client) enqueueSpoolAppend(contact *Contact, convoMesgID MessageID, groupID *GroupID, control bool, serialized []byte) error {
 	item := &queuedSpoolCommand{Receiver: contact.spoolWriteDescriptor.Receiver,
 		Provider: contact.spoolWriteDescriptor.Provider,
-		Command:  appendCmd, ID: convoMesgID}
+		ID:       convoMesgID, GroupID: groupID, Control: control}
+	if geo := c.sphinxGeometry(); geo != nil {
+		appendCmds, err := c.spoolAppendCommands(contact, convoMesgID, serialized, geo)
+		if err != nil {
+			return err
+		}
+		item.setCommands(appendCmds)
+	} else {
+		item.Serialized = serialized
+	}
+
+	// enqueue the message for sending
 	if _, err := contact.outbound.Peek(); err == ErrQueueEmpty {
 		// no messages already queued, so call sendMessage immediately
 		c.connMutex.RLock()
@@ -930,24 +1042,56 @@ func (c *Client) doSendMessage(convoMesgID MessageID, nickname string, message [
 	}
 	if err := contact.outbound.Push(item); err != nil {
 		c.log.Debugf("Failed to enqueue message!")
-		c.eventCh.In() <- &MessageNotSentEvent{
-			Nickname:  nickname,
-			MessageID: convoMesgID,
-			Err:       err,
+		return err
+	}
+	return nil
+}
+
+// spoolAppendCommands returns the spool append commands of the serialized
+// message encrypted for the contact, one per fragment if it does not fit
+// in a single spool append.
+func (c *Client) spoolAppendCommands(contact *Contact, convoMesgID MessageID, serialized []byte, geo *sphinx.Geometry) ([][]byte, error) {
+	// messages which do not fit in a single spool append are fragmented
+	payloads := [][]byte{serialized}
+	if len(serialized) > DoubleRatchetPayloadLength(geo) {
+		var err error
+		payloads, err = fragmentMessage(convoMesgID, serialized, geo)
+		if err != nil {
+			c.log.Errorf("failed to fragment message: %s", err)
+			return nil, err
 		}
-		return
 	}
 
-	// update the conversation history
-	c.conversationsMutex.Lock()
-	_, ok = c.conversations[nickname]
-	if !ok {
-		c.conversations[nickname] = make(map[MessageID]*Message)
+	appendCmds := make([][]byte, 0, len(payloads))
+	for _, payload := range payloads {
+		contact.ratchetMutex.Lock()
+		ciphertext, err := contact.ratchet.Encrypt(nil, payload)
+		contact.ratchetMutex.Unlock()
+		if err != nil {
+			c.log.Errorf("failed to encrypt: %s", err)
+			return nil, err
+		}
+
+		appendCmd, err := common.AppendToSpool(contact.spoolWriteDescriptor.ID, ciphertext, geo)
+		if err != nil {
+			c.log.Errorf("failed to compute spool append command: %s", err)
+			return nil, err
+		}
+		appendCmds = append(appendCmds, appendCmd)
 	}
-	c.conversations[nickname][convoMesgID] = &outMessage
-	c.contactNicknames[nickname].LastMessage = &outMessage
-	c.conversationsMutex.Unlock()
-	c.save()
+	return appendCmds, nil
+}
+
+// setCommands sets the spool commands of the message, the first of which
+// is sent first.
+func (q *queuedSpoolCommand) setCommands(appendCmds [][]byte) {
+	q.Command = appendCmds[0]
+	q.Fragments = nil
+	if len(appendCmds) > 1 {
+		q.Fragments = appendCmds[1:]
+	}
+	q.FragmentCount = len(appendCmds)
+	q.Serialized = nil
 }
 
 func (c *Client) sendMessage(contact *Contact) {
@@ -957,6 +1101,27 @@ func (c *Client) sendMessage(contact *Contact) {
 		c.log.Debugf("No messages to send for contact: %s", contact.Nickname)
 		return
 	}
+	if cmd.Serialized != nil {
+		// the message was queued while the Sphinx geometry was unknown
+		geo := c.session.SphinxGeometry()
+		if geo == nil {
+			c.log.Errorf("failed to send message to %s: no Sphinx geometry", contact.Nickname)
+			return
+		}
+		cmd, err = contact.outbound.Seal(func(item *queuedSpoolCommand) error {
+			appendCmds, err := c.spoolAppendCommands(contact, item.ID, item.Serialized, geo)
+			if err != nil {
+				return err
+			}
+			item.setCommands(appendCmds)
+			return nil
+		})
+		if err != nil {
+			c.log.Errorf("failed to encrypt queued message to %s: %s", contact.Nickname, err)
+			return
+		}
+		c.save()
+	}
 
 	// XXX: unfortunately this command does not tell us when to expect the message delivery to have occurred even though minclient knows it...
 	mesgID, err := c.session.SendReliableMessage(cmd.Receiver, cmd.Provider, cmd.Command)
@@ -966,8 +1131,11 @@ func (c *Client) sendMessage(contact *Contact) {
 	}
 	c.log.Debug("Message enqueued for sending to %s, message-ID: %x", contact.Nickname, *mesgID)
 	c.sendMap.Store(*mesgID, &SentMessageDescriptor{
+		contactID: contact.id,
 		Nickname:  contact.Nickname,
 		MessageID: cmd.ID,
+		GroupID:   cmd.GroupID,
+		control:   cmd.Control,
 	})
 }
 
@@ -999,6 +1167,23 @@ func (c *Client) sendReadInbox() {
 	c.sendMap.Store(*mesgID, &ReadMessageDescriptor{MessageID: a})
 }
 
+// sendDeleteMessage deletes the message with the given ID from the remote
+// spool, once the spool read descriptor has moved past it.
+func (c *Client) sendDeleteMessage(messageID uint32) {
+	cmd, err := c.spoolReadDescriptor.DeleteCommand(messageID)
+	if err != nil {
+		c.log.Errorf("failed to compose spool delete command: %s", err)
+		return
+	}
+	mesgID, err := c.session.SendUnreliableMessage(c.spoolReadDescriptor.Receiver, c.spoolReadDescriptor.Provider, cmd)
+	if err != nil {
+		c.log.Errorf("sendDeleteMessage failure: %v", err)
+		return
+	}
+	c.log.Debug("Message enqueued for deleting %x:%d from remote spool, message-ID: %x", c.spoolReadDescriptor.ID, messageID, mesgID)
+	c.sendMap.Store(*mesgID, &DeleteMessageDescriptor{SpoolMessageID: messageID})
+}
+
 func (c *Client) garbageCollectSendMap(gcEvent *client.MessageIDGarbageCollected) {
 	c.log.Debug("Garbage Collecting Message ID %x", gcEvent.MessageID[:])
 	c.sendMap.Delete(gcEvent.MessageID)
@@ -1015,30 +1200,49 @@ func (c *Client) handleSent(sentEvent *client.MessageSentEvent) {
 				c.log.Debugf("readInbox command %x sent", *sentEvent.MessageID)
 			}
 			return
+		case *DeleteMessageDescriptor:
+			if sentEvent.Err != nil {
+				c.log.Debugf("delete command %x for spool message %d failed with %s", *sentEvent.MessageID, tp.SpoolMessageID, sentEvent.Err)
+			}
+			return
 		case *SentMessageDescriptor:
 			// since the retransmission occurs per contact
 			// set a timer on the contact
-			if contact, ok := c.contactNicknames[tp.Nickname]; !ok {
+			if contact, ok := c.contacts[tp.contactID]; !ok {
 				return
 			} else {
 				if sentEvent.Err != nil {
 					c.log.Debugf("message send for %s failed with err: %s", tp.Nickname, sentEvent.Err)
+					if tp.control {
+						return
+					}
 					c.eventCh.In() <- &MessageNotSentEvent{
 						Nickname:  tp.Nickname,
 						MessageID: tp.MessageID,
+						GroupID:   tp.GroupID,
 						Err:       sentEvent.Err,
 					}
 					return
 				}
 				// keep track of the MessageID that has not been ACK'd yet
 				contact.ackID = *sentEvent.MessageID
+
+				// the message is not sent until its last fragment is sent
+				if item, err := contact.outbound.Peek(); err == nil && item.ID == tp.MessageID && len(item.Fragments) > 0 {
+					c.log.Debugf("MessageSentEvent for fragment %x", *sentEvent.MessageID)
+					return
+				}
+			}
+			if tp.control {
+				return
 			}
 
 			c.log.Debugf("MessageSentEvent for %x", *sentEvent.MessageID)
-			c.setMessageSent(tp.Nickname, tp.MessageID)
+			c.setMessageSent(tp.Nickname, tp.GroupID, tp.MessageID)
 			c.eventCh.In() <- &MessageSentEvent{
 				Nickname:  tp.Nickname,
 				MessageID: tp.MessageID,
+				GroupID:   tp.GroupID,
 			}
 		default:
 			c.fatalErrCh <- errors.New("BUG, sendMap entry has incorrect type")
@@ -1056,7 +1260,10 @@ func (c *Client) handleReply(replyEvent *client.MessageReplyEvent) {
 			err := cbor.Unmarshal(replyEvent.Payload, &spoolResponse)
 			if err != nil {
 				c.log.Errorf("Could not deserialize SpoolResponse to message ID %d: %s", tp.MessageID, err)
-				c.eventCh.In() <- &MessageNotDeliveredEvent{Nickname: tp.Nickname, MessageID: tp.MessageID,
+				if tp.control {
+					return
+				}
+				c.eventCh.In() <- &MessageNotDeliveredEvent{Nickname: tp.Nickname, MessageID: tp.MessageID, GroupID: tp.GroupID,
 					Err: fmt.Errorf("Invalid spool response: %s", err),
 				}
 				return
@@ -1065,19 +1272,55 @@ func (c *Client) handleReply(replyEvent *client.MessageReplyEvent) {
 			if !spoolResponse.IsOK() {
 				c.log.Errorf("Spool response ID %d status error: %s for SpoolID %x",
 					spoolResponse.MessageID, spoolResponse.Status, spoolResponse.SpoolID)
-
-				c.eventCh.In() <- &MessageNotDeliveredEvent{Nickname: tp.Nickname, MessageID: tp.MessageID,
+				if tp.control {
+					return
+				}
+				c.eventCh.In() <- &MessageNotDeliveredEvent{Nickname: tp.Nickname, MessageID: tp.MessageID, GroupID: tp.GroupID,
 					Err: spoolResponse.StatusAsError(),
 				}
 				return
 			}
 			c.log.Debugf("MessageDeliveredEvent for %s MessageID %x", tp.Nickname, *replyEvent.MessageID)
-			if contact, ok := c.contactNicknames[tp.Nickname]; ok {
+			if contact, ok := c.contacts[tp.contactID]; ok {
 				if contact.ackID != *replyEvent.MessageID {
 					// spurious ACK
 					c.log.Debugf("Dropping spurious ACK for %x", *replyEvent.MessageID)
 					return
 				}
+				contact.ackID = [cConstants.MessageIDLength]byte{}
+
+				// send the next fragment of a fragmented message
+				item, err := contact.outbound.Advance()
+				if err != nil {
+					c.log.Debugf("Maybe duplicate ACK received for %s with MessageID %x %s",
+						contact.Nickname, *replyEvent.MessageID, err)
+					return
+				}
+				if item != nil {
+					c.log.Debugf("Sending MessageSendProgressEvent for %s", tp.Nickname)
+					c.save()
+					c.sendMessage(contact)
+					if tp.control {
+						return
+					}
+					c.eventCh.In() <- &MessageSendProgressEvent{
+						Nickname:  tp.Nickname,
+						MessageID: tp.MessageID,
+						GroupID:   tp.GroupID,
+						Delivered: item.FragmentCount - len(item.Fragments) - 1,
+						Total:     item.FragmentCount,
+					}
+					return
+				}
+				if item, err := contact.outbound.Peek(); err == nil && item.FragmentCount > 1 && !tp.control {
+					c.eventCh.In() <- &MessageSendProgressEvent{
+						Nickname:  tp.Nickname,
+						MessageID: tp.MessageID,
+						GroupID:   tp.GroupID,
+						Delivered: item.FragmentCount,
+						Total:     item.FragmentCount,
+					}
+				}
 				if _, err := contact.outbound.Pop(); err != nil {
 					// duplicate ACK?
 					c.log.Debugf("Maybe duplicate ACK received for %s with MessageID %x %s",
@@ -1087,10 +1330,14 @@ func (c *Client) handleReply(replyEvent *client.MessageReplyEvent) {
 					// try to send the next message, if one exists
 					defer c.sendMessage(contact)
 				}
+				if tp.control {
+					c.save()
+					return
+				}
 				c.log.Debugf("Sending MessageDeliveredEvent for %s", tp.Nickname)
-				c.setMessageDelivered(tp.Nickname, tp.MessageID)
+				c.setMessageDelivered(tp.Nickname, tp.GroupID, tp.MessageID)
 				c.save()
-				c.eventCh.In() <- &MessageDeliveredEvent{Nickname: tp.Nickname, MessageID: tp.MessageID}
+				c.eventCh.In() <- &MessageDeliveredEvent{Nickname: tp.Nickname, MessageID: tp.MessageID, GroupID: tp.GroupID}
 				return
 			}
 		case *ReadMessageDescriptor:
@@ -1101,6 +1348,16 @@ func (c *Client) handleReply(replyEvent *client.MessageReplyEvent) {
 				c.log.Errorf("Could not deserialize SpoolResponse to ReadInbox ID %d: %s", tp.MessageID, err)
 				return
 			}
+			if spoolResponse.IsGone() {
+				// the messages up to the next one expired or were deleted, skip them
+				if spoolResponse.MessageID == c.spoolReadDescriptor.ReadOffset && spoolResponse.NextMessageID > c.spoolReadDescriptor.ReadOffset {
+					c.log.Warningf("Spool messages %d to %d are gone, skipping them",
+						spoolResponse.MessageID, spoolResponse.NextMessageID-1)
+					c.spoolReadDescriptor.ReadOffset = spoolResponse.NextMessageID
+					c.save()
+				}
+				return
+			}
 			if !spoolResponse.IsOK() {
 				// no new messages were returned
 				c.log.Debugf("Spool response ID %d status error: %s for SpoolID %x",
@@ -1139,12 +1396,26 @@ func (c *Client) handleReply(replyEvent *client.MessageReplyEvent) {
 					c.log.Debugf("failure to decrypt tip of spool - MessageID: %x, err: %s", *replyEvent.MessageID, err.Error())
 				}
 				// in all other cases, advance the spool read descriptor
+				// and delete the message from the spool
 				c.spoolReadDescriptor.IncrementOffset()
 				c.save()
+				c.sendDeleteMessage(spoolResponse.MessageID)
 			default:
 				panic("received spool response for MessageID not requested yet")
 			}
 			return
+		case *DeleteMessageDescriptor:
+			spoolResponse := common.SpoolResponse{}
+			err := cbor.Unmarshal(replyEvent.Payload, &spoolResponse)
+			if err != nil {
+				c.log.Errorf("Could not deserialize SpoolResponse to delete of spool message %d: %s", tp.SpoolMessageID, err)
+				return
+			}
+			if !spoolResponse.IsOK() {
+				c.log.Debugf("Spool delete of message %d status error: %s for SpoolID %x",
+					tp.SpoolMessageID, spoolResponse.Status, spoolResponse.SpoolID)
+			}
+			return
 		default:
 			c.fatalErrCh <- errors.New("BUG, sendMap entry has incorrect type")
 			return
@@ -1238,6 +1509,56 @@ func (c *Client) decryptMessage(messageID *[cConstants.MessageIDLength]byte, cip
 			decrypted = true
 			nickname = contact.Nickname
 
+			// reassemble fragmented messages
+			if f := parseMessageFragment(plaintext); f != nil {
+				c.conversationsMutex.Lock()
+				serialized, partial, err := c.addFragment(contact, f)
+				c.conversationsMutex.Unlock()
+				if err != nil {
+					c.log.Errorf("Dropping message fragment from %s: %s", nickname, err)
+					return err
+				}
+				c.log.Debugf("Received fragment %d of %d from %s", partial.Received, len(partial.Fragments), nickname)
+				c.eventCh.In() <- &MessageReceiveProgressEvent{
+					Nickname:  nickname,
+					MessageID: f.ID,
+					Received:  partial.Received,
+					Total:     len(partial.Fragments),
+				}
+				if serialized == nil {
+					c.save()
+					return nil
+				}
+				plaintext = serialized
+			}
+
+			// linked devices only send device syncs
+			if contact.IsDevice {
+				return c.handleDeviceSync(contact, plaintext)
+			}
+
+			// messages from the linked devices of a contact are from the contact
+			if contact.deviceOf != 0 {
+				parent, ok := c.contacts[contact.deviceOf]
+				if !ok {
+					return ErrContactNotFound
+				}
+				contact = parent
+				nickname = contact.Nickname
+			}
+
+			// group messages are handled separately from the contact's conversation
+			if m := parseGroupMessage(plaintext); m != nil {
+				return c.handleGroupMessage(contact, m)
+			}
+			if r := parseReadReceipt(plaintext); r != nil {
+				c.handleReadReceipt(contact, r)
+				return nil
+			}
+			if i := parseIntroduction(plaintext); i != nil {
+				return c.handleIntroduction(contact, i)
+			}
+
 			// if the message is a cbor-encoded Message, extract the fields
 			err := cbor.Unmarshal(plaintext, &message)
 			if err != nil {
@@ -1261,6 +1582,7 @@ func (c *Client) decryptMessage(messageID *[cConstants.MessageIDLength]byte, cip
 
 			}
 			message.Outbound = false
+			message.Read = false
 			break
 		default:
 			// every other type of error indicates an invalid message
@@ -1291,35 +1613,51 @@ func (c *Client) decryptMessage(messageID *[cConstants.MessageIDLength]byte, cip
 			Message:   message.Plaintext,
 			Timestamp: message.Timestamp,
 		}
+		if message.ID != (MessageID{}) {
+			c.sendReadReceipt(c.contactNicknames[nickname], message.ID)
+		}
+		c.syncMessageToDevices(c.contactNicknames[nickname], &message, nil)
 		return nil
 	}
 	c.log.Debugf("trial ratchet decryption failure for message ID %x reported ratchet error: %s", *messageID, err)
 	return ErrTrialDecryptionFailed
 }
 
+// conversationMessage returns the Message MessageID of the conversation with
+// the contact, or of the group conversation if groupID is not nil. It must be
+// called with the conversationsMutex held.
+func (c *Client) conversationMessage(nickname string, groupID *GroupID, msgId MessageID) *Message {
+	if groupID != nil {
+		if g, ok := c.groups[*groupID]; ok {
+			return g.Conversation[msgId]
+		}
+		return nil
+	}
+	if ch, ok := c.conversations[nickname]; ok {
+		return ch[msgId]
+	}
+	return nil
+}
+
 // setMessageSent sets Message MessageID Sent = true and returns true on success
-func (c *Client) setMessageSent(nickname string, msgId MessageID) bool {
+func (c *Client) setMessageSent(nickname string, groupID *GroupID, msgId MessageID) bool {
 	c.conversationsMutex.Lock()
 	defer c.conversationsMutex.Unlock()
-	if ch, ok := c.conversations[nickname]; ok {
-		if m, ok := ch[msgId]; ok {
-			m.Sent = true
-			return true
-		}
+	if m := c.conversationMessage(nickname, groupID, msgId); m != nil {
+		m.Sent = true
+		return true
 	}
 
 	return false
 }
 
 // setMessageDelivered sets Message MessageID Delivered = true and returns true on success
-func (c *Client) setMessageDelivered(nickname string, msgId MessageID) bool {
+func (c *Client) setMessageDelivered(nickname string, groupID *GroupID, msgId MessageID) bool {
 	c.conversationsMutex.Lock()
 	defer c.conversationsMutex.Unlock()
-	if ch, ok := c.conversations[nickname]; ok {
-		if m, ok := ch[msgId]; ok {
-			m.Delivered = true
-			return true
-		}
+	if m := c.conversationMessage(nickname, groupID, msgId); m != nil {
+		m.Delivered = true
+		return true
 	}
 
 	return false
@@ -0,0 +1,100 @@
+// main.go - catshadow state backup tool
+// Copyright (C) 2022  David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Command backup exports a catshadow statefile to a portable, passphrase
+// encrypted backup bundle, and imports a bundle to a new statefile.
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/term"
+
+	"github.com/katzenpost/katzenpost/catshadow"
+)
+
+// readPassphrase reads a passphrase from the terminal without echoing it,
+// or a line from stdin if it is not a terminal.
+func readPassphrase(r *bufio.Reader, prompt string) []byte {
+	fmt.Fprint(os.Stderr, prompt)
+	if fd := int(os.Stdin.Fd()); term.IsTerminal(fd) {
+		passphrase, err := term.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to read passphrase: %v\n", err)
+			os.Exit(1)
+		}
+		return passphrase
+	}
+	line, err := r.ReadString('\n')
+	if err != nil && line == "" {
+		fmt.Fprintf(os.Stderr, "Failed to read passphrase: %v\n", err)
+		os.Exit(1)
+	}
+	return []byte(strings.TrimRight(line, "\r\n"))
+}
+
+func main() {
+	stateFile := flag.String("state", "catshadow_statefile", "The catshadow statefile.")
+	backupFile := flag.String("backup", "catshadow_backup", "The backup bundle.")
+	doImport := flag.Bool("import", false, "Import the backup bundle to a new statefile, rather than exporting.")
+	history := flag.Bool("history", false, "Include the conversation history in the exported backup.")
+	flag.Parse()
+
+	r := bufio.NewReader(os.Stdin)
+	if *doImport {
+		if _, err := os.Stat(*stateFile); err == nil {
+			fmt.Fprintf(os.Stderr, "Statefile '%s' already exists.\n", *stateFile)
+			os.Exit(1)
+		}
+		bundle, err := os.ReadFile(*backupFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to read backup: %v\n", err)
+			os.Exit(1)
+		}
+		state, err := catshadow.ImportState(bundle, readPassphrase(r, "Backup passphrase: "))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to import backup: %v\n", err)
+			os.Exit(1)
+		}
+		if err := catshadow.WriteStateFile(*stateFile, state, readPassphrase(r, "New statefile passphrase: ")); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to write statefile: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Fprintf(os.Stderr, "Imported %d contacts to '%s'.\n", len(state.Contacts), *stateFile)
+		return
+	}
+
+	state, err := catshadow.ReadStateFile(*stateFile, readPassphrase(r, "Statefile passphrase: "))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to decrypt statefile: %v\n", err)
+		os.Exit(1)
+	}
+	bundle, err := catshadow.ExportState(state, readPassphrase(r, "Backup passphrase: "), *history)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to export state: %v\n", err)
+		os.Exit(1)
+	}
+	if err := os.WriteFile(*backupFile, bundle, 0600); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to write backup: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Fprintf(os.Stderr, "Exported %d contacts to '%s'.\n", len(state.Contacts), *backupFile)
+}
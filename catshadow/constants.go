@@ -22,11 +22,15 @@ import (
 	"time"
 
 	ratchet "github.com/katzenpost/doubleratchet"
+	"github.com/katzenpost/katzenpost/core/sphinx"
 	"github.com/katzenpost/katzenpost/memspool/common"
 )
 
-// DoubleRatchetPayloadLength is the length of the payload encrypted by the ratchet.
-var DoubleRatchetPayloadLength = common.SpoolPayloadLength - ratchet.DoubleRatchetOverhead
+// DoubleRatchetPayloadLength returns the length of the payload encrypted
+// by the ratchet for the given Sphinx geometry.
+func DoubleRatchetPayloadLength(geo *sphinx.Geometry) int {
+	return common.SpoolPayloadLength(geo) - ratchet.DoubleRatchetOverhead
+}
 
 const (
 	// MessageExpirationDuration is the duration of time after which messages will be removed.
@@ -39,4 +43,12 @@ const (
 	// GarbageCollectionInterval is the time interval between garbage collecting
 	// old messages.
 	GarbageCollectionInterval = 120 * time.Minute
+
+	// MaxMessageSize is the maximum size of a message plaintext. Messages
+	// which do not fit in a single spool append are sent as fragments.
+	MaxMessageSize = 256 * 1024
+
+	// PartialMessageExpirationDuration is the duration of time after the last
+	// received fragment after which an incomplete message will be removed.
+	PartialMessageExpirationDuration = 72 * time.Hour
 )
@@ -65,6 +65,13 @@ type serializedContact struct {
 	SharedSecret         []byte
 	SpoolWriteDescriptor *memspoolClient.SpoolWriteDescriptor
 	MessageExpiration    time.Duration
+	DisableReadReceipts  bool
+	IsDevice             bool
+	LinkedContacts       []linkedContact
+	Introducer           uint64
+	IntroducedDevices    []uint64
+	DeviceOf             uint64
+	DeviceID             uint64
 }
 
 type boundExchange struct {
@@ -85,6 +92,9 @@ type Contact struct {
 	// IsPending is true if the key exchange has not been completed.
 	IsPending bool
 
+	// IsDevice is true if the contact is another of our own devices.
+	IsDevice bool
+
 	// keyExchange is the serialised double ratchet key exchange we generated.
 	keyExchange []byte
 
@@ -132,6 +142,28 @@ type Contact struct {
 
 	// messageExpiration is the duration after which conversation history is cleared
 	messageExpiration time.Duration
+
+	// disableReadReceipts is set if read receipts are not sent to this contact.
+	disableReadReceipts bool
+
+	// linkedContacts are the contacts of a linked device.
+	linkedContacts []linkedContact
+
+	// introducer is the ID of the linked device which introduced us to
+	// the contact, and through which our key exchange is made.
+	introducer uint64
+
+	// introducedDevices are the IDs of our linked devices which were
+	// introduced to the contact, and which receive its messages directly.
+	introducedDevices []uint64
+
+	// deviceOf is the ID of the contact whose linked device was introduced
+	// to us. Such a Contact is not known by a nickname, and the messages
+	// to the contact are also sent to its linked devices.
+	deviceOf uint64
+
+	// deviceID is the ID of the linked device at the contact.
+	deviceID uint64
 }
 
 // NewContact creates a new Contact or returns an error.
@@ -183,6 +215,13 @@ func (c *Contact) MarshalBinary() ([]byte, error) {
 		SpoolWriteDescriptor: c.spoolWriteDescriptor,
 		Outbound:             c.outbound,
 		MessageExpiration:    c.messageExpiration,
+		DisableReadReceipts:  c.disableReadReceipts,
+		IsDevice:             c.IsDevice,
+		LinkedContacts:       c.linkedContacts,
+		Introducer:           c.introducer,
+		IntroducedDevices:    c.introducedDevices,
+		DeviceOf:             c.deviceOf,
+		DeviceID:             c.deviceID,
 	}
 	return cbor.Marshal(s)
 }
@@ -215,6 +254,13 @@ func (c *Contact) UnmarshalBinary(data []byte) error {
 	c.spoolWriteDescriptor = s.SpoolWriteDescriptor
 	c.outbound = s.Outbound
 	c.messageExpiration = s.MessageExpiration
+	c.disableReadReceipts = s.DisableReadReceipts
+	c.IsDevice = s.IsDevice
+	c.linkedContacts = s.LinkedContacts
+	c.introducer = s.Introducer
+	c.introducedDevices = s.IntroducedDevices
+	c.deviceOf = s.DeviceOf
+	c.deviceID = s.DeviceID
 	if c.IsPending {
 		c.pandaShutdownChan = make(chan struct{})
 		c.reunionShutdownChan = make(chan struct{})
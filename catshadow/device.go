@@ -0,0 +1,525 @@
+// device.go - Linked devices.
+// Copyright (C) 2022  David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package catshadow
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+
+	"github.com/katzenpost/katzenpost/core/crypto/rand"
+)
+
+var (
+	ErrIsDevice          = errors.New("Contact is a linked device")
+	ErrInvalidDeviceSync = errors.New("Invalid device sync")
+)
+
+const (
+	// syncContacts is a deviceSync of the sending device's contacts.
+	syncContacts = iota + 1
+	// syncMessage is a deviceSync of a message sent to or received from
+	// one of the sending device's contacts.
+	syncMessage
+	// syncRelay is a deviceSync requesting that the receiving device send
+	// the message to one of its contacts.
+	syncRelay
+	// syncIntroduction is a deviceSync requesting that the receiving device
+	// introduce us to one of its contacts, with our contact exchange.
+	syncIntroduction
+	// syncIntroduced is a deviceSync of the contact exchange with which a
+	// contact replied to our introduction.
+	syncIntroduced
+)
+
+// linkedContact is a contact of a linked device.
+type linkedContact struct {
+	// ID is the contact ID, which is shared by the linked devices.
+	ID uint64
+
+	// Nickname is the nickname of the contact on the linked device.
+	Nickname string
+}
+
+// LinkedContact is a contact to which we were introduced by a linked device.
+type LinkedContact struct {
+	// ID is the contact ID, which is shared by the linked devices.
+	ID uint64
+
+	// Nickname is our nickname of the contact, which has the
+	// nickname of the device appended if it was already taken.
+	Nickname string
+
+	// Device is the nickname of the linked device.
+	Device string
+}
+
+// deviceSync is exchanged between linked devices over their pairwise
+// ratchet. Each device has its own ratchet with each of the contacts, with
+// whom the devices are introduced to each other through the device which
+// has the contact, and the conversations are synced so that they appear
+// on all of the devices.
+type deviceSync struct {
+	Kind uint8
+
+	// Contacts are the contacts of the sending device.
+	Contacts []linkedContact
+
+	// ContactID is the ID of the contact of the Message or Exchange.
+	ContactID uint64
+
+	// Message is the synced or relayed message.
+	Message *Message
+
+	// Exchange is the contact exchange of an introduction.
+	Exchange []byte
+}
+
+// introduction is sent to a contact to introduce one of our linked
+// devices, and the contact replies with its own contact exchange. The
+// contact then sends its messages to each of our devices.
+type introduction struct {
+	// Device is our ID of the introduced device.
+	Device uint64
+
+	// Exchange is the contact exchange of the device, or of
+	// the contact in the Reply.
+	Exchange []byte
+
+	// Reply is set on the reply of the contact.
+	Reply bool
+}
+
+// parseIntroduction returns the introduction contained in the given
+// plaintext, or nil if the plaintext is not an introduction.
+func parseIntroduction(plaintext []byte) *introduction {
+	i := new(introduction)
+	if err := cbor.Unmarshal(plaintext, i); err != nil || i.Device == 0 || len(i.Exchange) == 0 {
+		return nil
+	}
+	return i
+}
+
+// LinkDevice links another device of the same user, which must call
+// LinkDevice with the same sharedSecret. Linked devices are introduced
+// to the contacts of each other and share their conversations.
+func (c *Client) LinkDevice(name string, sharedSecret []byte) {
+	select {
+	case <-c.HaltCh():
+	case c.opCh <- &opAddContact{
+		name:         name,
+		sharedSecret: sharedSecret,
+		isDevice:     true,
+	}:
+	}
+}
+
+// GetLinkedContacts returns the contacts to which we were introduced by
+// our linked devices. Contacts which are pending the introduction receive
+// our messages through the linked device.
+func (c *Client) GetLinkedContacts() []LinkedContact {
+	getLinkedContactsOp := &opGetLinkedContacts{
+		responseChan: make(chan []LinkedContact, 1),
+	}
+	select {
+	case c.opCh <- getLinkedContactsOp:
+	case <-c.HaltCh():
+		return nil
+	}
+	select {
+	case <-c.HaltCh():
+	case l := <-getLinkedContactsOp.responseChan:
+		return l
+	}
+	return nil
+}
+
+func (c *Client) doGetLinkedContacts() []LinkedContact {
+	linked := []LinkedContact{}
+	for _, device := range c.devices() {
+		linked = append(linked, c.deviceLinkedContacts(device)...)
+	}
+	return linked
+}
+
+// deviceLinkedContacts returns the contacts to which the device introduced us.
+func (c *Client) deviceLinkedContacts(device *Contact) []LinkedContact {
+	linked := []LinkedContact{}
+	for _, l := range device.linkedContacts {
+		contact, ok := c.contacts[l.ID]
+		if !ok || contact.introducer != device.id {
+			continue
+		}
+		linked = append(linked, LinkedContact{ID: l.ID, Nickname: contact.Nickname, Device: device.Nickname})
+	}
+	return linked
+}
+
+// devices returns our linked devices, sorted by nickname.
+func (c *Client) devices() []*Contact {
+	devices := []*Contact{}
+	for _, contact := range c.contacts {
+		if contact.IsDevice && !contact.IsPending {
+			devices = append(devices, contact)
+		}
+	}
+	sort.Slice(devices, func(i, j int) bool { return devices[i].Nickname < devices[j].Nickname })
+	return devices
+}
+
+// contactDevices returns the linked devices of the contact which were
+// introduced to us.
+func (c *Client) contactDevices(contact *Contact) []*Contact {
+	devices := []*Contact{}
+	for _, d := range c.contacts {
+		if d.deviceOf == contact.id {
+			devices = append(devices, d)
+		}
+	}
+	return devices
+}
+
+// receivesDirectly returns true if the linked device receives the messages
+// of the contact directly, because it introduced us or was introduced.
+func receivesDirectly(device, contact *Contact) bool {
+	if contact.introducer == device.id {
+		return true
+	}
+	for _, id := range contact.introducedDevices {
+		if id == device.id {
+			return true
+		}
+	}
+	return false
+}
+
+// sendDeviceSync sends a deviceSync to each of the given linked devices.
+func (c *Client) sendDeviceSync(s *deviceSync, devices []*Contact) {
+	if len(devices) == 0 {
+		return
+	}
+	serialized, err := cbor.Marshal(s)
+	if err != nil {
+		c.log.Errorf("failed to serialize device sync: %s", err)
+		return
+	}
+	for _, device := range devices {
+		c.sendControlMessage(device, serialized)
+	}
+}
+
+// sendControlMessage sends a protocol message to the contact only, and
+// not to its linked devices.
+func (c *Client) sendControlMessage(contact *Contact, serialized []byte) {
+	convoMesgID := MessageID{}
+	if _, err := rand.Reader.Read(convoMesgID[:]); err != nil {
+		c.fatalErrCh <- err
+		return
+	}
+	if err := c.enqueueSpoolAppend(contact, convoMesgID, nil, true, serialized); err != nil {
+		c.log.Errorf("failed to send control message to %s: %s", contact.Nickname, err)
+	}
+}
+
+// syncContactsToDevices sends our contacts to our linked devices.
+func (c *Client) syncContactsToDevices() {
+	contacts := []linkedContact{}
+	for _, contact := range c.contacts {
+		if contact.IsDevice || contact.IsPending || contact.deviceOf != 0 {
+			continue
+		}
+		contacts = append(contacts, linkedContact{ID: contact.id, Nickname: contact.Nickname})
+	}
+	sort.Slice(contacts, func(i, j int) bool { return contacts[i].Nickname < contacts[j].Nickname })
+	c.sendDeviceSync(&deviceSync{Kind: syncContacts, Contacts: contacts}, c.devices())
+}
+
+// syncMessageToDevices sends a message of the conversation with the contact
+// to our linked devices except the given device. Received messages are not
+// sent to the devices which receive the messages of the contact directly.
+func (c *Client) syncMessageToDevices(contact *Contact, message *Message, except *Contact) {
+	devices := []*Contact{}
+	for _, device := range c.devices() {
+		if device == except || (!message.Outbound && receivesDirectly(device, contact)) {
+			continue
+		}
+		devices = append(devices, device)
+	}
+	c.sendDeviceSync(&deviceSync{Kind: syncMessage, ContactID: contact.id, Message: message}, devices)
+}
+
+// relayMessage asks the linked device to send the message to the contact,
+// to whom it has not yet introduced us.
+func (c *Client) relayMessage(device, contact *Contact, convoMesgID MessageID, message []byte) {
+	outMessage := Message{
+		Plaintext: message,
+		Timestamp: time.Now(),
+		Outbound:  true,
+		ID:        convoMesgID,
+	}
+	serialized, err := cbor.Marshal(&deviceSync{Kind: syncRelay, ContactID: contact.id, Message: &outMessage})
+	if err != nil {
+		c.eventCh.In() <- &MessageNotSentEvent{
+			Nickname:  contact.Nickname,
+			MessageID: convoMesgID,
+			Err:       err,
+		}
+		return
+	}
+	if err := c.enqueueSpoolAppend(device, convoMesgID, nil, true, serialized); err != nil {
+		c.eventCh.In() <- &MessageNotSentEvent{
+			Nickname:  contact.Nickname,
+			MessageID: convoMesgID,
+			Err:       err,
+		}
+		return
+	}
+	c.storeSyncedMessage(contact, convoMesgID, &outMessage)
+	c.save()
+}
+
+// storeSyncedMessage adds the message to the conversation with the contact,
+// replacing any message with the same MessageID.
+func (c *Client) storeSyncedMessage(contact *Contact, convoMesgID MessageID, message *Message) {
+	c.conversationsMutex.Lock()
+	defer c.conversationsMutex.Unlock()
+	if _, ok := c.conversations[contact.Nickname]; !ok {
+		c.conversations[contact.Nickname] = make(map[MessageID]*Message)
+	}
+	c.conversations[contact.Nickname][convoMesgID] = message
+	contact.LastMessage = message
+}
+
+// syncedContact returns the Contact with the given ID of a deviceSync.
+func (c *Client) syncedContact(id uint64) (*Contact, error) {
+	contact, ok := c.contacts[id]
+	if !ok || contact.IsDevice || contact.deviceOf != 0 {
+		return nil, ErrContactNotFound
+	}
+	return contact, nil
+}
+
+// introduceContact adds the contact of the linked device, and asks the
+// device to introduce us with the contact exchange of our new ratchet.
+func (c *Client) introduceContact(device *Contact, l linkedContact) error {
+	if l.ID == 0 || l.Nickname == "" {
+		return ErrInvalidDeviceSync
+	}
+	nickname := l.Nickname
+	if _, ok := c.contactNicknames[nickname]; ok {
+		nickname = fmt.Sprintf("%s@%s", l.Nickname, device.Nickname)
+		if _, ok := c.contactNicknames[nickname]; ok {
+			return fmt.Errorf("Contact with nickname %s, already exists.", nickname)
+		}
+	}
+	contact, err := NewContact(nickname, l.ID, nil)
+	if err != nil {
+		return err
+	}
+	contact.introducer = device.id
+	if err := c.initKeyExchange(contact); err != nil {
+		return err
+	}
+	c.contacts[contact.id] = contact
+	c.contactNicknames[contact.Nickname] = contact
+	c.sendDeviceSync(&deviceSync{Kind: syncIntroduction, ContactID: contact.id, Exchange: contact.keyExchange}, []*Contact{device})
+	return nil
+}
+
+// completeIntroduction completes our key exchange with the contact to whom
+// a linked device introduced us, with the contact exchange of their reply.
+func (c *Client) completeIntroduction(contact *Contact, exchangeBytes []byte) error {
+	exchange, err := parseContactExchangeBytes(exchangeBytes)
+	if err != nil {
+		return err
+	}
+	contact.ratchetMutex.Lock()
+	err = contact.ratchet.ProcessKeyExchange(exchange.KeyExchange)
+	contact.ratchetMutex.Unlock()
+	if err != nil {
+		return err
+	}
+	contact.spoolWriteDescriptor = exchange.SpoolWriteDescriptor
+	contact.keyExchange = nil
+	contact.IsPending = false
+	c.log.Infof("Introduction to %s completed", contact.Nickname)
+	c.save()
+	c.eventCh.In() <- &KeyExchangeCompletedEvent{
+		Nickname: contact.Nickname,
+	}
+	c.syncContactsToDevices()
+	return nil
+}
+
+// handleIntroduction handles an introduction received from the contact.
+func (c *Client) handleIntroduction(contact *Contact, i *introduction) error {
+	if i.Reply {
+		// the contact replied to the introduction of our linked device
+		device, ok := c.contacts[i.Device]
+		if !ok || !device.IsDevice {
+			return ErrContactNotFound
+		}
+		if !receivesDirectly(device, contact) {
+			contact.introducedDevices = append(contact.introducedDevices, device.id)
+		}
+		c.save()
+		c.sendDeviceSync(&deviceSync{Kind: syncIntroduced, ContactID: contact.id, Exchange: i.Exchange}, []*Contact{device})
+		return nil
+	}
+
+	// a linked device of the contact was introduced, replacing
+	// any previous ratchet with the same device
+	for _, d := range c.contactDevices(contact) {
+		if d.deviceID == i.Device {
+			delete(c.contacts, d.id)
+			d.Destroy()
+		}
+	}
+	exchange, err := parseContactExchangeBytes(i.Exchange)
+	if err != nil {
+		return err
+	}
+	device, err := NewContact("", c.randID(), nil)
+	if err != nil {
+		return err
+	}
+	device.deviceOf = contact.id
+	device.deviceID = i.Device
+	if err := c.initKeyExchange(device); err != nil {
+		return err
+	}
+	device.ratchetMutex.Lock()
+	err = device.ratchet.ProcessKeyExchange(exchange.KeyExchange)
+	device.ratchetMutex.Unlock()
+	if err != nil {
+		return err
+	}
+	device.spoolWriteDescriptor = exchange.SpoolWriteDescriptor
+	device.IsPending = false
+	c.contacts[device.id] = device
+	c.log.Infof("Linked device of %s introduced", contact.Nickname)
+
+	serialized, err := cbor.Marshal(&introduction{Device: i.Device, Exchange: device.keyExchange, Reply: true})
+	if err != nil {
+		return err
+	}
+	device.keyExchange = nil
+	c.sendControlMessage(contact, serialized)
+	c.save()
+	return nil
+}
+
+// handleDeviceSync handles a deviceSync received from a linked device.
+func (c *Client) handleDeviceSync(device *Contact, plaintext []byte) error {
+	s := new(deviceSync)
+	if err := cbor.Unmarshal(plaintext, s); err != nil {
+		return err
+	}
+	switch s.Kind {
+	case syncContacts:
+		device.linkedContacts = s.Contacts
+		for _, l := range s.Contacts {
+			if _, ok := c.contacts[l.ID]; ok {
+				continue
+			}
+			if err := c.introduceContact(device, l); err != nil {
+				c.log.Errorf("Cannot add contact %s of %s: %s", l.Nickname, device.Nickname, err)
+			}
+		}
+		c.save()
+		c.eventCh.In() <- &DeviceContactsSyncedEvent{
+			Device:   device.Nickname,
+			Contacts: c.deviceLinkedContacts(device),
+		}
+		return nil
+	case syncMessage:
+		if s.Message == nil {
+			return ErrInvalidDeviceSync
+		}
+		contact, err := c.syncedContact(s.ContactID)
+		if err != nil {
+			c.log.Errorf("Cannot sync message from %s for unknown contact %d", device.Nickname, s.ContactID)
+			return err
+		}
+		convoMesgID := s.Message.ID
+		if !s.Message.Outbound || convoMesgID == (MessageID{}) {
+			if _, err := rand.Reader.Read(convoMesgID[:]); err != nil {
+				c.fatalErrCh <- err
+				return err
+			}
+		}
+		s.Message.Read = s.Message.Read && s.Message.Outbound
+		c.storeSyncedMessage(contact, convoMesgID, s.Message)
+		c.save()
+		if !s.Message.Outbound {
+			c.eventCh.In() <- &MessageReceivedEvent{
+				Nickname:  contact.Nickname,
+				Message:   s.Message.Plaintext,
+				Timestamp: s.Message.Timestamp,
+			}
+		}
+		return nil
+	case syncRelay:
+		if s.Message == nil {
+			return ErrInvalidDeviceSync
+		}
+		contact, err := c.syncedContact(s.ContactID)
+		if err != nil {
+			c.log.Errorf("Cannot relay message from %s to unknown contact %d", device.Nickname, s.ContactID)
+			return err
+		}
+		c.doSendMessage(s.Message.ID, contact.Nickname, s.Message.Plaintext)
+		return nil
+	case syncIntroduction:
+		contact, err := c.syncedContact(s.ContactID)
+		if err != nil {
+			c.log.Errorf("Cannot introduce %s to unknown contact %d", device.Nickname, s.ContactID)
+			return err
+		}
+		if contact.IsPending {
+			return ErrPendingKeyExchange
+		}
+		serialized, err := cbor.Marshal(&introduction{Device: device.id, Exchange: s.Exchange})
+		if err != nil {
+			return err
+		}
+		c.sendControlMessage(contact, serialized)
+		return nil
+	case syncIntroduced:
+		contact, err := c.syncedContact(s.ContactID)
+		if err != nil {
+			return err
+		}
+		if !contact.IsPending || contact.introducer != device.id {
+			c.log.Errorf("Dropping unexpected introduction to %s from %s", contact.Nickname, device.Nickname)
+			return ErrInvalidDeviceSync
+		}
+		if err := c.completeIntroduction(contact, s.Exchange); err != nil {
+			c.log.Errorf("Introduction to %s failed: %s", contact.Nickname, err)
+			c.eventCh.In() <- &KeyExchangeCompletedEvent{
+				Nickname: contact.Nickname,
+				Err:      err,
+			}
+			return err
+		}
+		return nil
+	}
+	return ErrInvalidDeviceSync
+}
@@ -0,0 +1,324 @@
+// device_test.go - Linked device tests.
+// Copyright (C) 2022  David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package catshadow
+
+import (
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/awnumar/memguard"
+	"github.com/fxamacker/cbor/v2"
+	ratchet "github.com/katzenpost/doubleratchet"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/eapache/channels.v1"
+
+	cConstants "github.com/katzenpost/katzenpost/client/constants"
+	"github.com/katzenpost/katzenpost/core/crypto/rand"
+	"github.com/katzenpost/katzenpost/core/log"
+	"github.com/katzenpost/katzenpost/core/sphinx"
+	memspoolClient "github.com/katzenpost/katzenpost/memspool/client"
+	"github.com/katzenpost/katzenpost/memspool/common"
+	rClient "github.com/katzenpost/katzenpost/reunion/client"
+)
+
+func TestDeviceSyncEncoding(t *testing.T) {
+	require := require.New(t)
+
+	message := &Message{Plaintext: []byte("hello"), Timestamp: time.Now(), Outbound: true, ID: MessageID{1}}
+	serialized, err := cbor.Marshal(&deviceSync{Kind: syncRelay, ContactID: 2, Message: message})
+	require.NoError(err)
+
+	s := new(deviceSync)
+	require.NoError(cbor.Unmarshal(serialized, s))
+	require.Equal(uint8(syncRelay), s.Kind)
+	require.Equal(uint64(2), s.ContactID)
+	require.Equal(message.Plaintext, s.Message.Plaintext)
+	require.Equal(message.ID, s.Message.ID)
+
+	// introductions are not mistaken for other messages
+	serialized, err = cbor.Marshal(&introduction{Device: 3, Exchange: []byte("exchange")})
+	require.NoError(err)
+	require.NotNil(parseIntroduction(serialized))
+	require.Nil(parseGroupMessage(serialized))
+	require.Nil(parseReadReceipt(serialized))
+	serialized, err = cbor.Marshal(message)
+	require.NoError(err)
+	require.Nil(parseIntroduction(serialized))
+}
+
+func TestContactIsDevice(t *testing.T) {
+	require := require.New(t)
+
+	contact, err := NewContact("laptop", 1, []byte("secret"))
+	require.NoError(err)
+	contact.IsDevice = true
+	contact.linkedContacts = []linkedContact{{ID: 2, Nickname: "alice"}, {ID: 3, Nickname: "bob"}}
+	contact.introducer = 4
+	contact.introducedDevices = []uint64{5}
+	contact.deviceOf = 6
+	contact.deviceID = 7
+
+	serialized, err := contact.MarshalBinary()
+	require.NoError(err)
+	contact2 := new(Contact)
+	require.NoError(contact2.UnmarshalBinary(serialized))
+	require.True(contact2.IsDevice)
+	require.Equal(contact.linkedContacts, contact2.linkedContacts)
+	require.Equal(contact.introducer, contact2.introducer)
+	require.Equal(contact.introducedDevices, contact2.introducedDevices)
+	require.Equal(contact.deviceOf, contact2.deviceOf)
+	require.Equal(contact.deviceID, contact2.deviceID)
+}
+
+// newOfflineTestClient returns an offline Client which discards its state.
+func newOfflineTestClient(t *testing.T) *Client {
+	logBackend, err := log.New("", "DEBUG", false)
+	require.NoError(t, err)
+	stateWorker := &StateWriter{stateCh: make(chan *memguard.LockedBuffer)}
+	go func() {
+		for range stateWorker.stateCh {
+		}
+	}()
+	t.Cleanup(func() { close(stateWorker.stateCh) })
+	return &Client{
+		logBackend:         logBackend,
+		log:                logBackend.GetLogger("catshadow"),
+		contacts:           make(map[uint64]*Contact),
+		contactNicknames:   make(map[string]*Contact),
+		conversations:      make(map[string]map[MessageID]*Message),
+		conversationsMutex: new(sync.Mutex),
+		blobMutex:          new(sync.Mutex),
+		connMutex:          new(sync.RWMutex),
+		stateWorker:        stateWorker,
+		eventCh:            channels.NewInfiniteChannel(),
+	}
+}
+
+func TestReunionSyncsContactsToDevices(t *testing.T) {
+	require := require.New(t)
+
+	c := newOfflineTestClient(t)
+
+	// a linked device, with which the key exchange is complete
+	device, err := NewContact("laptop", 1, nil)
+	require.NoError(err)
+	device.IsDevice = true
+	device.IsPending = false
+	device.spoolWriteDescriptor = &memspoolClient.SpoolWriteDescriptor{Receiver: "spool", Provider: "provider"}
+	devicePeer, err := ratchet.InitRatchet(rand.Reader)
+	require.NoError(err)
+	kx, err := device.ratchet.CreateKeyExchange()
+	require.NoError(err)
+	peerKx, err := devicePeer.CreateKeyExchange()
+	require.NoError(err)
+	require.NoError(device.ratchet.ProcessKeyExchange(peerKx))
+	require.NoError(devicePeer.ProcessKeyExchange(kx))
+	c.contacts[device.id] = device
+
+	// a contact pending a Reunion key exchange
+	alice, err := NewContact("alice", 2, []byte("secret"))
+	require.NoError(err)
+	alice.reunionKeyExchange = map[uint64]boundExchange{3: {}}
+	alice.reunionResult = make(map[uint64]string)
+	_, err = alice.ratchet.CreateKeyExchange()
+	require.NoError(err)
+	alicePeer, err := ratchet.InitRatchet(rand.Reader)
+	require.NoError(err)
+	alicePeerKx, err := alicePeer.CreateKeyExchange()
+	require.NoError(err)
+	c.contacts[alice.id] = alice
+
+	result, err := NewContactExchangeBytes(&memspoolClient.SpoolWriteDescriptor{Receiver: "spool", Provider: "provider"}, alicePeerKx)
+	require.NoError(err)
+	c.processReunionUpdate(&rClient.ReunionUpdate{ContactID: alice.id, ExchangeID: 3, Result: result})
+	require.False(alice.IsPending)
+
+	// the device is sent our contacts, now including alice, which are
+	// encrypted once the Sphinx geometry is known
+	item, err := device.outbound.Peek()
+	require.NoError(err)
+	require.True(item.Control)
+	require.Nil(item.Command)
+	sealTestMessage(t, c, device)
+	request := new(common.SpoolRequest)
+	require.NoError(request.Unmarshal(item.Command))
+	plaintext, err := devicePeer.Decrypt(request.Message)
+	require.NoError(err)
+	s := new(deviceSync)
+	require.NoError(cbor.Unmarshal(plaintext, s))
+	require.Equal(uint8(syncContacts), s.Kind)
+	require.Equal([]linkedContact{{ID: alice.id, Nickname: "alice"}}, s.Contacts)
+}
+
+// newSpoolTestClient returns an offline Client with a spool read descriptor.
+func newSpoolTestClient(t *testing.T, provider string) *Client {
+	c := newOfflineTestClient(t)
+	c.spoolReadDescriptor = &memspoolClient.SpoolReadDescriptor{Receiver: "spool", Provider: provider}
+	_, err := rand.Reader.Read(c.spoolReadDescriptor.ID[:])
+	require.NoError(t, err)
+	return c
+}
+
+// pairTestContacts adds contacts to c1 and c2 with which
+// their key exchange is complete.
+func pairTestContacts(t *testing.T, c1 *Client, name1 string, c2 *Client, name2 string, isDevice bool) (*Contact, *Contact) {
+	require := require.New(t)
+
+	contact1, err := NewContact(name1, c1.randID(), nil)
+	require.NoError(err)
+	contact2, err := NewContact(name2, c2.randID(), nil)
+	require.NoError(err)
+	kx1, err := contact1.ratchet.CreateKeyExchange()
+	require.NoError(err)
+	kx2, err := contact2.ratchet.CreateKeyExchange()
+	require.NoError(err)
+	require.NoError(contact1.ratchet.ProcessKeyExchange(kx2))
+	require.NoError(contact2.ratchet.ProcessKeyExchange(kx1))
+	contact1.spoolWriteDescriptor = c2.spoolReadDescriptor.GetWriteDescriptor()
+	contact2.spoolWriteDescriptor = c1.spoolReadDescriptor.GetWriteDescriptor()
+	for _, c := range []struct {
+		client  *Client
+		contact *Contact
+	}{{c1, contact1}, {c2, contact2}} {
+		c.contact.IsPending = false
+		c.contact.IsDevice = isDevice
+		c.client.contacts[c.contact.id] = c.contact
+		c.client.contactNicknames[c.contact.Nickname] = c.contact
+	}
+	return contact1, contact2
+}
+
+// sealTestMessage encrypts the message at the head of the queue of the
+// contact, which offline Clients queue unencrypted, for the default Sphinx
+// geometry.
+func sealTestMessage(t *testing.T, c *Client, contact *Contact) {
+	_, err := contact.outbound.Seal(func(item *queuedSpoolCommand) error {
+		if item.Serialized == nil {
+			return nil
+		}
+		appendCmds, err := c.spoolAppendCommands(contact, item.ID, item.Serialized, sphinx.DefaultGeometry())
+		if err != nil {
+			return err
+		}
+		item.setCommands(appendCmds)
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+// deliverTestMessages delivers the messages queued for the contact to the
+// Client whose spool the contact writes to.
+func deliverTestMessages(t *testing.T, contact *Contact, to *Client) {
+	require := require.New(t)
+
+	require.Equal(to.spoolReadDescriptor.ID, contact.spoolWriteDescriptor.ID)
+	for {
+		if _, err := contact.outbound.Peek(); err == nil {
+			sealTestMessage(t, to, contact)
+		}
+		item, err := contact.outbound.Pop()
+		if err == ErrQueueEmpty {
+			return
+		}
+		require.NoError(err)
+		for _, cmd := range append([][]byte{item.Command}, item.Fragments...) {
+			request := new(common.SpoolRequest)
+			require.NoError(request.Unmarshal(cmd))
+			require.NoError(to.decryptMessage(&[cConstants.MessageIDLength]byte{}, request.Message))
+		}
+	}
+}
+
+// conversationTexts returns the plaintexts of the conversation, sorted.
+func conversationTexts(c *Client, nickname string) []string {
+	texts := []string{}
+	for _, m := range c.conversations[nickname] {
+		texts = append(texts, string(m.Plaintext))
+	}
+	sort.Strings(texts)
+	return texts
+}
+
+func TestLinkedDeviceRoundTrip(t *testing.T) {
+	require := require.New(t)
+
+	alice := newSpoolTestClient(t, "alice-provider")
+	phone := newSpoolTestClient(t, "phone-provider")
+	laptop := newSpoolTestClient(t, "laptop-provider")
+
+	// bob's phone is alice's contact, and is linked with his laptop
+	aliceBob, phoneAlice := pairTestContacts(t, alice, "bob", phone, "alice", false)
+	phoneLaptop, laptopPhone := pairTestContacts(t, phone, "laptop", laptop, "phone", true)
+	// the laptop has another contact also named alice
+	pairTestContacts(t, laptop, "alice", newSpoolTestClient(t, "other-provider"), "bob", false)
+
+	// the phone sends its contacts to the laptop, which asks to be
+	// introduced to alice under a distinct nickname and the same ID
+	phone.syncContactsToDevices()
+	deliverTestMessages(t, phoneLaptop, laptop)
+	laptopAlice, ok := laptop.contacts[phoneAlice.id]
+	require.True(ok)
+	require.Equal("alice@phone", laptopAlice.Nickname)
+	require.True(laptopAlice.IsPending)
+	require.Equal([]LinkedContact{{ID: phoneAlice.id, Nickname: "alice@phone", Device: "phone"}}, laptop.doGetLinkedContacts())
+
+	// until the introduction completes, messages are relayed through the phone
+	laptop.doSendMessage(MessageID{1}, "alice@phone", []byte("relayed"))
+	deliverTestMessages(t, laptopPhone, phone)
+	require.Equal([]string{"relayed"}, conversationTexts(phone, "alice"))
+	require.Empty(conversationTexts(phone, "laptop"))
+
+	// alice receives the introduction of the laptop and the relayed message,
+	// and replies to the introduction
+	deliverTestMessages(t, phoneAlice, alice)
+	require.Equal([]string{"relayed"}, conversationTexts(alice, "bob"))
+	require.Len(alice.contactDevices(aliceBob), 1)
+	aliceLaptop := alice.contactDevices(aliceBob)[0]
+	require.Equal(laptop.spoolReadDescriptor.ID, aliceLaptop.spoolWriteDescriptor.ID)
+	_, ok = alice.contactNicknames[""]
+	require.False(ok)
+
+	// the phone passes the reply on to the laptop, which completes the introduction
+	deliverTestMessages(t, aliceBob, phone)
+	require.Equal([]uint64{phoneLaptop.id}, phoneAlice.introducedDevices)
+	deliverTestMessages(t, phoneLaptop, laptop)
+	require.False(laptopAlice.IsPending)
+	require.Equal([]string{"relayed"}, conversationTexts(laptop, "alice@phone"))
+	// the read receipt of alice reached the laptop directly
+	deliverTestMessages(t, aliceLaptop, laptop)
+	require.True(laptop.conversations["alice@phone"][MessageID{1}].Read)
+
+	// alice sends her messages to both devices, which do not sync them
+	alice.doSendMessage(MessageID{2}, "bob", []byte("hello bob"))
+	deliverTestMessages(t, aliceBob, phone)
+	deliverTestMessages(t, aliceLaptop, laptop)
+	require.Equal([]string{"hello bob", "relayed"}, conversationTexts(phone, "alice"))
+	require.Equal([]string{"hello bob", "relayed"}, conversationTexts(laptop, "alice@phone"))
+	require.Empty(conversationTexts(laptop, "alice"))
+	_, err := phoneLaptop.outbound.Peek()
+	require.Equal(ErrQueueEmpty, err)
+
+	// the laptop now sends to alice directly, and syncs the message to the phone
+	laptop.doSendMessage(MessageID{3}, "alice@phone", []byte("hello alice"))
+	deliverTestMessages(t, laptopAlice, alice)
+	deliverTestMessages(t, laptopPhone, phone)
+	require.Equal([]string{"hello alice", "hello bob", "relayed"}, conversationTexts(alice, "bob"))
+	require.Equal([]string{"hello alice", "hello bob", "relayed"}, conversationTexts(phone, "alice"))
+	require.True(phone.conversations["alice"][MessageID{3}].Outbound)
+}
@@ -19,10 +19,13 @@
 package catshadow
 
 import (
+	"bytes"
+	"crypto/subtle"
 	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
+	"sync"
 
 	"github.com/awnumar/memguard"
 	"github.com/fxamacker/cbor/v2"
@@ -38,19 +41,41 @@ import (
 const (
 	keySize   = 32
 	nonceSize = 24
+	saltSize  = 16
+
+	// maxKDFTime, maxKDFMemory (in KiB) and maxKDFThreads bound the KDF
+	// parameters read from statefiles and backups, so that crafted ones
+	// can't make deriving the key exhaust the memory or the CPU.
+	maxKDFTime    = 64
+	maxKDFMemory  = 1024 * 1024
+	maxKDFThreads = 64
+
+	// stateFileVersion is the version of the statefile header.
+	stateFileVersion = 1
 )
 
 var (
-	DecryptStateFailed = errors.New("failed to decrypted statefile")
+	DecryptStateFailed  = errors.New("failed to decrypted statefile")
+	ErrWrongPassphrase  = errors.New("wrong passphrase")
+	ErrStateFileVersion = errors.New("unsupported statefile version")
+	ErrInvalidKDFParams = errors.New("invalid KDF parameters")
+
+	// stateFileMagic prefixes statefiles with a header, unlike legacy
+	// statefiles which begin with the random nonce.
+	stateFileMagic = []byte("KATZENPOST_CATSHADOW_STATEFILE\x00")
 )
 
 // State is the struct type representing the Client's state
 // which is encrypted and persisted to disk.
 type State struct {
+	// Version is the State schema version, see StateVersion.
+	Version             uint32
 	SpoolReadDescriptor *client.SpoolReadDescriptor
 	Contacts            []*Contact
 	Providers           []*pki.MixDescriptor
 	Conversations       map[string]map[MessageID]*Message
+	PartialMessages     map[uint64]map[MessageID]*PartialMessage
+	Groups              map[GroupID]*Group
 	Blob                map[string][]byte
 }
 
@@ -64,8 +89,14 @@ type StateWriter struct {
 	stateCh   chan *memguard.LockedBuffer
 	stateFile string
 
+	// Mutex serializes statefile writes and changes of the key.
+	sync.Mutex
+
 	// TODO: memguard.LockedBuffer
 	key *[32]byte
+
+	// kdf are the parameters from which key was derived.
+	kdf *KDFParams
 }
 
 func encryptState(state []byte, key *[32]byte) ([]byte, error) {
@@ -90,6 +121,7 @@ func decryptState(ciphertext []byte, key *[32]byte) ([]byte, error) {
 	return plaintext, nil
 }
 
+// stretchKey derives the key of legacy statefiles, which have no header.
 func stretchKey(passphrase []byte) *[32]byte {
 	secret := argon2.Key(passphrase, nil, 3, 32*1024, 4, keySize)
 	key := [keySize]byte{}
@@ -97,23 +129,100 @@ func stretchKey(passphrase []byte) *[32]byte {
 	return &key
 }
 
-func decryptStateFile(stateFile string, key *[32]byte) (*State, error) {
+// KDFParams are the argon2id parameters used to derive an encryption key
+// from a passphrase.
+type KDFParams struct {
+	Salt    []byte
+	Time    uint32
+	Memory  uint32
+	Threads uint8
+}
+
+// DefaultKDFParams returns new KDFParams with a random salt.
+func DefaultKDFParams() (*KDFParams, error) {
+	p := &KDFParams{
+		Salt:    make([]byte, saltSize),
+		Time:    3,
+		Memory:  32 * 1024,
+		Threads: 4,
+	}
+	if _, err := rand.Reader.Read(p.Salt); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *KDFParams) validate() error {
+	if len(p.Salt) < saltSize || p.Time == 0 || p.Memory == 0 || p.Threads == 0 {
+		return ErrInvalidKDFParams
+	}
+	if p.Time > maxKDFTime || p.Memory > maxKDFMemory || p.Threads > maxKDFThreads {
+		return ErrInvalidKDFParams
+	}
+	return nil
+}
+
+func (p *KDFParams) deriveKey(passphrase []byte) *[keySize]byte {
+	secret := argon2.IDKey(passphrase, p.Salt, p.Time, p.Memory, p.Threads, keySize)
+	key := [keySize]byte{}
+	copy(key[:], secret)
+	return &key
+}
+
+// stateFileHeader is the header of a statefile, which follows
+// stateFileMagic and records the KDF parameters of the statefile key.
+type stateFileHeader struct {
+	Version    uint32
+	KDF        *KDFParams
+	Ciphertext []byte
+}
+
+// readStateFile decrypts the statefile, and returns the State along with
+// the key and KDF parameters of the statefile. The returned KDF parameters
+// are nil if the statefile is a legacy statefile without a header.
+func readStateFile(stateFile string, passphrase []byte) (*State, *[keySize]byte, *KDFParams, error) {
 	rawFile, err := os.ReadFile(stateFile)
 	if err != nil {
-		return nil, err
+		return nil, nil, nil, err
+	}
+	var key *[keySize]byte
+	var kdf *KDFParams
+	ciphertext := rawFile
+	if bytes.HasPrefix(rawFile, stateFileMagic) {
+		header := new(stateFileHeader)
+		if err = cbor.Unmarshal(rawFile[len(stateFileMagic):], header); err != nil {
+			return nil, nil, nil, err
+		}
+		if header.Version != stateFileVersion || header.KDF == nil {
+			return nil, nil, nil, ErrStateFileVersion
+		}
+		if err = header.KDF.validate(); err != nil {
+			return nil, nil, nil, err
+		}
+		kdf = header.KDF
+		key = kdf.deriveKey(passphrase)
+		ciphertext = header.Ciphertext
+	} else {
+		key = stretchKey(passphrase)
 	}
-	plaintext, err := decryptState(rawFile, key)
+	if len(ciphertext) < nonceSize {
+		return nil, nil, nil, DecryptStateFailed
+	}
+	plaintext, err := decryptState(ciphertext, key)
 	if err != nil {
-		return nil, err
+		return nil, nil, nil, err
 	}
 	state := new(State)
 	if err = cbor.Unmarshal(plaintext, &state); err != nil {
-		return nil, err
+		return nil, nil, nil, err
+	}
+	if err = migrateState(state); err != nil {
+		return nil, nil, nil, err
 	}
-	return state, nil
+	return state, key, kdf, nil
 }
 
-func encryptStateFile(stateFile string, state []byte, key *[32]byte) error {
+func encryptStateFile(stateFile string, state []byte, key *[32]byte, kdf *KDFParams) error {
 	outFn := stateFile
 	tmpFn := fmt.Sprintf("%s.tmp", stateFile)
 	backupFn := fmt.Sprintf("%s~", stateFile)
@@ -121,11 +230,19 @@ func encryptStateFile(stateFile string, state []byte, key *[32]byte) error {
 	if err != nil {
 		return err
 	}
+	header, err := cbor.Marshal(&stateFileHeader{
+		Version:    stateFileVersion,
+		KDF:        kdf,
+		Ciphertext: ciphertext,
+	})
+	if err != nil {
+		return err
+	}
 	out, err := os.OpenFile(tmpFn, os.O_TRUNC|os.O_CREATE|os.O_WRONLY, 0600)
 	if err != nil {
 		return err
 	}
-	_, err = out.Write(ciphertext)
+	_, err = out.Write(append(stateFileMagic, header...))
 	if err != nil {
 		return err
 	}
@@ -153,36 +270,128 @@ func encryptStateFile(stateFile string, state []byte, key *[32]byte) error {
 	return dir.Close()
 }
 
+// rekeyStateFile is like encryptStateFile, for a key other than that of
+// the existing statefile, the backup of which is removed lest it remain
+// decryptable with the previous key.
+func rekeyStateFile(stateFile string, state []byte, key *[32]byte, kdf *KDFParams) error {
+	if err := encryptStateFile(stateFile, state, key, kdf); err != nil {
+		return err
+	}
+	if err := os.Remove(fmt.Sprintf("%s~", stateFile)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	dir, err := os.Open(filepath.Dir(stateFile))
+	if err != nil {
+		return err
+	}
+	if err := dir.Sync(); err != nil {
+		dir.Close()
+		return err
+	}
+	return dir.Close()
+}
+
 // LoadStateWriter decrypts the given stateFile and returns the State
-// as well as a new StateWriter.
+// as well as a new StateWriter. Legacy statefiles are rewritten with
+// a header and a newly derived key.
 func LoadStateWriter(log *logging.Logger, stateFile string, passphrase []byte) (*StateWriter, *State, error) {
 	worker := &StateWriter{
 		log:       log,
 		stateCh:   make(chan *memguard.LockedBuffer),
 		stateFile: stateFile,
 	}
-	key := stretchKey(passphrase)
-	state, err := decryptStateFile(stateFile, key)
+	state, key, kdf, err := readStateFile(stateFile, passphrase)
 	if err != nil {
 		return nil, nil, err
 	}
+	if kdf == nil {
+		log.Notice("Migrating legacy statefile to a salted key")
+		if kdf, err = DefaultKDFParams(); err != nil {
+			return nil, nil, err
+		}
+		key = kdf.deriveKey(passphrase)
+		serialized, err := marshalState(state)
+		if err != nil {
+			return nil, nil, err
+		}
+		if err = rekeyStateFile(stateFile, serialized, key, kdf); err != nil {
+			return nil, nil, err
+		}
+	}
 	worker.key = key
+	worker.kdf = kdf
 	return worker, state, nil
 }
 
 // NewStateWriter is a constructor for StateWriter which is to be used when creating
 // the statefile for the first time.
 func NewStateWriter(log *logging.Logger, stateFile string, passphrase []byte) (*StateWriter, error) {
-	key := stretchKey(passphrase)
+	kdf, err := DefaultKDFParams()
+	if err != nil {
+		return nil, err
+	}
+	return NewStateWriterWithKDFParams(log, stateFile, passphrase, kdf)
+}
+
+// NewStateWriterWithKDFParams is like NewStateWriter, but derives the
+// statefile key using the given KDF parameters.
+func NewStateWriterWithKDFParams(log *logging.Logger, stateFile string, passphrase []byte, kdf *KDFParams) (*StateWriter, error) {
+	if err := kdf.validate(); err != nil {
+		return nil, err
+	}
 	worker := &StateWriter{
 		log:       log,
 		stateCh:   make(chan *memguard.LockedBuffer),
 		stateFile: stateFile,
-		key:       key,
+		key:       kdf.deriveKey(passphrase),
+		kdf:       kdf,
 	}
 	return worker, nil
 }
 
+// ChangePassphrase re-encrypts the statefile with a key derived from the
+// new passphrase, using the given KDF parameters or, if nil, the default
+// parameters with a new salt. The statefile is replaced atomically.
+func (w *StateWriter) ChangePassphrase(oldPassphrase, newPassphrase []byte, kdf *KDFParams) error {
+	var err error
+	if kdf == nil {
+		if kdf, err = DefaultKDFParams(); err != nil {
+			return err
+		}
+	}
+	if err = kdf.validate(); err != nil {
+		return err
+	}
+
+	w.Lock()
+	defer w.Unlock()
+	if subtle.ConstantTimeCompare(w.kdf.deriveKey(oldPassphrase)[:], w.key[:]) != 1 {
+		return ErrWrongPassphrase
+	}
+	rawFile, err := os.ReadFile(w.stateFile)
+	if err != nil {
+		return err
+	}
+	header := new(stateFileHeader)
+	if !bytes.HasPrefix(rawFile, stateFileMagic) {
+		return ErrStateFileVersion
+	}
+	if err = cbor.Unmarshal(rawFile[len(stateFileMagic):], header); err != nil {
+		return err
+	}
+	plaintext, err := decryptState(header.Ciphertext, w.key)
+	if err != nil {
+		return err
+	}
+	key := kdf.deriveKey(newPassphrase)
+	if err = rekeyStateFile(w.stateFile, plaintext, key, kdf); err != nil {
+		return err
+	}
+	w.key = key
+	w.kdf = kdf
+	return nil
+}
+
 // Start starts the StateWriter's worker goroutine.
 func (w *StateWriter) Start() {
 	w.log.Debug("StateWriter starting worker")
@@ -190,7 +399,9 @@ func (w *StateWriter) Start() {
 }
 
 func (w *StateWriter) writeState(payload []byte) error {
-	return encryptStateFile(w.stateFile, payload, w.key)
+	w.Lock()
+	defer w.Unlock()
+	return encryptStateFile(w.stateFile, payload, w.key, w.kdf)
 }
 
 func (w *StateWriter) worker() {
@@ -0,0 +1,113 @@
+// disk_test.go - Statefile tests.
+// Copyright (C) 2022  David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package catshadow
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/katzenpost/katzenpost/core/log"
+)
+
+// requireNoFileDecrypts asserts that the passphrase decrypts no file in the
+// directory of the statefile but, if allowStateFile, the statefile.
+func requireNoFileDecrypts(t *testing.T, stateFile string, passphrase []byte, allowStateFile bool) {
+	entries, err := os.ReadDir(filepath.Dir(stateFile))
+	require.NoError(t, err)
+	for _, e := range entries {
+		f := filepath.Join(filepath.Dir(stateFile), e.Name())
+		if allowStateFile && f == stateFile {
+			continue
+		}
+		_, _, _, err := readStateFile(f, passphrase)
+		require.Error(t, err, f)
+	}
+}
+
+func TestLegacyStateFileMigration(t *testing.T) {
+	require := require.New(t)
+	stateFile := filepath.Join(t.TempDir(), "catshadow_statefile")
+	logBackend, err := log.New("", "ERROR", true)
+	require.NoError(err)
+
+	// write a statefile without a header, keyed without a salt
+	serialized, err := marshalState(newTestState(t))
+	require.NoError(err)
+	ciphertext, err := encryptState(serialized, stretchKey([]byte("passphrase")))
+	require.NoError(err)
+	require.NoError(os.WriteFile(stateFile, ciphertext, 0600))
+
+	_, _, err = LoadStateWriter(logBackend.GetLogger("state"), stateFile, []byte("wrong"))
+	require.Error(err)
+
+	w, state, err := LoadStateWriter(logBackend.GetLogger("state"), stateFile, []byte("passphrase"))
+	require.NoError(err)
+	require.Equal("alice", state.Contacts[0].Nickname)
+	require.NotNil(w.kdf)
+
+	// the statefile was rewritten with a header
+	rawFile, err := os.ReadFile(stateFile)
+	require.NoError(err)
+	require.True(bytes.HasPrefix(rawFile, stateFileMagic))
+	state, _, kdf, err := readStateFile(stateFile, []byte("passphrase"))
+	require.NoError(err)
+	require.Equal(w.kdf, kdf)
+	require.Equal("alice", state.Contacts[0].Nickname)
+
+	// the unsalted statefile is not left behind
+	requireNoFileDecrypts(t, stateFile, []byte("passphrase"), true)
+}
+
+func TestChangePassphrase(t *testing.T) {
+	require := require.New(t)
+	stateFile := filepath.Join(t.TempDir(), "catshadow_statefile")
+	logBackend, err := log.New("", "ERROR", true)
+	require.NoError(err)
+
+	kdf := &KDFParams{Salt: make([]byte, saltSize), Time: 1, Memory: 1024, Threads: 1}
+	w, err := NewStateWriterWithKDFParams(logBackend.GetLogger("state"), stateFile, []byte("old"), kdf)
+	require.NoError(err)
+	serialized, err := marshalState(newTestState(t))
+	require.NoError(err)
+	require.NoError(w.writeState(serialized))
+
+	_, err = NewStateWriterWithKDFParams(logBackend.GetLogger("state"), stateFile, []byte("old"), &KDFParams{})
+	require.Equal(ErrInvalidKDFParams, err)
+	_, err = NewStateWriterWithKDFParams(logBackend.GetLogger("state"), stateFile, []byte("old"), &KDFParams{Salt: make([]byte, saltSize), Time: 1, Memory: maxKDFMemory + 1, Threads: 1})
+	require.Equal(ErrInvalidKDFParams, err)
+
+	require.Equal(ErrWrongPassphrase, w.ChangePassphrase([]byte("wrong"), []byte("new"), nil))
+	require.NoError(w.writeState(serialized))
+	require.NoError(w.ChangePassphrase([]byte("old"), []byte("new"), nil))
+	require.NotEqual(kdf, w.kdf)
+	requireNoFileDecrypts(t, stateFile, []byte("old"), false)
+
+	_, _, err = LoadStateWriter(logBackend.GetLogger("state"), stateFile, []byte("old"))
+	require.Error(err)
+	_, state, err := LoadStateWriter(logBackend.GetLogger("state"), stateFile, []byte("new"))
+	require.NoError(err)
+	require.Equal("alice", state.Contacts[0].Nickname)
+
+	// subsequent writes use the new key
+	require.NoError(w.writeState(serialized))
+	_, _, _, err = readStateFile(stateFile, []byte("new"))
+	require.NoError(err)
+}
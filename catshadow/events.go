@@ -41,6 +41,9 @@ type MessageNotSentEvent struct {
 	// MessageID is the key in the conversation map referencing a specific message.
 	MessageID MessageID
 
+	// GroupID is the Group of a group message, or nil.
+	GroupID *GroupID
+
 	// Err is an error with reason for failure
 	Err error
 }
@@ -53,6 +56,9 @@ type MessageSentEvent struct {
 
 	// MessageID is the key in the conversation map referencing a specific message.
 	MessageID MessageID
+
+	// GroupID is the Group of a group message, or nil.
+	GroupID *GroupID
 }
 
 // MessageDeliveredEvent is an event signaling that the message
@@ -63,6 +69,9 @@ type MessageDeliveredEvent struct {
 
 	// MessageID is the key in the conversation map referencing a specific message.
 	MessageID MessageID
+
+	// GroupID is the Group of a group message, or nil.
+	GroupID *GroupID
 }
 
 // MessageNotDeliveredEvent is an event signaling that the message
@@ -74,6 +83,9 @@ type MessageNotDeliveredEvent struct {
 	// MessageID is the key in the conversation map referencing a specific message.
 	MessageID MessageID
 
+	// GroupID is the Group of a group message, or nil.
+	GroupID *GroupID
+
 	// Err is an error with reason for failure
 	Err error
 }
@@ -86,4 +98,82 @@ type MessageReceivedEvent struct {
 	Message []byte
 	// Timestamp is the time the message was received.
 	Timestamp time.Time
+	// GroupID is the Group of a group message, or nil.
+	GroupID *GroupID
+}
+
+// MessageSendProgressEvent reports the delivery of a fragment of a
+// message which was too large to be sent in a single spool append.
+type MessageSendProgressEvent struct {
+	// Nickname is the nickname of the recipient of our message.
+	Nickname string
+
+	// MessageID is the key in the conversation map referencing a specific message.
+	MessageID MessageID
+
+	// GroupID is the Group of a group message, or nil.
+	GroupID *GroupID
+
+	// Delivered is the number of fragments which have been delivered.
+	Delivered int
+
+	// Total is the total number of fragments of the message.
+	Total int
+}
+
+// MessageReceiveProgressEvent reports the receipt of a fragment of a
+// message, which will be followed by a MessageReceivedEvent once all
+// of the fragments have been received.
+type MessageReceiveProgressEvent struct {
+	// Nickname is the nickname from whom we are receiving a message.
+	Nickname string
+
+	// MessageID is the sender's identifier of the message, which is
+	// shared by the progress events of the same message.
+	MessageID MessageID
+
+	// Received is the number of fragments which have been received.
+	Received int
+
+	// Total is the total number of fragments of the message.
+	Total int
+}
+
+// GroupUpdatedEvent is emitted when a Group is created or its members
+// are changed by its owner.
+type GroupUpdatedEvent struct {
+	// GroupID is the Group which was updated.
+	GroupID GroupID
+
+	// Name is the name of the group.
+	Name string
+
+	// Owner is the nickname of the group owner.
+	Owner string
+
+	// Members are the nicknames of the members who are our contacts.
+	Members []string
+
+	// IsMember is false if we were removed from the group.
+	IsMember bool
+}
+
+// MessageReadEvent is emitted when a read receipt is received for a
+// message, which indicates that the contact's client has fetched it.
+type MessageReadEvent struct {
+	// Nickname is the nickname of the recipient of our message.
+	Nickname string
+
+	// MessageID is the key in the conversation map referencing a specific message.
+	MessageID MessageID
+}
+
+// DeviceContactsSyncedEvent is emitted when a linked device sends us its
+// contacts, to which it introduces us.
+type DeviceContactsSyncedEvent struct {
+	// Device is the nickname of the linked device.
+	Device string
+
+	// Contacts are the contacts to which the device introduced us.
+	Contacts []LinkedContact
 }
@@ -0,0 +1,211 @@
+// fragment.go - Message fragmentation and reassembly.
+// Copyright (C) 2022  David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package catshadow
+
+import (
+	"errors"
+	"math"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+
+	"github.com/katzenpost/katzenpost/core/sphinx"
+)
+
+var (
+	ErrMessageTooLarge  = errors.New("Message exceeds the maximum message size")
+	ErrInvalidFragment  = errors.New("Invalid message fragment")
+	ErrFragmentMismatch = errors.New("Message fragment does not match partial message")
+)
+
+// messageFragmentOverhead is the upper bound on the number of bytes
+// that a serialized Message adds to its Plaintext, which is used to
+// bound the size of reassembled messages.
+const messageFragmentOverhead = 256
+
+// messageFragment is one of the numbered fragments of a serialized
+// Message that is too large to be sent in a single spool append.
+// Each fragment is encrypted and appended to the spool separately.
+type messageFragment struct {
+	// ID is the sender's MessageID shared by all fragments of a message.
+	ID MessageID
+	// Index is the position of this fragment, starting from 0.
+	Index uint32
+	// Count is the total number of fragments of the message.
+	Count uint32
+	// Data is this fragment's portion of the serialized Message.
+	Data []byte
+}
+
+// PartialMessage is a fragmented message which is being reassembled.
+type PartialMessage struct {
+	// Fragments are the fragment payloads indexed by fragment number,
+	// nil entries have not yet been received.
+	Fragments [][]byte
+	// Received is the number of fragments received.
+	Received int
+	// LastReceived is the time at which the most recent fragment was
+	// received, and is used to expire abandoned partial messages.
+	LastReceived time.Time
+}
+
+// fragmentPayloadLength returns the maximum length of the Data of a
+// messageFragment which fits within a single ratchet encrypted spool
+// append of the given geometry.
+func fragmentPayloadLength(geo *sphinx.Geometry) int {
+	f := &messageFragment{Index: math.MaxUint32, Count: math.MaxUint32}
+	b, err := cbor.Marshal(f)
+	if err != nil {
+		panic(err)
+	}
+	// Data is encoded as nil, reserve space for a byte string header.
+	return DoubleRatchetPayloadLength(geo) - len(b) - 4
+}
+
+// maxFragmentCount returns the maximum number of fragments of a message
+// no larger than MaxMessageSize for the given geometry.
+func maxFragmentCount(geo *sphinx.Geometry) int {
+	n := fragmentPayloadLength(geo)
+	return (MaxMessageSize + messageFragmentOverhead + n - 1) / n
+}
+
+// fragmentMessage splits a serialized Message into serialized fragments
+// that each fit within a single spool append of the given geometry.
+func fragmentMessage(id MessageID, serialized []byte, geo *sphinx.Geometry) ([][]byte, error) {
+	n := fragmentPayloadLength(geo)
+	count := (len(serialized) + n - 1) / n
+	if count > maxFragmentCount(geo) {
+		return nil, ErrMessageTooLarge
+	}
+	fragments := make([][]byte, 0, count)
+	for i := 0; i < count; i++ {
+		end := (i + 1) * n
+		if end > len(serialized) {
+			end = len(serialized)
+		}
+		f := &messageFragment{
+			ID:    id,
+			Index: uint32(i),
+			Count: uint32(count),
+			Data:  serialized[i*n : end],
+		}
+		b, err := cbor.Marshal(f)
+		if err != nil {
+			return nil, err
+		}
+		fragments = append(fragments, b)
+	}
+	return fragments, nil
+}
+
+// parseMessageFragment returns the messageFragment contained in the given
+// plaintext, or nil if the plaintext is not a fragment.
+func parseMessageFragment(plaintext []byte) *messageFragment {
+	f := new(messageFragment)
+	if err := cbor.Unmarshal(plaintext, f); err != nil || f.Count == 0 {
+		return nil
+	}
+	return f
+}
+
+// newPartialMessage creates a PartialMessage for the given fragment.
+func newPartialMessage(f *messageFragment, geo *sphinx.Geometry) (*PartialMessage, error) {
+	if f.Count < 2 || int(f.Count) > maxFragmentCount(geo) {
+		return nil, ErrInvalidFragment
+	}
+	return &PartialMessage{Fragments: make([][]byte, f.Count)}, nil
+}
+
+// add adds the fragment to the PartialMessage, and returns the reassembled
+// serialized Message once all of the fragments have been received.
+func (p *PartialMessage) add(f *messageFragment, geo *sphinx.Geometry) ([]byte, error) {
+	if int(f.Count) != len(p.Fragments) {
+		return nil, ErrFragmentMismatch
+	}
+	if f.Index >= f.Count || len(f.Data) == 0 || len(f.Data) > fragmentPayloadLength(geo) {
+		return nil, ErrInvalidFragment
+	}
+	p.LastReceived = time.Now()
+	if p.Fragments[f.Index] != nil {
+		// duplicate fragment
+		return nil, nil
+	}
+	p.Fragments[f.Index] = f.Data
+	p.Received++
+	if p.Received < len(p.Fragments) {
+		return nil, nil
+	}
+	serialized := []byte{}
+	for _, data := range p.Fragments {
+		serialized = append(serialized, data...)
+	}
+	return serialized, nil
+}
+
+// addFragment adds a fragment received from the contact to the matching
+// partial message, and returns the reassembled serialized Message once
+// all of its fragments have been received. It must be called with the
+// conversationsMutex held.
+func (c *Client) addFragment(contact *Contact, f *messageFragment) ([]byte, *PartialMessage, error) {
+	geo := c.sphinxGeometry()
+	if geo == nil {
+		return nil, nil, errors.New("no Sphinx geometry")
+	}
+	partials, ok := c.partialMessages[contact.id]
+	if !ok {
+		partials = make(map[MessageID]*PartialMessage)
+		c.partialMessages[contact.id] = partials
+	}
+	p, ok := partials[f.ID]
+	if !ok {
+		var err error
+		if p, err = newPartialMessage(f, geo); err != nil {
+			return nil, nil, err
+		}
+		partials[f.ID] = p
+	}
+	serialized, err := p.add(f, geo)
+	if err != nil {
+		delete(partials, f.ID)
+		return nil, nil, err
+	}
+	if serialized != nil {
+		delete(partials, f.ID)
+	}
+	return serialized, p, nil
+}
+
+// garbageCollectPartialMessages removes partial messages which have not
+// received a fragment within PartialMessageExpirationDuration, and those
+// of removed contacts. It must be called with the conversationsMutex held.
+func (c *Client) garbageCollectPartialMessages() {
+	for id, partials := range c.partialMessages {
+		if _, ok := c.contacts[id]; !ok {
+			delete(c.partialMessages, id)
+			continue
+		}
+		for mesgID, p := range partials {
+			if time.Now().After(p.LastReceived.Add(PartialMessageExpirationDuration)) {
+				c.log.Debugf("Expiring partial message %x with %d of %d fragments", mesgID, p.Received, len(p.Fragments))
+				delete(partials, mesgID)
+			}
+		}
+		if len(partials) == 0 {
+			delete(c.partialMessages, id)
+		}
+	}
+}
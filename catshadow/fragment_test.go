@@ -0,0 +1,90 @@
+// fragment_test.go - Message fragmentation tests.
+// Copyright (C) 2022  David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package catshadow
+
+import (
+	"testing"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/stretchr/testify/require"
+
+	"github.com/katzenpost/katzenpost/core/crypto/rand"
+	"github.com/katzenpost/katzenpost/core/sphinx"
+)
+
+func TestFragmentReassembly(t *testing.T) {
+	require := require.New(t)
+	geo := sphinx.DefaultGeometry()
+
+	plaintext := make([]byte, 3*DoubleRatchetPayloadLength(geo)+123)
+	_, err := rand.Reader.Read(plaintext)
+	require.NoError(err)
+	serialized, err := cbor.Marshal(&Message{Plaintext: plaintext, Timestamp: time.Now(), Outbound: true})
+	require.NoError(err)
+
+	id := MessageID{1, 2, 3, 4}
+	fragments, err := fragmentMessage(id, serialized, geo)
+	require.NoError(err)
+	require.True(len(fragments) > 3)
+	for _, b := range fragments {
+		require.True(len(b) <= DoubleRatchetPayloadLength(geo))
+	}
+
+	// a Message is not a fragment
+	require.Nil(parseMessageFragment(serialized))
+
+	// fragments may arrive in any order and may be duplicated
+	var partial *PartialMessage
+	var reassembled []byte
+	for i := len(fragments) - 1; i >= 0; i-- {
+		f := parseMessageFragment(fragments[i])
+		require.NotNil(f)
+		require.Equal(id, f.ID)
+		if partial == nil {
+			partial, err = newPartialMessage(f, geo)
+			require.NoError(err)
+		}
+		reassembled, err = partial.add(f, geo)
+		require.NoError(err)
+		if i > 0 {
+			require.Nil(reassembled)
+			dup, err := partial.add(f, geo)
+			require.NoError(err)
+			require.Nil(dup)
+		}
+	}
+	require.Equal(serialized, reassembled)
+
+	m := new(Message)
+	err = cbor.Unmarshal(reassembled, m)
+	require.NoError(err)
+	require.Equal(plaintext, m.Plaintext)
+
+	// fragments of a different message are rejected
+	f := parseMessageFragment(fragments[0])
+	f.Count++
+	_, err = partial.add(f, geo)
+	require.Error(err)
+
+	// messages larger than MaxMessageSize cannot be fragmented
+	_, err = fragmentMessage(id, make([]byte, MaxMessageSize+messageFragmentOverhead+fragmentPayloadLength(geo)), geo)
+	require.Error(err)
+	f.Count = uint32(maxFragmentCount(geo) + 1)
+	_, err = newPartialMessage(f, geo)
+	require.Error(err)
+}
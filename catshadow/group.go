@@ -0,0 +1,579 @@
+// group.go - Group conversations.
+// Copyright (C) 2022  David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package catshadow
+
+import (
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+
+	"github.com/katzenpost/katzenpost/core/crypto/rand"
+	"github.com/katzenpost/katzenpost/memspool/common"
+)
+
+// GroupIDLen is the length of a GroupID.
+const GroupIDLen = 16
+
+var (
+	ErrGroupNotFound       = errors.New("Group not found")
+	ErrNotGroupOwner       = errors.New("Only the group owner may change the group members")
+	ErrNotGroupMember      = errors.New("Not a member of the group")
+	ErrAlreadyGroupMember  = errors.New("Contact is already a member of the group")
+	ErrInvalidGroupMessage = errors.New("Invalid group message")
+)
+
+// GroupID uniquely identifies a Group across all of its members.
+type GroupID [GroupIDLen]byte
+
+// GroupMember identifies a member of a Group by the remote spool to which
+// their messages are written, which is the same for all of the members.
+type GroupMember struct {
+	Provider string
+	SpoolID  [common.SpoolIDSize]byte
+}
+
+// Group is a group conversation. Group messages are sent to each of
+// the members over the pairwise ratchet and spool of their Contact.
+type Group struct {
+	// ID is the GroupID shared by all members.
+	ID GroupID
+
+	// Name is the name of the group.
+	Name string
+
+	// Owner is the member who created the group, and who alone may
+	// change the group's members.
+	Owner GroupMember
+
+	// Version is incremented by the Owner upon each change of the
+	// group's members, and stale updates are ignored.
+	Version uint64
+
+	// Members are the members of the group, including ourself.
+	Members []GroupMember
+
+	// Conversation is the group's conversation history.
+	Conversation map[MessageID]*Message
+
+	LastMessage *Message
+}
+
+// hasMember returns true if m is a member of the Group.
+func (g *Group) hasMember(m GroupMember) bool {
+	for _, member := range g.Members {
+		if member == m {
+			return true
+		}
+	}
+	return false
+}
+
+// groupUpdate is the group metadata sent by the Owner to the members
+// whenever the group's members change.
+type groupUpdate struct {
+	Name    string
+	Owner   GroupMember
+	Version uint64
+	Members []GroupMember
+}
+
+// groupMessage is sent to each member of a Group, and contains either a
+// groupUpdate or a Message.
+type groupMessage struct {
+	GroupID GroupID
+	Update  *groupUpdate
+	Message *Message
+}
+
+// parseGroupMessage returns the groupMessage contained in the given
+// plaintext, or nil if the plaintext is not a group message.
+func parseGroupMessage(plaintext []byte) *groupMessage {
+	m := new(groupMessage)
+	if err := cbor.Unmarshal(plaintext, m); err != nil || m.GroupID == (GroupID{}) {
+		return nil
+	}
+	return m
+}
+
+// contactGroupMember returns the GroupMember of the contact.
+func contactGroupMember(contact *Contact) GroupMember {
+	return GroupMember{
+		Provider: contact.spoolWriteDescriptor.Provider,
+		SpoolID:  contact.spoolWriteDescriptor.ID,
+	}
+}
+
+// selfGroupMember returns our own GroupMember.
+func (c *Client) selfGroupMember() (GroupMember, error) {
+	if c.spoolReadDescriptor == nil {
+		return GroupMember{}, ErrNoSpool
+	}
+	return GroupMember{
+		Provider: c.spoolReadDescriptor.Provider,
+		SpoolID:  c.spoolReadDescriptor.ID,
+	}, nil
+}
+
+// groupMemberContact returns the Contact of a GroupMember, or nil
+// if we cannot send messages to them.
+func (c *Client) groupMemberContact(m GroupMember) *Contact {
+	for _, contact := range c.contacts {
+		if contact.IsPending || contact.IsDevice || contact.deviceOf != 0 || contact.spoolWriteDescriptor == nil {
+			continue
+		}
+		if contactGroupMember(contact) == m {
+			return contact
+		}
+	}
+	return nil
+}
+
+// sendableContact returns the Contact with the given nickname if
+// messages may be sent to them.
+func (c *Client) sendableContact(nickname string) (*Contact, error) {
+	contact, ok := c.contactNicknames[nickname]
+	if !ok {
+		return nil, ErrContactNotFound
+	}
+	if contact.IsPending {
+		return nil, ErrPendingKeyExchange
+	}
+	if contact.IsDevice {
+		return nil, ErrIsDevice
+	}
+	return contact, nil
+}
+
+// memberNicknames returns the nicknames of the members of the Group
+// who are our contacts.
+func (c *Client) memberNicknames(g *Group) []string {
+	nicknames := []string{}
+	for _, m := range g.Members {
+		if contact := c.groupMemberContact(m); contact != nil {
+			nicknames = append(nicknames, contact.Nickname)
+		}
+	}
+	return nicknames
+}
+
+// CreateGroup creates a new Group with ourself as its owner and the
+// contacts with the given nicknames as its members, and returns its
+// GroupID.
+func (c *Client) CreateGroup(name string, nicknames []string) (GroupID, error) {
+	createGroupOp := &opCreateGroup{
+		name:         name,
+		nicknames:    nicknames,
+		responseChan: make(chan interface{}, 1),
+	}
+	select {
+	case <-c.HaltCh():
+		return GroupID{}, ErrHalted
+	case c.opCh <- createGroupOp:
+	}
+	select {
+	case <-c.HaltCh():
+	case r := <-createGroupOp.responseChan:
+		switch r := r.(type) {
+		case error:
+			return GroupID{}, r
+		case GroupID:
+			return r, nil
+		}
+	}
+	return GroupID{}, ErrHalted
+}
+
+func (c *Client) doCreateGroup(name string, nicknames []string) (GroupID, error) {
+	self, err := c.selfGroupMember()
+	if err != nil {
+		return GroupID{}, err
+	}
+	g := &Group{
+		Name:         name,
+		Owner:        self,
+		Version:      1,
+		Members:      []GroupMember{self},
+		Conversation: make(map[MessageID]*Message),
+	}
+	if _, err := rand.Reader.Read(g.ID[:]); err != nil {
+		return GroupID{}, err
+	}
+	for _, nickname := range nicknames {
+		contact, err := c.sendableContact(nickname)
+		if err != nil {
+			return GroupID{}, err
+		}
+		if m := contactGroupMember(contact); !g.hasMember(m) {
+			g.Members = append(g.Members, m)
+		}
+	}
+
+	c.conversationsMutex.Lock()
+	c.groups[g.ID] = g
+	c.conversationsMutex.Unlock()
+	c.sendGroupUpdate(g, nil)
+	c.save()
+	return g.ID, nil
+}
+
+// AddMember adds the contact with the given nickname to the Group, which
+// must be owned by us.
+func (c *Client) AddMember(groupID GroupID, nickname string) error {
+	return c.changeMembers(groupID, nickname, true)
+}
+
+// RemoveMember removes the contact with the given nickname from the
+// Group, which must be owned by us.
+func (c *Client) RemoveMember(groupID GroupID, nickname string) error {
+	return c.changeMembers(groupID, nickname, false)
+}
+
+func (c *Client) changeMembers(groupID GroupID, nickname string, add bool) error {
+	changeMembersOp := &opChangeGroupMembers{
+		id:           groupID,
+		name:         nickname,
+		add:          add,
+		responseChan: make(chan error, 1),
+	}
+	select {
+	case <-c.HaltCh():
+		return ErrHalted
+	case c.opCh <- changeMembersOp:
+	}
+	select {
+	case <-c.HaltCh():
+	case err := <-changeMembersOp.responseChan:
+		return err
+	}
+	return ErrHalted
+}
+
+func (c *Client) doChangeGroupMembers(groupID GroupID, nickname string, add bool) error {
+	c.conversationsMutex.Lock()
+	g, ok := c.groups[groupID]
+	c.conversationsMutex.Unlock()
+	if !ok {
+		return ErrGroupNotFound
+	}
+	self, err := c.selfGroupMember()
+	if err != nil {
+		return err
+	}
+	if g.Owner != self {
+		return ErrNotGroupOwner
+	}
+	contact, err := c.sendableContact(nickname)
+	if err != nil {
+		return err
+	}
+	m := contactGroupMember(contact)
+
+	c.conversationsMutex.Lock()
+	var removed []GroupMember
+	switch {
+	case add && g.hasMember(m):
+		c.conversationsMutex.Unlock()
+		return ErrAlreadyGroupMember
+	case add:
+		g.Members = append(g.Members, m)
+	case !g.hasMember(m):
+		c.conversationsMutex.Unlock()
+		return ErrNotGroupMember
+	default:
+		members := make([]GroupMember, 0, len(g.Members)-1)
+		for _, member := range g.Members {
+			if member != m {
+				members = append(members, member)
+			}
+		}
+		g.Members = members
+		// the removed member must learn of their removal
+		removed = []GroupMember{m}
+	}
+	g.Version++
+	c.conversationsMutex.Unlock()
+
+	c.sendGroupUpdate(g, removed)
+	c.save()
+	return nil
+}
+
+// sendGroupUpdate sends the Group's metadata to each of its members, and to
+// the removed members.
+func (c *Client) sendGroupUpdate(g *Group, removed []GroupMember) {
+	update := &groupMessage{
+		GroupID: g.ID,
+		Update: &groupUpdate{
+			Name:    g.Name,
+			Owner:   g.Owner,
+			Version: g.Version,
+			Members: g.Members,
+		},
+	}
+	serialized, err := cbor.Marshal(update)
+	if err != nil {
+		c.log.Errorf("failed to serialize group update: %s", err)
+		return
+	}
+	convoMesgID := MessageID{}
+	if _, err := rand.Reader.Read(convoMesgID[:]); err != nil {
+		c.fatalErrCh <- err
+		return
+	}
+	recipients := make([]GroupMember, 0, len(g.Members)+len(removed))
+	recipients = append(recipients, g.Members...)
+	recipients = append(recipients, removed...)
+	self, _ := c.selfGroupMember()
+	for _, m := range recipients {
+		if m == self {
+			continue
+		}
+		contact := c.groupMemberContact(m)
+		if contact == nil {
+			c.log.Warningf("Cannot send group update to member of group %x who is not a contact", g.ID)
+			continue
+		}
+		if err := c.enqueueMessage(contact, convoMesgID, &g.ID, true, serialized); err != nil {
+			c.log.Errorf("failed to send group update to %s: %s", contact.Nickname, err)
+		}
+	}
+}
+
+// SendGroupMessage sends a message to each of the members of the Group
+// with the given GroupID.
+func (c *Client) SendGroupMessage(groupID GroupID, message []byte) MessageID {
+	if len(message) > MaxMessageSize {
+		return MessageID{}
+	}
+	convoMesgID := MessageID{}
+	_, err := rand.Reader.Read(convoMesgID[:])
+	if err != nil {
+		c.fatalErrCh <- err
+	}
+
+	select {
+	case <-c.HaltCh():
+	case c.opCh <- &opSendGroupMessage{
+		id:      convoMesgID,
+		groupID: groupID,
+		payload: message,
+	}:
+	}
+	return convoMesgID
+}
+
+func (c *Client) doSendGroupMessage(convoMesgID MessageID, groupID GroupID, message []byte) {
+	c.conversationsMutex.Lock()
+	g, ok := c.groups[groupID]
+	c.conversationsMutex.Unlock()
+	if !ok {
+		c.eventCh.In() <- &MessageNotSentEvent{
+			MessageID: convoMesgID,
+			GroupID:   &groupID,
+			Err:       ErrGroupNotFound,
+		}
+		return
+	}
+	self, err := c.selfGroupMember()
+	if err == nil && !g.hasMember(self) {
+		err = ErrNotGroupMember
+	}
+	if err != nil {
+		c.eventCh.In() <- &MessageNotSentEvent{
+			MessageID: convoMesgID,
+			GroupID:   &groupID,
+			Err:       err,
+		}
+		return
+	}
+
+	outMessage := Message{
+		Plaintext: message,
+		Timestamp: time.Now(),
+		Outbound:  true,
+	}
+	serialized, err := cbor.Marshal(&groupMessage{GroupID: groupID, Message: &outMessage})
+	if err != nil {
+		c.eventCh.In() <- &MessageNotSentEvent{
+			MessageID: convoMesgID,
+			GroupID:   &groupID,
+			Err:       err,
+		}
+		return
+	}
+	for _, m := range g.Members {
+		if m == self {
+			continue
+		}
+		contact := c.groupMemberContact(m)
+		if contact == nil {
+			c.log.Warningf("Cannot send message to member of group %x who is not a contact", groupID)
+			continue
+		}
+		if err := c.enqueueMessage(contact, convoMesgID, &groupID, false, serialized); err != nil {
+			c.eventCh.In() <- &MessageNotSentEvent{
+				Nickname:  contact.Nickname,
+				MessageID: convoMesgID,
+				GroupID:   &groupID,
+				Err:       err,
+			}
+		}
+	}
+
+	// update the group conversation history
+	c.conversationsMutex.Lock()
+	g.Conversation[convoMesgID] = &outMessage
+	g.LastMessage = &outMessage
+	c.conversationsMutex.Unlock()
+	c.save()
+}
+
+// handleGroupMessage handles a group message received from the contact.
+func (c *Client) handleGroupMessage(contact *Contact, m *groupMessage) error {
+	sender := contactGroupMember(contact)
+	switch {
+	case m.Update != nil:
+		return c.handleGroupUpdate(contact, m.GroupID, m.Update)
+	case m.Message != nil:
+		c.conversationsMutex.Lock()
+		g, ok := c.groups[m.GroupID]
+		if !ok || !g.hasMember(sender) {
+			c.conversationsMutex.Unlock()
+			c.log.Warningf("Dropping message for group %x from non-member %s", m.GroupID, contact.Nickname)
+			return ErrNotGroupMember
+		}
+		convoMesgID := MessageID{}
+		if _, err := rand.Reader.Read(convoMesgID[:]); err != nil {
+			c.conversationsMutex.Unlock()
+			c.fatalErrCh <- err
+			return err
+		}
+		message := m.Message
+		message.Outbound = false
+		message.Sent = false
+		message.Delivered = false
+		message.Sender = contact.Nickname
+		g.Conversation[convoMesgID] = message
+		g.LastMessage = message
+		c.conversationsMutex.Unlock()
+		c.save()
+
+		c.eventCh.In() <- &MessageReceivedEvent{
+			Nickname:  contact.Nickname,
+			Message:   message.Plaintext,
+			Timestamp: message.Timestamp,
+			GroupID:   &m.GroupID,
+		}
+		return nil
+	}
+	return ErrInvalidGroupMessage
+}
+
+// handleGroupUpdate applies group metadata received from the contact, which
+// must be the Owner of the group. Updates which are not newer than the
+// current Version are ignored.
+func (c *Client) handleGroupUpdate(contact *Contact, groupID GroupID, u *groupUpdate) error {
+	if u.Owner != contactGroupMember(contact) {
+		c.log.Warningf("Dropping update for group %x from non-owner %s", groupID, contact.Nickname)
+		return ErrNotGroupOwner
+	}
+	self, err := c.selfGroupMember()
+	if err != nil {
+		return err
+	}
+
+	c.conversationsMutex.Lock()
+	g, ok := c.groups[groupID]
+	switch {
+	case ok && g.Owner != u.Owner:
+		c.conversationsMutex.Unlock()
+		return ErrNotGroupOwner
+	case ok && u.Version <= g.Version:
+		c.conversationsMutex.Unlock()
+		c.log.Debugf("Ignoring stale update for group %x", groupID)
+		return nil
+	case !ok:
+		isMember := false
+		for _, m := range u.Members {
+			if m == self {
+				isMember = true
+			}
+		}
+		if !isMember {
+			c.conversationsMutex.Unlock()
+			return ErrNotGroupMember
+		}
+		g = &Group{
+			ID:           groupID,
+			Owner:        u.Owner,
+			Conversation: make(map[MessageID]*Message),
+		}
+		c.groups[groupID] = g
+	}
+	g.Name = u.Name
+	g.Version = u.Version
+	g.Members = u.Members
+	members := c.memberNicknames(g)
+	c.conversationsMutex.Unlock()
+	c.save()
+
+	c.eventCh.In() <- &GroupUpdatedEvent{
+		GroupID:  groupID,
+		Name:     u.Name,
+		Owner:    contact.Nickname,
+		Members:  members,
+		IsMember: g.hasMember(self),
+	}
+	return nil
+}
+
+// GetGroups returns the groups map.
+func (c *Client) GetGroups() map[GroupID]*Group {
+	getGroupsOp := &opGetGroups{
+		responseChan: make(chan map[GroupID]*Group, 1),
+	}
+	select {
+	case c.opCh <- getGroupsOp:
+	case <-c.HaltCh():
+		return nil
+	}
+	select {
+	case <-c.HaltCh():
+	case g := <-getGroupsOp.responseChan:
+		return g
+	}
+	return nil
+}
+
+// GetSortedGroupConversation returns the Messages of the Group's
+// conversation, sorted by Timestamp.
+func (c *Client) GetSortedGroupConversation(groupID GroupID) Messages {
+	c.conversationsMutex.Lock()
+	defer c.conversationsMutex.Unlock()
+	g, ok := c.groups[groupID]
+	if !ok {
+		return nil
+	}
+	var msg Messages
+	for _, m := range g.Conversation {
+		msg = append(msg, m)
+	}
+	sort.Sort(msg)
+	return msg
+}
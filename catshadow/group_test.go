@@ -0,0 +1,65 @@
+// group_test.go - Group conversation tests.
+// Copyright (C) 2022  David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package catshadow
+
+import (
+	"testing"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/stretchr/testify/require"
+
+	"github.com/katzenpost/katzenpost/core/sphinx"
+)
+
+func TestGroupMessageEncoding(t *testing.T) {
+	require := require.New(t)
+
+	owner := GroupMember{Provider: "provider1", SpoolID: [12]byte{1}}
+	member := GroupMember{Provider: "provider2", SpoolID: [12]byte{2}}
+	g := &Group{ID: GroupID{1, 2, 3}, Owner: owner, Members: []GroupMember{owner, member}}
+	require.True(g.hasMember(owner))
+	require.True(g.hasMember(member))
+	require.False(g.hasMember(GroupMember{Provider: "provider1", SpoolID: [12]byte{2}}))
+
+	// a Message is not a group message
+	message := &Message{Plaintext: []byte("hello"), Timestamp: time.Now()}
+	serialized, err := cbor.Marshal(message)
+	require.NoError(err)
+	require.Nil(parseGroupMessage(serialized))
+
+	// group updates and messages are not fragments
+	update := &groupMessage{GroupID: g.ID, Update: &groupUpdate{Name: "group", Owner: owner, Version: 2, Members: g.Members}}
+	serialized, err = cbor.Marshal(update)
+	require.NoError(err)
+	require.Nil(parseMessageFragment(serialized))
+	m := parseGroupMessage(serialized)
+	require.NotNil(m)
+	require.Equal(update, m)
+
+	serialized, err = cbor.Marshal(&groupMessage{GroupID: g.ID, Message: message})
+	require.NoError(err)
+	m = parseGroupMessage(serialized)
+	require.NotNil(m)
+	require.Nil(m.Update)
+	require.Equal(message.Plaintext, m.Message.Plaintext)
+
+	// fragments are not group messages
+	fragments, err := fragmentMessage(MessageID{1}, make([]byte, 2*DoubleRatchetPayloadLength(sphinx.DefaultGeometry())), sphinx.DefaultGeometry())
+	require.NoError(err)
+	require.Nil(parseGroupMessage(fragments[0]))
+}
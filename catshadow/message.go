@@ -24,11 +24,20 @@ import (
 
 // SentMessageDescriptor is used to track Spool Write Responses
 type SentMessageDescriptor struct {
+	// contactID is the ID of the Contact to whose spool the message was sent.
+	contactID uint64
+
 	// Nickname is the contact nickname to whom a message was sent.
 	Nickname string
 
 	// MessageID is the key in the conversation map referencing a specific message.
 	MessageID MessageID
+
+	// GroupID is the Group of a group message, or nil.
+	GroupID *GroupID
+
+	// control is set for protocol messages which do not emit message events.
+	control bool
 }
 
 // ReadMessageDescriptor is used to track Spool Read Responses
@@ -37,6 +46,12 @@ type ReadMessageDescriptor struct {
 	MessageID MessageID
 }
 
+// DeleteMessageDescriptor is used to track Spool Delete Responses
+type DeleteMessageDescriptor struct {
+	// SpoolMessageID is the ID of the message deleted from the spool.
+	SpoolMessageID uint32
+}
+
 // Message encapsulates message that is sent or received.
 type Message struct {
 	Plaintext []byte
@@ -44,6 +59,15 @@ type Message struct {
 	Outbound  bool
 	Sent      bool
 	Delivered bool
+
+	// Sender is the nickname of the contact who sent an inbound group message.
+	Sender string
+
+	// ID is the sender's MessageID, which is referenced by read receipts.
+	ID MessageID
+
+	// Read is set on outbound messages for which a read receipt was received.
+	Read bool
 }
 
 type Messages []*Message
@@ -44,6 +44,7 @@ type opUpdateSpool struct {
 type opAddContact struct {
 	name         string
 	sharedSecret []byte
+	isDevice     bool
 }
 
 type opRemoveContact struct {
@@ -103,3 +104,41 @@ type opGetSpoolProviders struct {
 type opSpoolWriteDescriptor struct {
 	responseChan chan *client.SpoolWriteDescriptor
 }
+
+type opCreateGroup struct {
+	name         string
+	nicknames    []string
+	responseChan chan interface{}
+}
+
+type opChangeGroupMembers struct {
+	id           GroupID
+	name         string
+	add          bool
+	responseChan chan error
+}
+
+type opSendGroupMessage struct {
+	id      MessageID
+	groupID GroupID
+	payload []byte
+}
+
+type opGetGroups struct {
+	responseChan chan map[GroupID]*Group
+}
+
+type opGetReadReceipts struct {
+	name         string
+	responseChan chan interface{}
+}
+
+type opChangeReadReceipts struct {
+	name         string
+	enabled      bool
+	responseChan chan error
+}
+
+type opGetLinkedContacts struct {
+	responseChan chan []LinkedContact
+}
@@ -152,6 +152,8 @@ func (c *Client) processPANDAUpdate(update *panda.PandaUpdate) {
 		c.eventCh.In() <- &KeyExchangeCompletedEvent{
 			Nickname: contact.Nickname,
 		}
+		// our linked devices may now be introduced to the new contact
+		c.syncContactsToDevices()
 	}
 	c.save()
 }
@@ -82,6 +82,40 @@ func (q *Queue) Peek() (*queuedSpoolCommand, error) {
 	return result, nil
 }
 
+// Advance replaces the command of the message at the head of the queue
+// with its next remaining fragment and returns it, or returns nil if
+// the message has no remaining fragments.
+func (q *Queue) Advance() (*queuedSpoolCommand, error) {
+	q.Lock()
+	defer q.Unlock()
+	if q.len <= 0 {
+		return nil, ErrQueueEmpty
+	}
+	result := q.content[q.readHead]
+	if len(result.Fragments) == 0 {
+		return nil, nil
+	}
+	result.Command = result.Fragments[0]
+	result.Fragments = result.Fragments[1:]
+	return result, nil
+}
+
+// Seal calls seal with the message at the head of the queue, which was
+// queued without its spool commands, and returns it once seal computed
+// them.
+func (q *Queue) Seal(seal func(*queuedSpoolCommand) error) (*queuedSpoolCommand, error) {
+	q.Lock()
+	defer q.Unlock()
+	if q.len <= 0 {
+		return nil, ErrQueueEmpty
+	}
+	result := q.content[q.readHead]
+	if err := seal(result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
 type serializedQ struct {
 	Content   [MaxQueueSize]*queuedSpoolCommand
 	ReadHead  int
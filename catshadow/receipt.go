@@ -0,0 +1,154 @@
+// receipt.go - End to end read receipts.
+// Copyright (C) 2022  David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package catshadow
+
+import (
+	"errors"
+
+	"github.com/fxamacker/cbor/v2"
+
+	"github.com/katzenpost/katzenpost/core/crypto/rand"
+)
+
+// readReceipt is sent to a contact once their messages have been
+// fetched from our spool, and references the sender's MessageIDs.
+type readReceipt struct {
+	ReadMessageIDs []MessageID
+}
+
+// parseReadReceipt returns the readReceipt contained in the given
+// plaintext, or nil if the plaintext is not a read receipt.
+func parseReadReceipt(plaintext []byte) *readReceipt {
+	r := new(readReceipt)
+	if err := cbor.Unmarshal(plaintext, r); err != nil || len(r.ReadMessageIDs) == 0 {
+		return nil
+	}
+	return r
+}
+
+// sendReadReceipt sends a read receipt for the message with the sender's
+// MessageID to the contact, unless read receipts are disabled for them.
+func (c *Client) sendReadReceipt(contact *Contact, id MessageID) {
+	if contact == nil || contact.disableReadReceipts {
+		return
+	}
+	serialized, err := cbor.Marshal(&readReceipt{ReadMessageIDs: []MessageID{id}})
+	if err != nil {
+		c.log.Errorf("failed to serialize read receipt: %s", err)
+		return
+	}
+	convoMesgID := MessageID{}
+	if _, err := rand.Reader.Read(convoMesgID[:]); err != nil {
+		c.fatalErrCh <- err
+		return
+	}
+	if err := c.enqueueMessage(contact, convoMesgID, nil, true, serialized); err != nil {
+		c.log.Errorf("failed to send read receipt to %s: %s", contact.Nickname, err)
+		return
+	}
+	c.save()
+}
+
+// handleReadReceipt marks the messages referenced by a read receipt from
+// the contact as Read.
+func (c *Client) handleReadReceipt(contact *Contact, r *readReceipt) {
+	read := []MessageID{}
+	c.conversationsMutex.Lock()
+	for _, id := range r.ReadMessageIDs {
+		m := c.conversationMessage(contact.Nickname, nil, id)
+		if m == nil || !m.Outbound || m.Read {
+			continue
+		}
+		m.Read = true
+		read = append(read, id)
+	}
+	c.conversationsMutex.Unlock()
+	c.save()
+
+	for _, id := range read {
+		c.eventCh.In() <- &MessageReadEvent{
+			Nickname:  contact.Nickname,
+			MessageID: id,
+		}
+	}
+}
+
+// GetReadReceipts returns true if read receipts are sent to the contact.
+func (c *Client) GetReadReceipts(name string) (bool, error) {
+	getReadReceiptsOp := &opGetReadReceipts{
+		name:         name,
+		responseChan: make(chan interface{}, 1),
+	}
+	select {
+	case <-c.HaltCh():
+		return false, ErrHalted
+	case c.opCh <- getReadReceiptsOp:
+	}
+
+	select {
+	case <-c.HaltCh():
+		return false, ErrHalted
+	case v := <-getReadReceiptsOp.responseChan:
+		switch v := v.(type) {
+		case error:
+			return false, v
+		case bool:
+			return v, nil
+		default:
+			return false, errors.New("Unknown")
+		}
+	}
+}
+
+func (c *Client) doGetReadReceipts(name string, responseChan chan interface{}) {
+	if contact, ok := c.contactNicknames[name]; !ok {
+		responseChan <- ErrContactNotFound
+	} else {
+		responseChan <- !contact.disableReadReceipts
+	}
+}
+
+// ChangeReadReceipts enables or disables sending read receipts to the
+// contact. Read receipts are enabled by default.
+func (c *Client) ChangeReadReceipts(name string, enabled bool) error {
+	changeReadReceiptsOp := &opChangeReadReceipts{
+		name:         name,
+		enabled:      enabled,
+		responseChan: make(chan error, 1),
+	}
+	select {
+	case <-c.HaltCh():
+		return ErrHalted
+	case c.opCh <- changeReadReceiptsOp:
+	}
+	select {
+	case <-c.HaltCh():
+	case r := <-changeReadReceiptsOp.responseChan:
+		return r
+	}
+	return ErrHalted
+}
+
+func (c *Client) doChangeReadReceipts(name string, enabled bool) error {
+	contact, ok := c.contactNicknames[name]
+	if !ok {
+		return ErrContactNotFound
+	}
+	contact.disableReadReceipts = !enabled
+	c.save()
+	return nil
+}
@@ -0,0 +1,61 @@
+// receipt_test.go - Read receipt tests.
+// Copyright (C) 2022  David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package catshadow
+
+import (
+	"testing"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadReceiptEncoding(t *testing.T) {
+	require := require.New(t)
+
+	id := MessageID{1, 2, 3, 4}
+	serialized, err := cbor.Marshal(&readReceipt{ReadMessageIDs: []MessageID{id}})
+	require.NoError(err)
+	r := parseReadReceipt(serialized)
+	require.NotNil(r)
+	require.Equal([]MessageID{id}, r.ReadMessageIDs)
+	require.Nil(parseMessageFragment(serialized))
+	require.Nil(parseGroupMessage(serialized))
+
+	// a Message is not a read receipt
+	serialized, err = cbor.Marshal(&Message{Plaintext: []byte("hello"), Timestamp: time.Now(), ID: id, Read: true})
+	require.NoError(err)
+	require.Nil(parseReadReceipt(serialized))
+	m := new(Message)
+	require.NoError(cbor.Unmarshal(serialized, m))
+	require.Equal(id, m.ID)
+}
+
+func TestContactReadReceipts(t *testing.T) {
+	require := require.New(t)
+
+	contact, err := NewContact("alice", 1, []byte("secret"))
+	require.NoError(err)
+	require.False(contact.disableReadReceipts)
+	contact.disableReadReceipts = true
+
+	serialized, err := contact.MarshalBinary()
+	require.NoError(err)
+	contact2 := new(Contact)
+	require.NoError(contact2.UnmarshalBinary(serialized))
+	require.True(contact2.disableReadReceipts)
+}
@@ -106,6 +106,8 @@ func (c *Client) processReunionUpdate(update *rClient.ReunionUpdate) {
 		c.eventCh.In() <- &KeyExchangeCompletedEvent{
 			Nickname: contact.Nickname,
 		}
+		// our linked devices may now reach the new contact through us
+		c.syncContactsToDevices()
 	}
 	c.save()
 }
@@ -118,7 +120,7 @@ func (c *Client) restartReunionExchanges() {
 		return
 	}
 	for _, contact := range c.contacts {
-		if contact.IsPending {
+		if contact.IsPending && contact.introducer == 0 {
 			err := c.initKeyExchange(contact)
 			if err != ErrAlreadyHaveKeyExchange && err != nil {
 				// skip if a ratchet keyexchange cannot be found or created
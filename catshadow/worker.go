@@ -93,7 +93,7 @@ func (c *Client) worker() {
 					op.responseChan <- errors.New("Nil spool descriptor")
 				}
 			case *opAddContact:
-				err := c.createContact(op.name, op.sharedSecret)
+				err := c.createContact(op.name, op.sharedSecret, op.isDevice)
 				if err != nil {
 					c.log.Errorf("create contact failure: %s", err.Error())
 				}
@@ -105,12 +105,30 @@ func (c *Client) worker() {
 				c.doGetExpiration(op.name, op.responseChan)
 			case *opChangeExpiration:
 				op.responseChan <- c.doChangeExpiration(op.name, op.expiration)
+			case *opGetReadReceipts:
+				c.doGetReadReceipts(op.name, op.responseChan)
+			case *opChangeReadReceipts:
+				op.responseChan <- c.doChangeReadReceipts(op.name, op.enabled)
 			case *opRestartSending:
 				c.sendMessage(op.contact)
 			case *opSendMessage:
 				c.doSendMessage(op.id, op.name, op.payload)
 			case *opGetContacts:
 				op.responseChan <- c.contactNicknames
+			case *opGetLinkedContacts:
+				op.responseChan <- c.doGetLinkedContacts()
+			case *opCreateGroup:
+				if id, err := c.doCreateGroup(op.name, op.nicknames); err != nil {
+					op.responseChan <- err
+				} else {
+					op.responseChan <- id
+				}
+			case *opChangeGroupMembers:
+				op.responseChan <- c.doChangeGroupMembers(op.id, op.name, op.add)
+			case *opSendGroupMessage:
+				c.doSendGroupMessage(op.id, op.groupID, op.payload)
+			case *opGetGroups:
+				op.responseChan <- c.groups
 			case *opGetConversation:
 				c.doGetConversation(op.name, op.responseChan)
 			case *opWipeConversation:
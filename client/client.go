@@ -20,6 +20,7 @@ package client
 import (
 	"context"
 	"errors"
+	"fmt"
 	"path/filepath"
 	"sync"
 	"time"
@@ -54,13 +55,21 @@ func (c *Client) GetConfig() *config.Config {
 	return c.cfg
 }
 
-// PKIBootstrap returns a pkiClient and fetches a consensus.
+// PKIBootstrap returns a pkiClient and fetches a consensus.  If the
+// configuration has a DataDir, the pkiClient caches the consensus
+// documents there, and the cached consensus is used if there is one.
 func PKIBootstrap(c *Client, linkKey wire.PrivateKey) (pki.Client, *pki.Document, error) {
 	// Retrieve a copy of the PKI consensus document.
 	pkiClient, err := c.cfg.NewPKIClient(c.logBackend, c.cfg.UpstreamProxyConfig(), linkKey)
 	if err != nil {
 		return nil, nil, err
 	}
+	if c.cfg.DataDir != "" {
+		pkiClient, err = newCachingPKIClient(pkiClient, filepath.Join(c.cfg.DataDir, "pki"), c.logBackend.GetLogger("katzenpost/client/pkicache"))
+		if err != nil {
+			return nil, nil, err
+		}
+	}
 	currentEpoch, _, _ := epochtime.FromUnix(time.Now().Unix())
 	ctx, cancel := context.WithTimeout(context.Background(), initialPKIConsensusTimeout)
 	defer cancel()
@@ -186,3 +195,49 @@ func (c *Client) NewTOFUSession() (*Session, error) {
 	c.session, err = NewSession(ctx, pkiclient, c.fatalErrCh, c.logBackend, c.cfg, linkKey, provider)
 	return c.session, err
 }
+
+// NewPersistentSession creates and returns a new session which persists
+// its egress queue and the messages awaiting replies in the store. A
+// session created with a store that was used by a previous session
+// reuses its link key and Provider, resumes its pending sends and
+// accepts the replies to its in-flight messages.
+func (c *Client) NewPersistentSession(store *SessionStore) (*Session, error) {
+	timeout := time.Duration(c.cfg.Debug.SessionDialTimeout) * time.Second
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	linkKey, providerName, err := store.identity()
+	if err != nil {
+		return nil, err
+	}
+	if linkKey == nil {
+		linkKey, _ = wire.DefaultScheme.GenerateKeypair(rand.Reader)
+	}
+
+	pkiclient, doc, err := PKIBootstrap(c, linkKey)
+	if err != nil {
+		return nil, err
+	}
+	var provider *pki.MixDescriptor
+	if providerName == "" {
+		if provider, err = SelectProvider(doc); err != nil {
+			return nil, err
+		}
+	} else {
+		for _, p := range doc.Providers {
+			if p.Name == providerName {
+				provider = p
+				break
+			}
+		}
+		if provider == nil {
+			return nil, fmt.Errorf("Provider %s of persisted session not found in the consensus", providerName)
+		}
+	}
+	if err = store.setIdentity(linkKey, provider.Name); err != nil {
+		return nil, err
+	}
+
+	c.session, err = newSession(ctx, pkiclient, c.fatalErrCh, c.logBackend, c.cfg, linkKey, provider, store)
+	return c.session, err
+}
@@ -21,6 +21,7 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
 	"strings"
 
 	"github.com/BurntSushi/toml"
@@ -33,6 +34,7 @@ import (
 	"github.com/katzenpost/katzenpost/core/crypto/pem"
 	"github.com/katzenpost/katzenpost/core/log"
 	"github.com/katzenpost/katzenpost/core/pki"
+	"github.com/katzenpost/katzenpost/core/transport"
 	"github.com/katzenpost/katzenpost/core/wire"
 )
 
@@ -41,6 +43,9 @@ const (
 	defaultPollingInterval             = 10
 	defaultInitialMaxPKIRetrievalDelay = 30
 	defaultSessionDialTimeout          = 30
+	defaultRetransmitBackoff           = 2.0
+	defaultRetransmitJitter            = 0.1
+	defaultMaxRetransmitTimeout        = 60 * 60
 )
 
 var defaultLogging = Logging{
@@ -93,9 +98,41 @@ type Debug struct {
 	// transmit performance.
 	PollingInterval int
 
+	// EnablePushDelivery requests that the Provider sends messages as
+	// soon as they arrive, instead of waiting for the next poll.
+	EnablePushDelivery bool
+
+	// DisablePollCover disables polling the receive queue when
+	// EnablePushDelivery is set.  This saves bandwidth, but the polls
+	// otherwise hide when messages are received from an observer of
+	// the connection to the Provider.
+	DisablePollCover bool
+
 	// PreferedTransports is a list of the transports will be used to make
-	// outgoing network connections, with the most prefered first.
+	// outgoing network connections, with the most prefered first, for
+	// example ["quic", "ws"] to only use the QUIC and WebSocket transports.
+	// QUIC is only used when listed, and can't be used with an
+	// UpstreamProxy.
 	PreferedTransports []pki.Transport
+
+	// MaxRetransmissions is the maximum number of retransmissions of a
+	// reliable message before it is reported as failed, or 0 for no limit.
+	MaxRetransmissions int
+
+	// RetransmitBackoff is the factor by which the reply timeout of a
+	// reliable message grows with each retransmission. By default this
+	// is 2.
+	RetransmitBackoff float64
+
+	// RetransmitJitter is the maximum fraction of the reply timeout of a
+	// reliable message by which it is randomly shortened or lengthened.
+	// By default this is 0.1, negative values disable the jitter.
+	RetransmitJitter float64
+
+	// MaxRetransmitTimeout is the maximum number of seconds to wait for
+	// the reply to a reliable message before retransmitting it. By
+	// default this is one hour.
+	MaxRetransmitTimeout int
 }
 
 func (d *Debug) fixup() {
@@ -108,6 +145,38 @@ func (d *Debug) fixup() {
 	if d.SessionDialTimeout == 0 {
 		d.SessionDialTimeout = defaultSessionDialTimeout
 	}
+	if d.RetransmitBackoff == 0 {
+		d.RetransmitBackoff = defaultRetransmitBackoff
+	}
+	if d.RetransmitJitter == 0 {
+		d.RetransmitJitter = defaultRetransmitJitter
+	} else if d.RetransmitJitter < 0 {
+		d.RetransmitJitter = 0
+	}
+	if d.MaxRetransmitTimeout == 0 {
+		d.MaxRetransmitTimeout = defaultMaxRetransmitTimeout
+	}
+}
+
+func (d *Debug) validate() error {
+	if d.MaxRetransmissions < 0 {
+		return errors.New("config: Debug: MaxRetransmissions is negative")
+	}
+	if d.RetransmitBackoff < 1 {
+		return errors.New("config: Debug: RetransmitBackoff must be at least 1")
+	}
+	if d.RetransmitJitter >= 1 {
+		return errors.New("config: Debug: RetransmitJitter must be less than 1")
+	}
+	if d.MaxRetransmitTimeout < 0 {
+		return errors.New("config: Debug: MaxRetransmitTimeout is negative")
+	}
+	for _, t := range d.PreferedTransports {
+		if _, err := transport.Get(t); err != nil {
+			return fmt.Errorf("config: Debug: PreferedTransports: %v", err)
+		}
+	}
+	return nil
 }
 
 // NonvotingAuthority is a non-voting authority configuration.
@@ -228,6 +297,11 @@ func (uCfg *UpstreamProxy) toProxyConfig() (*proxy.Config, error) {
 
 // Config is the top level client configuration.
 type Config struct {
+	// DataDir is the optional absolute path to the directory in which
+	// the client persists the consensus documents it obtains, so that it
+	// can start without fetching the current document.
+	DataDir string
+
 	Logging            *Logging
 	UpstreamProxy      *UpstreamProxy
 	Debug              *Debug
@@ -254,19 +328,32 @@ func (c *Config) FixupAndValidate() error {
 			PollingInterval:             defaultPollingInterval,
 			InitialMaxPKIRetrievalDelay: defaultInitialMaxPKIRetrievalDelay,
 		}
-	} else {
-		c.Debug.fixup()
 	}
+	c.Debug.fixup()
 
 	// Validate/fixup the various sections.
+	if c.DataDir != "" && !filepath.IsAbs(c.DataDir) {
+		return fmt.Errorf("config: DataDir '%v' is not an absolute path", c.DataDir)
+	}
 	if err := c.Logging.validate(); err != nil {
 		return err
 	}
+	if err := c.Debug.validate(); err != nil {
+		return err
+	}
 	if uCfg, err := c.UpstreamProxy.toProxyConfig(); err == nil {
 		c.upstreamProxy = uCfg
 	} else {
 		return err
 	}
+	if c.upstreamProxy.IsProxied() {
+		// QUIC can't be carried over the proxy.
+		for _, t := range c.Debug.PreferedTransports {
+			if t == pki.TransportQUIC {
+				return errors.New("config: Debug: PreferedTransports: QUIC can't be used with an UpstreamProxy")
+			}
+		}
+	}
 	switch {
 	case c.NonvotingAuthority == nil && c.VotingAuthority != nil:
 		if err := c.VotingAuthority.validate(); err != nil {
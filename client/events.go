@@ -82,6 +82,10 @@ type MessageSentEvent struct {
 	// ReplyETA is the expected round trip time to receive a response.
 	ReplyETA time.Duration
 
+	// Retransmissions is the number of times the message has been
+	// retransmitted, which is 0 for its first transmission.
+	Retransmissions uint32
+
 	// Err is the error encountered when sending the message if any.
 	Err error
 }
@@ -94,6 +98,26 @@ func (e *MessageSentEvent) String() string {
 	return fmt.Sprintf("MessageSent: %v", hex.EncodeToString(e.MessageID[:]))
 }
 
+// MessageFailedEvent is the event sent when no reply to a reliable
+// message arrived after it was retransmitted the maximum number of
+// times allowed by the RetransmitPolicy. The message is not retransmitted
+// again.
+type MessageFailedEvent struct {
+	// MessageID is the local unique identifier for the message.
+	MessageID *[cConstants.MessageIDLength]byte
+
+	// Retransmissions is the number of times the message was retransmitted.
+	Retransmissions uint32
+
+	// Err is the reason the message failed.
+	Err error
+}
+
+// String returns a string representation of a MessageFailedEvent.
+func (e *MessageFailedEvent) String() string {
+	return fmt.Sprintf("MessageFailed: %v after %d retransmissions: %v", hex.EncodeToString(e.MessageID[:]), e.Retransmissions, e.Err)
+}
+
 // MessageIDGarbageCollected is the event used to signal when a given
 // message ID has been garbage collected.
 type MessageIDGarbageCollected struct {
@@ -120,6 +120,11 @@ func (cfg *Config) FixupAndValidate() error {
 	return nil
 }
 
+// IsProxied returns true iff a proxy is configured.
+func (cfg *Config) IsProxied() bool {
+	return cfg.Type != typeNone
+}
+
 // ToDialContext returns a function matching Dialer.DialContext() that will
 // utilize the configured proxy or nil iff no proxy is configured.
 func (cfg *Config) ToDialContext(tag string) DialContextFn {
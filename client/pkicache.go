@@ -0,0 +1,143 @@
+// pkicache.go - Persistent PKI document cache.
+// Copyright (C) 2022  David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"gopkg.in/op/go-logging.v1"
+
+	"github.com/katzenpost/katzenpost/core/epochtime"
+	"github.com/katzenpost/katzenpost/core/pki"
+)
+
+const pkiCacheFilePrefix = "consensus-"
+
+// cachingPKIClient is a pki.Client which persists the raw signed
+// consensus documents it obtains in a directory, and serves the cached
+// documents without a network round trip.  Cached documents are verified
+// by the underlying pki.Client each time they are loaded.
+type cachingPKIClient struct {
+	pki.Client
+
+	log *logging.Logger
+	dir string
+}
+
+func newCachingPKIClient(impl pki.Client, dir string, log *logging.Logger) (*cachingPKIClient, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &cachingPKIClient{
+		Client: impl,
+		log:    log,
+		dir:    dir,
+	}, nil
+}
+
+func (c *cachingPKIClient) path(epoch uint64) string {
+	return filepath.Join(c.dir, fmt.Sprintf("%s%d", pkiCacheFilePrefix, epoch))
+}
+
+// Get returns the cached document for the epoch if there is one, and
+// otherwise fetches it and adds it to the cache.
+func (c *cachingPKIClient) Get(ctx context.Context, epoch uint64) (*pki.Document, []byte, error) {
+	if doc, raw, err := c.cached(epoch); err == nil {
+		c.log.Debugf("Using cached PKI document for epoch %v", epoch)
+		return doc, raw, nil
+	} else if !os.IsNotExist(err) {
+		c.log.Warningf("Discarding cached PKI document for epoch %v: %v", epoch, err)
+		os.Remove(c.path(epoch))
+	}
+	doc, raw, err := c.Client.Get(ctx, epoch)
+	if err != nil {
+		return nil, nil, err
+	}
+	c.store(epoch, raw)
+	return doc, raw, nil
+}
+
+// Deserialize verifies and returns the document, adding it to the cache.
+func (c *cachingPKIClient) Deserialize(raw []byte) (*pki.Document, error) {
+	doc, err := c.Client.Deserialize(raw)
+	if err != nil {
+		return nil, err
+	}
+	c.store(doc.Epoch, raw)
+	return doc, nil
+}
+
+func (c *cachingPKIClient) cached(epoch uint64) (*pki.Document, []byte, error) {
+	raw, err := os.ReadFile(c.path(epoch))
+	if err != nil {
+		return nil, nil, err
+	}
+	doc, err := c.Client.Deserialize(raw)
+	if err != nil {
+		return nil, nil, err
+	}
+	if doc.Epoch != epoch {
+		return nil, nil, pki.ErrInvalidEpoch
+	}
+	return doc, raw, nil
+}
+
+// store atomically writes the document to the cache, and prunes the
+// documents of past epochs.  Failures are not fatal, as the cache only
+// saves network round trips.
+func (c *cachingPKIClient) store(epoch uint64, raw []byte) {
+	path := c.path(epoch)
+	if _, err := os.Stat(path); err == nil {
+		return
+	}
+	tmpFn := path + ".tmp"
+	if err := os.WriteFile(tmpFn, raw, 0600); err != nil {
+		c.log.Warningf("Failed to cache PKI document for epoch %v: %v", epoch, err)
+		return
+	}
+	if err := os.Rename(tmpFn, path); err != nil {
+		c.log.Warningf("Failed to cache PKI document for epoch %v: %v", epoch, err)
+		os.Remove(tmpFn)
+		return
+	}
+	c.prune()
+}
+
+func (c *cachingPKIClient) prune() {
+	now, _, _ := epochtime.Now()
+	entries, err := os.ReadDir(c.dir)
+	if err != nil {
+		return
+	}
+	for _, e := range entries {
+		name := e.Name()
+		if !strings.HasPrefix(name, pkiCacheFilePrefix) {
+			continue
+		}
+		epoch, err := strconv.ParseUint(strings.TrimPrefix(name, pkiCacheFilePrefix), 10, 64)
+		if err != nil || epoch >= now {
+			continue
+		}
+		c.log.Debugf("Discarding cached PKI document for epoch %v", epoch)
+		os.Remove(filepath.Join(c.dir, name))
+	}
+}
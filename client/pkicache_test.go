@@ -0,0 +1,134 @@
+// pkicache_test.go - Persistent PKI document cache tests.
+// Copyright (C) 2022  David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/katzenpost/katzenpost/core/crypto/cert"
+	"github.com/katzenpost/katzenpost/core/crypto/sign"
+	"github.com/katzenpost/katzenpost/core/epochtime"
+	"github.com/katzenpost/katzenpost/core/log"
+	"github.com/katzenpost/katzenpost/core/pki"
+)
+
+// mockPKIClient serves signed documents and counts its fetches.
+type mockPKIClient struct {
+	verifier cert.Verifier
+	docs     map[uint64][]byte
+	fetches  int
+}
+
+func (m *mockPKIClient) Get(ctx context.Context, epoch uint64) (*pki.Document, []byte, error) {
+	m.fetches++
+	raw, ok := m.docs[epoch]
+	if !ok {
+		return nil, nil, pki.ErrNoDocument
+	}
+	doc, err := m.Deserialize(raw)
+	return doc, raw, err
+}
+
+func (m *mockPKIClient) Post(ctx context.Context, epoch uint64, signingPrivateKey sign.PrivateKey, signingPublicKey sign.PublicKey, d *pki.MixDescriptor) error {
+	return errors.New("not implemented")
+}
+
+func (m *mockPKIClient) Deserialize(raw []byte) (*pki.Document, error) {
+	if _, err := cert.Verify(m.verifier, raw); err != nil {
+		return nil, err
+	}
+	doc := new(pki.Document)
+	if err := doc.UnmarshalBinary(raw); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+func TestPKICache(t *testing.T) {
+	require := require.New(t)
+
+	signer, verifier := cert.Scheme.NewKeypair()
+	now, _, _ := epochtime.Now()
+	mock := &mockPKIClient{
+		verifier: verifier,
+		docs:     make(map[uint64][]byte),
+	}
+	for _, epoch := range []uint64{now, now + 1} {
+		raw, err := pki.SignDocument(signer, verifier, &pki.Document{Epoch: epoch})
+		require.NoError(err)
+		mock.docs[epoch] = raw
+	}
+
+	logBackend, err := log.New("", "DEBUG", false)
+	require.NoError(err)
+	dir := filepath.Join(t.TempDir(), "pki")
+	c, err := newCachingPKIClient(mock, dir, logBackend.GetLogger("pkicache"))
+	require.NoError(err)
+
+	// the first fetch goes to the network and is cached
+	doc, raw, err := c.Get(context.Background(), now)
+	require.NoError(err)
+	require.Equal(now, doc.Epoch)
+	require.Equal(mock.docs[now], raw)
+	require.Equal(1, mock.fetches)
+
+	// after a restart the cached document is used
+	c, err = newCachingPKIClient(mock, dir, logBackend.GetLogger("pkicache"))
+	require.NoError(err)
+	doc, raw, err = c.Get(context.Background(), now)
+	require.NoError(err)
+	require.Equal(now, doc.Epoch)
+	require.Equal(mock.docs[now], raw)
+	require.Equal(1, mock.fetches)
+
+	// documents received from the Provider are cached
+	doc, err = c.Deserialize(mock.docs[now+1])
+	require.NoError(err)
+	_, err = os.Stat(c.path(now + 1))
+	require.NoError(err)
+
+	// a cached document which fails verification is refetched
+	require.NoError(os.WriteFile(c.path(now), mock.docs[now+1], 0600))
+	doc, _, err = c.Get(context.Background(), now)
+	require.NoError(err)
+	require.Equal(now, doc.Epoch)
+	require.Equal(2, mock.fetches)
+	otherSigner, otherVerifier := cert.Scheme.NewKeypair()
+	forged, err := pki.SignDocument(otherSigner, otherVerifier, &pki.Document{Epoch: now})
+	require.NoError(err)
+	require.NoError(os.WriteFile(c.path(now), forged, 0600))
+	doc, raw, err = c.Get(context.Background(), now)
+	require.NoError(err)
+	require.Equal(mock.docs[now], raw)
+	require.Equal(3, mock.fetches)
+
+	// documents of past epochs are pruned
+	require.NoError(os.WriteFile(c.path(now-2), mock.docs[now], 0600))
+	require.NoError(os.Remove(c.path(now)))
+	_, _, err = c.Get(context.Background(), now)
+	require.NoError(err)
+	_, err = os.Stat(c.path(now - 2))
+	require.True(os.IsNotExist(err))
+	_, err = os.Stat(c.path(now))
+	require.NoError(err)
+}
@@ -40,6 +40,10 @@ type EgressQueue interface {
 
 	// Push pushes the item onto the queue.
 	Push(Item) error
+
+	// Remove removes the items for which the filter returns true,
+	// and returns the number of removed items.
+	Remove(filter func(Item) bool) int
 }
 
 // Queue is our in-memory queue implementation used as our egress FIFO queue
@@ -92,3 +96,27 @@ func (q *Queue) Peek() (Item, error) {
 	result := q.content[q.readHead]
 	return result, nil
 }
+
+// Remove removes the message refs for which the filter returns true
+// from the queue, preserving the order of the remaining message refs,
+// and returns the number of removed message refs.
+func (q *Queue) Remove(filter func(Item) bool) int {
+	q.Lock()
+	defer q.Unlock()
+	kept := 0
+	for i := 0; i < q.len; i++ {
+		e := q.content[(q.readHead+i)%constants.MaxEgressQueueSize]
+		if filter(e) {
+			continue
+		}
+		q.content[(q.readHead+kept)%constants.MaxEgressQueueSize] = e
+		kept++
+	}
+	removed := q.len - kept
+	for i := kept; i < q.len; i++ {
+		q.content[(q.readHead+i)%constants.MaxEgressQueueSize] = &Message{}
+	}
+	q.len = kept
+	q.writeHead = (q.readHead + kept) % constants.MaxEgressQueueSize
+	return removed
+}
@@ -39,3 +39,28 @@ func TestQueue(t *testing.T) {
 	_, err = q.Pop()
 	assert.Error(err)
 }
+
+func TestQueueRemove(t *testing.T) {
+	assert := assert.New(t)
+	q := new(Queue)
+	// wrap around the ring buffer
+	for i := 0; i < constants.MaxEgressQueueSize-2; i++ {
+		assert.NoError(q.Push(foo{"skip"}))
+		_, err := q.Pop()
+		assert.NoError(err)
+	}
+	for _, x := range []string{"a", "b", "c", "b", "d"} {
+		assert.NoError(q.Push(foo{x}))
+	}
+	removed := q.Remove(func(e Item) bool { return e.(foo).x == "b" })
+	assert.Equal(2, removed)
+	assert.Equal(0, q.Remove(func(e Item) bool { return e.(foo).x == "b" }))
+	assert.NoError(q.Push(foo{"e"}))
+	for _, x := range []string{"a", "c", "d", "e"} {
+		s, err := q.Pop()
+		assert.NoError(err)
+		assert.Equal(x, s.(foo).x)
+	}
+	_, err := q.Pop()
+	assert.Error(err)
+}
@@ -0,0 +1,103 @@
+// retransmit.go - Reliable message retransmission policy.
+// Copyright (C) 2022  David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"errors"
+	"math"
+	"time"
+
+	"github.com/katzenpost/katzenpost/client/config"
+	"github.com/katzenpost/katzenpost/core/crypto/rand"
+)
+
+// ErrRetransmissionsExhausted is the error reported by MessageFailedEvent
+// when a reliable message was not replied to after its last retransmission.
+var ErrRetransmissionsExhausted = errors.New("no reply after the maximum number of retransmissions")
+
+// RetransmitPolicy decides how long to wait for the reply to a reliable
+// message before retransmitting it, and how many times it is retransmitted.
+//
+// Retransmissions are placed on the egress queue, and so are sent in the
+// slots of the Poisson send schedule like any other message.
+type RetransmitPolicy interface {
+	// Timeout returns the duration to wait for the reply to a message
+	// that has been retransmitted the given number of times, where eta
+	// is the expected round trip time of the transmission.
+	Timeout(eta time.Duration, retransmissions uint32) time.Duration
+
+	// ShouldRetransmit returns true if a message that has been
+	// retransmitted the given number of times is to be retransmitted
+	// again if no reply arrives.
+	ShouldRetransmit(retransmissions uint32) bool
+}
+
+// BackoffPolicy is a RetransmitPolicy with exponential backoff and jitter.
+type BackoffPolicy struct {
+	// MaxRetransmissions is the maximum number of retransmissions,
+	// or 0 for no limit.
+	MaxRetransmissions uint32
+
+	// Backoff is the factor by which the timeout grows with each
+	// retransmission.
+	Backoff float64
+
+	// Jitter is the maximum fraction of the timeout by which it is
+	// randomly shortened or lengthened.
+	Jitter float64
+
+	// MaxTimeout is the maximum timeout before jitter is applied,
+	// or 0 for DefaultMaxRetransmitTimeout.
+	MaxTimeout time.Duration
+}
+
+// DefaultMaxRetransmitTimeout is the maximum timeout of a BackoffPolicy
+// without a MaxTimeout, as the timeout must not outgrow a Duration.
+const DefaultMaxRetransmitTimeout = time.Hour
+
+// NewBackoffPolicy returns the BackoffPolicy of the client configuration.
+func NewBackoffPolicy(cfg *config.Debug) *BackoffPolicy {
+	return &BackoffPolicy{
+		MaxRetransmissions: uint32(cfg.MaxRetransmissions),
+		Backoff:            cfg.RetransmitBackoff,
+		Jitter:             cfg.RetransmitJitter,
+		MaxTimeout:         time.Duration(cfg.MaxRetransmitTimeout) * time.Second,
+	}
+}
+
+// Timeout returns twice the expected round trip time, multiplied by
+// Backoff for each retransmission.
+func (p *BackoffPolicy) Timeout(eta time.Duration, retransmissions uint32) time.Duration {
+	// add a round-trip worth of delay before timing out
+	timeout := float64(2*eta) * math.Pow(p.Backoff, float64(retransmissions))
+	maxTimeout := p.MaxTimeout
+	if maxTimeout <= 0 {
+		maxTimeout = DefaultMaxRetransmitTimeout
+	}
+	if timeout > float64(maxTimeout) {
+		timeout = float64(maxTimeout)
+	}
+	if p.Jitter > 0 {
+		timeout *= 1 + p.Jitter*(2*rand.NewMath().Float64()-1)
+	}
+	return time.Duration(timeout)
+}
+
+// ShouldRetransmit returns true until MaxRetransmissions is reached.
+func (p *BackoffPolicy) ShouldRetransmit(retransmissions uint32) bool {
+	return p.MaxRetransmissions == 0 || retransmissions < p.MaxRetransmissions
+}
@@ -0,0 +1,87 @@
+// retransmit_test.go - Reliable message retransmission policy tests.
+// Copyright (C) 2022  David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"gopkg.in/eapache/channels.v1"
+
+	"github.com/katzenpost/katzenpost/core/log"
+)
+
+func TestBackoffPolicy(t *testing.T) {
+	require := require.New(t)
+
+	p := &BackoffPolicy{Backoff: 2, MaxTimeout: time.Minute}
+	require.Equal(2*time.Second, p.Timeout(time.Second, 0))
+	require.Equal(4*time.Second, p.Timeout(time.Second, 1))
+	require.Equal(16*time.Second, p.Timeout(time.Second, 3))
+	require.Equal(time.Minute, p.Timeout(time.Second, 10))
+	require.True(p.ShouldRetransmit(1000))
+
+	// without a MaxTimeout the timeout is bounded by the default one
+	unbounded := &BackoffPolicy{Backoff: 2}
+	for _, n := range []uint32{40, 100, 10000} {
+		require.Equal(DefaultMaxRetransmitTimeout, unbounded.Timeout(time.Second, n))
+	}
+
+	p.Jitter = 0.1
+	for i := 0; i < 100; i++ {
+		timeout := p.Timeout(time.Second, 1)
+		require.True(timeout >= 3600*time.Millisecond)
+		require.True(timeout <= 4400*time.Millisecond)
+	}
+
+	p.MaxRetransmissions = 2
+	require.True(p.ShouldRetransmit(0))
+	require.True(p.ShouldRetransmit(1))
+	require.False(p.ShouldRetransmit(2))
+}
+
+func TestRetransmissionsExhausted(t *testing.T) {
+	require := require.New(t)
+	logBackend, err := log.New("", "DEBUG", false)
+	require.NoError(err)
+	s := &Session{
+		log:              logBackend.GetLogger("session"),
+		opCh:             make(chan workerOp, 8),
+		eventCh:          channels.NewInfiniteChannel(),
+		retransmitPolicy: &BackoffPolicy{MaxRetransmissions: 1, Backoff: 2},
+	}
+
+	// a message without a reply is retransmitted
+	msg := newTestMessage(t, true)
+	s.storeSURB(*msg.SURBID, msg)
+	require.NoError(s.Push(msg))
+	op := <-s.opCh
+	require.Equal(msg, op.(opRetransmit).msg)
+
+	// until the policy gives up
+	msg.Retransmissions = 1
+	s.storeSURB(*msg.SURBID, msg)
+	require.NoError(s.Push(msg))
+	require.Len(s.opCh, 0)
+	e := (<-s.eventCh.Out()).(*MessageFailedEvent)
+	require.Equal(msg.ID, e.MessageID)
+	require.Equal(uint32(1), e.Retransmissions)
+	require.Equal(ErrRetransmissionsExhausted, e.Err)
+	_, ok := s.surbIDMap.Load(*msg.SURBID)
+	require.False(ok)
+}
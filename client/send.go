@@ -17,6 +17,7 @@
 package client
 
 import (
+	"context"
 	"encoding/hex"
 	"errors"
 	"fmt"
@@ -31,6 +32,9 @@ import (
 
 var ErrReplyTimeout = errors.New("failure waiting for reply, timeout reached")
 var ErrMessageNotSent = errors.New("failure sending message")
+var ErrNoDocument = errors.New("no PKI document for current epoch")
+var ErrMessageNotFound = errors.New("message not found")
+var ErrHalted = errors.New("session is halted")
 
 func (s *Session) sendNext() {
 	msg, err := s.egressQueue.Peek()
@@ -54,7 +58,17 @@ func (s *Session) doRetransmit(msg *Message) {
 	msg.Retransmissions++
 	msgIdStr := fmt.Sprintf("[%v]", hex.EncodeToString(msg.ID[:]))
 	s.log.Debugf("doRetransmit: %d for %s", msg.Retransmissions, msgIdStr)
-	s.egressQueue.Push(msg)
+	surbID := msg.SURBID
+	if err := s.egressQueue.Push(msg); err != nil {
+		s.log.Errorf("Failed to queue retransmission of %s: %s", msgIdStr, err)
+		return
+	}
+	// the message is persisted as pending, and no longer in flight
+	if s.store != nil && surbID != nil {
+		if err := s.store.removeInFlight(surbID); err != nil {
+			s.log.Errorf("Failed to remove in-flight message from store: %s", err)
+		}
+	}
 }
 
 func (s *Session) doSend(msg *Message) {
@@ -81,18 +95,25 @@ func (s *Session) doSend(msg *Message) {
 	if err == nil {
 		msg.SentAt = time.Now()
 	}
+	// the message is complete unless a reply is expected
+	if err != nil || !msg.WithSURB {
+		s.messageDone(msg.ID)
+	}
 	// expect a reply
 	if msg.WithSURB {
 		if err == nil {
-			s.log.Debugf("doSend setting ReplyETA to %v", eta)
-			// increase the timeout for each retransmission
-			msg.ReplyETA = eta * (1 + time.Duration(msg.Retransmissions))
+			msg.ReplyETA = eta
+			if msg.Reliable {
+				// the retransmit policy decides how long to wait
+				// for the reply before retransmitting
+				msg.ReplyETA = s.RetransmitPolicy().Timeout(eta, msg.Retransmissions)
+			}
+			s.log.Debugf("doSend setting ReplyETA to %v", msg.ReplyETA)
 			msg.Key = key
-			s.surbIDMap.Store(surbID, msg)
+			s.storeSURB(surbID, msg)
 			if msg.Reliable {
 				s.log.Debugf("Sending reliable message with retransmissions")
-				timeSlop := eta // add a round-trip worth of delay before timing out
-				msg.SetPriority(uint64(msg.SentAt.Add(msg.ReplyETA).Add(timeSlop).UnixNano()))
+				msg.SetPriority(uint64(msg.SentAt.Add(msg.ReplyETA).UnixNano()))
 				s.timerQ.Push(msg)
 			}
 		}
@@ -117,15 +138,21 @@ func (s *Session) doSend(msg *Message) {
 		}
 	}
 	s.eventCh.In() <- &MessageSentEvent{
-		MessageID: msg.ID,
-		Err:       err,
-		SentAt:    msg.SentAt,
-		ReplyETA:  msg.ReplyETA,
+		MessageID:       msg.ID,
+		Err:             err,
+		SentAt:          msg.SentAt,
+		ReplyETA:        msg.ReplyETA,
+		Retransmissions: msg.Retransmissions,
 	}
 }
 
 func (s *Session) sendDropDecoy(loopSvc *utils.ServiceDescriptor) {
-	payload := make([]byte, s.geo.UserForwardPayloadLength)
+	geo := s.SphinxGeometry()
+	if geo == nil {
+		s.log.Debug("no PKI document, not sending drop decoy")
+		return
+	}
+	payload := make([]byte, geo.UserForwardPayloadLength)
 	id := [cConstants.MessageIDLength]byte{}
 	_, err := io.ReadFull(rand.Reader, id[:])
 	if err != nil {
@@ -145,7 +172,12 @@ func (s *Session) sendDropDecoy(loopSvc *utils.ServiceDescriptor) {
 
 func (s *Session) sendLoopDecoy(loopSvc *utils.ServiceDescriptor) {
 	s.log.Info("sending loop decoy")
-	payload := make([]byte, s.geo.UserForwardPayloadLength)
+	geo := s.SphinxGeometry()
+	if geo == nil {
+		s.log.Debug("no PKI document, not sending loop decoy")
+		return
+	}
+	payload := make([]byte, geo.UserForwardPayloadLength)
 	id := [cConstants.MessageIDLength]byte{}
 	_, err := io.ReadFull(rand.Reader, id[:])
 	if err != nil {
@@ -166,10 +198,14 @@ func (s *Session) sendLoopDecoy(loopSvc *utils.ServiceDescriptor) {
 
 func (s *Session) composeMessage(recipient, provider string, message []byte, isBlocking bool) (*Message, error) {
 	s.log.Debug("SendMessage")
-	if len(message) > s.geo.UserForwardPayloadLength {
-		return nil, fmt.Errorf("message too large: %v > %v", len(message), s.geo.UserForwardPayloadLength)
+	geo := s.SphinxGeometry()
+	if geo == nil {
+		return nil, ErrNoDocument
+	}
+	if len(message) > geo.UserForwardPayloadLength {
+		return nil, fmt.Errorf("message too large: %v > %v", len(message), geo.UserForwardPayloadLength)
 	}
-	payload := make([]byte, s.geo.UserForwardPayloadLength)
+	payload := make([]byte, geo.UserForwardPayloadLength)
 	copy(payload, message)
 	id := [cConstants.MessageIDLength]byte{}
 	_, err := io.ReadFull(rand.Reader, id[:])
@@ -189,13 +225,24 @@ func (s *Session) composeMessage(recipient, provider string, message []byte, isB
 
 // SendReliableMessage asynchronously sends messages with automatic retransmissiosn.
 func (s *Session) SendReliableMessage(recipient, provider string, message []byte) (*[cConstants.MessageIDLength]byte, error) {
+	return s.SendReliableMessageContext(context.Background(), recipient, provider, message)
+}
+
+// SendReliableMessageContext is like SendReliableMessage, but the message
+// is cancelled if the context is done before its reply is received.
+func (s *Session) SendReliableMessageContext(ctx context.Context, recipient, provider string, message []byte) (*[cConstants.MessageIDLength]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	msg, err := s.composeMessage(recipient, provider, message, false)
 	if err != nil {
 		return nil, err
 	}
 	msg.Reliable = true
+	s.cancelOnDone(ctx, msg.ID)
 	err = s.egressQueue.Push(msg)
 	if err != nil {
+		s.messageDone(msg.ID)
 		return nil, err
 	}
 	return msg.ID, nil
@@ -203,61 +250,68 @@ func (s *Session) SendReliableMessage(recipient, provider string, message []byte
 
 // SendUnreliableMessage asynchronously sends message without any automatic retransmissions.
 func (s *Session) SendUnreliableMessage(recipient, provider string, message []byte) (*[cConstants.MessageIDLength]byte, error) {
+	return s.SendUnreliableMessageContext(context.Background(), recipient, provider, message)
+}
+
+// SendUnreliableMessageContext is like SendUnreliableMessage, but the
+// message is cancelled if the context is done before its reply is received.
+func (s *Session) SendUnreliableMessageContext(ctx context.Context, recipient, provider string, message []byte) (*[cConstants.MessageIDLength]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	msg, err := s.composeMessage(recipient, provider, message, false)
 	if err != nil {
 		return nil, err
 	}
+	s.cancelOnDone(ctx, msg.ID)
 	err = s.egressQueue.Push(msg)
 	if err != nil {
+		s.messageDone(msg.ID)
 		return nil, err
 	}
 	return msg.ID, nil
 }
 
 func (s *Session) BlockingSendUnreliableMessage(recipient, provider string, message []byte) ([]byte, error) {
+	return s.BlockingSendUnreliableMessageContext(context.Background(), recipient, provider, message)
+}
+
+// BlockingSendUnreliableMessageContext is like BlockingSendUnreliableMessage,
+// but returns the context error and cancels the message if the context is
+// done before the reply is received.
+func (s *Session) BlockingSendUnreliableMessageContext(ctx context.Context, recipient, provider string, message []byte) ([]byte, error) {
 	msg, err := s.composeMessage(recipient, provider, message, true)
 	if err != nil {
 		return nil, err
 	}
-	sentWaitChan := make(chan *Message)
-	s.sentWaitChanMap.Store(*msg.ID, sentWaitChan)
-	defer s.sentWaitChanMap.Delete(*msg.ID)
+	return s.blockingSend(ctx, msg)
+}
 
-	replyWaitChan := make(chan []byte)
-	s.replyWaitChanMap.Store(*msg.ID, replyWaitChan)
-	defer s.replyWaitChanMap.Delete(*msg.ID)
+// BlockingSendReliableMessage sends a message with automatic message
+// retransmission enabled, and waits for its reply until the
+// RetransmitPolicy gives up on the message, in which case it returns
+// ErrRetransmissionsExhausted. Without a MaxRetransmissions the policy
+// never gives up, and BlockingSendReliableMessageContext bounds the wait.
+func (s *Session) BlockingSendReliableMessage(recipient, provider string, message []byte) ([]byte, error) {
+	return s.BlockingSendReliableMessageContext(context.Background(), recipient, provider, message)
+}
 
-	err = s.egressQueue.Push(msg)
+// BlockingSendReliableMessageContext is like BlockingSendReliableMessage,
+// but returns the context error and cancels the message if the context is
+// done before the reply is received.
+func (s *Session) BlockingSendReliableMessageContext(ctx context.Context, recipient, provider string, message []byte) ([]byte, error) {
+	msg, err := s.composeMessage(recipient, provider, message, true)
 	if err != nil {
 		return nil, err
 	}
-
-	// wait until sent so that we know the ReplyETA for the waiting below
-	sentMessage := <-sentWaitChan
-
-	// if the message failed to send we will receive a nil message
-	if sentMessage == nil {
-		return nil, ErrMessageNotSent
-	}
-
-	// wait for reply or round trip timeout
-	select {
-	case reply := <-replyWaitChan:
-		return reply, nil
-	// these timeouts are often far too aggressive
-	case <-time.After(sentMessage.ReplyETA + cConstants.RoundTripTimeSlop):
-		return nil, ErrReplyTimeout
-	}
-	// unreachable
+	msg.Reliable = true
+	return s.blockingSend(ctx, msg)
 }
 
-// BlockingSendReliableMessage sends a message with automatic message retransmission enabled
-func (s *Session) BlockingSendReliableMessage(recipient, provider string, message []byte) ([]byte, error) {
-	msg, err := s.composeMessage(recipient, provider, message, true)
-	if err != nil {
+func (s *Session) blockingSend(ctx context.Context, msg *Message) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
 		return nil, err
 	}
-	msg.Reliable = true
 	sentWaitChan := make(chan *Message)
 	s.sentWaitChanMap.Store(*msg.ID, sentWaitChan)
 	defer s.sentWaitChanMap.Delete(*msg.ID)
@@ -266,26 +320,125 @@ func (s *Session) BlockingSendReliableMessage(recipient, provider string, messag
 	s.replyWaitChanMap.Store(*msg.ID, replyWaitChan)
 	defer s.replyWaitChanMap.Delete(*msg.ID)
 
-	err = s.egressQueue.Push(msg)
+	failWaitChan := make(chan error, 1)
+	s.failWaitChanMap.Store(*msg.ID, failWaitChan)
+	defer s.failWaitChanMap.Delete(*msg.ID)
+
+	err := s.egressQueue.Push(msg)
 	if err != nil {
 		return nil, err
 	}
 
 	// wait until sent so that we know the ReplyETA for the waiting below
-	sentMessage := <-sentWaitChan
+	var sentMessage *Message
+	select {
+	case sentMessage = <-sentWaitChan:
+	case <-ctx.Done():
+		s.Cancel(msg.ID)
+		return nil, ctx.Err()
+	}
 
 	// if the message failed to send we will receive a nil message
 	if sentMessage == nil {
 		return nil, ErrMessageNotSent
 	}
 
-	// TODO: it would be better to have the message automatically retransmitted a configurable number of times before emitting a failure to this channel
-	// wait for reply or round trip timeout
+	// reliable messages are retransmitted until they are replied to or
+	// the RetransmitPolicy gives up on them
+	var timeoutCh <-chan time.Time
+	if !msg.Reliable {
+		// these timeouts are often far too aggressive
+		timeoutCh = time.After(sentMessage.ReplyETA + cConstants.RoundTripTimeSlop)
+	}
+	// wait for reply, failure or round trip timeout
 	select {
 	case reply := <-replyWaitChan:
 		return reply, nil
-	case <-time.After(cConstants.RoundTripTimeSlop):
+	case err := <-failWaitChan:
+		return nil, err
+	case <-timeoutCh:
 		return nil, ErrReplyTimeout
+	case <-ctx.Done():
+		s.Cancel(msg.ID)
+		return nil, ctx.Err()
+	}
+}
+
+// cancelOnDone cancels the message when the context is done, unless
+// the message completes first.
+func (s *Session) cancelOnDone(ctx context.Context, id *[cConstants.MessageIDLength]byte) {
+	if ctx.Done() == nil {
+		return
+	}
+	doneCh := make(chan struct{})
+	s.doneChanMap.Store(*id, doneCh)
+	go func() {
+		select {
+		case <-ctx.Done():
+			s.Cancel(id)
+			s.doneChanMap.Delete(*id)
+		case <-doneCh:
+		case <-s.HaltCh():
+		}
+	}()
+}
+
+// messageDone stops watching the context of a message which was
+// replied to, has failed or was cancelled.
+func (s *Session) messageDone(id *[cConstants.MessageIDLength]byte) {
+	if doneChRaw, ok := s.doneChanMap.LoadAndDelete(*id); ok {
+		close(doneChRaw.(chan struct{}))
+	}
+}
+
+// Cancel removes the message with the given ID from the egress queue,
+// stops its retransmission and forgets its SURBs, so that a reply to the
+// message is discarded. It returns ErrMessageNotFound if the message is
+// neither queued nor awaiting a reply.
+func (s *Session) Cancel(id *[cConstants.MessageIDLength]byte) error {
+	op := opCancel{
+		id:           id,
+		responseChan: make(chan error, 1),
+	}
+	select {
+	case s.opCh <- op:
+	case <-s.HaltCh():
+		return ErrHalted
+	}
+	select {
+	case err := <-op.responseChan:
+		return err
+	case <-s.HaltCh():
+		return ErrHalted
+	}
+}
+
+func (s *Session) doCancel(id *[cConstants.MessageIDLength]byte) error {
+	found := s.egressQueue.Remove(func(e Item) bool {
+		msg, ok := e.(*Message)
+		return ok && *msg.ID == *id
+	}) > 0
+	if found {
+		// wake a blocking sender waiting for the message to be sent
+		if sentWaitChanRaw, ok := s.sentWaitChanMap.LoadAndDelete(*id); ok {
+			close(sentWaitChanRaw.(chan *Message))
+		}
+	}
+	surbIDs := [][sConstants.SURBIDLength]byte{}
+	s.surbIDMap.Range(func(rawSurbID, rawMessage interface{}) bool {
+		if *rawMessage.(*Message).ID == *id {
+			surbIDs = append(surbIDs, rawSurbID.([sConstants.SURBIDLength]byte))
+		}
+		return true
+	})
+	for _, surbID := range surbIDs {
+		s.deleteSURB(surbID)
+		found = true
+	}
+	if !found {
+		return ErrMessageNotFound
 	}
-	// unreachable
+	s.messageDone(id)
+	s.log.Debugf("Cancelled message %x", *id)
+	return nil
 }
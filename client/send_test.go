@@ -0,0 +1,193 @@
+// send_test.go - mixnet client send tests
+// Copyright (C) 2022  David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"gopkg.in/eapache/channels.v1"
+
+	"github.com/katzenpost/katzenpost/core/log"
+)
+
+// newCancelTestSession returns a Session whose worker only handles opCancel.
+func newCancelTestSession(t *testing.T) *Session {
+	logBackend, err := log.New("", "DEBUG", false)
+	require.NoError(t, err)
+	s := &Session{
+		log:         logBackend.GetLogger("session"),
+		opCh:        make(chan workerOp, 8),
+		egressQueue: new(Queue),
+	}
+	s.Go(func() {
+		for {
+			select {
+			case <-s.HaltCh():
+				return
+			case op := <-s.opCh:
+				if op, ok := op.(opCancel); ok {
+					op.responseChan <- s.doCancel(op.id)
+				}
+			}
+		}
+	})
+	t.Cleanup(s.Halt)
+	return s
+}
+
+func TestCancel(t *testing.T) {
+	require := require.New(t)
+	s := newCancelTestSession(t)
+
+	queued := newTestMessage(t, false)
+	require.NoError(s.egressQueue.Push(queued))
+	inFlight := newTestMessage(t, true)
+	s.storeSURB(*inFlight.SURBID, inFlight)
+	// a retransmission of the in-flight message
+	retransmission := newTestMessage(t, true)
+	retransmission.ID = inFlight.ID
+	s.storeSURB(*retransmission.SURBID, retransmission)
+
+	require.NoError(s.Cancel(queued.ID))
+	_, err := s.egressQueue.Peek()
+	require.Equal(ErrQueueEmpty, err)
+	require.Equal(ErrMessageNotFound, s.Cancel(queued.ID))
+
+	require.NoError(s.Cancel(inFlight.ID))
+	_, ok := s.surbIDMap.Load(*inFlight.SURBID)
+	require.False(ok)
+	_, ok = s.surbIDMap.Load(*retransmission.SURBID)
+	require.False(ok)
+
+	// the retransmission timer does not retransmit cancelled messages
+	require.NoError(s.Push(inFlight))
+	require.Len(s.opCh, 0)
+}
+
+func TestBlockingSendContext(t *testing.T) {
+	require := require.New(t)
+	s := newCancelTestSession(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := s.blockingSend(ctx, newTestMessage(t, false))
+	require.Equal(context.Canceled, err)
+
+	// the message is removed from the queue when the context is done
+	msg := newTestMessage(t, false)
+	msg.IsBlocking = true
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err = s.blockingSend(ctx, msg)
+	require.Equal(context.DeadlineExceeded, err)
+	_, err = s.egressQueue.Peek()
+	require.Equal(ErrQueueEmpty, err)
+
+	// a blocking send is woken when its message is cancelled
+	msg = newTestMessage(t, false)
+	msg.IsBlocking = true
+	go func() {
+		for {
+			if _, err := s.egressQueue.Peek(); err == nil {
+				s.Cancel(msg.ID)
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}()
+	_, err = s.blockingSend(context.Background(), msg)
+	require.Equal(ErrMessageNotSent, err)
+}
+
+func TestBlockingSendReliableFailure(t *testing.T) {
+	require := require.New(t)
+	s := newCancelTestSession(t)
+	s.retransmitPolicy = &BackoffPolicy{MaxRetransmissions: 1}
+
+	// the reliable message is sent, and retransmitted once without a
+	// reply, past the round trip timeout of unreliable ones
+	msg := newTestMessage(t, true)
+	msg.IsBlocking = true
+	go func() {
+		for {
+			if _, err := s.egressQueue.Pop(); err == nil {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+		sentWaitChanRaw, _ := s.sentWaitChanMap.Load(*msg.ID)
+		sentWaitChanRaw.(chan *Message) <- msg
+		s.storeSURB(*msg.SURBID, msg)
+		msg.Retransmissions = 1
+		s.Push(msg)
+	}()
+	_, err := s.blockingSend(context.Background(), msg)
+	require.Equal(ErrRetransmissionsExhausted, err)
+}
+
+func TestCancelOnDone(t *testing.T) {
+	require := require.New(t)
+	s := newCancelTestSession(t)
+	s.eventCh = channels.NewInfiniteChannel()
+	s.retransmitPolicy = &BackoffPolicy{MaxRetransmissions: 1}
+
+	watch := func(ctx context.Context, msg *Message) chan struct{} {
+		s.cancelOnDone(ctx, msg.ID)
+		doneChRaw, ok := s.doneChanMap.Load(*msg.ID)
+		require.True(ok)
+		return doneChRaw.(chan struct{})
+	}
+	requireDone := func(msg *Message, doneCh chan struct{}) {
+		select {
+		case <-doneCh:
+		case <-time.After(time.Second):
+			require.Fail("the watcher of the message was not stopped")
+		}
+		_, ok := s.doneChanMap.Load(*msg.ID)
+		require.False(ok)
+	}
+
+	// the message is cancelled when the context is done
+	msg := newTestMessage(t, false)
+	require.NoError(s.egressQueue.Push(msg))
+	ctx, cancel := context.WithCancel(context.Background())
+	doneCh := watch(ctx, msg)
+	cancel()
+	requireDone(msg, doneCh)
+	_, err := s.egressQueue.Peek()
+	require.Equal(ErrQueueEmpty, err)
+
+	// the watcher stops when the message is cancelled
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	msg = newTestMessage(t, false)
+	require.NoError(s.egressQueue.Push(msg))
+	doneCh = watch(ctx, msg)
+	require.NoError(s.Cancel(msg.ID))
+	requireDone(msg, doneCh)
+
+	// the watcher stops when the message fails
+	msg = newTestMessage(t, true)
+	msg.Retransmissions = 1
+	s.storeSURB(*msg.SURBID, msg)
+	doneCh = watch(ctx, msg)
+	require.NoError(s.Push(msg))
+	requireDone(msg, doneCh)
+}
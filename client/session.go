@@ -44,9 +44,6 @@ import (
 type Session struct {
 	worker.Worker
 
-	geo    *sphinx.Geometry
-	sphinx *sphinx.Sphinx
-
 	cfg       *config.Config
 	pkiClient pki.Client
 	minclient *minclient.Client
@@ -70,8 +67,17 @@ type Session struct {
 	surbIDMap        sync.Map // [sConstants.SURBIDLength]byte -> *Message
 	sentWaitChanMap  sync.Map // MessageID -> chan *Message
 	replyWaitChanMap sync.Map // MessageID -> chan []byte
+	failWaitChanMap  sync.Map // MessageID -> chan error
+	doneChanMap      sync.Map // MessageID -> chan struct{}
 
 	decoyLoopTally uint64
+
+	// store persists the egress queue and the in-flight messages,
+	// or is nil if the Session is not persistent.
+	store *SessionStore
+
+	retransmitPolicyLock sync.RWMutex
+	retransmitPolicy     RetransmitPolicy
 }
 
 // New establishes a session with provider using key.
@@ -84,13 +90,23 @@ func NewSession(
 	cfg *config.Config,
 	linkKey wire.PrivateKey,
 	provider *pki.MixDescriptor) (*Session, error) {
+	return newSession(ctx, pkiClient, fatalErrCh, logBackend, cfg, linkKey, provider, nil)
+}
+
+func newSession(
+	ctx context.Context,
+	pkiClient pki.Client,
+	fatalErrCh chan error,
+	logBackend *log.Backend,
+	cfg *config.Config,
+	linkKey wire.PrivateKey,
+	provider *pki.MixDescriptor,
+	store *SessionStore) (*Session, error) {
 	var err error
 
 	clientLog := logBackend.GetLogger(fmt.Sprintf("%s_client", provider.Name))
 
 	s := &Session{
-		geo:         sphinx.DefaultGeometry(),
-		sphinx:      sphinx.DefaultSphinx(),
 		cfg:         cfg,
 		linkKey:     linkKey,
 		provider:    provider,
@@ -102,9 +118,16 @@ func NewSession(
 		EventSink:   make(chan Event),
 		opCh:        make(chan workerOp, 8),
 		egressQueue: new(Queue),
+		store:       store,
+
+		retransmitPolicy: NewBackoffPolicy(cfg.Debug),
 	}
 	// Configure the timerQ instance
 	s.timerQ = NewTimerQueue(s)
+	if store != nil {
+		s.egressQueue = NewPersistentQueue(store)
+		s.resume()
+	}
 	// Configure and bring up the minclient instance.
 	idHash := s.linkKey.PublicKey().Sum256()
 	// A per-connection tag (for Tor SOCKS5 stream isloation)
@@ -123,6 +146,8 @@ func NewSession(
 		DialContextFn:       cfg.UpstreamProxyConfig().ToDialContext(proxyContext),
 		PreferedTransports:  cfg.Debug.PreferedTransports,
 		MessagePollInterval: time.Duration(cfg.Debug.PollingInterval) * time.Millisecond,
+		EnablePushDelivery:  cfg.Debug.EnablePushDelivery,
+		DisablePollCover:    cfg.Debug.DisablePollCover,
 		EnableTimeSync:      false, // Be explicit about it.
 	}
 
@@ -189,7 +214,8 @@ func (s *Session) garbageCollect() {
 		message := rawMessage.(*Message)
 		if time.Now().After(message.SentAt.Add(message.ReplyETA).Add(cConstants.RoundTripTimeSlop)) {
 			s.log.Debug("Garbage collecting SURB ID Map entry for Message ID %x", message.ID)
-			s.surbIDMap.Delete(surbID)
+			s.deleteSURB(surbID)
+			s.messageDone(message.ID)
 			s.eventCh.In() <- &MessageIDGarbageCollected{
 				MessageID: message.ID,
 			}
@@ -269,14 +295,20 @@ func (s *Session) onACK(surbID *[sConstants.SURBIDLength]byte, ciphertext []byte
 		s.log.Debug("Strange, received reply with unexpected SURBID")
 		return nil
 	}
-	s.surbIDMap.Delete(*surbID)
+	s.deleteSURB(*surbID)
 	msg := rawMessage.(*Message)
-	plaintext, err := s.sphinx.DecryptSURBPayload(ciphertext, msg.Key)
+	s.messageDone(msg.ID)
+	mySphinx, err := sphinx.FromGeometry(s.SphinxGeometry())
+	if err != nil {
+		s.log.Infof("Discarding SURB Reply, no usable Sphinx geometry: %s", err)
+		return nil
+	}
+	plaintext, err := mySphinx.DecryptSURBPayload(ciphertext, msg.Key)
 	if err != nil {
 		s.log.Infof("Discarding SURB Reply, decryption failure: %s", err)
 		return nil
 	}
-	if len(plaintext) != s.geo.ForwardPayloadLength {
+	if len(plaintext) != mySphinx.Geometry().ForwardPayloadLength {
 		s.log.Warningf("Discarding SURB %v: Invalid payload size: %v", idStr, len(plaintext))
 		return nil
 	}
@@ -334,6 +366,12 @@ func (s *Session) CurrentDocument() *pki.Document {
 	return s.minclient.CurrentDocument()
 }
 
+// SphinxGeometry returns the Sphinx geometry published in the current
+// PKI document, or nil iff no document exists.
+func (s *Session) SphinxGeometry() *sphinx.Geometry {
+	return s.minclient.SphinxGeometry()
+}
+
 func (s *Session) Push(i Item) error {
 	// Push checks whether a message was ACK'd already and if it has
 	// not, reschedules the message for transmission again
@@ -343,12 +381,106 @@ func (s *Session) Push(i Item) error {
 	}
 	if _, ok := s.surbIDMap.Load(*m.SURBID); ok {
 		// still waiting for a SURB-ACK that hasn't arrived
+		if !s.RetransmitPolicy().ShouldRetransmit(m.Retransmissions) {
+			s.deleteSURB(*m.SURBID)
+			s.log.Debugf("Giving up on message %x after %d retransmissions", *m.ID, m.Retransmissions)
+			s.messageDone(m.ID)
+			if m.IsBlocking {
+				// the caller of the blocking send is waiting for
+				// the failure rather than for an event
+				if failWaitChanRaw, ok := s.failWaitChanMap.Load(*m.ID); ok {
+					select {
+					case failWaitChanRaw.(chan error) <- ErrRetransmissionsExhausted:
+					default:
+					}
+				}
+				return nil
+			}
+			s.eventCh.In() <- &MessageFailedEvent{
+				MessageID:       m.ID,
+				Retransmissions: m.Retransmissions,
+				Err:             ErrRetransmissionsExhausted,
+			}
+			return nil
+		}
+		// the message stays in the store until doRetransmit has queued
+		// it again, so that it is not lost if the client stops before
 		s.surbIDMap.Delete(*m.SURBID)
 		s.opCh <- opRetransmit{msg: m}
 	}
 	return nil
 }
 
+// RetransmitPolicy returns the RetransmitPolicy of reliable messages.
+func (s *Session) RetransmitPolicy() RetransmitPolicy {
+	s.retransmitPolicyLock.RLock()
+	defer s.retransmitPolicyLock.RUnlock()
+	return s.retransmitPolicy
+}
+
+// SetRetransmitPolicy replaces the RetransmitPolicy of reliable messages,
+// which by default is the BackoffPolicy of the client configuration.
+func (s *Session) SetRetransmitPolicy(policy RetransmitPolicy) {
+	s.retransmitPolicyLock.Lock()
+	defer s.retransmitPolicyLock.Unlock()
+	s.retransmitPolicy = policy
+}
+
+// storeSURB records the message awaiting a reply to the given SURB ID.
+func (s *Session) storeSURB(surbID [sConstants.SURBIDLength]byte, msg *Message) {
+	s.surbIDMap.Store(surbID, msg)
+	if s.store != nil && isPersistent(msg) {
+		if err := s.store.addInFlight(msg); err != nil {
+			s.log.Errorf("Failed to persist in-flight message: %s", err)
+		}
+	}
+}
+
+func (s *Session) deleteSURB(surbID [sConstants.SURBIDLength]byte) {
+	s.surbIDMap.Delete(surbID)
+	if s.store != nil {
+		if err := s.store.removeInFlight(&surbID); err != nil {
+			s.log.Errorf("Failed to remove in-flight message from store: %s", err)
+		}
+	}
+}
+
+// resume restores the egress queue and the in-flight messages from the
+// store. Reliable messages are retransmitted if no reply arrives before
+// their retransmission deadline, as they would have been had the session
+// not been restarted.
+func (s *Session) resume() {
+	pending, inFlight, err := s.store.messages()
+	if err != nil {
+		s.log.Errorf("Failed to load persisted messages: %s", err)
+		return
+	}
+	q := s.egressQueue.(*PersistentQueue)
+	for _, msg := range pending {
+		if err := q.Queue.Push(msg); err != nil {
+			s.log.Errorf("Failed to resume pending message %x: %s", *msg.ID, err)
+		}
+	}
+	now := time.Now()
+	for _, msg := range inFlight {
+		if msg.SURBID == nil {
+			continue
+		}
+		expired := now.After(msg.SentAt.Add(msg.ReplyETA).Add(cConstants.RoundTripTimeSlop))
+		if expired && !msg.Reliable {
+			if err := s.store.removeInFlight(msg.SURBID); err != nil {
+				s.log.Errorf("Failed to remove in-flight message from store: %s", err)
+			}
+			continue
+		}
+		s.surbIDMap.Store(*msg.SURBID, msg)
+		if msg.Reliable {
+			s.timerQ.Push(msg)
+		}
+	}
+	s.log.Debugf("Resumed %d pending and %d in-flight messages", len(pending), len(inFlight))
+}
+
 func (s *Session) ForceFetchPKI() {
 	s.minclient.ForceFetchPKI()
 }
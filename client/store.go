@@ -0,0 +1,370 @@
+// store.go - Persistent session state.
+// Copyright (C) 2022  David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/fxamacker/cbor/v2"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/nacl/secretbox"
+
+	cConstants "github.com/katzenpost/katzenpost/client/constants"
+	"github.com/katzenpost/katzenpost/core/crypto/rand"
+	sConstants "github.com/katzenpost/katzenpost/core/sphinx/constants"
+	"github.com/katzenpost/katzenpost/core/wire"
+)
+
+const (
+	storeKeySize   = 32
+	storeNonceSize = 24
+	storeSaltSize  = 16
+
+	// SessionStoreVersion is the version of the SessionStore file format.
+	SessionStoreVersion = 2
+)
+
+var (
+	ErrStoreDecryptFailed = errors.New("failed to decrypt session store")
+	ErrStoreVersion       = errors.New("unsupported session store version")
+)
+
+// sessionState is the persisted state of a Session.
+type sessionState struct {
+	// LinkKey is the link key of the Session, which identifies the
+	// Session to its Provider.
+	LinkKey []byte
+
+	// Provider is the name of the Provider of the Session.
+	Provider string
+
+	// Pending are the messages in the egress queue, in order.
+	Pending []*storedMessage
+
+	// InFlight are the messages which have been sent and are awaiting
+	// a SURB reply.
+	InFlight []*storedMessage
+}
+
+// storedMessage is a serialized snapshot of a Message, taken when it is
+// persisted by the goroutine sending it, so that saving the state never
+// reads the Messages the Session shares between its goroutines.
+type storedMessage struct {
+	ID      [cConstants.MessageIDLength]byte
+	SURBID  []byte
+	Message []byte
+}
+
+func newStoredMessage(msg *Message) (*storedMessage, error) {
+	raw, err := cbor.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+	m := &storedMessage{
+		ID:      *msg.ID,
+		Message: raw,
+	}
+	if msg.SURBID != nil {
+		m.SURBID = append([]byte{}, msg.SURBID[:]...)
+	}
+	return m, nil
+}
+
+// storeFile is the serialized form of the SessionStore file.
+type storeFile struct {
+	Version    uint32
+	Salt       []byte
+	Ciphertext []byte
+}
+
+// SessionStore is an encrypted file which persists the state a Session
+// needs to resume its sends after a restart: its link key and Provider,
+// its egress queue, and the messages awaiting a SURB reply along with
+// their SURB decryption keys.
+type SessionStore struct {
+	sync.Mutex
+
+	path  string
+	salt  []byte
+	key   *[storeKeySize]byte
+	state *sessionState
+}
+
+// OpenSessionStore opens the SessionStore at the given path, creating it
+// if it does not exist, encrypted with a key derived from the passphrase.
+func OpenSessionStore(path string, passphrase []byte) (*SessionStore, error) {
+	s := &SessionStore{
+		path:  path,
+		state: new(sessionState),
+	}
+	raw, err := os.ReadFile(path)
+	switch {
+	case os.IsNotExist(err):
+		s.salt = make([]byte, storeSaltSize)
+		if _, err := rand.Reader.Read(s.salt); err != nil {
+			return nil, err
+		}
+		s.key = deriveStoreKey(passphrase, s.salt)
+		return s, nil
+	case err != nil:
+		return nil, err
+	}
+	f := new(storeFile)
+	if err := cbor.Unmarshal(raw, f); err != nil {
+		return nil, err
+	}
+	if f.Version != SessionStoreVersion {
+		return nil, ErrStoreVersion
+	}
+	if len(f.Ciphertext) < storeNonceSize {
+		return nil, ErrStoreDecryptFailed
+	}
+	s.salt = f.Salt
+	s.key = deriveStoreKey(passphrase, s.salt)
+	nonce := [storeNonceSize]byte{}
+	copy(nonce[:], f.Ciphertext[:storeNonceSize])
+	plaintext, ok := secretbox.Open(nil, f.Ciphertext[storeNonceSize:], &nonce, s.key)
+	if !ok {
+		return nil, ErrStoreDecryptFailed
+	}
+	if err := cbor.Unmarshal(plaintext, s.state); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func deriveStoreKey(passphrase, salt []byte) *[storeKeySize]byte {
+	secret := argon2.IDKey(passphrase, salt, 3, 32*1024, 4, storeKeySize)
+	key := [storeKeySize]byte{}
+	copy(key[:], secret)
+	return &key
+}
+
+// save encrypts the state and atomically replaces the store file.
+// The SessionStore must be locked.
+func (s *SessionStore) save() error {
+	plaintext, err := cbor.Marshal(s.state)
+	if err != nil {
+		return err
+	}
+	nonce := [storeNonceSize]byte{}
+	if _, err := rand.Reader.Read(nonce[:]); err != nil {
+		return err
+	}
+	raw, err := cbor.Marshal(&storeFile{
+		Version:    SessionStoreVersion,
+		Salt:       s.salt,
+		Ciphertext: secretbox.Seal(nonce[:], plaintext, &nonce, s.key),
+	})
+	if err != nil {
+		return err
+	}
+	tmpFn := fmt.Sprintf("%s.tmp", s.path)
+	out, err := os.OpenFile(tmpFn, os.O_TRUNC|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = out.Write(raw); err != nil {
+		out.Close()
+		return err
+	}
+	if err = out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	if err = out.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(tmpFn, s.path); err != nil {
+		return err
+	}
+	dir, err := os.Open(filepath.Dir(s.path))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+// identity returns the link key and Provider name of the persisted
+// Session, or nil and an empty name if none were persisted.
+func (s *SessionStore) identity() (wire.PrivateKey, string, error) {
+	s.Lock()
+	defer s.Unlock()
+	if s.state.LinkKey == nil {
+		return nil, "", nil
+	}
+	linkKey, err := wire.DefaultScheme.PrivateKeyFromBytes(s.state.LinkKey)
+	if err != nil {
+		return nil, "", err
+	}
+	return linkKey, s.state.Provider, nil
+}
+
+func (s *SessionStore) setIdentity(linkKey wire.PrivateKey, provider string) error {
+	s.Lock()
+	defer s.Unlock()
+	s.state.LinkKey = linkKey.Bytes()
+	s.state.Provider = provider
+	return s.save()
+}
+
+// isPersistent returns true if the message should be persisted. Decoys
+// and blocking sends, whose callers do not survive a restart, are not.
+func isPersistent(msg *Message) bool {
+	return !msg.IsDecoy && !msg.IsBlocking
+}
+
+func (s *SessionStore) pushPending(msg *storedMessage) error {
+	s.Lock()
+	defer s.Unlock()
+	s.state.Pending = append(s.state.Pending, msg)
+	return s.save()
+}
+
+func (s *SessionStore) popPending(msg *Message) error {
+	s.Lock()
+	defer s.Unlock()
+	for i, m := range s.state.Pending {
+		if m.ID == *msg.ID {
+			s.state.Pending = append(s.state.Pending[:i], s.state.Pending[i+1:]...)
+			return s.save()
+		}
+	}
+	return nil
+}
+
+func (s *SessionStore) addInFlight(msg *Message) error {
+	m, err := newStoredMessage(msg)
+	if err != nil {
+		return err
+	}
+	s.Lock()
+	defer s.Unlock()
+	s.state.InFlight = append(s.state.InFlight, m)
+	return s.save()
+}
+
+func (s *SessionStore) removeInFlight(surbID *[sConstants.SURBIDLength]byte) error {
+	s.Lock()
+	defer s.Unlock()
+	for i, m := range s.state.InFlight {
+		if bytes.Equal(m.SURBID, surbID[:]) {
+			s.state.InFlight = append(s.state.InFlight[:i], s.state.InFlight[i+1:]...)
+			return s.save()
+		}
+	}
+	return nil
+}
+
+// messages returns the persisted pending and in-flight messages.
+func (s *SessionStore) messages() ([]*Message, []*Message, error) {
+	s.Lock()
+	defer s.Unlock()
+	pending, err := loadStoredMessages(s.state.Pending)
+	if err != nil {
+		return nil, nil, err
+	}
+	inFlight, err := loadStoredMessages(s.state.InFlight)
+	if err != nil {
+		return nil, nil, err
+	}
+	return pending, inFlight, nil
+}
+
+func loadStoredMessages(stored []*storedMessage) ([]*Message, error) {
+	messages := make([]*Message, 0, len(stored))
+	for _, m := range stored {
+		msg := new(Message)
+		if err := cbor.Unmarshal(m.Message, msg); err != nil {
+			return nil, err
+		}
+		messages = append(messages, msg)
+	}
+	return messages, nil
+}
+
+// PersistentQueue is an egress queue which persists its messages in a
+// SessionStore.
+type PersistentQueue struct {
+	Queue
+
+	store *SessionStore
+}
+
+// NewPersistentQueue returns a new PersistentQueue backed by the store.
+func NewPersistentQueue(store *SessionStore) *PersistentQueue {
+	return &PersistentQueue{store: store}
+}
+
+// Push pushes the item onto the queue and persists it. The message is
+// persisted as it is before being pushed, as it is then sent by the
+// worker goroutine.
+func (q *PersistentQueue) Push(e Item) error {
+	var stored *storedMessage
+	if msg, ok := e.(*Message); ok && isPersistent(msg) {
+		var err error
+		if stored, err = newStoredMessage(msg); err != nil {
+			return err
+		}
+	}
+	if err := q.Queue.Push(e); err != nil {
+		return err
+	}
+	if stored != nil {
+		return q.store.pushPending(stored)
+	}
+	return nil
+}
+
+// Pop pops the next item off the queue and removes it from the store.
+func (q *PersistentQueue) Pop() (Item, error) {
+	e, err := q.Queue.Pop()
+	if err != nil {
+		return nil, err
+	}
+	if msg, ok := e.(*Message); ok && isPersistent(msg) {
+		return e, q.store.popPending(msg)
+	}
+	return e, nil
+}
+
+// Remove removes the items for which the filter returns true from the
+// queue and the store.
+func (q *PersistentQueue) Remove(filter func(Item) bool) int {
+	removed := []*Message{}
+	n := q.Queue.Remove(func(e Item) bool {
+		if !filter(e) {
+			return false
+		}
+		if msg, ok := e.(*Message); ok && isPersistent(msg) {
+			removed = append(removed, msg)
+		}
+		return true
+	})
+	for _, msg := range removed {
+		// a failure to persist the removal only causes the message
+		// to be resent if the session is restarted
+		q.store.popPending(msg)
+	}
+	return n
+}
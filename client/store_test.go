@@ -0,0 +1,186 @@
+// store_test.go - Persistent session state tests.
+// Copyright (C) 2022  David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	cConstants "github.com/katzenpost/katzenpost/client/constants"
+	"github.com/katzenpost/katzenpost/core/crypto/rand"
+	"github.com/katzenpost/katzenpost/core/log"
+	sConstants "github.com/katzenpost/katzenpost/core/sphinx/constants"
+	"github.com/katzenpost/katzenpost/core/wire"
+)
+
+func newTestMessage(t *testing.T, reliable bool) *Message {
+	id := [cConstants.MessageIDLength]byte{}
+	_, err := rand.Reader.Read(id[:])
+	require.NoError(t, err)
+	surbID := [sConstants.SURBIDLength]byte{}
+	_, err = rand.Reader.Read(surbID[:])
+	require.NoError(t, err)
+	return &Message{
+		ID:        &id,
+		Recipient: "recipient",
+		Provider:  "provider",
+		Payload:   []byte("payload"),
+		SURBID:    &surbID,
+		Key:       []byte("key"),
+		WithSURB:  true,
+		Reliable:  reliable,
+	}
+}
+
+func TestSessionStore(t *testing.T) {
+	require := require.New(t)
+	path := filepath.Join(t.TempDir(), "session_store")
+
+	store, err := OpenSessionStore(path, []byte("passphrase"))
+	require.NoError(err)
+	linkKey, provider, err := store.identity()
+	require.NoError(err)
+	require.Nil(linkKey)
+	require.Equal("", provider)
+
+	linkKey, _ = wire.DefaultScheme.GenerateKeypair(rand.Reader)
+	require.NoError(store.setIdentity(linkKey, "provider"))
+
+	q := NewPersistentQueue(store)
+	m1 := newTestMessage(t, true)
+	m2 := newTestMessage(t, false)
+	decoy := newTestMessage(t, false)
+	decoy.IsDecoy = true
+	require.NoError(q.Push(m1))
+	require.NoError(q.Push(decoy))
+	require.NoError(q.Push(m2))
+	e, err := q.Pop()
+	require.NoError(err)
+	require.Equal(m1, e)
+	require.NoError(store.addInFlight(m1))
+
+	// the store keeps snapshots of the messages, which the session goes
+	// on updating
+	key := m1.Key
+	m1.Key = []byte("updated")
+
+	_, err = OpenSessionStore(path, []byte("wrong"))
+	require.Equal(ErrStoreDecryptFailed, err)
+
+	store, err = OpenSessionStore(path, []byte("passphrase"))
+	require.NoError(err)
+	loadedKey, provider, err := store.identity()
+	require.NoError(err)
+	require.Equal(linkKey.Bytes(), loadedKey.Bytes())
+	require.Equal("provider", provider)
+	pending, inFlight, err := store.messages()
+	require.NoError(err)
+	require.Len(pending, 1)
+	require.Equal(*m2.ID, *pending[0].ID)
+	require.Equal(m2.Payload, pending[0].Payload)
+	require.Len(inFlight, 1)
+	require.Equal(*m1.SURBID, *inFlight[0].SURBID)
+	require.Equal(key, inFlight[0].Key)
+
+	require.NoError(store.removeInFlight(m1.SURBID))
+	_, inFlight, err = store.messages()
+	require.NoError(err)
+	require.Len(inFlight, 0)
+}
+
+func TestSessionResume(t *testing.T) {
+	require := require.New(t)
+	path := filepath.Join(t.TempDir(), "session_store")
+	store, err := OpenSessionStore(path, []byte("passphrase"))
+	require.NoError(err)
+
+	pending := newTestMessage(t, false)
+	require.NoError(NewPersistentQueue(store).Push(pending))
+	inFlight := newTestMessage(t, false)
+	inFlight.SentAt = time.Now()
+	inFlight.ReplyETA = time.Minute
+	require.NoError(store.addInFlight(inFlight))
+	expired := newTestMessage(t, false)
+	expired.SentAt = time.Now().Add(-time.Hour)
+	require.NoError(store.addInFlight(expired))
+	reliable := newTestMessage(t, true)
+	reliable.SentAt = time.Now().Add(-time.Hour)
+	require.NoError(store.addInFlight(reliable))
+
+	logBackend, err := log.New("", "DEBUG", false)
+	require.NoError(err)
+	s := &Session{
+		log:   logBackend.GetLogger("session"),
+		store: store,
+	}
+	s.timerQ = NewTimerQueue(s)
+	s.egressQueue = NewPersistentQueue(store)
+	s.resume()
+
+	e, err := s.egressQueue.Peek()
+	require.NoError(err)
+	require.Equal(*pending.ID, *e.(*Message).ID)
+	_, ok := s.surbIDMap.Load(*inFlight.SURBID)
+	require.True(ok)
+	_, ok = s.surbIDMap.Load(*expired.SURBID)
+	require.False(ok)
+	_, ok = s.surbIDMap.Load(*reliable.SURBID)
+	require.True(ok)
+	require.Equal(1, s.timerQ.priq.Len())
+
+	// the expired message was removed from the store
+	p, f, err := store.messages()
+	require.NoError(err)
+	require.Len(p, 1)
+	require.Len(f, 2)
+}
+
+func TestRetransmissionPersisted(t *testing.T) {
+	require := require.New(t)
+	path := filepath.Join(t.TempDir(), "session_store")
+	store, err := OpenSessionStore(path, []byte("passphrase"))
+	require.NoError(err)
+	logBackend, err := log.New("", "DEBUG", false)
+	require.NoError(err)
+	s := &Session{
+		log:              logBackend.GetLogger("session"),
+		opCh:             make(chan workerOp, 8),
+		store:            store,
+		egressQueue:      NewPersistentQueue(store),
+		retransmitPolicy: &BackoffPolicy{Backoff: 2},
+	}
+
+	// the message stays in flight until its retransmission is queued
+	msg := newTestMessage(t, true)
+	s.storeSURB(*msg.SURBID, msg)
+	require.NoError(s.Push(msg))
+	pending, inFlight, err := store.messages()
+	require.NoError(err)
+	require.Len(pending, 0)
+	require.Len(inFlight, 1)
+
+	op := <-s.opCh
+	s.doRetransmit(op.(opRetransmit).msg)
+	pending, inFlight, err = store.messages()
+	require.NoError(err)
+	require.Len(pending, 1)
+	require.Equal(*msg.ID, *pending[0].ID)
+	require.Len(inFlight, 0)
+}
@@ -43,6 +43,11 @@ type opRetransmit struct {
 	msg *Message
 }
 
+type opCancel struct {
+	id           *[cConstants.MessageIDLength]byte
+	responseChan chan error
+}
+
 func (s *Session) connStatusChange(op opConnStatusChanged) bool {
 	isConnected := op.isConnected
 	if isConnected {
@@ -125,6 +130,8 @@ func (s *Session) worker() {
 			switch op := qo.(type) {
 			case opRetransmit:
 				s.doRetransmit(op.msg)
+			case opCancel:
+				op.responseChan <- s.doCancel(op.id)
 			case opConnStatusChanged:
 				newConnectedStatus := s.connStatusChange(op)
 				isConnected = newConnectedStatus
@@ -168,10 +168,14 @@ func (c *Certificate) message() ([]byte, error) {
 }
 
 func (c *Certificate) sanityCheck() error {
+	current, _, _ := epochtime.Now()
+	return c.sanityCheckAt(current)
+}
+
+func (c *Certificate) sanityCheckAt(current uint64) error {
 	if c.Version != CertVersion {
 		return ErrVersionMismatch
 	}
-	current, _, _ := epochtime.Now()
 	if current >= c.Expiration {
 		return ErrCertificateExpired
 	}
@@ -360,12 +364,20 @@ func AddSignature(verifier Verifier, signature Signature, rawCert []byte) ([]byt
 // Verify is used to verify one of the signatures attached to the certificate.
 // It returns the certified data if the signature is valid.
 func Verify(verifier Verifier, rawCert []byte) ([]byte, error) {
+	current, _, _ := epochtime.Now()
+	return VerifyAt(verifier, rawCert, current)
+}
+
+// VerifyAt is like Verify, but checks the expiration of the certificate
+// against the given epoch instead of the current one, so that archived
+// certificates may be verified.
+func VerifyAt(verifier Verifier, rawCert []byte, epoch uint64) ([]byte, error) {
 	cert := new(Certificate)
 	err := cbor.Unmarshal(rawCert, cert)
 	if err != nil {
 		return nil, ErrImpossibleEncode
 	}
-	err = cert.sanityCheck()
+	err = cert.sanityCheckAt(epoch)
 	if err != nil {
 		return nil, err
 	}
@@ -69,6 +69,25 @@ func TestCertificate(t *testing.T) {
 	assert.Equal(mesg, toSign)
 }
 
+func TestVerifyAt(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	signingPrivKey, signingPubKey := Scheme.NewKeypair()
+	current, _, _ := epochtime.Now()
+
+	toSign := []byte("archived")
+	certificate, err := Sign(signingPrivKey, signingPubKey, toSign, current+1)
+	require.NoError(err)
+
+	mesg, err := VerifyAt(signingPubKey, certificate, current)
+	require.NoError(err)
+	require.Equal(toSign, mesg)
+
+	_, err = VerifyAt(signingPubKey, certificate, current+1)
+	require.Equal(ErrCertificateExpired, err)
+}
+
 func TestBadCertificate(t *testing.T) {
 	t.Parallel()
 
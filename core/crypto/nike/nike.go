@@ -50,12 +50,23 @@ type PublicKey interface {
 // non-interactive key exchange.
 type Nike interface {
 
+	// Name returns the name of the NIKE scheme.
+	Name() string
+
 	// PublicKeySize returns the size in bytes of the public key.
 	PublicKeySize() int
 
 	// PrivateKeySize returns the size in bytes of the private key.
 	PrivateKeySize() int
 
+	// NewEmptyPublicKey returns an uninitialized public key which is
+	// suitable to be loaded via FromBytes.
+	NewEmptyPublicKey() PublicKey
+
+	// NewEmptyPrivateKey returns an uninitialized private key which is
+	// suitable to be loaded via FromBytes.
+	NewEmptyPrivateKey() PrivateKey
+
 	// NewKeypair returns a newly generated key pair.
 	NewKeypair() (PrivateKey, PublicKey)
 
@@ -0,0 +1,49 @@
+// schemes.go - NIKE scheme registry.
+// Copyright (C) 2022  David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package schemes provides a registry of the NIKE schemes which may be
+// selected by name, for example from a Sphinx geometry.
+package schemes
+
+import (
+	"strings"
+
+	"github.com/katzenpost/katzenpost/core/crypto/nike"
+	"github.com/katzenpost/katzenpost/core/crypto/nike/ecdh"
+	"github.com/katzenpost/katzenpost/core/crypto/rand"
+)
+
+var allSchemes = []nike.Nike{
+	ecdh.NewEcdhNike(rand.Reader),
+}
+
+// ByName returns the NIKE scheme with the given name, or nil iff
+// no such scheme is known.  Names are matched case insensitively.
+func ByName(name string) nike.Nike {
+	for _, scheme := range allSchemes {
+		if strings.EqualFold(scheme.Name(), name) {
+			return scheme
+		}
+	}
+	return nil
+}
+
+// All returns all of the known NIKE schemes.
+func All() []nike.Nike {
+	a := make([]nike.Nike, len(allSchemes))
+	copy(a, allSchemes)
+	return a
+}
@@ -23,13 +23,18 @@ import (
 	"fmt"
 	"net"
 	"strconv"
+	"strings"
 
+	"github.com/cloudflare/circl/kem"
+	kemschemes "github.com/cloudflare/circl/kem/schemes"
 	"github.com/fxamacker/cbor/v2"
 	"golang.org/x/net/idna"
 
 	"github.com/katzenpost/katzenpost/core/crypto/cert"
-	"github.com/katzenpost/katzenpost/core/crypto/ecdh"
+	"github.com/katzenpost/katzenpost/core/crypto/nike"
+	nikeschemes "github.com/katzenpost/katzenpost/core/crypto/nike/schemes"
 	"github.com/katzenpost/katzenpost/core/crypto/sign"
+	"github.com/katzenpost/katzenpost/core/sphinx"
 	"github.com/katzenpost/katzenpost/core/sphinx/constants"
 	"github.com/katzenpost/katzenpost/core/wire"
 )
@@ -61,8 +66,13 @@ type MixDescriptor struct {
 	// LinkKey is the node's wire protocol public key.
 	LinkKey wire.PublicKey
 
-	// MixKeys is a map of epochs to Sphinx keys.
-	MixKeys map[uint64]*ecdh.PublicKey
+	// MixKeys is a map of epochs to serialized Sphinx public keys, of the
+	// NIKE or KEM scheme named by the Document's SphinxGeometry.
+	MixKeys map[uint64][]byte
+
+	// MixKeyScheme is the name of the NIKE or KEM scheme of the MixKeys.
+	// If omitted, the scheme is that of the Document's SphinxGeometry.
+	MixKeyScheme string
 
 	// Addresses is the map of transport to address combinations that can
 	// be used to reach the node.
@@ -75,9 +85,21 @@ type MixDescriptor struct {
 	// Provider indicates that this Mix is a Provider
 	Provider bool
 
-	// LoadWeight is the node's load balancing weight (unused).
+	// LoadWeight is the node's declared load balancing weight, which
+	// should be proportional to its bandwidth.  It is informative only,
+	// path selection uses the weights assigned by the authorities.
 	LoadWeight uint8
 
+	// LoopReport is the node's measurement of the decoy loops it sent
+	// through its peers during a past epoch, from which the directory
+	// authorities derive the reputation of the nodes.
+	LoopReport *LoopReport `cbor:",omitempty"`
+
+	// KeyRotation is the signed KeyRotation statement from the node's
+	// previous identity key to its IdentityKey, by which the directory
+	// authorities transfer the authorization of the node to the new key.
+	KeyRotation []byte `cbor:",omitempty"`
+
 	// AuthenticationType is the authentication mechanism required
 	AuthenticationType string
 
@@ -271,7 +293,9 @@ func IsDescriptorWellFormed(d *MixDescriptor, epoch uint64) error {
 			if !d.Provider {
 				return fmt.Errorf("Non-provider published Transport '%v'", transport)
 			}
-			if transport != TransportTCP {
+			switch transport {
+			case TransportTCP, TransportQUIC, TransportWebSocket, TransportWebSocketTLS:
+			default:
 				// Ignore transports that don't have validation logic.
 				continue
 			}
@@ -311,6 +335,11 @@ func IsDescriptorWellFormed(d *MixDescriptor, epoch uint64) error {
 	if len(d.Addresses[TransportTCPv4]) == 0 {
 		return fmt.Errorf("Descriptor contains no TCPv4 addresses")
 	}
+	if d.LoopReport != nil {
+		if err := validateLoopReport(d.LoopReport, d.IdentityKey.Sum256(), epoch); err != nil {
+			return fmt.Errorf("Descriptor contains invalid LoopReport: %v", err)
+		}
+	}
 	if !d.Provider {
 		if d.Kaetzchen != nil {
 			return fmt.Errorf("Descriptor contains Kaetzchen when a mix")
@@ -323,6 +352,72 @@ func IsDescriptorWellFormed(d *MixDescriptor, epoch uint64) error {
 	return nil
 }
 
+// NrHops returns the number of Sphinx hops a client packet takes through
+// a topology of nrLayers: a Provider, every layer, and a Provider.
+func NrHops(nrLayers int) int {
+	return nrLayers + 2
+}
+
+// IsTopologyGeometryCompatible returns a descriptive error iff client
+// packets through a topology of nrLayers can not be routed with Sphinx
+// packets of the given geometry.
+func IsTopologyGeometryCompatible(nrLayers int, geo *sphinx.Geometry) error {
+	if NrHops(nrLayers) > geo.NrHops {
+		return fmt.Errorf("%d layers exceed SphinxGeometry NrHops %d", nrLayers, geo.NrHops)
+	}
+	return nil
+}
+
+// IsDescriptorGeometryCompatible returns a descriptive error iff the
+// descriptor's mix keys can not be used to construct Sphinx packets of
+// the given geometry.
+func IsDescriptorGeometryCompatible(d *MixDescriptor, geo *sphinx.Geometry) error {
+	if d.MixKeyScheme != "" {
+		scheme := geo.NIKEName
+		if geo.KEMName != "" {
+			scheme = geo.KEMName
+		}
+		if !strings.EqualFold(d.MixKeyScheme, scheme) {
+			return fmt.Errorf("Descriptor '%v' MixKeyScheme '%v' does not match '%v'", d.Name, d.MixKeyScheme, scheme)
+		}
+	}
+	for epoch, k := range d.MixKeys {
+		if _, _, err := UnmarshalMixKey(geo, k); err != nil {
+			return fmt.Errorf("Descriptor '%v' MixKey[%v] is invalid: %v", d.Name, epoch, err)
+		}
+	}
+	return nil
+}
+
+// UnmarshalMixKey deserializes a mix key published in a descriptor using the
+// NIKE or KEM scheme named by the given geometry.  Exactly one of the returned
+// public keys will be non-nil on success.
+func UnmarshalMixKey(geo *sphinx.Geometry, b []byte) (nike.PublicKey, kem.PublicKey, error) {
+	if geo.KEMName != "" {
+		scheme := kemschemes.ByName(geo.KEMName)
+		if scheme == nil {
+			return nil, nil, fmt.Errorf("unknown KEM '%v'", geo.KEMName)
+		}
+		pk, err := scheme.UnmarshalBinaryPublicKey(b)
+		if err != nil {
+			return nil, nil, err
+		}
+		return nil, pk, nil
+	}
+	scheme := nikeschemes.ByName(geo.NIKEName)
+	if scheme == nil {
+		return nil, nil, fmt.Errorf("unknown NIKE '%v'", geo.NIKEName)
+	}
+	if len(b) != scheme.PublicKeySize() {
+		return nil, nil, fmt.Errorf("invalid '%v' public key length: %v", geo.NIKEName, len(b))
+	}
+	pk, err := scheme.UnmarshalBinaryPublicKey(b)
+	if err != nil {
+		return nil, nil, err
+	}
+	return pk, nil, nil
+}
+
 func validateKaetzchen(m map[string]map[string]interface{}) error {
 	const keyEndpoint = "endpoint"
 
@@ -25,6 +25,7 @@ import (
 	"github.com/katzenpost/katzenpost/core/crypto/cert"
 	"github.com/katzenpost/katzenpost/core/crypto/ecdh"
 	"github.com/katzenpost/katzenpost/core/crypto/rand"
+	"github.com/katzenpost/katzenpost/core/sphinx"
 	"github.com/katzenpost/katzenpost/core/wire"
 )
 
@@ -55,12 +56,13 @@ func TestDescriptor(t *testing.T) {
 	d.IdentityKey = identityPub
 	scheme := wire.DefaultScheme
 	_, d.LinkKey = scheme.GenerateKeypair(rand.Reader)
-	d.MixKeys = make(map[uint64]*ecdh.PublicKey)
+	d.MixKeys = make(map[uint64][]byte)
 	for e := debugTestEpoch; e < debugTestEpoch+3; e++ {
 		mPriv, err := ecdh.NewKeypair(rand.Reader)
 		require.NoError(err, "[%d]: ecdh.NewKeypair()", e)
-		d.MixKeys[uint64(e)] = mPriv.PublicKey()
+		d.MixKeys[uint64(e)] = mPriv.PublicKey().Bytes()
 	}
+	d.MixKeyScheme = "x25519"
 	d.Kaetzchen = make(map[string]map[string]interface{})
 	d.Kaetzchen["miau"] = map[string]interface{}{
 		"endpoint":  "+miau",
@@ -68,6 +70,12 @@ func TestDescriptor(t *testing.T) {
 	}
 	err = IsDescriptorWellFormed(d, debugTestEpoch)
 	require.NoError(err, "IsDescriptorWellFormed(good)")
+	err = IsDescriptorGeometryCompatible(d, sphinx.DefaultGeometry())
+	require.NoError(err, "IsDescriptorGeometryCompatible(good)")
+	d.MixKeyScheme = "ctidh"
+	err = IsDescriptorGeometryCompatible(d, sphinx.DefaultGeometry())
+	require.Error(err, "IsDescriptorGeometryCompatible(scheme mismatch)")
+	d.MixKeyScheme = "x25519"
 
 	// Sign the descriptor.
 	signed, err := SignDescriptor(identityPriv, identityPub, d)
@@ -85,10 +93,19 @@ func TestDescriptor(t *testing.T) {
 	assert.Equal(d.LoadWeight, dd.LoadWeight, "LoadWeight")
 	assert.Equal(d.IdentityKey.Bytes(), dd.IdentityKey.Bytes(), "IdentityKey")
 	assert.Equal(d.LinkKey.Bytes(), dd.LinkKey.Bytes(), "LinkKey")
+	assert.Equal(d.MixKeyScheme, dd.MixKeyScheme, "MixKeyScheme")
 	require.Equal(len(d.MixKeys), len(dd.MixKeys), "len(MixKeys)")
 	for k, v := range d.MixKeys {
 		vv := dd.MixKeys[k]
 		require.NotNil(vv)
-		require.Equal(v.Bytes(), vv.Bytes(), "MixKeys[%v]", k)
+		require.Equal(v, vv, "MixKeys[%v]", k)
 	}
 }
+
+func TestTopologyGeometryCompatible(t *testing.T) {
+	require := require.New(t)
+	geo := sphinx.DefaultGeometry()
+	require.Equal(geo.NrHops, NrHops(geo.NrHops-2))
+	require.NoError(IsTopologyGeometryCompatible(geo.NrHops-2, geo))
+	require.Error(IsTopologyGeometryCompatible(geo.NrHops-1, geo))
+}
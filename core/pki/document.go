@@ -25,12 +25,14 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"sort"
 
 	"github.com/fxamacker/cbor/v2"
 	"golang.org/x/crypto/blake2b"
 
 	"github.com/katzenpost/katzenpost/core/crypto/cert"
 	"github.com/katzenpost/katzenpost/core/crypto/sign"
+	"github.com/katzenpost/katzenpost/core/sphinx"
 )
 
 const (
@@ -124,6 +126,11 @@ type Document struct {
 	// LambdaMMaxDelay is the maximum send interval in milliseconds.
 	LambdaMMaxDelay uint64
 
+	// SphinxGeometry is the geometry of the Sphinx packets used by the
+	// mix network, from which nodes and clients derive all of their
+	// packet and payload lengths.
+	SphinxGeometry *sphinx.Geometry
+
 	// Topology is the mix network topology, excluding providers.
 	Topology [][]*MixDescriptor
 
@@ -131,6 +138,15 @@ type Document struct {
 	// network.
 	Providers []*MixDescriptor
 
+	// LoadWeights is the map of load balancing weights assigned to the
+	// mixes by the directory authorities, by IdentityKey hash.  Mixes
+	// without an entry are given the median weight of their layer.
+	LoadWeights map[[PublicKeyHashSize]byte]uint8 `cbor:",omitempty"`
+
+	// KeyRotations are the key rotation statements of the directory
+	// authorities, which clients follow to keep authenticating them.
+	KeyRotations [][]byte `cbor:",omitempty"`
+
 	// Signatures holds detached Signatures from deserializing a signed Document
 	Signatures map[[PublicKeyHashSize]byte]cert.Signature `cbor:"-"`
 
@@ -177,6 +193,9 @@ func (d *Document) String() string {
 	s += fmt.Sprintf("Providers:[]{%v}", d.Providers)
 	s += "}}\n"
 
+	for id, weight := range d.LoadWeights {
+		s += fmt.Sprintf("  LoadWeight: %x, %d\n", id, weight)
+	}
 	for id, signedCommit := range d.SharedRandomCommit {
 		commit, err := cert.GetCertified(signedCommit)
 		if err != nil {
@@ -290,6 +309,39 @@ func (d *Document) GetNode(name string) (*MixDescriptor, error) {
 	return nil, fmt.Errorf("pki: node not found")
 }
 
+// LoadWeight returns the load balancing weight the directory authorities
+// assigned to the given mix, or 0 if they assigned none.  The weight
+// declared in the descriptor is never used, as nothing vouches for it.
+func (d *Document) LoadWeight(desc *MixDescriptor) uint8 {
+	return d.LoadWeights[desc.IdentityKey.Sum256()]
+}
+
+// LayerLoadWeights returns the load balancing weights of the mixes of the
+// layer, from the given weights assigned by the directory authorities.  The
+// mixes without a weight are given the median weight of the layer, and if
+// no mix has one, all the weights are 0.
+func LayerLoadWeights(layer []*MixDescriptor, weights map[[PublicKeyHashSize]byte]uint8) []uint8 {
+	layerWeights := make([]uint8, len(layer))
+	assigned := make([]int, 0, len(layer))
+	for i, desc := range layer {
+		layerWeights[i] = weights[desc.IdentityKey.Sum256()]
+		if layerWeights[i] != 0 {
+			assigned = append(assigned, int(layerWeights[i]))
+		}
+	}
+	if len(assigned) == 0 {
+		return layerWeights
+	}
+	sort.Ints(assigned)
+	median := uint8(assigned[(len(assigned)-1)/2])
+	for i, w := range layerWeights {
+		if w == 0 {
+			layerWeights[i] = median
+		}
+	}
+	return layerWeights
+}
+
 // GetNodeByKeyHash returns the specific descriptor corresponding to the
 // specified IdentityKey hash.
 func (d *Document) GetNodeByKeyHash(keyhash *[32]byte) (*MixDescriptor, error) {
@@ -319,13 +371,27 @@ var (
 	// TransportTCPv6 is TCP over IPv6.
 	TransportTCPv6 Transport = "tcp6"
 
+	// TransportQUIC is QUIC, with each connection carried on a single
+	// stream.
+	TransportQUIC Transport = "quic"
+
+	// TransportWebSocket is WebSocket over TCP, with the HTTP endpoint
+	// at `core/transport.WebSocketPath`.
+	TransportWebSocket Transport = "ws"
+
+	// TransportWebSocketTLS is WebSocket over TLS over TCP, whose TLS
+	// handshake is not authenticated.
+	TransportWebSocketTLS Transport = "wss"
+
 	// InternalTransports is the list of transports used for non-client related
 	// communications.
 	InternalTransports = []Transport{TransportTCPv4, TransportTCPv6}
 
 	// ClientTransports is the list of transports used by default for client
-	// to provider communication.
-	ClientTransports = []Transport{TransportTCP, TransportTCPv4, TransportTCPv6}
+	// to provider communication, in decreasing order of preference.  QUIC
+	// is only used when listed in the client's preferred transports, as
+	// it can't be carried over a proxy.
+	ClientTransports = []Transport{TransportTCP, TransportTCPv4, TransportTCPv6, TransportWebSocket, TransportWebSocketTLS}
 )
 
 // Client is the abstract interface used for PKI interaction.
@@ -340,6 +406,15 @@ type Client interface {
 	Deserialize(raw []byte) (*Document, error)
 }
 
+// ArchiveClient is the interface of the PKI clients which fetch the
+// documents archived by the authorities.
+type ArchiveClient interface {
+	// GetRange returns the archived documents along with their raw
+	// serialized form, for the epochs from first to last included which
+	// have one, in order.
+	GetRange(ctx context.Context, first, last uint64) ([]*Document, [][]byte, error)
+}
+
 // FromPayload deserializes, then verifies a Document, and returns the Document or error.
 func FromPayload(verifier cert.Verifier, payload []byte) (*Document, error) {
 	_, err := cert.Verify(verifier, payload)
@@ -442,6 +517,48 @@ func VerifyAndParseDocument(b []byte, verifiers []cert.Verifier) (*Document, err
 	return d, nil
 }
 
+// VerifyAndParseArchivedDocument verifies the signatures of the archived
+// Document of the epoch, which must have been valid in that epoch and be
+// signed by at least threshold of the signers, and returns the Document.
+// The verifiers hold the identity keys of each signer, its current one and
+// the ones it retired through key rotations, and a signer counts once.
+// Unlike VerifyAndParseDocument it accepts expired Documents, and doesn't
+// verify their shared random commits and reveals, which expire as well.
+func VerifyAndParseArchivedDocument(b []byte, verifiers [][]cert.Verifier, threshold int, epoch uint64) (*Document, error) {
+	if threshold > len(verifiers) {
+		return nil, cert.ErrInvalidThreshold
+	}
+	var certified []byte
+	good := 0
+	for _, keys := range verifiers {
+		for _, v := range keys {
+			c, err := cert.VerifyAt(v, b, epoch)
+			if err != nil {
+				continue
+			}
+			certified = c
+			good++
+			break
+		}
+	}
+	if good == 0 || good < threshold {
+		return nil, cert.ErrThresholdNotMet
+	}
+
+	d := new(Document)
+	if err := cbor.Unmarshal(certified, (*document)(d)); err != nil {
+		return nil, err
+	}
+	d.Signatures = make(map[[PublicKeyHashSize]byte]cert.Signature)
+	if d.Version != DocumentVersion {
+		return nil, fmt.Errorf("Invalid Document Version: '%v'", d.Version)
+	}
+	if d.Epoch != epoch {
+		return nil, ErrInvalidEpoch
+	}
+	return d, nil
+}
+
 // IsDocumentWellFormed validates the document and returns a descriptive error
 // iff there are any problems that invalidates the document.
 func IsDocumentWellFormed(d *Document, verifiers []cert.Verifier) error {
@@ -511,9 +628,18 @@ func IsDocumentWellFormed(d *Document, verifiers []cert.Verifier) error {
 			}
 		}
 	}
+	if d.SphinxGeometry == nil {
+		return fmt.Errorf("Document has no SphinxGeometry")
+	}
+	if err := d.SphinxGeometry.Validate(); err != nil {
+		return fmt.Errorf("Document has invalid SphinxGeometry: %v", err)
+	}
 	if len(d.Topology) == 0 {
 		return fmt.Errorf("Document contains no Topology")
 	}
+	if err := IsTopologyGeometryCompatible(len(d.Topology), d.SphinxGeometry); err != nil {
+		return fmt.Errorf("Document Topology is invalid: %v", err)
+	}
 	pks := make(map[[sign.PublicKeyHashSize]byte]bool)
 	for layer, nodes := range d.Topology {
 		if len(nodes) == 0 {
@@ -523,6 +649,9 @@ func IsDocumentWellFormed(d *Document, verifiers []cert.Verifier) error {
 			if err := IsDescriptorWellFormed(desc, d.Epoch); err != nil {
 				return err
 			}
+			if err := IsDescriptorGeometryCompatible(desc, d.SphinxGeometry); err != nil {
+				return err
+			}
 			pk := desc.IdentityKey.Sum256()
 			if _, ok := pks[pk]; ok {
 				return fmt.Errorf("Document contains multiple entries for %v", desc.IdentityKey)
@@ -537,6 +666,9 @@ func IsDocumentWellFormed(d *Document, verifiers []cert.Verifier) error {
 		if err := IsDescriptorWellFormed(desc, d.Epoch); err != nil {
 			return err
 		}
+		if err := IsDescriptorGeometryCompatible(desc, d.SphinxGeometry); err != nil {
+			return err
+		}
 		if !desc.Provider {
 			return fmt.Errorf("Document lists %v as a Provider with desc.Provider = false %v", desc.IdentityKey, desc.Provider)
 		}
@@ -546,6 +678,11 @@ func IsDocumentWellFormed(d *Document, verifiers []cert.Verifier) error {
 		}
 		pks[pk] = true
 	}
+	for id := range d.LoadWeights {
+		if _, ok := pks[id]; !ok {
+			return fmt.Errorf("Document has a LoadWeight for unknown node %x", id)
+		}
+	}
 
 	return nil
 }
@@ -25,6 +25,7 @@ import (
 
 	"github.com/katzenpost/katzenpost/core/crypto/cert"
 	"github.com/katzenpost/katzenpost/core/crypto/ecdh"
+	"github.com/katzenpost/katzenpost/core/sphinx"
 	"github.com/katzenpost/katzenpost/core/wire"
 	"github.com/stretchr/testify/require"
 )
@@ -43,11 +44,11 @@ func genDescriptor(require *require.Assertions, idx int, provider bool) (*MixDes
 	d.IdentityKey = identityPub
 	scheme := wire.DefaultScheme
 	_, d.LinkKey = scheme.GenerateKeypair(rand.Reader)
-	d.MixKeys = make(map[uint64]*ecdh.PublicKey)
+	d.MixKeys = make(map[uint64][]byte)
 	for e := debugTestEpoch; e < debugTestEpoch+3; e++ {
 		mPriv, err := ecdh.NewKeypair(rand.Reader)
 		require.NoError(err, "[%d]: ecdh.NewKeypair()", e)
-		d.MixKeys[uint64(e)] = mPriv.PublicKey()
+		d.MixKeys[uint64(e)] = mPriv.PublicKey().Bytes()
 	}
 	if provider {
 		d.Kaetzchen = make(map[string]map[string]interface{})
@@ -86,6 +87,7 @@ func TestDocument(t *testing.T) {
 		MuMaxDelay:         23,
 		LambdaP:            0.69,
 		LambdaPMaxDelay:    17,
+		SphinxGeometry:     sphinx.DefaultGeometry(),
 		SharedRandomCommit: make(map[[PublicKeyHashSize]byte][]byte),
 		SharedRandomReveal: make(map[[PublicKeyHashSize]byte][]byte),
 		SharedRandomValue:  make([]byte, SharedRandomValueLength),
@@ -118,6 +120,9 @@ func TestDocument(t *testing.T) {
 		doc.Providers = append(doc.Providers, d)
 		idx++
 	}
+	doc.LoadWeights = map[[PublicKeyHashSize]byte]uint8{
+		doc.Topology[0][0].IdentityKey.Sum256(): 42,
+	}
 
 	// Serialize and sign.
 	signed, err := SignDocument(k, idPub, doc)
@@ -138,11 +143,16 @@ func TestDocument(t *testing.T) {
 	require.Equal(doc.LambdaDMaxDelay, ddoc.LambdaDMaxDelay, "VerifyAndParseDocument(): LambdaDMaxDelay")
 	require.Equal(doc.LambdaM, ddoc.LambdaM, "VerifyAndParseDocument(): LambdaM")
 	require.Equal(doc.LambdaMMaxDelay, ddoc.LambdaMMaxDelay, "VerifyAndParseDocument(): LambdaMMaxDelay")
+	require.Equal(doc.SphinxGeometry, ddoc.SphinxGeometry, "VerifyAndParseDocument(): SphinxGeometry")
 	require.Equal(doc.SharedRandomValue, ddoc.SharedRandomValue, "VerifyAndParseDocument(): SharedRandomValue")
 	require.Equal(doc.PriorSharedRandom, ddoc.PriorSharedRandom, "VerifyAndParseDocument(): PriorSharedRandom")
 	require.Equal(doc.SharedRandomCommit, ddoc.SharedRandomCommit, "VerifyAndParseDocument(): SharedRandomCommit")
 	require.Equal(doc.SharedRandomReveal, ddoc.SharedRandomReveal, "VerifyAndParseDocument(): SharedRandomReveal")
 	require.Equal(doc.Version, ddoc.Version, "VerifyAndParseDocument(): Version")
+	require.Equal(doc.LoadWeights, ddoc.LoadWeights, "VerifyAndParseDocument(): LoadWeights")
+	require.Equal(uint8(42), ddoc.LoadWeight(ddoc.Topology[0][0]))
+	require.Zero(ddoc.LoadWeight(ddoc.Topology[0][1]), "the declared LoadWeight is not used")
+	require.Equal(uint8(42), LayerLoadWeights(ddoc.Topology[0], ddoc.LoadWeights)[1])
 
 	// check that MixDescriptors are signed correctly and can be deserialized and reserialized from the Document
 	for l, layer := range ddoc.Topology {
@@ -168,4 +178,62 @@ func TestDocument(t *testing.T) {
 		require.NoError(err)
 		require.True(bytes.Equal(d, d2))
 	}
+
+	// check that archived Documents are verified as of their epoch
+	adoc, err := VerifyAndParseArchivedDocument(signed, [][]cert.Verifier{{idPub}}, 1, doc.Epoch)
+	require.NoError(err)
+	require.Equal(doc.Epoch, adoc.Epoch)
+	require.Equal(doc.LoadWeights, adoc.LoadWeights)
+	require.Len(adoc.Topology, len(doc.Topology))
+	_, err = VerifyAndParseArchivedDocument(signed, [][]cert.Verifier{{idPub}}, 1, doc.Epoch-1)
+	require.Equal(ErrInvalidEpoch, err)
+	_, err = VerifyAndParseArchivedDocument(signed, [][]cert.Verifier{{idPub}}, 1, doc.Epoch+5)
+	require.Error(err)
+	_, otherPub := cert.Scheme.NewKeypair()
+	_, err = VerifyAndParseArchivedDocument(signed, [][]cert.Verifier{{idPub}, {otherPub}}, 2, doc.Epoch)
+	require.Equal(cert.ErrThresholdNotMet, err)
+
+	// check that a signer verified by any of its keys counts once
+	_, err = VerifyAndParseArchivedDocument(signed, [][]cert.Verifier{{otherPub, idPub}}, 1, doc.Epoch)
+	require.NoError(err)
+	_, err = VerifyAndParseArchivedDocument(signed, [][]cert.Verifier{{idPub, idPub}, {otherPub}}, 2, doc.Epoch)
+	require.Equal(cert.ErrThresholdNotMet, err)
+
+	// check that Documents with a LoadWeight for an unknown node are rejected
+	doc.LoadWeights[[PublicKeyHashSize]byte{}] = 1
+	require.Error(IsDocumentWellFormed(doc, []cert.Verifier{idPub}))
+	delete(doc.LoadWeights, [PublicKeyHashSize]byte{})
+
+	// check that Documents with an unusable SphinxGeometry are rejected
+	geo := sphinx.DefaultGeometry()
+	doc.SphinxGeometry, err = sphinx.NewGeometry(geo.NIKEName, "", geo.UserForwardPayloadLength, len(doc.Topology)+1)
+	require.NoError(err)
+	require.Error(IsDocumentWellFormed(doc, []cert.Verifier{idPub}))
+	tampered := *geo
+	tampered.ForwardPayloadLength++
+	doc.SphinxGeometry = &tampered
+	require.Error(IsDocumentWellFormed(doc, []cert.Verifier{idPub}))
+	doc.SphinxGeometry = nil
+	require.Error(IsDocumentWellFormed(doc, []cert.Verifier{idPub}))
+}
+
+func TestLayerLoadWeights(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	layer := make([]*MixDescriptor, 5)
+	for i := range layer {
+		layer[i], _ = genDescriptor(require, i, false)
+	}
+	weights := make(map[[PublicKeyHashSize]byte]uint8)
+
+	// without a weight, the mixes are all unweighted
+	require.Equal([]uint8{0, 0, 0, 0, 0}, LayerLoadWeights(layer, weights))
+
+	// the mixes without a weight are given the lower median weight
+	weights[layer[1].IdentityKey.Sum256()] = 5
+	weights[layer[3].IdentityKey.Sum256()] = 200
+	require.Equal([]uint8{5, 5, 5, 200, 5}, LayerLoadWeights(layer, weights))
+	weights[layer[4].IdentityKey.Sum256()] = 9
+	require.Equal([]uint8{9, 5, 9, 200, 9}, LayerLoadWeights(layer, weights))
 }
@@ -0,0 +1,334 @@
+// keyrotation.go - Katzenpost node identity key rotation statements.
+// Copyright (C) 2022  David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package pki
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+
+	"github.com/katzenpost/katzenpost/core/crypto/cert"
+	"github.com/katzenpost/katzenpost/core/crypto/sign"
+	"github.com/katzenpost/katzenpost/core/epochtime"
+	"github.com/katzenpost/katzenpost/core/wire"
+)
+
+// KeyRotationLifetime is the time for which a key rotation statement is
+// valid.  The directory authorities must see a descriptor carrying the
+// statement within that time to follow the rotation.
+const KeyRotationLifetime = 7 * 24 * time.Hour
+
+var (
+	// ErrInvalidKeyRotation is the error returned when a key rotation
+	// statement is not signed by both of its keys.
+	ErrInvalidKeyRotation = errors.New("pki: invalid key rotation statement")
+)
+
+// KeyRotation is the statement by which a node announces the successor
+// of its identity key.  It is certified by both the old and the new
+// identity keys, so that only the holder of the old key can name a
+// successor, and only a successor the holder of which consents to it.
+type KeyRotation struct {
+	// Epoch is the epoch in which the statement was made.
+	Epoch uint64
+
+	// OldIdentityKey is the serialized identity key being retired.
+	OldIdentityKey []byte
+
+	// NewIdentityKey is the serialized identity key succeeding it.
+	NewIdentityKey []byte
+
+	// NewLinkKey is the serialized link key succeeding the link key of a
+	// directory authority, which its peers and clients authenticate it
+	// by.  Only the statements of the authorities carry one.
+	NewLinkKey []byte `cbor:",omitempty"`
+}
+
+// SignKeyRotation returns a key rotation statement from the old identity
+// key to the new one, certified by both keys.
+func SignKeyRotation(oldSigner sign.PrivateKey, oldKey sign.PublicKey, newSigner sign.PrivateKey, newKey sign.PublicKey) ([]byte, error) {
+	return signKeyRotation(oldSigner, oldKey, newSigner, newKey, nil)
+}
+
+// SignAuthorityKeyRotation returns the key rotation statement of a
+// directory authority, from its old identity key to the new one, which
+// also names its new link key.
+func SignAuthorityKeyRotation(oldSigner sign.PrivateKey, oldKey sign.PublicKey, newSigner sign.PrivateKey, newKey sign.PublicKey, newLinkKey wire.PublicKey) ([]byte, error) {
+	return signKeyRotation(oldSigner, oldKey, newSigner, newKey, newLinkKey.Bytes())
+}
+
+func signKeyRotation(oldSigner sign.PrivateKey, oldKey sign.PublicKey, newSigner sign.PrivateKey, newKey sign.PublicKey, newLinkKey []byte) ([]byte, error) {
+	epoch, _, _ := epochtime.Now()
+	r := &KeyRotation{
+		Epoch:          epoch,
+		OldIdentityKey: oldKey.Bytes(),
+		NewIdentityKey: newKey.Bytes(),
+		NewLinkKey:     newLinkKey,
+	}
+	payload, err := ccbor.Marshal(r)
+	if err != nil {
+		return nil, err
+	}
+	expiration := epoch + uint64(KeyRotationLifetime/epochtime.Period)
+	signed, err := cert.Sign(oldSigner, oldKey, payload, expiration)
+	if err != nil {
+		return nil, err
+	}
+	return cert.SignMulti(newSigner, newKey, signed)
+}
+
+// VerifyKeyRotation verifies that the key rotation statement is certified
+// by both of its keys and has not expired, and returns the old and new
+// identity keys.
+func VerifyKeyRotation(rawRotation []byte) (sign.PublicKey, sign.PublicKey, error) {
+	_, oldKey, newKey, err := verifyKeyRotation(rawRotation)
+	return oldKey, newKey, err
+}
+
+func verifyKeyRotation(rawRotation []byte) (*KeyRotation, sign.PublicKey, sign.PublicKey, error) {
+	certified, err := cert.GetCertified(rawRotation)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	r := new(KeyRotation)
+	if err := cbor.Unmarshal(certified, r); err != nil {
+		return nil, nil, nil, err
+	}
+	oldKey := cert.Scheme.NewEmptyPublicKey()
+	if err := oldKey.FromBytes(r.OldIdentityKey); err != nil {
+		return nil, nil, nil, err
+	}
+	newKey := cert.Scheme.NewEmptyPublicKey()
+	if err := newKey.FromBytes(r.NewIdentityKey); err != nil {
+		return nil, nil, nil, err
+	}
+	if oldKey.Equal(newKey) {
+		return nil, nil, nil, ErrInvalidKeyRotation
+	}
+	if _, err := cert.VerifyAll([]cert.Verifier{oldKey, newKey}, rawRotation); err != nil {
+		return nil, nil, nil, ErrInvalidKeyRotation
+	}
+	return r, oldKey, newKey, nil
+}
+
+// AuthorityKeyRotation is a verified key rotation statement of a directory
+// authority.
+type AuthorityKeyRotation struct {
+	// Epoch is the epoch in which the statement was made.
+	Epoch uint64
+
+	// OldIdentityKey is the identity key being retired.
+	OldIdentityKey sign.PublicKey
+
+	// NewIdentityKey is the identity key succeeding it.
+	NewIdentityKey sign.PublicKey
+
+	// NewLinkKey is the link key succeeding the one of the authority.
+	NewLinkKey wire.PublicKey
+
+	// Raw is the serialized statement.
+	Raw []byte
+}
+
+// VerifyAuthorityKeyRotation verifies that the key rotation statement of a
+// directory authority is certified by both of its identity keys, names a
+// new link key, and has not expired.
+func VerifyAuthorityKeyRotation(rawRotation []byte) (*AuthorityKeyRotation, error) {
+	r, oldKey, newKey, err := verifyKeyRotation(rawRotation)
+	if err != nil {
+		return nil, err
+	}
+	if len(r.NewLinkKey) == 0 {
+		return nil, ErrInvalidKeyRotation
+	}
+	linkKey, err := wire.DefaultScheme.PublicKeyFromBytes(r.NewLinkKey)
+	if err != nil {
+		return nil, err
+	}
+	return &AuthorityKeyRotation{
+		Epoch:          r.Epoch,
+		OldIdentityKey: oldKey,
+		NewIdentityKey: newKey,
+		NewLinkKey:     linkKey,
+		Raw:            rawRotation,
+	}, nil
+}
+
+// AuthorityKeyRotations returns the valid key rotation statements of the
+// directory authorities carried by the document, in the order they were
+// made, ignoring the invalid and expired ones.  The statements are
+// certified by the keys they retire, so they may be followed before the
+// document is verified.
+func (d *Document) AuthorityKeyRotations() []*AuthorityKeyRotation {
+	rotations := []*AuthorityKeyRotation{}
+	for _, raw := range d.KeyRotations {
+		r, err := VerifyAuthorityKeyRotation(raw)
+		if err != nil {
+			continue
+		}
+		rotations = append(rotations, r)
+	}
+	sort.SliceStable(rotations, func(i, j int) bool {
+		return rotations[i].Epoch < rotations[j].Epoch
+	})
+	return rotations
+}
+
+// NodeAuthorizations are the nodes authorized by a directory authority, by
+// identity key hash, the authorizations of which follow the key rotations
+// of the nodes.
+type NodeAuthorizations struct {
+	// Mixes are the authorized mixes.
+	Mixes map[[PublicKeyHashSize]byte]bool
+
+	// LoadWeights are the load weights assigned to mixes.
+	LoadWeights map[[PublicKeyHashSize]byte]uint8
+
+	// Providers are the authorized providers, with their identifiers.
+	Providers map[[PublicKeyHashSize]byte]string
+
+	// Rotations map the retired identity keys to their successors.
+	Rotations map[[PublicKeyHashSize]byte][PublicKeyHashSize]byte
+}
+
+// IsAuthorized returns true iff the identity key is authorized as a mix or
+// a provider.
+func (a *NodeAuthorizations) IsAuthorized(pk [PublicKeyHashSize]byte) bool {
+	_, ok := a.Providers[pk]
+	return ok || a.Mixes[pk]
+}
+
+// IsDescriptorAuthorized returns true iff the descriptor is from an
+// authorized node.
+func (a *NodeAuthorizations) IsDescriptorAuthorized(desc *MixDescriptor) bool {
+	pk := desc.IdentityKey.Sum256()
+	if !desc.Provider {
+		return a.Mixes[pk]
+	}
+	name, ok := a.Providers[pk]
+	if !ok {
+		return false
+	}
+	return name == desc.Name
+}
+
+// Deauthorize removes the authorization of the identity key.
+func (a *NodeAuthorizations) Deauthorize(pk [PublicKeyHashSize]byte) {
+	delete(a.Mixes, pk)
+	delete(a.LoadWeights, pk)
+	delete(a.Providers, pk)
+}
+
+// CurrentKey returns the identity key which succeeded the given one
+// through key rotations, or the given one if it was never rotated.
+func (a *NodeAuthorizations) CurrentKey(pk [PublicKeyHashSize]byte) [PublicKeyHashSize]byte {
+	for {
+		next, ok := a.Rotations[pk]
+		if !ok {
+			return pk
+		}
+		pk = next
+	}
+}
+
+// Rotate transfers the authorization of an identity key to its successor.
+func (a *NodeAuthorizations) Rotate(oldPk, pk [PublicKeyHashSize]byte) error {
+	if _, ok := a.Rotations[pk]; ok {
+		return fmt.Errorf("rotation to retired key %x", pk)
+	}
+	if a.IsAuthorized(pk) {
+		return fmt.Errorf("rotation to authorized key %x", pk)
+	}
+	if a.Mixes[oldPk] {
+		delete(a.Mixes, oldPk)
+		a.Mixes[pk] = true
+		if w, ok := a.LoadWeights[oldPk]; ok {
+			delete(a.LoadWeights, oldPk)
+			a.LoadWeights[pk] = w
+		}
+	} else if name, ok := a.Providers[oldPk]; ok {
+		delete(a.Providers, oldPk)
+		a.Providers[pk] = name
+	} else {
+		return fmt.Errorf("rotation from unauthorized key %x", oldPk)
+	}
+	a.Rotations[oldPk] = pk
+	return nil
+}
+
+// AcceptKeyRotation follows the key rotation statement carried by the
+// descriptor of a node which is not authorized yet, and returns the
+// retired identity key, or nil if there is no rotation to follow.
+func (a *NodeAuthorizations) AcceptKeyRotation(desc *MixDescriptor) (sign.PublicKey, error) {
+	if desc.KeyRotation == nil || a.IsDescriptorAuthorized(desc) {
+		return nil, nil
+	}
+	oldKey, newKey, err := VerifyKeyRotation(desc.KeyRotation)
+	if err != nil {
+		return nil, err
+	}
+	if !newKey.Equal(desc.IdentityKey) {
+		return nil, errors.New("not a rotation to the descriptor identity key")
+	}
+	oldPk := oldKey.Sum256()
+	if _, ok := a.Providers[oldPk]; ok && !desc.Provider || a.Mixes[oldPk] && desc.Provider {
+		return nil, errors.New("rotation between a mix and a provider")
+	}
+	if err := a.Rotate(oldPk, newKey.Sum256()); err != nil {
+		return nil, err
+	}
+	return oldKey, nil
+}
+
+// RestoreKeyRotations follows the persisted key rotations, from the retired
+// identity keys to their successors, in the order they were made, which is
+// the order in which their old keys are authorized.
+func (a *NodeAuthorizations) RestoreKeyRotations(rotations map[[PublicKeyHashSize]byte][PublicKeyHashSize]byte) error {
+	pending := make(map[[PublicKeyHashSize]byte][PublicKeyHashSize]byte)
+	for oldPk, pk := range rotations {
+		pending[oldPk] = pk
+	}
+	for len(pending) > 0 {
+		rotated := false
+		for oldPk, pk := range pending {
+			if !a.IsAuthorized(oldPk) {
+				continue
+			}
+			if a.IsAuthorized(pk) {
+				// The new key was authorized through the management
+				// interface since, which supersedes the rotation.
+				a.Deauthorize(oldPk)
+				a.Rotations[oldPk] = pk
+			} else if err := a.Rotate(oldPk, pk); err != nil {
+				return err
+			}
+			delete(pending, oldPk)
+			rotated = true
+		}
+		if !rotated {
+			break
+		}
+	}
+	// The keys of the nodes deauthorized since remain retired.
+	for oldPk, pk := range pending {
+		a.Rotations[oldPk] = pk
+	}
+	return nil
+}
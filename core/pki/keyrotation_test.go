@@ -0,0 +1,173 @@
+// keyrotation_test.go - Katzenpost key rotation statement tests.
+// Copyright (C) 2022  David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package pki
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/katzenpost/katzenpost/core/crypto/cert"
+	"github.com/katzenpost/katzenpost/core/crypto/rand"
+	"github.com/katzenpost/katzenpost/core/crypto/sign"
+	"github.com/katzenpost/katzenpost/core/wire"
+)
+
+func TestKeyRotation(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	oldPriv, oldPub := cert.Scheme.NewKeypair()
+	newPriv, newPub := cert.Scheme.NewKeypair()
+
+	statement, err := SignKeyRotation(oldPriv, oldPub, newPriv, newPub)
+	require.NoError(err)
+	oldKey, newKey, err := VerifyKeyRotation(statement)
+	require.NoError(err)
+	require.True(oldKey.Equal(oldPub))
+	require.True(newKey.Equal(newPub))
+
+	// The statement must be signed by both keys.
+	otherPriv, otherPub := cert.Scheme.NewKeypair()
+	statement, err = SignKeyRotation(oldPriv, oldPub, otherPriv, newPub)
+	require.NoError(err)
+	_, _, err = VerifyKeyRotation(statement)
+	require.Equal(ErrInvalidKeyRotation, err)
+	statement, err = SignKeyRotation(otherPriv, oldPub, newPriv, newPub)
+	require.NoError(err)
+	_, _, err = VerifyKeyRotation(statement)
+	require.Equal(ErrInvalidKeyRotation, err)
+	_, _, err = VerifyKeyRotation(statement[1:])
+	require.Error(err)
+
+	// The statement is carried by the descriptor of the new key.
+	statement, err = SignKeyRotation(oldPriv, oldPub, newPriv, newPub)
+	require.NoError(err)
+	d, _ := genDescriptor(require, 1, false)
+	d.IdentityKey = otherPub
+	d.KeyRotation = statement
+	signed, err := SignDescriptor(otherPriv, otherPub, d)
+	require.NoError(err)
+	d, err = VerifyDescriptor(signed)
+	require.NoError(err)
+	require.Equal(statement, d.KeyRotation)
+}
+
+func TestAuthorityKeyRotation(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	oldPriv, oldPub := cert.Scheme.NewKeypair()
+	newPriv, newPub := cert.Scheme.NewKeypair()
+	_, linkPub := wire.DefaultScheme.GenerateKeypair(rand.Reader)
+
+	statement, err := SignAuthorityKeyRotation(oldPriv, oldPub, newPriv, newPub, linkPub)
+	require.NoError(err)
+	r, err := VerifyAuthorityKeyRotation(statement)
+	require.NoError(err)
+	require.True(r.OldIdentityKey.Equal(oldPub))
+	require.True(r.NewIdentityKey.Equal(newPub))
+	require.True(r.NewLinkKey.Equal(linkPub))
+	require.Equal(statement, r.Raw)
+
+	// The statements of the nodes name no link key.
+	nodeStatement, err := SignKeyRotation(oldPriv, oldPub, newPriv, newPub)
+	require.NoError(err)
+	_, err = VerifyAuthorityKeyRotation(nodeStatement)
+	require.Equal(ErrInvalidKeyRotation, err)
+
+	// Documents only yield the valid statements of the authorities.
+	otherPriv, _ := cert.Scheme.NewKeypair()
+	forged, err := SignAuthorityKeyRotation(otherPriv, oldPub, newPriv, newPub, linkPub)
+	require.NoError(err)
+	doc := &Document{KeyRotations: [][]byte{nodeStatement, forged, statement, statement[1:]}}
+	rotations := doc.AuthorityKeyRotations()
+	require.Len(rotations, 1)
+	require.Equal(statement, rotations[0].Raw)
+}
+
+func TestNodeAuthorizations(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	newAuthorizations := func() *NodeAuthorizations {
+		return &NodeAuthorizations{
+			Mixes:       make(map[[PublicKeyHashSize]byte]bool),
+			LoadWeights: make(map[[PublicKeyHashSize]byte]uint8),
+			Providers:   make(map[[PublicKeyHashSize]byte]string),
+			Rotations:   make(map[[PublicKeyHashSize]byte][PublicKeyHashSize]byte),
+		}
+	}
+	keyA, pubA := cert.Scheme.NewKeypair()
+	keyB, pubB := cert.Scheme.NewKeypair()
+	keyC, pubC := cert.Scheme.NewKeypair()
+	a := newAuthorizations()
+	a.Mixes[pubA.Sum256()] = true
+	a.LoadWeights[pubA.Sum256()] = 5
+
+	rotation := func(oldKey sign.PrivateKey, oldPub sign.PublicKey, newKey sign.PrivateKey, newPub sign.PublicKey, provider bool) *MixDescriptor {
+		statement, err := SignKeyRotation(oldKey, oldPub, newKey, newPub)
+		require.NoError(err)
+		return &MixDescriptor{Name: "mix", IdentityKey: newPub, Provider: provider, KeyRotation: statement}
+	}
+
+	// A mix can't rotate to a provider.
+	_, err := a.AcceptKeyRotation(rotation(keyA, pubA, keyB, pubB, true))
+	require.Error(err)
+
+	// The authorization and the load weight follow the rotations.
+	oldKey, err := a.AcceptKeyRotation(rotation(keyA, pubA, keyB, pubB, false))
+	require.NoError(err)
+	require.True(oldKey.Equal(pubA))
+	oldKey, err = a.AcceptKeyRotation(rotation(keyA, pubA, keyB, pubB, false))
+	require.NoError(err)
+	require.Nil(oldKey)
+	_, err = a.AcceptKeyRotation(rotation(keyB, pubB, keyC, pubC, false))
+	require.NoError(err)
+	require.False(a.IsAuthorized(pubA.Sum256()))
+	require.False(a.IsAuthorized(pubB.Sum256()))
+	require.True(a.IsAuthorized(pubC.Sum256()))
+	require.Equal(uint8(5), a.LoadWeights[pubC.Sum256()])
+	require.Equal(pubC.Sum256(), a.CurrentKey(pubA.Sum256()))
+
+	// A retired key can't be rotated to.
+	_, err = a.AcceptKeyRotation(rotation(keyC, pubC, keyA, pubA, false))
+	require.Error(err)
+
+	// The rotations are restored in the order they were made.
+	restored := newAuthorizations()
+	restored.Mixes[pubA.Sum256()] = true
+	restored.LoadWeights[pubA.Sum256()] = 5
+	require.NoError(restored.RestoreKeyRotations(a.Rotations))
+	require.Equal(a, restored)
+
+	// A new key authorized since supersedes the rotation.
+	restored = newAuthorizations()
+	restored.Mixes[pubA.Sum256()] = true
+	restored.Mixes[pubC.Sum256()] = true
+	require.NoError(restored.RestoreKeyRotations(a.Rotations))
+	require.False(restored.IsAuthorized(pubA.Sum256()))
+	require.False(restored.IsAuthorized(pubB.Sum256()))
+	require.True(restored.IsAuthorized(pubC.Sum256()))
+	require.Equal(a.Rotations, restored.Rotations)
+
+	// The keys of deauthorized nodes remain retired.
+	restored = newAuthorizations()
+	require.NoError(restored.RestoreKeyRotations(a.Rotations))
+	require.False(restored.IsAuthorized(pubC.Sum256()))
+	require.Equal(a.Rotations, restored.Rotations)
+}
@@ -0,0 +1,192 @@
+// reputation.go - Katzenpost node reputation from loop reports.
+// Copyright (C) 2022  David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package pki
+
+import (
+	"fmt"
+	"sort"
+)
+
+// The reputation rule is part of the consensus protocol: every directory
+// authority must use the same constants for their votes to converge.
+const (
+	// ReputationMinLoops is the minimum number of loops a mix must have
+	// sent through a peer for its measurement of the peer to be counted.
+	ReputationMinLoops = 20
+
+	// ReputationMinReporters is the minimum number of mixes which must
+	// have measured a node for the node to have a reputation.
+	ReputationMinReporters = 3
+
+	// ReputationMaxReportAge is the maximum number of epochs between the
+	// epoch of a LoopReport and the epoch of the Document it is used for.
+	ReputationMaxReportAge = 3
+
+	// ReputationExcludeRatio is the reputation under which a mix is
+	// excluded from the Document.
+	ReputationExcludeRatio = 0.5
+
+	// ReputationPenaltyRatio is the reputation under which the load
+	// weight of a mix is scaled down by its reputation.
+	ReputationPenaltyRatio = 0.9
+
+	// ReputationBaseWeight is the load weight given to the mixes of a
+	// layer without load weights when one of them is scaled down.
+	ReputationBaseWeight = 100
+)
+
+// LoopCounts is the number of decoy loops a mix sent through a peer, and
+// the number of them which returned.
+type LoopCounts struct {
+	Sent     uint64
+	Returned uint64
+}
+
+// SuccessRatio returns the ratio of the loops which returned.
+func (c *LoopCounts) SuccessRatio() float64 {
+	if c.Sent == 0 {
+		return 0
+	}
+	return float64(c.Returned) / float64(c.Sent)
+}
+
+// LoopReport is the measurement of the decoy loops sent by a mix during an
+// epoch, published in its descriptor.
+type LoopReport struct {
+	// Epoch is the epoch during which the loops were sent.
+	Epoch uint64
+
+	// Peers is the map of the loops sent through each peer, by
+	// IdentityKey hash.
+	Peers map[[PublicKeyHashSize]byte]*LoopCounts
+}
+
+func validateLoopReport(r *LoopReport, reporter [PublicKeyHashSize]byte, epoch uint64) error {
+	if r.Epoch > epoch {
+		return fmt.Errorf("LoopReport is for future epoch %v", r.Epoch)
+	}
+	for id, c := range r.Peers {
+		if id == reporter {
+			return fmt.Errorf("LoopReport contains the reporting node")
+		}
+		if c == nil || c.Returned > c.Sent {
+			return fmt.Errorf("LoopReport contains invalid counts for %x", id)
+		}
+	}
+	return nil
+}
+
+// Reputations returns the reputation of the nodes of the descriptors, as
+// measured by the LoopReports of the descriptors, for the Document of the
+// given epoch.  The rule is deterministic, so that all the authorities
+// tallying the same descriptors compute the same reputations:
+//
+//  1. The reports older than ReputationMaxReportAge epochs are ignored,
+//     and so are the peers of a report through which less than
+//     ReputationMinLoops loops were sent, or which have no descriptor.
+//  2. The measure of a node is the upper median of the loop success
+//     ratios reported for it, provided that there are at least
+//     ReputationMinReporters of them.  A node never reports for itself.
+//     A strict majority of its reporters must thus report a low ratio to
+//     lower the measure of a node, so that colluding mixes can't get an
+//     honest competitor excluded unless they outnumber its honest
+//     reporters.
+//  3. The baseline is the lower median of the measures of all the nodes.
+//  4. The reputation of a node is its measure divided by the baseline,
+//     capped to 1.
+//
+// As a lost loop is reported against every hop of the loop, the losses
+// caused by a node lower the measures of the others too, and losses
+// which are not caused by any node lower every measure.  Comparing the
+// measures to the baseline only singles out the nodes which lose more
+// loops than the others.
+//
+// Nodes without enough measurements have no reputation, and are
+// neither excluded nor penalized.
+func Reputations(descs []*MixDescriptor, epoch uint64) map[[PublicKeyHashSize]byte]float64 {
+	known := make(map[[PublicKeyHashSize]byte]bool)
+	for _, desc := range descs {
+		known[desc.IdentityKey.Sum256()] = true
+	}
+
+	ratios := make(map[[PublicKeyHashSize]byte][]float64)
+	for _, desc := range descs {
+		r := desc.LoopReport
+		if r == nil || r.Epoch >= epoch || epoch-r.Epoch > ReputationMaxReportAge {
+			continue
+		}
+		reporter := desc.IdentityKey.Sum256()
+		for id, c := range r.Peers {
+			if id == reporter || !known[id] || c == nil || c.Sent < ReputationMinLoops || c.Returned > c.Sent {
+				continue
+			}
+			ratios[id] = append(ratios[id], c.SuccessRatio())
+		}
+	}
+
+	measures := make(map[[PublicKeyHashSize]byte]float64)
+	all := []float64{}
+	for id, v := range ratios {
+		if len(v) < ReputationMinReporters {
+			continue
+		}
+		measures[id] = upperMedian(v)
+		all = append(all, measures[id])
+	}
+
+	reputations := make(map[[PublicKeyHashSize]byte]float64)
+	if len(all) == 0 {
+		return reputations
+	}
+	baseline := lowerMedian(all)
+	if baseline == 0 {
+		// Every loop is lost, which no node can be singled out for.
+		return reputations
+	}
+	for id, m := range measures {
+		reputation := m / baseline
+		if reputation > 1 {
+			reputation = 1
+		}
+		reputations[id] = reputation
+	}
+	return reputations
+}
+
+// ReputationWeight returns the load weight of a mix with the given weight
+// and reputation: the weight scaled down by the reputation if it is under
+// ReputationPenaltyRatio, but no less than 1.
+func ReputationWeight(weight uint8, reputation float64) uint8 {
+	if reputation >= ReputationPenaltyRatio {
+		return weight
+	}
+	w := uint8(float64(weight) * reputation)
+	if w == 0 {
+		w = 1
+	}
+	return w
+}
+
+func lowerMedian(v []float64) float64 {
+	sort.Float64s(v)
+	return v[(len(v)-1)/2]
+}
+
+func upperMedian(v []float64) float64 {
+	sort.Float64s(v)
+	return v[len(v)/2]
+}
@@ -0,0 +1,131 @@
+// reputation_test.go - Katzenpost node reputation tests.
+// Copyright (C) 2022  David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package pki
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestReputations(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	const epoch = debugTestEpoch + 1
+
+	// Every node reports every other: node 0 loses most of the loops
+	// through it, and node 1 some of them, which are also reported
+	// against the others.
+	returned := []uint64{30, 70, 80, 80, 80}
+	descs := make([]*MixDescriptor, len(returned))
+	ids := make([][PublicKeyHashSize]byte, len(returned))
+	for i := range descs {
+		descs[i], _ = genDescriptor(require, i+1, false)
+		ids[i] = descs[i].IdentityKey.Sum256()
+	}
+	for i, desc := range descs {
+		desc.LoopReport = &LoopReport{
+			Epoch: epoch - 2,
+			Peers: make(map[[PublicKeyHashSize]byte]*LoopCounts),
+		}
+		for j := range descs {
+			if i != j {
+				desc.LoopReport.Peers[ids[j]] = &LoopCounts{Sent: 100, Returned: returned[j]}
+			}
+		}
+		require.NoError(IsDescriptorWellFormed(desc, debugTestEpoch))
+	}
+
+	reputations := Reputations(descs, epoch)
+	require.Len(reputations, len(descs))
+	require.InDelta(0.375, reputations[ids[0]], 1e-9)
+	require.InDelta(0.875, reputations[ids[1]], 1e-9)
+	for _, id := range ids[2:] {
+		require.Equal(1.0, reputations[id])
+	}
+	require.True(reputations[ids[0]] < ReputationExcludeRatio)
+	require.Equal(uint8(8), ReputationWeight(10, reputations[ids[1]]))
+	require.Equal(uint8(1), ReputationWeight(1, reputations[ids[1]]))
+	require.Equal(uint8(10), ReputationWeight(10, reputations[ids[2]]))
+
+	// The order of the descriptors doesn't matter.
+	reversed := make([]*MixDescriptor, 0, len(descs))
+	for i := len(descs) - 1; i >= 0; i-- {
+		reversed = append(reversed, descs[i])
+	}
+	require.Equal(reputations, Reputations(reversed, epoch))
+
+	// Old reports are ignored.
+	require.Len(Reputations(descs, epoch+ReputationMaxReportAge), 0)
+
+	// Nodes with less than ReputationMinReporters reporters, or measured
+	// with too few loops, have no reputation.
+	descs[2].LoopReport = nil
+	descs[3].LoopReport.Peers[ids[0]].Sent = ReputationMinLoops - 1
+	reputations = Reputations(descs, epoch)
+	require.NotContains(reputations, ids[0])
+	require.Contains(reputations, ids[1])
+
+	// Nodes may not report invalid counts, nor for themselves.
+	descs[4].LoopReport.Peers[ids[0]].Returned = 101
+	require.Error(IsDescriptorWellFormed(descs[4], debugTestEpoch))
+	descs[4].LoopReport.Peers[ids[0]].Returned = 0
+	descs[4].LoopReport.Peers[ids[4]] = &LoopCounts{Sent: 1}
+	require.Error(IsDescriptorWellFormed(descs[4], debugTestEpoch))
+}
+
+func TestReputationsCollusion(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	const epoch = debugTestEpoch + 1
+
+	descs := make([]*MixDescriptor, 5)
+	ids := make([][PublicKeyHashSize]byte, len(descs))
+	for i := range descs {
+		descs[i], _ = genDescriptor(require, i+1, false)
+		ids[i] = descs[i].IdentityKey.Sum256()
+	}
+	for i, desc := range descs {
+		desc.LoopReport = &LoopReport{
+			Epoch: epoch - 1,
+			Peers: make(map[[PublicKeyHashSize]byte]*LoopCounts),
+		}
+		for j := range descs {
+			if i != j {
+				desc.LoopReport.Peers[ids[j]] = &LoopCounts{Sent: 100, Returned: 80}
+			}
+		}
+	}
+	collude := func(colluders ...int) {
+		for _, i := range colluders {
+			descs[i].LoopReport.Peers[ids[0]].Returned = 0
+		}
+	}
+
+	// Half of the reporters of node 0 colluding against it can't lower
+	// its reputation.
+	collude(3, 4)
+	reputations := Reputations(descs, epoch)
+	require.Equal(1.0, reputations[ids[0]])
+
+	// A strict majority of them can.
+	collude(2)
+	reputations = Reputations(descs, epoch)
+	require.True(reputations[ids[0]] < ReputationExcludeRatio)
+}
@@ -37,23 +37,24 @@ func KEMGeometryFromUserForwardPayloadLength(kem kem.Scheme, userForwardPayloadL
 		nrHops: nrHops,
 	}
 
+	if withSURB {
+		f.forwardPayloadLength = f.deriveForwardPayloadLength(userForwardPayloadLength)
+	} else {
+		f.forwardPayloadLength = userForwardPayloadLength
+	}
 	geo := &Geometry{
 		NrHops:                      nrHops,
 		HeaderLength:                f.headerLength(),
-		PacketLength:                f.packetLength(),
+		PacketLength:                f.packetLength(), // Requires f.forwardPayloadLength.
 		SURBLength:                  f.surbLength(),
 		UserForwardPayloadLength:    userForwardPayloadLength,
+		ForwardPayloadLength:        f.forwardPayloadLength,
 		PayloadTagLength:            payloadTagLength,
 		SphinxPlaintextHeaderLength: sphinxPlaintextHeaderLength,
 		SURBIDLength:                constants.SURBIDLength,
 		RoutingInfoLength:           f.routingInfoLength(),
 		PerHopRoutingInfoLength:     f.perHopRoutingInfoLength(),
-	}
-
-	if withSURB {
-		geo.ForwardPayloadLength = f.deriveForwardPayloadLength(userForwardPayloadLength)
-	} else {
-		geo.ForwardPayloadLength = userForwardPayloadLength
+		KEMName:                     kem.Name(),
 	}
 	return geo
 }
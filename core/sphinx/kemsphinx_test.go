@@ -77,6 +77,17 @@ func TestKEMForwardSphinx(t *testing.T) {
 	testForwardKEMSphinx(t, mykem, sphinx, []byte(testPayload))
 }
 
+func TestKEMSURB(t *testing.T) {
+	t.Parallel()
+	const testPayload = "The smallest minority on earth is the individual."
+
+	mykem := kyber768.Scheme()
+
+	geo := KEMGeometryFromUserForwardPayloadLength(mykem, len(testPayload), false, 5)
+	sphinx := NewKEMSphinx(mykem, geo)
+	testKEMSURB(t, mykem, sphinx, []byte(testPayload))
+}
+
 func newKEMNode(require *require.Assertions, mykem kem.Scheme) *kemNodeParams {
 	n := new(kemNodeParams)
 
@@ -141,6 +152,7 @@ func testForwardKEMSphinx(t *testing.T, mykem kem.Scheme, sphinx *Sphinx, testPa
 		pkt, err := sphinx.NewKEMPacket(rand.Reader, path, payload)
 		require.NoError(err, "NewKEMPacket failed")
 		require.Len(pkt, sphinx.Geometry().HeaderLength+sphinx.Geometry().PayloadTagLength+len(payload), "Packet Length")
+		require.Len(pkt, sphinx.Geometry().PacketLength, "Geometry PacketLength")
 
 		// Unwrap the packet, validating the output.
 		for i := range nodes {
@@ -165,3 +177,50 @@ func testForwardKEMSphinx(t *testing.T, mykem kem.Scheme, sphinx *Sphinx, testPa
 		}
 	}
 }
+
+func testKEMSURB(t *testing.T, mykem kem.Scheme, sphinx *Sphinx, testPayload []byte) {
+	require := require.New(t)
+
+	for nrHops := 1; nrHops <= sphinx.Geometry().NrHops; nrHops++ {
+		t.Logf("Testing %d hop(s).", nrHops)
+
+		// Generate the "nodes" and path for the SURB.
+		nodes, path := newKEMPathVector(require, mykem, nrHops, true)
+
+		// Create the SURB.
+		surb, surbKeys, err := sphinx.NewSURB(rand.Reader, path)
+		require.NoError(err, "NewSURB failed")
+		require.Equal(sphinx.Geometry().SURBLength, len(surb), "SURB length")
+
+		// Create a reply packet using the SURB.
+		payload := []byte(testPayload)
+		pkt, firstHop, err := sphinx.NewPacketFromSURB(surb, payload)
+		require.NoError(err, "NewPacketFromSURB failed")
+		require.EqualValues(&nodes[0].id, firstHop, "NewPacketFromSURB: 0th hop")
+
+		// Unwrap the packet, validating the output.
+		for i := range nodes {
+			b, _, cmds, err := sphinx.KEMUnwrap(nodes[i].privateKey, pkt)
+			require.NoErrorf(err, "SURB Hop %d: Unwrap failed", i)
+
+			if i == len(path)-1 {
+				require.Equalf(2, len(cmds), "SURB Hop %d: Unexpected number of commands", i)
+				require.EqualValuesf(path[i].Commands[0], cmds[0], "SURB Hop %d: recipient mismatch", i)
+				require.EqualValuesf(path[i].Commands[1], cmds[1], "SURB Hop %d: surb_reply mismatch", i)
+
+				b, err = sphinx.DecryptSURBPayload(b, surbKeys)
+				require.NoError(err, "DecryptSURBPayload")
+				require.Equalf(b, payload, "SURB Hop %d: payload mismatch", i)
+			} else {
+				require.Equalf(2, len(cmds), "SURB Hop %d: Unexpected number of commands", i)
+				require.EqualValuesf(path[i].Commands[0], cmds[0], "SURB Hop %d: delay mismatch", i)
+
+				nextNode, ok := cmds[1].(*commands.NextNodeHop)
+				require.Truef(ok, "SURB Hop %d: cmds[1] is not a NextNodeHop", i)
+				require.Equalf(path[i+1].ID, nextNode.ID, "SURB Hop %d: NextNodeHop.ID mismatch", i)
+
+				require.Nil(b, "SURB Hop %d: returned payload", i)
+			}
+		}
+	}
+}
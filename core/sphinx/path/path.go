@@ -61,8 +61,8 @@ selectLoop:
 			epoch, _, _ := epochtime.FromUnix(then.Unix())
 			if k, ok := desc.MixKeys[epoch]; !ok {
 				continue selectLoop
-			} else {
-				h.NIKEPublicKey = k
+			} else if h.NIKEPublicKey, h.KEMPublicKey, err = pki.UnmarshalMixKey(doc.SphinxGeometry, k); err != nil {
+				return nil, time.Time{}, err
 			}
 
 			// All non-terminal hops, and the terminal forward hop iff the
@@ -164,13 +164,37 @@ func selectHops(rng *mRand.Rand, doc *pki.Document, src, dst *pki.MixDescriptor,
 		if len(nodes) == 0 {
 			return nil, fmt.Errorf("path: layer %v has no nodes", i)
 		}
-		hops = append(hops, nodes[rng.Intn(len(nodes))])
+		hops = append(hops, selectWeighted(rng, doc, nodes))
 	}
 	hops = append(hops, dst)
 
 	return hops, nil
 }
 
+// selectWeighted picks one of the nodes of a layer with probability
+// proportional to its load weight in the document, following
+// pki.LayerLoadWeights, so that all clients with the same document select
+// hops with the same distribution.  If no node of the layer has a weight,
+// the node is picked uniformly at random.
+func selectWeighted(rng *mRand.Rand, doc *pki.Document, nodes []*pki.MixDescriptor) *pki.MixDescriptor {
+	weights := pki.LayerLoadWeights(nodes, doc.LoadWeights)
+	total := 0
+	for _, w := range weights {
+		total += int(w)
+	}
+	if total == 0 {
+		return nodes[rng.Intn(len(nodes))]
+	}
+	n := rng.Intn(total)
+	for i, w := range weights {
+		if n < int(w) {
+			return nodes[i]
+		}
+		n -= int(w)
+	}
+	panic("path: BUG: weighted selection out of range")
+}
+
 // ToString returns a slice of strings representing the "useful" component of
 // each PathHop, suitable for debugging.
 func ToString(doc *pki.Document, p []*sphinx.PathHop) ([]string, error) {
@@ -0,0 +1,110 @@
+// path_test.go - Path selection tests.
+// Copyright (C) 2022  David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package path
+
+import (
+	"fmt"
+	mRand "math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/katzenpost/katzenpost/core/crypto/cert"
+	"github.com/katzenpost/katzenpost/core/pki"
+)
+
+func genDescriptor(name string, provider bool, weight uint8) *pki.MixDescriptor {
+	_, identityPub := cert.Scheme.NewKeypair()
+	return &pki.MixDescriptor{
+		Name:        name,
+		IdentityKey: identityPub,
+		Provider:    provider,
+		LoadWeight:  weight,
+	}
+}
+
+// TestWeightedSelection simulates the selection of many client paths and
+// checks that the traffic each mix receives is proportional to its weight.
+func TestWeightedSelection(t *testing.T) {
+	require := require.New(t)
+
+	declared := [][]uint8{
+		{0, 0, 0, 0},
+		{0, 0, 0, 0},
+		{10, 10, 0, 0},
+		{255, 0, 0, 0},
+	}
+	assigned := [][]uint8{
+		{0, 0, 0, 0},   // unweighted layer, uniform selection
+		{1, 2, 3, 4},   // weighted layer
+		{10, 28, 0, 0}, // partially weighted layer, the others get the median
+		{0, 0, 0, 0},   // declared weights are ignored
+	}
+	doc := &pki.Document{
+		Topology:    make([][]*pki.MixDescriptor, len(assigned)),
+		LoadWeights: make(map[[pki.PublicKeyHashSize]byte]uint8),
+	}
+	for l, layer := range assigned {
+		for i, w := range layer {
+			desc := genDescriptor(fmt.Sprintf("mix%d-%d", l, i), false, declared[l][i])
+			doc.Topology[l] = append(doc.Topology[l], desc)
+			if w != 0 {
+				doc.LoadWeights[desc.IdentityKey.Sum256()] = w
+			}
+		}
+	}
+	src := genDescriptor("provider0", true, 0)
+	dst := genDescriptor("provider1", true, 0)
+	doc.Providers = []*pki.MixDescriptor{src, dst}
+
+	const nPaths = 100000
+	counts := make(map[string]int)
+	rng := mRand.New(mRand.NewSource(1))
+	for i := 0; i < nPaths; i++ {
+		hops, err := selectHops(rng, doc, src, dst, true, true)
+		require.NoError(err)
+		require.Len(hops, len(doc.Topology)+2)
+		for _, hop := range hops[1 : len(hops)-1] {
+			counts[hop.Name]++
+		}
+	}
+
+	expected := [][]float64{
+		{0.25, 0.25, 0.25, 0.25},
+		{0.1, 0.2, 0.3, 0.4},
+		{10.0 / 58, 28.0 / 58, 10.0 / 58, 10.0 / 58},
+		{0.25, 0.25, 0.25, 0.25},
+	}
+	for l, layer := range doc.Topology {
+		for i, desc := range layer {
+			share := float64(counts[desc.Name]) / nPaths
+			t.Logf("layer %d %s: weight %d, %.4f of traffic", l, desc.Name, doc.LoadWeight(desc), share)
+			require.InDelta(expected[l][i], share, 0.01, desc.Name)
+		}
+	}
+
+	// the same document and seed yields the same paths
+	rng1 := mRand.New(mRand.NewSource(2))
+	rng2 := mRand.New(mRand.NewSource(2))
+	for i := 0; i < 100; i++ {
+		hops1, err := selectHops(rng1, doc, src, dst, true, true)
+		require.NoError(err)
+		hops2, err := selectHops(rng2, doc, src, dst, true, true)
+		require.NoError(err)
+		require.Equal(hops1, hops2)
+	}
+}
@@ -25,9 +25,11 @@ import (
 	"strings"
 
 	"github.com/cloudflare/circl/kem"
+	kemschemes "github.com/cloudflare/circl/kem/schemes"
 
 	"github.com/katzenpost/katzenpost/core/crypto/nike"
 	"github.com/katzenpost/katzenpost/core/crypto/nike/ecdh"
+	nikeschemes "github.com/katzenpost/katzenpost/core/crypto/nike/schemes"
 	"github.com/katzenpost/katzenpost/core/crypto/rand"
 	"github.com/katzenpost/katzenpost/core/sphinx/commands"
 	"github.com/katzenpost/katzenpost/core/sphinx/constants"
@@ -112,11 +114,24 @@ type Geometry struct {
 
 	// NodeIDLength is the node identifier length in bytes.
 	NodeIDLength int
+
+	// NIKEName is the name of the NIKE scheme used by the mixnet's
+	// Sphinx packets, and is mutually exclusive with KEMName.
+	NIKEName string
+
+	// KEMName is the name of the KEM scheme used by the mixnet's
+	// Sphinx packets, and is mutually exclusive with NIKEName.
+	KEMName string
 }
 
 func (g *Geometry) String() string {
 	var b strings.Builder
 	b.WriteString("sphinx_packet_geometry:\n")
+	if g.KEMName != "" {
+		b.WriteString(fmt.Sprintf("kem: %s\n", g.KEMName))
+	} else {
+		b.WriteString(fmt.Sprintf("nike: %s\n", g.NIKEName))
+	}
 	b.WriteString(fmt.Sprintf("packet size: %d\n", g.PacketLength))
 	b.WriteString(fmt.Sprintf("number of hops: %d\n", g.NrHops))
 	b.WriteString(fmt.Sprintf("header size: %d\n", g.HeaderLength))
@@ -217,6 +232,7 @@ func GeometryFromUserForwardPayloadLength(nike nike.Nike, userForwardPayloadLeng
 		SURBIDLength:                constants.SURBIDLength,
 		RoutingInfoLength:           f.routingInfoLength(),
 		PerHopRoutingInfoLength:     f.perHopRoutingInfoLength(),
+		NIKEName:                    nike.Name(),
 	}
 
 	return geo
@@ -240,7 +256,88 @@ func GeometryFromForwardPayloadLength(nike nike.Nike, forwardPayloadLength, nrHo
 		SURBIDLength:                constants.SURBIDLength,
 		RoutingInfoLength:           f.routingInfoLength(),
 		PerHopRoutingInfoLength:     f.perHopRoutingInfoLength(),
+		NIKEName:                    nike.Name(),
+	}
+}
+
+// NewGeometry returns the Geometry of Sphinx packets that carry
+// userForwardPayloadLength bytes of user payload along with a SURB
+// across at most nrHops hops, using either the named NIKE or the
+// named KEM.  Exactly one of nikeName and kemName must be set.
+func NewGeometry(nikeName, kemName string, userForwardPayloadLength, nrHops int) (*Geometry, error) {
+	if nrHops <= 0 {
+		return nil, fmt.Errorf("sphinx: invalid number of hops: %d", nrHops)
+	}
+	if userForwardPayloadLength <= 0 {
+		return nil, fmt.Errorf("sphinx: invalid user forward payload length: %d", userForwardPayloadLength)
+	}
+	switch {
+	case nikeName != "" && kemName != "":
+		return nil, errors.New("sphinx: NIKE and KEM are mutually exclusive")
+	case kemName != "":
+		k := kemschemes.ByName(kemName)
+		if k == nil {
+			return nil, fmt.Errorf("sphinx: unknown KEM: '%v'", kemName)
+		}
+		return KEMGeometryFromUserForwardPayloadLength(k, userForwardPayloadLength, true, nrHops), nil
+	case nikeName != "":
+		n := nikeschemes.ByName(nikeName)
+		if n == nil {
+			return nil, fmt.Errorf("sphinx: unknown NIKE: '%v'", nikeName)
+		}
+		return GeometryFromUserForwardPayloadLength(n, userForwardPayloadLength, true, nrHops), nil
+	default:
+		return nil, errors.New("sphinx: neither NIKE nor KEM specified")
+	}
+}
+
+// Validate returns an error iff the Geometry does not describe Sphinx
+// packets built with its named NIKE or KEM, for example because it was
+// deserialized from an untrusted source and has been tampered with.
+func (g *Geometry) Validate() error {
+	if g == nil {
+		return errors.New("sphinx: missing geometry")
 	}
+	expected, err := NewGeometry(g.NIKEName, g.KEMName, g.UserForwardPayloadLength, g.NrHops)
+	if err != nil {
+		return err
+	}
+	if !g.Equal(expected) {
+		return errors.New("sphinx: geometry is inconsistent with its parameters")
+	}
+	return nil
+}
+
+// Equal returns true iff the two geometries are identical.
+func (g *Geometry) Equal(other *Geometry) bool {
+	if g == nil || other == nil {
+		return g == other
+	}
+	return *g == *other
+}
+
+// FixupGeometry returns the complete Geometry described by a possibly
+// partially specified Geometry, such as one read from a configuration
+// file where only NIKEName or KEMName, NrHops and UserForwardPayloadLength
+// are meaningful.  Unspecified parameters are taken from DefaultGeometry.
+func FixupGeometry(g *Geometry) (*Geometry, error) {
+	def := DefaultGeometry()
+	if g == nil {
+		return def, nil
+	}
+	nikeName, kemName := g.NIKEName, g.KEMName
+	if nikeName == "" && kemName == "" {
+		nikeName = def.NIKEName
+	}
+	nrHops := g.NrHops
+	if nrHops <= 0 {
+		nrHops = def.NrHops
+	}
+	userForwardPayloadLength := g.UserForwardPayloadLength
+	if userForwardPayloadLength <= 0 {
+		userForwardPayloadLength = def.UserForwardPayloadLength
+	}
+	return NewGeometry(nikeName, kemName, userForwardPayloadLength, nrHops)
 }
 
 // Sphinx is a modular implementation of the Sphinx cryptographic packet
@@ -260,6 +357,18 @@ func NewSphinx(n nike.Nike, geometry *Geometry) *Sphinx {
 	return s
 }
 
+// FromGeometry returns a new instance of Sphinx using the NIKE or KEM
+// named by the provided geometry.
+func FromGeometry(geometry *Geometry) (*Sphinx, error) {
+	if err := geometry.Validate(); err != nil {
+		return nil, err
+	}
+	if geometry.KEMName != "" {
+		return NewKEMSphinx(kemschemes.ByName(geometry.KEMName), geometry), nil
+	}
+	return NewSphinx(nikeschemes.ByName(geometry.NIKEName), geometry), nil
+}
+
 // Geometry returns the Sphinx packet geometry.
 func (s *Sphinx) Geometry() *Geometry {
 	return s.geometry
@@ -304,6 +413,10 @@ func (s *Sphinx) commandsToBytes(cmds []commands.RoutingCommand, isTerminal bool
 }
 
 func (s *Sphinx) createHeader(r io.Reader, path []*PathHop) ([]byte, []*sprpKey, error) {
+	if s.kem != nil {
+		return s.createKEMHeader(r, path)
+	}
+
 	nrHops := len(path)
 	if nrHops > s.geometry.NrHops {
 		return nil, nil, errors.New("sphinx: invalid path")
@@ -171,3 +171,38 @@ func testSURB(t *testing.T, mynike nike.Nike, sphinx *Sphinx, testPayload []byte
 		}
 	}
 }
+
+func TestGeometryValidate(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	geo := DefaultGeometry()
+	require.NoError(geo.Validate())
+
+	geo2, err := NewGeometry(geo.NIKEName, "", geo.UserForwardPayloadLength, geo.NrHops)
+	require.NoError(err)
+	require.True(geo.Equal(geo2))
+
+	s, err := FromGeometry(geo2)
+	require.NoError(err)
+	require.True(geo.Equal(s.Geometry()))
+
+	tampered := *geo
+	tampered.PacketLength++
+	require.Error(tampered.Validate())
+
+	_, err = NewGeometry("", "", geo.UserForwardPayloadLength, geo.NrHops)
+	require.Error(err)
+	_, err = NewGeometry("bogus", "", geo.UserForwardPayloadLength, geo.NrHops)
+	require.Error(err)
+	_, err = NewGeometry(geo.NIKEName, "Kyber768-X25519", geo.UserForwardPayloadLength, geo.NrHops)
+	require.Error(err)
+
+	kemGeo, err := NewGeometry("", "Kyber768-X25519", geo.UserForwardPayloadLength, geo.NrHops)
+	require.NoError(err)
+	require.NoError(kemGeo.Validate())
+	require.Equal(kemGeo.HeaderLength+kemGeo.PayloadTagLength+kemGeo.ForwardPayloadLength, kemGeo.PacketLength)
+	s, err = FromGeometry(kemGeo)
+	require.NoError(err)
+	require.True(kemGeo.Equal(s.Geometry()))
+}
@@ -0,0 +1,111 @@
+// transport.go - Link transports.
+// Copyright (C) 2022  David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package transport provides the link transports which carry the wire
+// protocol between clients and Providers.
+package transport
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/katzenpost/katzenpost/core/pki"
+)
+
+// DialFunc is a function which establishes TCP connections, such as
+// net.Dialer.DialContext.
+type DialFunc func(ctx context.Context, network, address string) (net.Conn, error)
+
+// Transport is a link transport.
+type Transport interface {
+	// Listen returns a listener which accepts connections at the
+	// address.
+	Listen(addr string) (net.Listener, error)
+
+	// Dial connects to the address, using dialFn for any TCP connection
+	// the transport requires.  A nil dialFn connects directly, and a
+	// transport which can't carry its connections over dialFn, such as
+	// a proxy, refuses to dial rather than connect directly.
+	Dial(ctx context.Context, dialFn DialFunc, addr string) (net.Conn, error)
+}
+
+// ErrDialFuncUnsupported is the error returned when dialing with a
+// transport which can't use the given DialFunc.
+var ErrDialFuncUnsupported = errors.New("transport: transport can't be used with the configured dialer")
+
+var (
+	defaultDialer = net.Dialer{
+		KeepAlive: 3 * time.Minute,
+		Timeout:   1 * time.Minute,
+	}
+
+	transportsLock sync.RWMutex
+	transports     = map[pki.Transport]Transport{
+		pki.TransportTCP:          &tcpTransport{network: "tcp"},
+		pki.TransportTCPv4:        &tcpTransport{network: "tcp4"},
+		pki.TransportTCPv6:        &tcpTransport{network: "tcp6"},
+		pki.TransportQUIC:         new(quicTransport),
+		pki.TransportWebSocket:    &webSocketTransport{},
+		pki.TransportWebSocketTLS: &webSocketTransport{tls: true},
+	}
+)
+
+// Register registers the implementation of a link transport, replacing
+// any existing implementation.
+func Register(t pki.Transport, impl Transport) {
+	transportsLock.Lock()
+	defer transportsLock.Unlock()
+	transports[t] = impl
+}
+
+// Get returns the implementation of a link transport.
+func Get(t pki.Transport) (Transport, error) {
+	transportsLock.RLock()
+	defer transportsLock.RUnlock()
+	impl, ok := transports[t]
+	if !ok {
+		return nil, fmt.Errorf("transport: unsupported transport: '%v'", t)
+	}
+	return impl, nil
+}
+
+// errListenerClosed returns the error returned by Accept once a listener
+// is closed, which like that of a net.TCPListener is a net.Error.
+func errListenerClosed(addr net.Addr) error {
+	return &net.OpError{Op: "accept", Net: addr.Network(), Addr: addr, Err: net.ErrClosed}
+}
+
+type tcpTransport struct {
+	network string
+}
+
+func (t *tcpTransport) Listen(addr string) (net.Listener, error) {
+	return net.Listen(t.network, addr)
+}
+
+func (t *tcpTransport) Dial(ctx context.Context, dialFn DialFunc, addr string) (net.Conn, error) {
+	// The addresses of the IP version specific transports are IP
+	// literals, so dial "tcp" which alternative dialers such as proxies
+	// are the most likely to support.
+	if dialFn == nil {
+		dialFn = defaultDialer.DialContext
+	}
+	return dialFn(ctx, "tcp", addr)
+}
@@ -0,0 +1,138 @@
+// transport_test.go - Link transport tests.
+// Copyright (C) 2022  David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package transport
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/katzenpost/katzenpost/core/crypto/rand"
+	"github.com/katzenpost/katzenpost/core/pki"
+)
+
+func testTransport(t *testing.T, tr pki.Transport) {
+	require := require.New(t)
+
+	impl, err := Get(tr)
+	require.NoError(err)
+	l, err := impl.Listen("127.0.0.1:0")
+	require.NoError(err)
+	defer l.Close()
+
+	// echo the first message back, larger than a single frame or packet
+	msg := make([]byte, 100*1024)
+	_, err = rand.Reader.Read(msg)
+	require.NoError(err)
+	errCh := make(chan error, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			errCh <- err
+			return
+		}
+		defer conn.Close()
+		buf := make([]byte, len(msg))
+		if _, err = io.ReadFull(conn, buf); err != nil {
+			errCh <- err
+			return
+		}
+		_, err = conn.Write(buf)
+		errCh <- err
+	}()
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancelFn()
+	conn, err := impl.Dial(ctx, nil, l.Addr().String())
+	require.NoError(err)
+	defer conn.Close()
+	require.NotNil(conn.LocalAddr())
+	require.NotNil(conn.RemoteAddr())
+	require.NoError(conn.SetDeadline(time.Now().Add(10 * time.Second)))
+	_, err = conn.Write(msg)
+	require.NoError(err)
+	buf := make([]byte, len(msg))
+	_, err = io.ReadFull(conn, buf)
+	require.NoError(err)
+	require.Equal(msg, buf)
+	require.NoError(<-errCh)
+
+	// a closed listener stops accepting
+	require.NoError(l.Close())
+	_, err = l.Accept()
+	require.ErrorIs(err, net.ErrClosed)
+	netErr, ok := err.(net.Error)
+	require.True(ok)
+	require.False(netErr.Temporary())
+}
+
+func TestTransports(t *testing.T) {
+	for _, tr := range []pki.Transport{pki.TransportTCP, pki.TransportQUIC, pki.TransportWebSocket, pki.TransportWebSocketTLS} {
+		t.Run(string(tr), func(t *testing.T) {
+			testTransport(t, tr)
+		})
+	}
+}
+
+func TestProxiedQUIC(t *testing.T) {
+	require := require.New(t)
+
+	impl, err := Get(pki.TransportQUIC)
+	require.NoError(err)
+	l, err := impl.Listen("127.0.0.1:0")
+	require.NoError(err)
+	defer l.Close()
+
+	// A proxy can't carry QUIC, which must not connect directly instead.
+	dialer := new(net.Dialer)
+	_, err = impl.Dial(context.Background(), dialer.DialContext, l.Addr().String())
+	require.ErrorIs(err, ErrDialFuncUnsupported)
+}
+
+func TestUnsupportedTransport(t *testing.T) {
+	_, err := Get(pki.Transport("carrier-pigeon"))
+	require.Error(t, err)
+}
+
+func TestWebSocketTLS(t *testing.T) {
+	require := require.New(t)
+
+	impl, err := Get(pki.TransportWebSocketTLS)
+	require.NoError(err)
+	l, err := impl.Listen("127.0.0.1:0")
+	require.NoError(err)
+	defer l.Close()
+
+	// The listener speaks TLS, with a self-signed certificate.
+	conn, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+	require.NoError(err)
+	defer conn.Close()
+	require.Len(conn.ConnectionState().PeerCertificates, 1)
+
+	// A plain WebSocket can't connect to it.
+	ws, err := Get(pki.TransportWebSocket)
+	require.NoError(err)
+	ctx, cancelFn := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancelFn()
+	_, err = ws.Dial(ctx, nil, l.Addr().String())
+	require.Error(err)
+}
@@ -0,0 +1,209 @@
+// websocket.go - WebSocket link transport.
+// Copyright (C) 2022  David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package transport
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// WebSocketPath is the HTTP path of the WebSocket endpoint.
+const WebSocketPath = "/katzenpost"
+
+// webSocketTransport carries each connection on a WebSocket, in binary
+// frames, which lets clients connect through networks which only allow
+// HTTP traffic, or through HTTP reverse proxies.
+//
+// With tls set, the WebSocket is carried over TLS, like HTTPS traffic.
+// As with QUIC, the TLS handshake is not authenticated: the server
+// presents an ephemeral self-signed certificate, and the peers are
+// authenticated by the wire protocol handshake.
+type webSocketTransport struct {
+	tls bool
+}
+
+func (t *webSocketTransport) Listen(addr string) (net.Listener, error) {
+	tl, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	sl := tl
+	if t.tls {
+		cert, err := newSelfSignedCertificate()
+		if err != nil {
+			tl.Close()
+			return nil, err
+		}
+		sl = tls.NewListener(tl, &tls.Config{
+			Certificates: []tls.Certificate{*cert},
+		})
+	}
+	l := &webSocketListener{
+		l:       tl,
+		connCh:  make(chan net.Conn),
+		closeCh: make(chan interface{}),
+	}
+	mux := http.NewServeMux()
+	mux.Handle(WebSocketPath, websocket.Server{
+		// Clients are not browsers, there is no Origin to check.
+		Handshake: func(*websocket.Config, *http.Request) error { return nil },
+		Handler:   l.onWebSocket,
+	})
+	l.srv = &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: time.Minute,
+	}
+	go l.srv.Serve(sl)
+	return l, nil
+}
+
+func (t *webSocketTransport) Dial(ctx context.Context, dialFn DialFunc, addr string) (net.Conn, error) {
+	scheme, origin := "ws", "http"
+	if t.tls {
+		scheme, origin = "wss", "https"
+	}
+	cfg, err := websocket.NewConfig(fmt.Sprintf("%s://%s%s", scheme, addr, WebSocketPath), fmt.Sprintf("%s://%s/", origin, addr))
+	if err != nil {
+		return nil, err
+	}
+	if dialFn == nil {
+		dialFn = defaultDialer.DialContext
+	}
+	conn, err := dialFn(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	var rwc net.Conn = conn
+	if t.tls {
+		tlsConn := tls.Client(conn, &tls.Config{
+			InsecureSkipVerify: true,
+		})
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		rwc = tlsConn
+	}
+	ws, err := websocket.NewClient(cfg, rwc)
+	if err != nil {
+		rwc.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	ws.PayloadType = websocket.BinaryFrame
+	return newWebSocketConn(ws, conn.LocalAddr(), conn.RemoteAddr()), nil
+}
+
+type webSocketListener struct {
+	l   net.Listener
+	srv *http.Server
+
+	connCh    chan net.Conn
+	closeCh   chan interface{}
+	closeOnce sync.Once
+}
+
+func (l *webSocketListener) onWebSocket(ws *websocket.Conn) {
+	ws.PayloadType = websocket.BinaryFrame
+	var localAddr, remoteAddr net.Addr = l.l.Addr(), ws.RemoteAddr()
+	if addr, ok := ws.Request().Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		localAddr = addr
+	}
+	if addr, err := net.ResolveTCPAddr("tcp", ws.Request().RemoteAddr); err == nil {
+		remoteAddr = addr
+	}
+	c := newWebSocketConn(ws, localAddr, remoteAddr)
+	select {
+	case l.connCh <- c:
+	case <-l.closeCh:
+		return
+	}
+	// The WebSocket is closed when the handler returns.
+	<-c.closedCh
+}
+
+// Accept waits for and returns the next connection to the listener.
+func (l *webSocketListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.connCh:
+		return c, nil
+	case <-l.closeCh:
+		return nil, errListenerClosed(l.Addr())
+	}
+}
+
+// Close closes the listener, leaving the accepted connections open.
+func (l *webSocketListener) Close() error {
+	var err error
+	l.closeOnce.Do(func() {
+		close(l.closeCh)
+		err = l.srv.Close()
+	})
+	return err
+}
+
+// Addr returns the listener's network address.
+func (l *webSocketListener) Addr() net.Addr {
+	return l.l.Addr()
+}
+
+// webSocketConn is a net.Conn over a WebSocket, which reports the
+// addresses of the underlying TCP connection.
+type webSocketConn struct {
+	*websocket.Conn
+
+	localAddr  net.Addr
+	remoteAddr net.Addr
+	closedCh   chan interface{}
+	closeOnce  sync.Once
+}
+
+func newWebSocketConn(ws *websocket.Conn, localAddr, remoteAddr net.Addr) *webSocketConn {
+	return &webSocketConn{
+		Conn:       ws,
+		localAddr:  localAddr,
+		remoteAddr: remoteAddr,
+		closedCh:   make(chan interface{}),
+	}
+}
+
+func (c *webSocketConn) LocalAddr() net.Addr {
+	return c.localAddr
+}
+
+func (c *webSocketConn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+func (c *webSocketConn) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		err = c.Conn.Close()
+		close(c.closedCh)
+	})
+	return err
+}
@@ -0,0 +1,87 @@
+// swapFiles.go - Crash safe file replacement.
+// Copyright (C) 2022  David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package utils
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// SwapFiles retires the files of the directory with the ".old" suffix, and
+// moves the new files with the ".new" suffix in their place.  It completes
+// the swap when run again after being interrupted.
+func SwapFiles(dir string, files []string) error {
+	path := func(f string) string {
+		return filepath.Join(dir, f)
+	}
+	for _, f := range files {
+		if exists(path(f+".new")) && exists(path(f)) && !exists(path(f+".old")) {
+			if err := os.Rename(path(f), path(f+".old")); err != nil {
+				return err
+			}
+		}
+	}
+	for _, f := range files {
+		if exists(path(f + ".new")) {
+			if err := os.Rename(path(f+".new"), path(f)); err != nil {
+				return err
+			}
+		}
+	}
+	return SyncDir(dir)
+}
+
+// WriteFileSync atomically replaces the file with one holding b, which is
+// persisted when WriteFileSync returns.
+func WriteFileSync(f string, b []byte) error {
+	tmp := f + ".tmp"
+	out, err := os.OpenFile(tmp, os.O_TRUNC|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = out.Write(b); err == nil {
+		err = out.Sync()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, f); err != nil {
+		return err
+	}
+	return SyncDir(filepath.Dir(f))
+}
+
+// SyncDir persists the entries of the directory.
+func SyncDir(dirFn string) error {
+	dir, err := os.Open(dirFn)
+	if err != nil {
+		return err
+	}
+	if err := dir.Sync(); err != nil {
+		dir.Close()
+		return err
+	}
+	return dir.Close()
+}
+
+func exists(f string) bool {
+	_, err := os.Stat(f)
+	return err == nil
+}
@@ -36,6 +36,9 @@ const (
 	getConsensusLength  = 8
 	consensusBaseLength = 1
 
+	getConsensusRangeLength  = 8 + 8
+	consensusRangeBaseLength = 1 + 8
+
 	postDescriptorStatusLength = 1
 	postDescriptorLength       = 8
 
@@ -69,6 +72,9 @@ const (
 	sigStatus            commandID = 28
 	certificate          commandID = 29
 	certStatus           commandID = 30
+	enablePush           commandID = 31
+	getConsensusRange    commandID = 32
+	consensusRange       commandID = 33
 
 	// ConsensusOk signifies that the GetConsensus request has completed
 	// successfully.
@@ -327,6 +333,94 @@ func consensusFromBytes(b []byte) (Command, error) {
 	return r, nil
 }
 
+// GetConsensusRange is a de-serialized get_consensus_range command.  It
+// requests the archived documents of the epochs from FirstEpoch to
+// LastEpoch included.
+type GetConsensusRange struct {
+	FirstEpoch uint64
+	LastEpoch  uint64
+}
+
+// ToBytes serializes the GetConsensusRange and returns the resulting byte
+// slice.
+func (c *GetConsensusRange) ToBytes() []byte {
+	out := make([]byte, cmdOverhead+getConsensusRangeLength)
+	out[0] = byte(getConsensusRange)
+	binary.BigEndian.PutUint32(out[2:6], getConsensusRangeLength)
+	binary.BigEndian.PutUint64(out[6:14], c.FirstEpoch)
+	binary.BigEndian.PutUint64(out[14:22], c.LastEpoch)
+	return out
+}
+
+func getConsensusRangeFromBytes(b []byte) (Command, error) {
+	if len(b) != getConsensusRangeLength {
+		return nil, errInvalidCommand
+	}
+
+	r := new(GetConsensusRange)
+	r.FirstEpoch = binary.BigEndian.Uint64(b[0:8])
+	r.LastEpoch = binary.BigEndian.Uint64(b[8:16])
+	return r, nil
+}
+
+// ConsensusRange is a de-serialized consensus_range command.
+type ConsensusRange struct {
+	ErrorCode uint8
+
+	// NextEpoch is the first epoch of the requested range which is not
+	// covered by the reply, or 0 if the reply covers the whole range.
+	NextEpoch uint64
+
+	// Epochs are the covered epochs which have an archived document, in
+	// order, and Documents the matching documents.
+	Epochs    []uint64
+	Documents [][]byte
+}
+
+// ToBytes serializes the ConsensusRange and returns the resulting byte
+// slice.
+func (c *ConsensusRange) ToBytes() []byte {
+	consensusRangeLength := consensusRangeBaseLength
+	for _, d := range c.Documents {
+		consensusRangeLength += 8 + 4 + len(d)
+	}
+	out := make([]byte, cmdOverhead+consensusRangeBaseLength, cmdOverhead+consensusRangeLength)
+	out[0] = byte(consensusRange)
+	binary.BigEndian.PutUint32(out[2:6], uint32(consensusRangeLength))
+	out[6] = c.ErrorCode
+	binary.BigEndian.PutUint64(out[7:15], c.NextEpoch)
+	for i, d := range c.Documents {
+		out = binary.BigEndian.AppendUint64(out, c.Epochs[i])
+		out = binary.BigEndian.AppendUint32(out, uint32(len(d)))
+		out = append(out, d...)
+	}
+	return out
+}
+
+func consensusRangeFromBytes(b []byte) (Command, error) {
+	if len(b) < consensusRangeBaseLength {
+		return nil, errInvalidCommand
+	}
+
+	r := new(ConsensusRange)
+	r.ErrorCode = b[0]
+	r.NextEpoch = binary.BigEndian.Uint64(b[1:9])
+	for b = b[consensusRangeBaseLength:]; len(b) > 0; {
+		if len(b) < 8+4 {
+			return nil, errInvalidCommand
+		}
+		r.Epochs = append(r.Epochs, binary.BigEndian.Uint64(b[0:8]))
+		docLength := binary.BigEndian.Uint32(b[8:12])
+		b = b[12:]
+		if uint32(len(b)) < docLength {
+			return nil, errInvalidCommand
+		}
+		r.Documents = append(r.Documents, append([]byte{}, b[:docLength]...))
+		b = b[docLength:]
+	}
+	return r, nil
+}
+
 // PostDescriptor is a de-serialized post_descriptor command.
 type PostDescriptor struct {
 	Epoch   uint64
@@ -669,6 +763,21 @@ func retreiveMessageFromBytes(b []byte) (Command, error) {
 	return r, nil
 }
 
+// EnablePush is a de-serialized enable_push command. It requests that
+// the provider sends the head of the spool as a Message or MessageACK
+// as soon as it is stored, instead of waiting for a RetrieveMessage.
+// A pushed message is acknowledged with a RetrieveMessage carrying the
+// next sequence number, and no further message is pushed until the
+// spool has been drained to a MessageEmpty.
+type EnablePush struct{}
+
+// ToBytes serializes the EnablePush and returns the resulting slice.
+func (c *EnablePush) ToBytes() []byte {
+	out := make([]byte, cmdOverhead)
+	out[0] = byte(enablePush)
+	return out
+}
+
 // MessageACK is a de-serialized message command containing an ACK.
 type MessageACK struct {
 	Geo *sphinx.Geometry
@@ -831,6 +940,8 @@ func (c *Commands) FromBytes(b []byte) (Command, error) {
 			return &NoOp{}, nil
 		case disconnect:
 			return &Disconnect{}, nil
+		case enablePush:
+			return &EnablePush{}, nil
 		case sendPacket, postDescriptor:
 			// Shouldn't happen, but the caller should reject this, not the
 			// de-serialization.
@@ -852,6 +963,10 @@ func (c *Commands) FromBytes(b []byte) (Command, error) {
 		return getConsensusFromBytes(b)
 	case consensus:
 		return consensusFromBytes(b)
+	case getConsensusRange:
+		return getConsensusRangeFromBytes(b)
+	case consensusRange:
+		return consensusRangeFromBytes(b)
 	case postDescriptor:
 		return postDescriptorFromBytes(b)
 	case postDescriptorStatus:
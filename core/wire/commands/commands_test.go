@@ -74,6 +74,29 @@ func TestDisconnect(t *testing.T) {
 	require.IsType(cmd, c, "Disconnect: FromBytes() invalid type")
 }
 
+func TestEnablePush(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	cmd := &EnablePush{}
+	b := cmd.ToBytes()
+	require.Equal(cmdOverhead, len(b), "EnablePush: ToBytes() length")
+
+	nike := ecdh.NewEcdhNike(rand.Reader)
+	forwardPayloadLength := 123
+	nrHops := 5
+
+	geo := sphinx.GeometryFromForwardPayloadLength(nike, forwardPayloadLength, nrHops)
+	s := sphinx.NewSphinx(nike, geo)
+	cmds := &Commands{
+		geo: s.Geometry(),
+	}
+
+	c, err := cmds.FromBytes(b)
+	require.NoError(err, "EnablePush: FromBytes() failed")
+	require.IsType(cmd, c, "EnablePush: FromBytes() invalid type")
+}
+
 func TestSendPacket(t *testing.T) {
 	t.Parallel()
 	const payload = "A free man must be able to endure it when his fellow men act and live otherwise than he considers proper. He must free himself from the habit, just as soon as something does not please him, of calling for the police."
@@ -282,6 +305,52 @@ func TestConsensus(t *testing.T) {
 	require.Equal(d.ErrorCode, cmd.ErrorCode)
 }
 
+func TestGetConsensusRange(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	cmd := &GetConsensusRange{FirstEpoch: 0xdeadbabe, LastEpoch: 0xdeadbeef}
+	b := cmd.ToBytes()
+	require.Len(b, getConsensusRangeLength+cmdOverhead, "GetConsensusRange: ToBytes() length")
+
+	cmds := &Commands{}
+	c, err := cmds.FromBytes(b)
+	require.NoError(err, "GetConsensusRange: FromBytes() failed")
+	require.IsType(cmd, c, "GetConsensusRange: FromBytes() invalid type")
+	require.Equal(cmd, c)
+}
+
+func TestConsensusRange(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	cmd := &ConsensusRange{
+		ErrorCode: ConsensusOk,
+		NextEpoch: 42,
+		Epochs:    []uint64{39, 41},
+		Documents: [][]byte{[]byte("TANSTAFL"), []byte("There's ain't no such thing as a free lunch.")},
+	}
+	b := cmd.ToBytes()
+	require.Len(b, consensusRangeBaseLength+2*12+len(cmd.Documents[0])+len(cmd.Documents[1])+cmdOverhead, "ConsensusRange: ToBytes() length")
+
+	cmds := &Commands{}
+	c, err := cmds.FromBytes(b)
+	require.NoError(err, "ConsensusRange: FromBytes() failed")
+	require.IsType(cmd, c, "ConsensusRange: FromBytes() invalid type")
+	require.Equal(cmd, c)
+
+	// Truncated documents are rejected.
+	_, err = cmds.FromBytes(b[:len(b)-1])
+	require.Error(err, "ConsensusRange: FromBytes() accepted a truncated document")
+
+	cmd = &ConsensusRange{ErrorCode: ConsensusNotFound}
+	b = cmd.ToBytes()
+	require.Len(b, consensusRangeBaseLength+cmdOverhead, "ConsensusRange: ToBytes() length")
+	c, err = cmds.FromBytes(b)
+	require.NoError(err, "ConsensusRange: FromBytes() failed")
+	require.Equal(cmd, c)
+}
+
 func TestPostDescriptor(t *testing.T) {
 	t.Parallel()
 	require := require.New(t)
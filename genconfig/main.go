@@ -34,6 +34,8 @@ import (
 	"github.com/katzenpost/katzenpost/core/crypto/pem"
 	"github.com/katzenpost/katzenpost/core/crypto/rand"
 	"github.com/katzenpost/katzenpost/core/crypto/sign"
+	"github.com/katzenpost/katzenpost/core/pki"
+	"github.com/katzenpost/katzenpost/core/sphinx"
 	"github.com/katzenpost/katzenpost/core/wire"
 	sConfig "github.com/katzenpost/katzenpost/server/config"
 )
@@ -56,6 +58,7 @@ type katzenpost struct {
 	votingAuthConfigs []*vConfig.Config
 	authorities       map[[32]byte]*vConfig.Authority
 	authIdentity      sign.PublicKey
+	sphinxGeometry    *sphinx.Geometry
 
 	nodeConfigs []*sConfig.Config
 	basePort    uint16
@@ -140,6 +143,9 @@ func (s *katzenpost) genNodeConfig(isProvider bool, isVoting bool) error {
 		}
 	}
 
+	cfg.SphinxGeometry = s.sphinxGeometry
+	cfg.Server.SphinxNIKE = s.sphinxGeometry.NIKEName
+
 	// Debug section.
 	cfg.Debug = new(sConfig.Debug)
 	cfg.Debug.SendDecoyTraffic = true
@@ -342,6 +348,7 @@ func (s *katzenpost) genVotingAuthoritiesCfg(numAuthorities int, paramsFile stri
 			Level:   "DEBUG",
 		}
 		cfg.Parameters = parameters
+		cfg.SphinxGeometry = s.sphinxGeometry
 		cfg.Debug = &vConfig.Debug{
 			Layers:           nrLayers,
 			MinNodesPerLayer: 1,
@@ -428,6 +435,7 @@ func main() {
 	binSuffix := flag.String("S", "", "suffix for binaries in docker-compose.yml")
 	paramsFile := flag.String("t", "", "Path to read params.toml from (optional)")
 	omitTopology := flag.Bool("D", false, "Dynamic topology (omit fixed topology definition)")
+	nikeName := flag.String("nike", sphinx.DefaultGeometry().NIKEName, "Sphinx NIKE scheme (eg: x25519, ctidh)")
 	flag.Parse()
 	s := &katzenpost{}
 
@@ -440,6 +448,12 @@ func main() {
 	os.Mkdir(s.outDir, 0700)
 	os.Mkdir(filepath.Join(s.outDir, s.baseDir), 0700)
 
+	def := sphinx.DefaultGeometry()
+	s.sphinxGeometry, err = sphinx.NewGeometry(*nikeName, def.KEMName, def.UserForwardPayloadLength, pki.NrHops(*nrLayers))
+	if err != nil {
+		log.Fatalf("Failed to compute Sphinx geometry: %v", err)
+	}
+
 	if *voting {
 		// Generate the voting authority configurations
 		err := s.genVotingAuthoritiesCfg(*nrVoting, *paramsFile, *nrLayers)
@@ -59,6 +59,12 @@ func (r *SpoolReadDescriptor) IncrementOffset() {
 	r.ReadOffset += 1
 }
 
+// DeleteCommand returns the command deleting the message with the given ID
+// from the described spool, signed by the key of the spool.
+func (r *SpoolReadDescriptor) DeleteCommand(messageID uint32) ([]byte, error) {
+	return common.DeleteFromSpool(r.ID, messageID, r.PrivateKey)
+}
+
 // GetWriteDescriptor returns a SpoolWriteDescriptor which can
 // used write to the given spool.
 func (r *SpoolReadDescriptor) GetWriteDescriptor() *SpoolWriteDescriptor {
@@ -17,6 +17,7 @@
 package common
 
 import (
+	"encoding/binary"
 	"errors"
 
 	"github.com/fxamacker/cbor/v2"
@@ -58,15 +59,26 @@ const (
 	// RetrieveMessageCommand is the identity of the retrieve message command.
 	RetrieveMessageCommand = 3
 
+	// DeleteMessageCommand is the identity of the delete message command.
+	DeleteMessageCommand = 4
+
 	// SpoolServiceName is the canonical name of the memspool service.
 	SpoolServiceName = "spool"
 
 	// StatusOK is a status string indicating there was no error on the spool operation.
 	StatusOK = "OK"
+
+	// StatusMessageGone is a status string indicating that the message read
+	// expired or was deleted, the response naming the next message of the
+	// spool in its NextMessageID.
+	StatusMessageGone = "message gone"
 )
 
-// SpoolPayloadLength is the length of the spool append message payload.
-var SpoolPayloadLength = (sphinx.DefaultGeometry().UserForwardPayloadLength - 4) - QueryOverhead
+// SpoolPayloadLength returns the length of the spool append message
+// payload for the given Sphinx geometry.
+func SpoolPayloadLength(geo *sphinx.Geometry) int {
+	return (geo.UserForwardPayloadLength - 4) - QueryOverhead
+}
 
 // SpoolRequest is the message sent to the spool server
 type SpoolRequest struct {
@@ -97,6 +109,10 @@ type SpoolResponse struct {
 	MessageID uint32
 	Message   []byte
 	Status    string
+
+	// NextMessageID is the ID of the next message of the spool after a gone
+	// message, or of the next message to be appended if there is none.
+	NextMessageID uint32 `cbor:",omitempty"`
 }
 
 // Marshal implements cborplugin.Command
@@ -113,6 +129,11 @@ func (s *SpoolResponse) IsOK() bool {
 	return s.Status == StatusOK
 }
 
+// IsGone returns true if the message read expired or was deleted.
+func (s *SpoolResponse) IsGone() bool {
+	return s.Status == StatusMessageGone
+}
+
 func (s *SpoolResponse) StatusAsError() error {
 	return errors.New(s.Status)
 }
@@ -143,8 +164,8 @@ func PurgeSpool(spoolID [SpoolIDSize]byte, privKey *eddsa.PrivateKey) ([]byte, e
 	return s.Marshal()
 }
 
-func AppendToSpool(spoolID [SpoolIDSize]byte, message []byte) ([]byte, error) {
-	if len(message) > SpoolPayloadLength {
+func AppendToSpool(spoolID [SpoolIDSize]byte, message []byte, geo *sphinx.Geometry) ([]byte, error) {
+	if len(message) > SpoolPayloadLength(geo) {
 		return nil, errors.New("exceeds payload maximum")
 	}
 	s := SpoolRequest{
@@ -166,3 +187,26 @@ func ReadFromSpool(spoolID [SpoolIDSize]byte, messageID uint32, privKey *eddsa.P
 	}
 	return s.Marshal()
 }
+
+// DeleteSignedData returns the data signed by a delete message command,
+// which binds the signature to the spool and the message so that it
+// can't be replayed to delete other messages.
+func DeleteSignedData(spoolID [SpoolIDSize]byte, messageID uint32) []byte {
+	data := make([]byte, 1+SpoolIDSize+MessageIDSize)
+	data[0] = DeleteMessageCommand
+	copy(data[1:], spoolID[:])
+	binary.BigEndian.PutUint32(data[1+SpoolIDSize:], messageID)
+	return data
+}
+
+func DeleteFromSpool(spoolID [SpoolIDSize]byte, messageID uint32, privKey *eddsa.PrivateKey) ([]byte, error) {
+	signature := privKey.Sign(DeleteSignedData(spoolID, messageID))
+	s := SpoolRequest{
+		Command:   DeleteMessageCommand,
+		PublicKey: privKey.PublicKey().Bytes(),
+		Signature: signature,
+		SpoolID:   spoolID,
+		MessageID: messageID,
+	}
+	return s.Marshal()
+}
@@ -39,3 +39,22 @@ func TestCommandSerialization(t *testing.T) {
 	require.NotNil(sr.PublicKey)
 	require.NotNil(sr.MessageID)
 }
+
+func TestDeleteFromSpool(t *testing.T) {
+	require := require.New(t)
+	pk, err := eddsa.NewKeypair(rand.Reader)
+	require.NoError(err)
+	spoolID := [SpoolIDSize]byte{1, 2, 3}
+	cmd, err := DeleteFromSpool(spoolID, 7, pk)
+	require.NoError(err)
+	sr := new(SpoolRequest)
+	require.NoError(sr.Unmarshal(cmd))
+	require.Equal(uint8(DeleteMessageCommand), sr.Command)
+	require.Equal(uint32(7), sr.MessageID)
+
+	// the signature covers the command, the spool ID and the message ID
+	require.True(pk.PublicKey().Verify(sr.Signature, DeleteSignedData(spoolID, 7)))
+	require.False(pk.PublicKey().Verify(sr.Signature, DeleteSignedData(spoolID, 8)))
+	require.False(pk.PublicKey().Verify(sr.Signature, DeleteSignedData([SpoolIDSize]byte{}, 7)))
+	require.False(pk.PublicKey().Verify(sr.Signature, pk.PublicKey().Bytes()))
+}
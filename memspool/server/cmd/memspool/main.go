@@ -31,18 +31,25 @@ import (
 	"github.com/katzenpost/katzenpost/memspool/common"
 	"github.com/katzenpost/katzenpost/memspool/server"
 	"github.com/katzenpost/katzenpost/server/cborplugin"
+	"github.com/katzenpost/katzenpost/server/storage"
 )
 
 func main() {
 	var logLevel string
 	var logDir string
-	var dataStore string
-	flag.StringVar(&dataStore, "data_store", "", "data storage file path")
+	storageCfg := new(storage.Config)
+	spoolCfg := new(server.SpoolConfig)
+	flag.StringVar(&storageCfg.Backend, "storage", storage.BackendBolt, "storage backend could be set to: bolt, sql, mem")
+	flag.StringVar(&storageCfg.Path, "data_store", "", "data storage file path of the bolt storage backend")
+	flag.StringVar(&storageCfg.DataSourceName, "dsn", "", "data source name of the sql storage backend")
+	flag.DurationVar(&spoolCfg.MessageTTL, "message_ttl", 0, "duration after which spooled messages expire, or 0 to keep messages until deleted")
+	flag.IntVar(&spoolCfg.MaxMessages, "max_messages", 0, "maximum number of messages per spool, or 0 for no limit")
+	flag.IntVar(&spoolCfg.MaxBytes, "max_bytes", 0, "maximum total message bytes per spool, or 0 for no limit")
 	flag.StringVar(&logDir, "log_dir", "", "logging directory")
 	flag.StringVar(&logLevel, "log_level", "DEBUG", "logging level could be set to: DEBUG, INFO, NOTICE, WARNING, ERROR, CRITICAL")
 	flag.Parse()
 
-	if dataStore == "" {
+	if storageCfg.Backend == storage.BackendBolt && storageCfg.Path == "" {
 		fmt.Println("Must specify a data storage file path.")
 		os.Exit(1)
 	}
@@ -73,7 +80,7 @@ func main() {
 	}
 	socketFile := filepath.Join(tmpDir, fmt.Sprintf("%d.memspool.socket", os.Getpid()))
 
-	spoolMap, err := server.NewMemSpoolMap(dataStore, serverLog)
+	spoolMap, err := server.NewMemSpoolMapWithStorage(storageCfg, spoolCfg, serverLog)
 	if err != nil {
 		panic(err)
 	}
@@ -0,0 +1,124 @@
+// migrate.go - memspool bolt storage migration.
+// Copyright (C) 2022  David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"encoding/binary"
+	"errors"
+	"os"
+	"time"
+
+	"github.com/katzenpost/katzenpost/memspool/common"
+	bolt "go.etcd.io/bbolt"
+	"gopkg.in/op/go-logging.v1"
+)
+
+// The layout of the version 0 and 1 bolt databases, which kept a bucket
+// per spool in the legacy spools bucket.
+const (
+	legacySpoolsBucket   = "spools"
+	legacyMessagesKey    = "message"
+	legacySpoolMetadata  = "spoolMetadata"
+	legacySpoolPublicKey = "spoolPublicKey"
+)
+
+// migrateBolt converts a version 0 or 1 bolt database to the layout of
+// the bolt storage backend. Version 0 messages are prefixed with their
+// creation time, which is taken to be the time of the migration.
+func migrateBolt(fileStore string, log *logging.Logger) error {
+	if fi, err := os.Stat(fileStore); err != nil || fi.Size() == 0 {
+		// nothing to migrate
+		return nil
+	}
+	db, err := bolt.Open(fileStore, 0600, nil)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return db.Update(func(tx *bolt.Tx) error {
+		metaBucket := tx.Bucket([]byte(metadataBucket))
+		if metaBucket == nil {
+			return nil
+		}
+		version := metaBucket.Get([]byte(versionKey))
+		if len(version) != 1 || version[0] > 1 {
+			return nil
+		}
+		log.Noticef("migrating spool storage from version %d", version[0])
+		spoolsBucket := tx.Bucket([]byte(legacySpoolsBucket))
+		if spoolsBucket == nil {
+			return errors.New("spools bucket not found")
+		}
+		keysBucket, err := tx.CreateBucketIfNotExists([]byte(spoolKeysBucket))
+		if err != nil {
+			return err
+		}
+		sequencesBucket, err := tx.CreateBucketIfNotExists([]byte(spoolSequencesBucket))
+		if err != nil {
+			return err
+		}
+		messagesBucket, err := tx.CreateBucketIfNotExists([]byte(spoolMessagesBucket))
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+		c := spoolsBucket.Cursor()
+		for spoolID, value := c.First(); spoolID != nil; spoolID, value = c.Next() {
+			if value != nil {
+				return errors.New("spoolsBucket entry value should be nil")
+			}
+			spoolBucket := spoolsBucket.Bucket(spoolID)
+			spoolMetadata := spoolBucket.Bucket([]byte(legacySpoolMetadata))
+			if spoolMetadata == nil {
+				return errors.New("spool metadata bucket not found")
+			}
+			publicKey := spoolMetadata.Get([]byte(legacySpoolPublicKey))
+			if publicKey == nil {
+				return errors.New("spool key not found")
+			}
+			if err := keysBucket.Put(spoolID, publicKey); err != nil {
+				return err
+			}
+			spoolMessages := spoolBucket.Bucket([]byte(legacyMessagesKey))
+			if spoolMessages == nil {
+				return errors.New("spool messages bucket not found")
+			}
+			seq := uint32(spoolMessages.Sequence())
+			cur := spoolMessages.Cursor()
+			for k, v := cur.First(); k != nil; k, v = cur.Next() {
+				if version[0] == 0 {
+					v = encodeMessage(now, v)
+				}
+				if err := messagesBucket.Put(append(append([]byte{}, spoolID...), k...), v); err != nil {
+					return err
+				}
+				if id := binary.BigEndian.Uint32(k); id > seq {
+					seq = id
+				}
+			}
+			rawSeq := make([]byte, common.MessageIDSize)
+			binary.BigEndian.PutUint32(rawSeq, seq)
+			if err := sequencesBucket.Put(spoolID, rawSeq); err != nil {
+				return err
+			}
+		}
+		if err := tx.DeleteBucket([]byte(legacySpoolsBucket)); err != nil {
+			return err
+		}
+		return metaBucket.Put([]byte(versionKey), []byte{SpoolStorageVersion})
+	})
+}
@@ -21,14 +21,13 @@ import (
 	"errors"
 	"fmt"
 	"sync"
-	"sync/atomic"
 	"time"
 
 	sha512 "crypto/sha512"
 	"github.com/katzenpost/katzenpost/core/crypto/eddsa"
 	"github.com/katzenpost/katzenpost/core/worker"
 	"github.com/katzenpost/katzenpost/memspool/common"
-	bolt "go.etcd.io/bbolt"
+	"github.com/katzenpost/katzenpost/server/storage"
 	"gopkg.in/op/go-logging.v1"
 )
 
@@ -36,20 +35,57 @@ const (
 	metadataBucket = "metadata"
 	versionKey     = "version"
 
-	spoolsBucketName = "spools"
-	messagesKey      = "message"
-	spoolMetadataKey = "spoolMetadata"
-	spoolPublicKey   = "spoolPublicKey"
+	// spoolKeysBucket maps spool IDs to the public keys of the spools.
+	spoolKeysBucket = "spool_keys"
+
+	// spoolSequencesBucket maps spool IDs to the last message IDs of
+	// the spools.
+	spoolSequencesBucket = "spool_sequences"
+
+	// spoolMessagesBucket maps spool IDs followed by message IDs to
+	// the messages of the spools.
+	spoolMessagesBucket = "spool_messages"
+
+	// storageNamespace is the namespace of the spools in a shared SQL
+	// database.
+	storageNamespace = "memspool"
 
 	writeBackInterval = 30 * time.Second
 
-	SpoolStorageVersion = 0
+	// expiryInterval is the interval between removals of expired messages.
+	expiryInterval = 5 * time.Minute
+
+	// spoolIdleTimeout is the duration after which a spool that has not
+	// been accessed is evicted from memory.
+	spoolIdleTimeout = 2 * writeBackInterval
+
+	// messageHeaderSize is the size of the creation timestamp prefixing
+	// each stored message.
+	messageHeaderSize = 8
+
+	SpoolStorageVersion = 2
 )
 
 var (
-	errSpoolAlreadyExists = errors.New("Spool Already Exists")
+	errSpoolNotFound      = errors.New("spool not found")
+	errSpoolQuotaExceeded = errors.New("spool quota exceeded")
+	errInvalidSignature   = errors.New("invalid signature")
+	errStopIteration      = errors.New("stop iteration")
+	errMessageNotFound    = errors.New("message not found")
 )
 
+// messageGoneError is the error returned when reading a message which
+// expired or was deleted.
+type messageGoneError struct {
+	// next is the ID of the next message of the spool, or of the next
+	// message to be appended if there is none.
+	next uint32
+}
+
+func (e *messageGoneError) Error() string {
+	return common.StatusMessageGone
+}
+
 func HandleSpoolRequest(spoolMap *MemSpoolMap, request *common.SpoolRequest, log *logging.Logger) *common.SpoolResponse {
 	log.Debug("start of handle spool request")
 	spoolResponse := common.SpoolResponse{}
@@ -101,6 +137,12 @@ func HandleSpoolRequest(spoolMap *MemSpoolMap, request *common.SpoolRequest, log
 		log.Debug("after ReadFromSpool")
 		spoolResponse.SpoolID = spoolID
 		spoolResponse.MessageID = request.MessageID
+		if gone, ok := err.(*messageGoneError); ok {
+			spoolResponse.Status = common.StatusMessageGone
+			spoolResponse.NextMessageID = gone.next
+			log.Debugf("message %d gone, next message is %d", request.MessageID, gone.next)
+			return &spoolResponse
+		}
 		if err != nil {
 			spoolResponse.Status = err.Error()
 			log.Error(spoolResponse.Status)
@@ -108,51 +150,101 @@ func HandleSpoolRequest(spoolMap *MemSpoolMap, request *common.SpoolRequest, log
 		}
 		spoolResponse.Status = common.StatusOK
 		spoolResponse.Message = message
+	case common.DeleteMessageCommand:
+		log.Debugf("delete message %d from spool", request.MessageID)
+		err := spoolMap.DeleteFromSpool(spoolID, request.Signature, request.MessageID)
+		spoolResponse.SpoolID = spoolID
+		spoolResponse.MessageID = request.MessageID
+		if err != nil {
+			spoolResponse.Status = err.Error()
+			log.Error(spoolResponse.Status)
+			return &spoolResponse
+		}
+		spoolResponse.Status = common.StatusOK
 	}
 	log.Debug("end of handle spool request")
 	return &spoolResponse
 }
 
+// SpoolConfig is the configuration of the limits applied to each spool.
+// Zero values disable the respective limit.
+type SpoolConfig struct {
+	// MessageTTL is the duration after which messages are removed.
+	MessageTTL time.Duration
+
+	// MaxMessages is the maximum number of messages in a spool.
+	MaxMessages int
+
+	// MaxBytes is the maximum total size of the messages in a spool.
+	MaxBytes int
+}
+
+// MemSpoolMap is a map of spools persisted in a storage.Storage. Spools are
+// loaded from storage on demand and evicted from memory when idle, and only
+// the messages which have not yet been written to storage are held in memory.
 type MemSpoolMap struct {
 	worker.Worker
 
 	spools *sync.Map
-	db     *bolt.DB
+	db     storage.Storage
 	log    *logging.Logger
+	cfg    SpoolConfig
+
+	lastExpiry time.Time
 }
 
+// NewMemSpoolMap returns a MemSpoolMap without spool limits.
 func NewMemSpoolMap(fileStore string, log *logging.Logger) (*MemSpoolMap, error) {
+	return NewMemSpoolMapWithConfig(fileStore, &SpoolConfig{}, log)
+}
+
+// NewMemSpoolMapWithConfig returns a MemSpoolMap persisted in the bolt
+// database file, which applies the limits of the given SpoolConfig.
+func NewMemSpoolMapWithConfig(fileStore string, cfg *SpoolConfig, log *logging.Logger) (*MemSpoolMap, error) {
+	storageCfg := &storage.Config{
+		Backend: storage.BackendBolt,
+		Path:    fileStore,
+	}
+	return NewMemSpoolMapWithStorage(storageCfg, cfg, log)
+}
+
+// NewMemSpoolMapWithStorage returns a MemSpoolMap persisted in the storage
+// of the given storage.Config, which applies the limits of the given
+// SpoolConfig.
+func NewMemSpoolMapWithStorage(storageCfg *storage.Config, cfg *SpoolConfig, log *logging.Logger) (*MemSpoolMap, error) {
 	m := &MemSpoolMap{
-		spools: new(sync.Map),
-		log:    log,
+		spools:     new(sync.Map),
+		log:        log,
+		cfg:        *cfg,
+		lastExpiry: time.Now(),
+	}
+	if storageCfg.Backend == storage.BackendBolt {
+		if err := migrateBolt(storageCfg.Path, log); err != nil {
+			return nil, err
+		}
 	}
+	sCfg := *storageCfg
+	sCfg.Namespace = storageNamespace
 	var err error
-	m.db, err = bolt.Open(fileStore, 0600, nil)
+	m.db, err = storage.New(&sCfg, log)
 	if err != nil {
 		return nil, err
 	}
-	if err = m.db.Update(func(tx *bolt.Tx) error {
-		var metaBucket *bolt.Bucket
-		var spoolsBucket *bolt.Bucket
-		metaBucket, err = tx.CreateBucketIfNotExists([]byte(metadataBucket))
-		if err != nil {
-			return err
-		}
-		if spoolsBucket, err = tx.CreateBucketIfNotExists([]byte(spoolsBucketName)); err != nil {
-			return err
-		}
-		if b := metaBucket.Get([]byte(versionKey)); b != nil {
-			// database loaded
-			if len(b) != 1 || b[0] != SpoolStorageVersion {
-				return fmt.Errorf("spool storage: incompatible version: %d", uint(b[0]))
-			}
-			err = m.load(tx, spoolsBucket)
-			return err
+	version, err := m.db.Get(metadataBucket, []byte(versionKey))
+	switch err {
+	case nil:
+		// database loaded
+		if len(version) != 1 || version[0] != SpoolStorageVersion {
+			m.db.Close()
+			return nil, fmt.Errorf("spool storage: incompatible version: %v", version)
 		}
+	case storage.ErrNotFound:
 		// database created
-		metaBucket.Put([]byte(versionKey), []byte{SpoolStorageVersion})
-		return nil
-	}); err != nil {
+		if err = m.db.Put(metadataBucket, []byte(versionKey), []byte{SpoolStorageVersion}); err != nil {
+			m.db.Close()
+			return nil, err
+		}
+	default:
 		m.db.Close()
 		return nil, err
 	}
@@ -160,249 +252,396 @@ func NewMemSpoolMap(fileStore string, log *logging.Logger) (*MemSpoolMap, error)
 	return m, nil
 }
 
-// load iterates over each spool in spoolsBucket
-// and populates m.spools.
-func (m *MemSpoolMap) load(tx *bolt.Tx, spoolsBucket *bolt.Bucket) error {
-	m.log.Debug("loading existing db from disk")
-	c := spoolsBucket.Cursor()
-	for key, value := c.First(); key != nil; key, value = c.Next() {
-		if value != nil {
-			return errors.New("spoolsBucket entry value should be nil")
-		}
-		spoolBucket := spoolsBucket.Bucket(key)
-		if spoolBucket == nil {
-			return errors.New("spool bucket does not exist")
-		}
-		spoolMetadataBucket := spoolBucket.Bucket([]byte(spoolMetadataKey))
-		if spoolMetadataBucket == nil {
-			return errors.New("spool metadata bucket not found")
-		}
-		rawSpoolPubKey := spoolMetadataBucket.Get([]byte(spoolPublicKey))
-		if rawSpoolPubKey == nil {
-			return errors.New("spool key not found")
-		}
-		spoolID := [common.SpoolIDSize]byte{}
-		copy(spoolID[:], key)
-		spoolPubKey := new(eddsa.PublicKey)
-		err := spoolPubKey.FromBytes(rawSpoolPubKey)
-		if err != nil {
-			return err
-		}
-		err = m.addSpoolToMap(spoolPubKey, &spoolID)
-		if err != nil {
-			return err
+func messageKey(spoolID [common.SpoolIDSize]byte, messageID uint32) []byte {
+	key := make([]byte, common.SpoolIDSize+common.MessageIDSize)
+	copy(key, spoolID[:])
+	binary.BigEndian.PutUint32(key[common.SpoolIDSize:], messageID)
+	return key
+}
+
+func encodeMessage(created time.Time, message []byte) []byte {
+	value := make([]byte, messageHeaderSize+len(message))
+	binary.BigEndian.PutUint64(value, uint64(created.Unix()))
+	copy(value[messageHeaderSize:], message)
+	return value
+}
+
+func decodeMessage(value []byte) (time.Time, []byte, error) {
+	if len(value) < messageHeaderSize {
+		return time.Time{}, nil, errors.New("invalid message encountered")
+	}
+	created := time.Unix(int64(binary.BigEndian.Uint64(value)), 0)
+	return created, value[messageHeaderSize:], nil
+}
+
+// loadSpool loads the spool metadata from storage.
+func (m *MemSpoolMap) loadSpool(spoolID [common.SpoolIDSize]byte) (*MemSpool, error) {
+	rawSpoolPubKey, err := m.db.Get(spoolKeysBucket, spoolID[:])
+	if err == storage.ErrNotFound {
+		return nil, errSpoolNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	spoolPubKey := new(eddsa.PublicKey)
+	if err := spoolPubKey.FromBytes(rawSpoolPubKey); err != nil {
+		return nil, err
+	}
+	spool := NewMemSpool(spoolPubKey)
+	rawSeq, err := m.db.Get(spoolSequencesBucket, spoolID[:])
+	switch err {
+	case nil:
+		if len(rawSeq) != common.MessageIDSize {
+			return nil, errors.New("invalid spool sequence encountered")
 		}
-		messagesBucket := spoolBucket.Bucket([]byte(messagesKey))
-		if messagesBucket == nil {
-			return errors.New("spool messages bucket not found")
+		spool.current = binary.BigEndian.Uint32(rawSeq)
+		spool.persisted = spool.current
+	case storage.ErrNotFound:
+	default:
+		return nil, err
+	}
+	err = m.db.ForEach(spoolMessagesBucket, spoolID[:], func(k, v []byte) error {
+		if len(k) != common.SpoolIDSize+common.MessageIDSize || len(v) < messageHeaderSize {
+			return errors.New("invalid message encountered")
 		}
-		cur := messagesBucket.Cursor()
-		for k, v := cur.First(); k != nil; k, v = cur.Next() {
-			if len(k) != common.MessageIDSize {
-				return errors.New("invalid message ID encountered")
-			}
-			messageID := [common.MessageIDSize]byte{}
-			copy(messageID[:], k)
-			err := m.appendToSpoolWithMessageID(spoolID, messageID, v)
+		spool.count++
+		spool.bytes += len(v) - messageHeaderSize
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return spool, nil
+}
+
+// withSpool calls f with the locked spool, loading the spool from disk
+// if it is not in memory.
+func (m *MemSpoolMap) withSpool(spoolID [common.SpoolIDSize]byte, f func(*MemSpool) error) error {
+	for {
+		raw_spool, ok := m.spools.Load(spoolID)
+		if !ok {
+			spool, err := m.loadSpool(spoolID)
 			if err != nil {
 				return err
 			}
+			raw_spool, _ = m.spools.LoadOrStore(spoolID, spool)
 		}
-		raw_spool, ok := m.spools.Load(spoolID)
+		spool, ok := raw_spool.(*MemSpool)
 		if !ok {
-			panic("wtf")
+			return errors.New("invalid spool found")
 		}
-		k, _ := cur.Last() // obtain the latest MessageID
-		if k != nil {
-			raw_spool.(*MemSpool).current = binary.BigEndian.Uint32(k[:])
-		} // empty spool...
+		spool.Lock()
+		if spool.evicted {
+			// raced with the eviction or purge of the spool
+			spool.Unlock()
+			continue
+		}
+		spool.lastAccess = time.Now()
+		err := f(spool)
+		spool.Unlock()
+		return err
 	}
-	return nil
 }
 
-func (m *MemSpoolMap) addSpoolToMap(publicKey *eddsa.PublicKey, spoolID *[common.SpoolIDSize]byte) error {
-	spool := NewMemSpool(publicKey)
-	_, loaded := m.spools.LoadOrStore(*spoolID, spool)
-	if loaded {
-		return errSpoolAlreadyExists
+// CreateSpool creates a new spool and returns a spool ID or an error.
+func (m *MemSpoolMap) CreateSpool(publicKey *eddsa.PublicKey, signature []byte) (*[common.SpoolIDSize]byte, error) {
+	if !publicKey.Verify(signature, publicKey.Bytes()) {
+		return nil, errors.New("Spool creation failed, invalid signature")
 	}
-	return nil
+	spoolID := [common.SpoolIDSize]byte{}
+	spoolhash := sha512.Sum512_256(publicKey.Bytes())
+	copy(spoolID[:], spoolhash[:common.SpoolIDSize])
+	_, err := m.db.Get(spoolKeysBucket, spoolID[:])
+	switch err {
+	case nil:
+		// the spool already exists
+	case storage.ErrNotFound:
+		if err = m.db.Put(spoolKeysBucket, spoolID[:], publicKey.Bytes()); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, err
+	}
+	return &spoolID, nil
 }
 
-func (m *MemSpoolMap) createSpoolBucket(publicKey *eddsa.PublicKey, spoolID *[common.SpoolIDSize]byte) error {
-	err := m.db.Update(func(tx *bolt.Tx) error {
-		spoolsBucket := tx.Bucket([]byte(spoolsBucketName))
-		spoolBucket, err := spoolsBucket.CreateBucket(spoolID[:])
+// PurgeSpool delete the spool associated with the given spool ID.
+// Returns nil on success or an error.
+func (m *MemSpoolMap) PurgeSpool(spoolID [common.SpoolIDSize]byte, signature []byte) error {
+	return m.withSpool(spoolID, func(spool *MemSpool) error {
+		if !spool.PublicKey().Verify(signature, spool.PublicKey().Bytes()) {
+			return errInvalidSignature
+		}
+		b := new(storage.Batch)
+		err := m.db.ForEach(spoolMessagesBucket, spoolID[:], func(k, v []byte) error {
+			b.Delete(spoolMessagesBucket, append([]byte{}, k...))
+			return nil
+		})
 		if err != nil {
 			return err
 		}
-		spoolMetadata, err := spoolBucket.CreateBucket([]byte(spoolMetadataKey))
-		if err != nil {
+		b.Delete(spoolSequencesBucket, spoolID[:])
+		b.Delete(spoolKeysBucket, spoolID[:])
+		if err = m.db.Write(b); err != nil {
 			return err
 		}
-		err = spoolMetadata.Put([]byte(spoolPublicKey), publicKey.Bytes())
-		if err != nil {
+		spool.evicted = true
+		m.spools.Delete(spoolID)
+		return nil
+	})
+}
+
+// AppendToSpool appends the message to the spool, unless that would
+// exceed the spool quota.
+func (m *MemSpoolMap) AppendToSpool(spoolID [common.SpoolIDSize]byte, message []byte) error {
+	err := m.withSpool(spoolID, func(spool *MemSpool) error {
+		if m.cfg.MaxMessages > 0 && spool.count+1 > m.cfg.MaxMessages {
+			return errSpoolQuotaExceeded
+		}
+		if m.cfg.MaxBytes > 0 && spool.bytes+len(message) > m.cfg.MaxBytes {
+			return errSpoolQuotaExceeded
+		}
+		spool.Append(message)
+		return nil
+	})
+	if err == errSpoolNotFound {
+		m.log.Debugf("AppendToSpool: spool not found: %x", spoolID[:])
+		return errors.New("AppendToSpool: spool not found")
+	}
+	return err
+}
+
+// ReadFromSpool returns the message with the given ID from the spool. A
+// message which expired or was deleted is reported by a *messageGoneError,
+// so that the reader skips to the next message, while a message which was
+// not appended yet is not found.
+func (m *MemSpoolMap) ReadFromSpool(spoolID [common.SpoolIDSize]byte, signature []byte, messageID uint32) ([]byte, error) {
+	var payload []byte
+	err := m.withSpool(spoolID, func(spool *MemSpool) error {
+		if !spool.PublicKey().Verify(signature, spool.PublicKey().Bytes()) {
+			return errInvalidSignature
+		}
+		if messageID > spool.current {
+			return fmt.Errorf("message ID %d not found", messageID)
+		}
+		created, message, err := m.getMessage(spoolID, spool, messageID)
+		switch {
+		case err == errMessageNotFound || err == nil && m.isExpired(created):
+			next, err := m.nextMessageID(spoolID, spool, messageID)
+			if err != nil {
+				return err
+			}
+			return &messageGoneError{next: next}
+		case err != nil:
 			return err
 		}
-		_, err = spoolBucket.CreateBucket([]byte(messagesKey))
+		payload = message
+		return nil
+	})
+	if err == errSpoolNotFound {
+		return nil, errors.New("ReadFromSpool: spool not found")
+	}
+	return payload, err
+}
+
+// DeleteFromSpool removes the message with the given ID from the spool.
+// The signature must cover the data returned by common.DeleteSignedData.
+func (m *MemSpoolMap) DeleteFromSpool(spoolID [common.SpoolIDSize]byte, signature []byte, messageID uint32) error {
+	err := m.withSpool(spoolID, func(spool *MemSpool) error {
+		if !spool.PublicKey().Verify(signature, common.DeleteSignedData(spoolID, messageID)) {
+			return errInvalidSignature
+		}
+		if payload, ok := spool.delete(messageID); ok {
+			spool.count--
+			spool.bytes -= len(payload)
+			return nil
+		}
+		deleted, err := m.deleteMessages(spoolID, spool, []uint32{messageID})
 		if err != nil {
 			return err
 		}
-		return err
+		if deleted == 0 {
+			return fmt.Errorf("message ID %d not found", messageID)
+		}
+		return nil
 	})
+	if err == errSpoolNotFound {
+		return errors.New("DeleteFromSpool: spool not found")
+	}
 	return err
 }
 
-// CreateSpool creates a new spool and returns a spool ID or an error.
-func (m *MemSpoolMap) CreateSpool(publicKey *eddsa.PublicKey, signature []byte) (*[common.SpoolIDSize]byte, error) {
-	if !publicKey.Verify(signature, publicKey.Bytes()) {
-		return nil, errors.New("Spool creation failed, invalid signature")
-	}
-	spoolID := [common.SpoolIDSize]byte{}
-	spoolhash := sha512.Sum512_256(publicKey.Bytes())
-	copy(spoolID[:], spoolhash[:common.SpoolIDSize])
-	err := m.addSpoolToMap(publicKey, &spoolID)
-	if err == errSpoolAlreadyExists {
-		return &spoolID, nil
-	} else if err != nil {
-		return nil, err
-	}
-	err = m.createSpoolBucket(publicKey, &spoolID)
-	if err != nil {
-		return nil, err
-	}
-	return &spoolID, nil
+func (m *MemSpoolMap) isExpired(created time.Time) bool {
+	return m.cfg.MessageTTL > 0 && time.Since(created) > m.cfg.MessageTTL
 }
 
-// PurgeSpool delete the spool associated with the given spool ID.
-// Returns nil on success or an error.
-func (m *MemSpoolMap) PurgeSpool(spoolID [common.SpoolIDSize]byte, signature []byte) error {
-	raw_spool, ok := m.spools.Load(spoolID)
-	if !ok {
-		return errors.New("spool ID not found in spools map")
+// getMessage returns the message from memory if it has not been written
+// to storage, or from storage otherwise. The spool must be locked.
+func (m *MemSpoolMap) getMessage(spoolID [common.SpoolIDSize]byte, spool *MemSpool, messageID uint32) (time.Time, []byte, error) {
+	if entry, ok := spool.entry(messageID); ok {
+		return entry.Created, entry.Payload, nil
 	}
-	spool, ok := raw_spool.(*MemSpool)
-	if !ok {
-		return errors.New("invalid spool found")
+	value, err := m.db.Get(spoolMessagesBucket, messageKey(spoolID, messageID))
+	if err == storage.ErrNotFound {
+		return time.Time{}, nil, errMessageNotFound
 	}
-	if !spool.PublicKey().Verify(signature, spool.PublicKey().Bytes()) {
-		return errors.New("invalid signature")
+	if err != nil {
+		return time.Time{}, nil, err
 	}
-	m.spools.Delete(spoolID)
-	return nil
+	return decodeMessage(value)
 }
 
-func (m *MemSpoolMap) appendToSpoolWithMessageID(spoolID [common.SpoolIDSize]byte, messageID [common.MessageIDSize]byte, message []byte) error {
-	raw_spool, ok := m.spools.Load(spoolID)
-	if !ok {
-		m.log.Debugf("AppendToSpool: spool not found: %x", spoolID[:])
-		return errors.New("AppendToSpool: spool not found")
+// nextMessageID returns the ID of the first message of the spool after the
+// given one which has not expired, or the ID of the next message to be
+// appended if there is none. The spool must be locked.
+func (m *MemSpoolMap) nextMessageID(spoolID [common.SpoolIDSize]byte, spool *MemSpool, messageID uint32) (uint32, error) {
+	next := spool.current + 1
+	err := m.db.ForEachFrom(spoolMessagesBucket, spoolID[:], messageKey(spoolID, messageID+1), func(k, v []byte) error {
+		created, _, err := decodeMessage(v)
+		if err != nil {
+			return err
+		}
+		if m.isExpired(created) {
+			return nil
+		}
+		next = binary.BigEndian.Uint32(k[common.SpoolIDSize:])
+		return errStopIteration
+	})
+	if err != nil && err != errStopIteration {
+		return 0, err
 	}
-	spool, ok := raw_spool.(*MemSpool)
-	if !ok {
-		m.log.Debug("invalid spool found")
-		return errors.New("invalid spool found")
+	// the messages in memory are the latest ones
+	for id, entry := range spool.items {
+		if id > messageID && id < next && !m.isExpired(entry.Created) {
+			next = id
+		}
 	}
-	id := binary.BigEndian.Uint32(messageID[:])
-	spool.Put(id, message, false)
-	return nil
+	return next, nil
 }
 
-func (m *MemSpoolMap) AppendToSpool(spoolID [common.SpoolIDSize]byte, message []byte) error {
-	raw_spool, ok := m.spools.Load(spoolID)
-	if !ok {
-		m.log.Debugf("AppendToSpool: spool not found: %x", spoolID[:])
-		return errors.New("AppendToSpool: spool not found")
+// deleteMessages deletes the messages from storage, updates the spool
+// counters and returns the number of messages deleted. The spool must be
+// locked.
+func (m *MemSpoolMap) deleteMessages(spoolID [common.SpoolIDSize]byte, spool *MemSpool, messageIDs []uint32) (int, error) {
+	b := new(storage.Batch)
+	size := 0
+	for _, messageID := range messageIDs {
+		key := messageKey(spoolID, messageID)
+		value, err := m.db.Get(spoolMessagesBucket, key)
+		if err == storage.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		b.Delete(spoolMessagesBucket, key)
+		size += len(value) - messageHeaderSize
 	}
-	spool, ok := raw_spool.(*MemSpool)
-	if !ok {
-		m.log.Debug("invalid spool found")
-		return errors.New("invalid spool found")
+	if b.Len() == 0 {
+		return 0, nil
 	}
-	spool.Append(message)
-	return nil
+	if err := m.db.Write(b); err != nil {
+		return 0, err
+	}
+	spool.count -= b.Len()
+	spool.bytes -= size
+	return b.Len(), nil
 }
 
-func (m *MemSpoolMap) ReadFromSpool(spoolID [common.SpoolIDSize]byte, signature []byte, messageID uint32) ([]byte, error) {
-	raw_spool, ok := m.spools.Load(spoolID)
-	if !ok {
-		return nil, errors.New("ReadFromSpool: spool not found")
-	}
-	spool, ok := raw_spool.(*MemSpool)
-	if !ok {
-		return nil, errors.New("invalid spool found")
+// flushSpool writes the messages of the spool which are not in storage,
+// along with its last message ID, and removes them from memory. The spool
+// must be locked.
+func (m *MemSpoolMap) flushSpool(spoolID [common.SpoolIDSize]byte, spool *MemSpool) error {
+	if len(spool.items) == 0 && spool.current == spool.persisted {
+		return nil
 	}
-	if !spool.PublicKey().Verify(signature, spool.PublicKey().Bytes()) {
-		return nil, errors.New("invalid signature")
+	b := new(storage.Batch)
+	for messageID, entry := range spool.items {
+		b.Put(spoolMessagesBucket, messageKey(spoolID, messageID), encodeMessage(entry.Created, entry.Payload))
 	}
-	payload, _, err := spool.Get(messageID)
-	if err != nil {
-		return nil, err
+	rawSeq := make([]byte, common.MessageIDSize)
+	binary.BigEndian.PutUint32(rawSeq, spool.current)
+	b.Put(spoolSequencesBucket, spoolID[:], rawSeq)
+	if err := m.db.Write(b); err != nil {
+		return err
 	}
-	return payload, nil
+	spool.items = make(map[uint32]*SpoolEntry)
+	spool.persisted = spool.current
+	return nil
 }
 
 func (m *MemSpoolMap) doFlush() {
-	spoolsRange := func(rawSpoolID, rawSpool interface{}) bool {
-		spool, ok := rawSpool.(*MemSpool)
-		if !ok {
-			m.log.Error("Fatal error, doFlush encountered invalid MemSpool, wtf")
-			return false
+	now := time.Now()
+	m.spools.Range(func(rawSpoolID, rawSpool interface{}) bool {
+		spoolID := rawSpoolID.([common.SpoolIDSize]byte)
+		spool := rawSpool.(*MemSpool)
+		spool.Lock()
+		defer spool.Unlock()
+		if spool.evicted {
+			return true
 		}
+		if err := m.flushSpool(spoolID, spool); err != nil {
+			m.log.Errorf("Failed to write spool %x to disk: %s", spoolID[:], err)
+			panic(err)
+		}
+		if now.Sub(spool.lastAccess) > spoolIdleTimeout {
+			spool.evicted = true
+			m.spools.Delete(spoolID)
+		}
+		return true
+	})
+}
 
-		spoolRange := func(rawMessageID, rawEntry interface{}) bool {
-			entry, ok := rawEntry.(*SpoolEntry)
-			if !ok {
-				m.log.Error("invalid SpoolEntry, wtf")
-				panic("invalid SpoolEntry, wtf")
+// doExpire removes the expired messages of all spools from storage.
+func (m *MemSpoolMap) doExpire() {
+	if m.cfg.MessageTTL == 0 {
+		return
+	}
+	// find the spools whose oldest message has expired, without
+	// loading the other spools
+	spoolIDs := [][common.SpoolIDSize]byte{}
+	err := m.db.ForEach(spoolKeysBucket, nil, func(k, v []byte) error {
+		spoolID := [common.SpoolIDSize]byte{}
+		copy(spoolID[:], k)
+		spoolIDs = append(spoolIDs, spoolID)
+		return nil
+	})
+	if err != nil {
+		m.log.Errorf("Failed to list spools: %s", err)
+		return
+	}
+	expired := 0
+	for _, spoolID := range spoolIDs {
+		// message IDs are in order of creation
+		messageIDs := []uint32{}
+		err := m.db.ForEach(spoolMessagesBucket, spoolID[:], func(k, v []byte) error {
+			created, _, err := decodeMessage(v)
+			if err != nil {
+				return err
 			}
-			if entry.Dirty {
-				var err error
-				err = m.db.Update(func(tx *bolt.Tx) error {
-					var err error
-					spools := tx.Bucket([]byte(spoolsBucketName))
-					if spools == nil {
-						return errors.New("spoolsBucket does not exist, wtf")
-					}
-					spoolID, ok := rawSpoolID.([common.SpoolIDSize]byte)
-					if !ok {
-						return errors.New("encountered invalid spool ID, wtf")
-					}
-					spoolBucket := spools.Bucket(spoolID[:])
-					if spool == nil {
-						err = m.createSpoolBucket(spool.publicKey, &spoolID)
-						if err != nil {
-							return err
-						}
-					}
-					messageID, ok := rawMessageID.(uint32)
-					if !ok {
-						return errors.New("invalid message ID, wtf")
-					}
-					var msgID [4]byte
-					binary.BigEndian.PutUint32(msgID[:], messageID)
-					messagesBucket := spoolBucket.Bucket([]byte(messagesKey))
-					if messagesBucket == nil {
-						return errors.New("impossible error, messagesBucket is nil")
-					}
-					err = messagesBucket.Put(msgID[:], entry.Payload)
-					if err != nil {
-						return err
-					}
-					spool.Put(messageID, entry.Payload, false)
-					return nil
-				})
-				if err != nil {
-					panic(err)
-				}
+			if !m.isExpired(created) {
+				return errStopIteration
 			}
-			return true
+			messageIDs = append(messageIDs, binary.BigEndian.Uint32(k[common.SpoolIDSize:]))
+			return nil
+		})
+		if err != nil && err != errStopIteration {
+			m.log.Errorf("Failed to list messages of spool %x: %s", spoolID[:], err)
+			continue
+		}
+		if len(messageIDs) == 0 {
+			continue
+		}
+		err = m.withSpool(spoolID, func(spool *MemSpool) error {
+			n, err := m.deleteMessages(spoolID, spool, messageIDs)
+			expired += n
+			return err
+		})
+		if err != nil && err != errSpoolNotFound {
+			m.log.Errorf("Failed to expire messages of spool %x: %s", spoolID[:], err)
 		}
-
-		spool.items.Range(spoolRange)
-		return true
 	}
-	m.spools.Range(spoolsRange)
+	m.log.Debugf("Removed %d expired messages", expired)
 }
 
 func (m *MemSpoolMap) worker() {
@@ -418,32 +657,56 @@ func (m *MemSpoolMap) worker() {
 		case <-ticker.C:
 		}
 		m.doFlush()
+		if time.Since(m.lastExpiry) > expiryInterval {
+			m.doExpire()
+			m.lastExpiry = time.Now()
+		}
 	}
 }
 
 func (m *MemSpoolMap) Shutdown() {
-	m.log.Debug("halting spool worker and persisting db to disk")
+	m.log.Debug("halting spool worker and persisting spools to storage")
 	m.Halt()
-	m.db.Sync()
 	m.db.Close()
 }
 
+// SpoolEntry is a message which has not yet been written to disk.
 type SpoolEntry struct {
 	Payload []byte
-	Dirty   bool
+	Created time.Time
 }
 
+// MemSpool is the in-memory state of a spool. Its lock must be held
+// while it is accessed.
 type MemSpool struct {
+	sync.Mutex
+
 	publicKey *eddsa.PublicKey
-	items     *sync.Map
+	items     map[uint32]*SpoolEntry
 	current   uint32
+
+	// persisted is the last message ID written to storage, which falls
+	// behind current when the messages appended since are deleted from
+	// memory before being written.
+	persisted uint32
+
+	// count and bytes are the number and total size of the messages
+	// in the spool, both on disk and in memory.
+	count int
+	bytes int
+
+	lastAccess time.Time
+
+	// evicted is set when the spool is removed from the MemSpoolMap.
+	evicted bool
 }
 
 func NewMemSpool(publicKey *eddsa.PublicKey) *MemSpool {
 	return &MemSpool{
-		publicKey: publicKey,
-		items:     new(sync.Map),
-		current:   0,
+		publicKey:  publicKey,
+		items:      make(map[uint32]*SpoolEntry),
+		current:    0,
+		lastAccess: time.Now(),
 	}
 }
 
@@ -451,31 +714,39 @@ func (s *MemSpool) PublicKey() *eddsa.PublicKey {
 	return s.publicKey
 }
 
+// Append adds the message to the spool with the next message ID.
 func (s *MemSpool) Append(message []byte) {
-	current := atomic.AddUint32(&s.current, 1)
-	s.Put(current, message, true)
+	s.current++
+	s.items[s.current] = &SpoolEntry{
+		Payload: message,
+		Created: time.Now(),
+	}
+	s.count++
+	s.bytes += len(message)
 }
 
-func (s *MemSpool) Put(messageID uint32, message []byte, dirty bool) {
-	entry := SpoolEntry{
-		Payload: message,
-		Dirty:   dirty,
+func (s *MemSpool) entry(messageID uint32) (*SpoolEntry, bool) {
+	entry, ok := s.items[messageID]
+	return entry, ok
+}
+
+func (s *MemSpool) delete(messageID uint32) ([]byte, bool) {
+	entry, ok := s.items[messageID]
+	if !ok {
+		return nil, false
 	}
-	s.items.Store(messageID, &entry)
+	delete(s.items, messageID)
+	return entry.Payload, true
 }
 
-// Get returns a message payload from the spool given
-// a valid message ID. Second return value is the Dirty bool
-// which is set to true if the message has not been written to disk.
-// If returning an error then the Dirty return value is false.
+// Get returns a message payload from the spool given a valid message ID,
+// if the message has not been written to disk. Second return value is the
+// Dirty bool which is always true for messages held in memory. If returning
+// an error then the Dirty return value is false.
 func (s *MemSpool) Get(messageID uint32) ([]byte, bool, error) {
-	raw_message, ok := s.items.Load(messageID)
+	entry, ok := s.items[messageID]
 	if !ok {
 		return nil, false, fmt.Errorf("message ID %d not found", messageID)
 	}
-	entry, ok := raw_message.(*SpoolEntry)
-	if !ok {
-		return nil, false, errors.New("invalid message found")
-	}
-	return entry.Payload, entry.Dirty, nil
+	return entry.Payload, true, nil
 }
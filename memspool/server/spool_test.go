@@ -17,14 +17,21 @@
 package server
 
 import (
+	"crypto/sha512"
 	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/katzenpost/katzenpost/core/crypto/eddsa"
 	"github.com/katzenpost/katzenpost/core/crypto/rand"
 	"github.com/katzenpost/katzenpost/core/log"
+	"github.com/katzenpost/katzenpost/core/sphinx"
 	"github.com/katzenpost/katzenpost/memspool/common"
+	"github.com/katzenpost/katzenpost/server/storage"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	bolt "go.etcd.io/bbolt"
 )
 
 func TestSpool(t *testing.T) {
@@ -111,7 +118,7 @@ func TestPersistence(t *testing.T) {
 	assert.NoError(err)
 	messages := make([][]byte, 1)
 	for i := 1; i < 100; i++ {
-		msg := make([]byte, common.SpoolPayloadLength)
+		msg := make([]byte, common.SpoolPayloadLength(sphinx.DefaultGeometry()))
 		n, err := rand.Reader.Read(msg)
 		assert.NoError(err)
 		assert.Equal(n, len(msg))
@@ -128,3 +135,339 @@ func TestPersistence(t *testing.T) {
 	}
 	spoolMap.Shutdown()
 }
+
+func newTestSpoolMap(t *testing.T, cfg *SpoolConfig) *MemSpoolMap {
+	fileStore := filepath.Join(t.TempDir(), "memspool_test_filestore")
+	logBackend, err := log.New("", "debug", false)
+	require.NoError(t, err)
+	spoolMap, err := NewMemSpoolMapWithConfig(fileStore, cfg, logBackend.GetLogger("test_logger"))
+	require.NoError(t, err)
+	return spoolMap
+}
+
+func TestSpoolQuotaAndDelete(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	privKey, err := eddsa.NewKeypair(rand.NewMath())
+	require.NoError(err)
+	signature := privKey.Sign(privKey.PublicKey().Bytes())
+	spoolMap := newTestSpoolMap(t, &SpoolConfig{MaxMessages: 2, MaxBytes: 10})
+	defer spoolMap.Shutdown()
+	spoolID, err := spoolMap.CreateSpool(privKey.PublicKey(), signature)
+	require.NoError(err)
+
+	require.NoError(spoolMap.AppendToSpool(*spoolID, []byte("hello")))
+	require.Equal(errSpoolQuotaExceeded, spoolMap.AppendToSpool(*spoolID, []byte("goodbye")))
+	require.NoError(spoolMap.AppendToSpool(*spoolID, []byte("bye")))
+	require.Equal(errSpoolQuotaExceeded, spoolMap.AppendToSpool(*spoolID, []byte("a")))
+
+	// deleting messages in memory and on disk frees quota
+	deleteSignature := func(messageID uint32) []byte {
+		return privKey.Sign(common.DeleteSignedData(*spoolID, messageID))
+	}
+	require.Equal(errInvalidSignature, spoolMap.DeleteFromSpool(*spoolID, []byte("invalid"), 1))
+	require.NoError(spoolMap.DeleteFromSpool(*spoolID, deleteSignature(1), 1))
+	require.Error(spoolMap.DeleteFromSpool(*spoolID, deleteSignature(1), 1))
+	_, err = spoolMap.ReadFromSpool(*spoolID, signature, 1)
+	require.Error(err)
+	spoolMap.doFlush()
+	// a delete signature can't be replayed for another message
+	require.Equal(errInvalidSignature, spoolMap.DeleteFromSpool(*spoolID, deleteSignature(1), 2))
+	require.NoError(spoolMap.DeleteFromSpool(*spoolID, deleteSignature(2), 2))
+	require.NoError(spoolMap.AppendToSpool(*spoolID, []byte("hello")))
+	require.NoError(spoolMap.AppendToSpool(*spoolID, []byte("again")))
+
+	// message IDs are not reused
+	message, err := spoolMap.ReadFromSpool(*spoolID, signature, 4)
+	require.NoError(err)
+	require.Equal([]byte("again"), message)
+
+	// the delete command is handled
+	cmd, err := common.DeleteFromSpool(*spoolID, 3, privKey)
+	require.NoError(err)
+	request := new(common.SpoolRequest)
+	require.NoError(request.Unmarshal(cmd))
+	logBackend, err := log.New("", "debug", false)
+	require.NoError(err)
+	response := HandleSpoolRequest(spoolMap, request, logBackend.GetLogger("test_logger"))
+	require.True(response.IsOK())
+	_, err = spoolMap.ReadFromSpool(*spoolID, signature, 3)
+	require.Error(err)
+
+	// a delete command replayed for another message is refused
+	request.MessageID = 4
+	response = HandleSpoolRequest(spoolMap, request, logBackend.GetLogger("test_logger"))
+	require.Equal(errInvalidSignature.Error(), response.Status)
+	message, err = spoolMap.ReadFromSpool(*spoolID, signature, 4)
+	require.NoError(err)
+	require.Equal([]byte("again"), message)
+}
+
+func TestSpoolExpiryAndEviction(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	privKey, err := eddsa.NewKeypair(rand.NewMath())
+	require.NoError(err)
+	signature := privKey.Sign(privKey.PublicKey().Bytes())
+	spoolMap := newTestSpoolMap(t, &SpoolConfig{MessageTTL: time.Hour})
+	defer spoolMap.Shutdown()
+	spoolID, err := spoolMap.CreateSpool(privKey.PublicKey(), signature)
+	require.NoError(err)
+	require.NoError(spoolMap.AppendToSpool(*spoolID, []byte("hello")))
+
+	// idle spools are evicted from memory once written to disk
+	raw_spool, ok := spoolMap.spools.Load(*spoolID)
+	require.True(ok)
+	raw_spool.(*MemSpool).lastAccess = time.Now().Add(-2 * spoolIdleTimeout)
+	spoolMap.doFlush()
+	_, ok = spoolMap.spools.Load(*spoolID)
+	require.False(ok)
+	message, err := spoolMap.ReadFromSpool(*spoolID, signature, 1)
+	require.NoError(err)
+	require.Equal([]byte("hello"), message)
+
+	spoolMap.doExpire()
+	_, err = spoolMap.ReadFromSpool(*spoolID, signature, 1)
+	require.NoError(err)
+
+	spoolMap.cfg.MessageTTL = time.Nanosecond
+	require.NoError(spoolMap.AppendToSpool(*spoolID, []byte("goodbye")))
+	_, err = spoolMap.ReadFromSpool(*spoolID, signature, 2)
+	require.Error(err)
+	spoolMap.doFlush()
+	spoolMap.cfg.MessageTTL = time.Hour
+	spoolMap.doExpire()
+	_, err = spoolMap.ReadFromSpool(*spoolID, signature, 2)
+	require.NoError(err)
+
+	// expired messages are removed from disk
+	spoolMap.cfg.MessageTTL = time.Nanosecond
+	spoolMap.doExpire()
+	spoolMap.cfg.MessageTTL = 0
+	_, err = spoolMap.ReadFromSpool(*spoolID, signature, 1)
+	require.Error(err)
+	_, err = spoolMap.ReadFromSpool(*spoolID, signature, 2)
+	require.Error(err)
+	err = spoolMap.withSpool(*spoolID, func(spool *MemSpool) error {
+		require.Equal(0, spool.count)
+		require.Equal(0, spool.bytes)
+		return nil
+	})
+	require.NoError(err)
+}
+
+func TestSpoolSequenceAfterDeletedMessages(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	privKey, err := eddsa.NewKeypair(rand.NewMath())
+	require.NoError(err)
+	signature := privKey.Sign(privKey.PublicKey().Bytes())
+	spoolMap := newTestSpoolMap(t, &SpoolConfig{})
+	defer spoolMap.Shutdown()
+	spoolID, err := spoolMap.CreateSpool(privKey.PublicKey(), signature)
+	require.NoError(err)
+	require.NoError(spoolMap.AppendToSpool(*spoolID, []byte("hello")))
+	spoolMap.doFlush()
+
+	// the messages appended since the flush are read and deleted from
+	// memory before the next one
+	require.NoError(spoolMap.AppendToSpool(*spoolID, []byte("a")))
+	require.NoError(spoolMap.AppendToSpool(*spoolID, []byte("b")))
+	for messageID := uint32(2); messageID <= 3; messageID++ {
+		_, err = spoolMap.ReadFromSpool(*spoolID, signature, messageID)
+		require.NoError(err)
+		require.NoError(spoolMap.DeleteFromSpool(*spoolID, privKey.Sign(common.DeleteSignedData(*spoolID, messageID)), messageID))
+	}
+
+	// their message IDs are not reused once the spool is evicted
+	raw_spool, ok := spoolMap.spools.Load(*spoolID)
+	require.True(ok)
+	raw_spool.(*MemSpool).lastAccess = time.Now().Add(-2 * spoolIdleTimeout)
+	spoolMap.doFlush()
+	_, ok = spoolMap.spools.Load(*spoolID)
+	require.False(ok)
+	require.NoError(spoolMap.AppendToSpool(*spoolID, []byte("c")))
+	message, err := spoolMap.ReadFromSpool(*spoolID, signature, 4)
+	require.NoError(err)
+	require.Equal([]byte("c"), message)
+	_, err = spoolMap.ReadFromSpool(*spoolID, signature, 3)
+	require.Error(err)
+}
+
+func TestSpoolGoneMessages(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	privKey, err := eddsa.NewKeypair(rand.NewMath())
+	require.NoError(err)
+	signature := privKey.Sign(privKey.PublicKey().Bytes())
+	spoolMap := newTestSpoolMap(t, &SpoolConfig{MessageTTL: time.Hour})
+	defer spoolMap.Shutdown()
+	spoolID, err := spoolMap.CreateSpool(privKey.PublicKey(), signature)
+	require.NoError(err)
+	for _, m := range []string{"one", "two", "three"} {
+		require.NoError(spoolMap.AppendToSpool(*spoolID, []byte(m)))
+	}
+	spoolMap.doFlush()
+	require.NoError(spoolMap.AppendToSpool(*spoolID, []byte("four")))
+	require.NoError(spoolMap.AppendToSpool(*spoolID, []byte("five")))
+
+	// the second message, on disk, and the fourth, in memory, expire
+	expired := time.Now().Add(-2 * time.Hour)
+	require.NoError(spoolMap.db.Put(spoolMessagesBucket, messageKey(*spoolID, 2), encodeMessage(expired, []byte("two"))))
+	raw_spool, ok := spoolMap.spools.Load(*spoolID)
+	require.True(ok)
+	raw_spool.(*MemSpool).items[4].Created = expired
+
+	logBackend, err := log.New("", "debug", false)
+	require.NoError(err)
+	read := func(messageID uint32) *common.SpoolResponse {
+		cmd, err := common.ReadFromSpool(*spoolID, messageID, privKey)
+		require.NoError(err)
+		request := new(common.SpoolRequest)
+		require.NoError(request.Unmarshal(cmd))
+		return HandleSpoolRequest(spoolMap, request, logBackend.GetLogger("test_logger"))
+	}
+
+	// a gone message names the next live one
+	response := read(2)
+	require.True(response.IsGone())
+	require.False(response.IsOK())
+	require.Equal(uint32(2), response.MessageID)
+	require.Equal(uint32(3), response.NextMessageID)
+	response = read(3)
+	require.True(response.IsOK())
+	require.Equal([]byte("three"), response.Message)
+	response = read(4)
+	require.True(response.IsGone())
+	require.Equal(uint32(5), response.NextMessageID)
+
+	// a deleted message names the next live one, or the tip
+	require.NoError(spoolMap.DeleteFromSpool(*spoolID, privKey.Sign(common.DeleteSignedData(*spoolID, 3)), 3))
+	response = read(2)
+	require.True(response.IsGone())
+	require.Equal(uint32(5), response.NextMessageID)
+	require.NoError(spoolMap.DeleteFromSpool(*spoolID, privKey.Sign(common.DeleteSignedData(*spoolID, 5)), 5))
+	response = read(2)
+	require.True(response.IsGone())
+	require.Equal(uint32(6), response.NextMessageID)
+
+	// the tip is not gone, but not found
+	response = read(6)
+	require.False(response.IsGone())
+	require.False(response.IsOK())
+	require.NoError(spoolMap.AppendToSpool(*spoolID, []byte("six")))
+	response = read(6)
+	require.True(response.IsOK())
+	require.Equal([]byte("six"), response.Message)
+}
+
+func TestSpoolStorageMigration(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	privKey, err := eddsa.NewKeypair(rand.NewMath())
+	require.NoError(err)
+	signature := privKey.Sign(privKey.PublicKey().Bytes())
+	spoolID := [common.SpoolIDSize]byte{}
+	spoolhash := sha512.Sum512_256(privKey.PublicKey().Bytes())
+	copy(spoolID[:], spoolhash[:common.SpoolIDSize])
+
+	// write a version 0 database with a message
+	fileStore := filepath.Join(t.TempDir(), "memspool_test_filestore")
+	db, err := bolt.Open(fileStore, 0600, nil)
+	require.NoError(err)
+	err = db.Update(func(tx *bolt.Tx) error {
+		metaBucket, err := tx.CreateBucket([]byte(metadataBucket))
+		if err != nil {
+			return err
+		}
+		if err = metaBucket.Put([]byte(versionKey), []byte{0}); err != nil {
+			return err
+		}
+		spoolsBucket, err := tx.CreateBucket([]byte(legacySpoolsBucket))
+		if err != nil {
+			return err
+		}
+		spoolBucket, err := spoolsBucket.CreateBucket(spoolID[:])
+		if err != nil {
+			return err
+		}
+		spoolMetadata, err := spoolBucket.CreateBucket([]byte(legacySpoolMetadata))
+		if err != nil {
+			return err
+		}
+		if err = spoolMetadata.Put([]byte(legacySpoolPublicKey), privKey.PublicKey().Bytes()); err != nil {
+			return err
+		}
+		messagesBucket, err := spoolBucket.CreateBucket([]byte(legacyMessagesKey))
+		if err != nil {
+			return err
+		}
+		return messagesBucket.Put([]byte{0, 0, 0, 1}, []byte("hello"))
+	})
+	require.NoError(err)
+	require.NoError(db.Close())
+
+	logBackend, err := log.New("", "debug", false)
+	require.NoError(err)
+	spoolMap, err := NewMemSpoolMap(fileStore, logBackend.GetLogger("test_logger"))
+	require.NoError(err)
+	message, err := spoolMap.ReadFromSpool(spoolID, signature, 1)
+	require.NoError(err)
+	require.Equal([]byte("hello"), message)
+	require.NoError(spoolMap.AppendToSpool(spoolID, []byte("goodbye")))
+	message, err = spoolMap.ReadFromSpool(spoolID, signature, 2)
+	require.NoError(err)
+	require.Equal([]byte("goodbye"), message)
+	spoolMap.Shutdown()
+
+	// the migrated database is reopened as is
+	spoolMap, err = NewMemSpoolMap(fileStore, logBackend.GetLogger("test_logger"))
+	require.NoError(err)
+	defer spoolMap.Shutdown()
+	message, err = spoolMap.ReadFromSpool(spoolID, signature, 2)
+	require.NoError(err)
+	require.Equal([]byte("goodbye"), message)
+}
+
+func TestMemSpoolMapStorageBackends(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	privKey, err := eddsa.NewKeypair(rand.NewMath())
+	require.NoError(err)
+	signature := privKey.Sign(privKey.PublicKey().Bytes())
+	logBackend, err := log.New("", "debug", false)
+	require.NoError(err)
+
+	spoolMap, err := NewMemSpoolMapWithStorage(&storage.Config{Backend: storage.BackendMem}, &SpoolConfig{}, logBackend.GetLogger("test_logger"))
+	require.NoError(err)
+	defer spoolMap.Shutdown()
+	spoolID, err := spoolMap.CreateSpool(privKey.PublicKey(), signature)
+	require.NoError(err)
+	require.NoError(spoolMap.AppendToSpool(*spoolID, []byte("hello")))
+	spoolMap.doFlush()
+	require.NoError(spoolMap.AppendToSpool(*spoolID, []byte("goodbye")))
+	message, err := spoolMap.ReadFromSpool(*spoolID, signature, 1)
+	require.NoError(err)
+	require.Equal([]byte("hello"), message)
+	message, err = spoolMap.ReadFromSpool(*spoolID, signature, 2)
+	require.NoError(err)
+	require.Equal([]byte("goodbye"), message)
+
+	// purged spools are removed from storage
+	spoolMap.doFlush()
+	require.NoError(spoolMap.PurgeSpool(*spoolID, signature))
+	n := 0
+	require.NoError(spoolMap.db.ForEach(spoolMessagesBucket, nil, func(k, v []byte) error {
+		n++
+		return nil
+	}))
+	require.Equal(0, n)
+	_, err = spoolMap.ReadFromSpool(*spoolID, signature, 1)
+	require.Error(err)
+}
@@ -29,7 +29,6 @@ import (
 	"github.com/katzenpost/katzenpost/core/crypto/sign"
 	"github.com/katzenpost/katzenpost/core/log"
 	cpki "github.com/katzenpost/katzenpost/core/pki"
-	"github.com/katzenpost/katzenpost/core/sphinx"
 	"github.com/katzenpost/katzenpost/core/sphinx/constants"
 	"github.com/katzenpost/katzenpost/core/wire"
 	"gopkg.in/op/go-logging.v1"
@@ -94,7 +93,10 @@ type ClientConfig struct {
 	DialContextFn func(ctx context.Context, network, address string) (net.Conn, error)
 
 	// PreferedTransports is a list of the transports will be used to make
-	// outgoing network connections, with the most prefered first.
+	// outgoing network connections, with the most prefered first.  The
+	// QUIC and WebSocket transports (`core/pki.TransportQUIC`,
+	// `core/pki.TransportWebSocket` and `core/pki.TransportWebSocketTLS`)
+	// are only used when listed, or when the list is nil.
 	PreferedTransports []cpki.Transport
 
 	// MessagePollInterval is the interval at which the server will be
@@ -102,6 +104,18 @@ type ClientConfig struct {
 	// If left unset, an interval of 1 minute will be used.
 	MessagePollInterval time.Duration
 
+	// EnablePushDelivery requests that the Provider sends messages as
+	// soon as they are stored in the spool, instead of in reply to the
+	// polls sent every MessagePollInterval.  The polls are still sent,
+	// as cover for the acknowledgements of pushed messages, unless
+	// DisablePollCover is set.
+	EnablePushDelivery bool
+
+	// DisablePollCover disables the periodic polls when EnablePushDelivery
+	// is set, which saves bandwidth but reveals when messages are received
+	// to an observer of the connection to the Provider.
+	DisablePollCover bool
+
 	// EnableTimeSync enables the use of skewed remote provider time
 	// instead of system time when available.
 	EnableTimeSync bool
@@ -144,9 +158,6 @@ type Client struct {
 	cfg *ClientConfig
 	log *logging.Logger
 
-	geo    *sphinx.Geometry
-	sphinx *sphinx.Sphinx
-
 	rng  *mRand.Rand
 	pki  *pki
 	conn *connection
@@ -192,8 +203,6 @@ func New(cfg *ClientConfig) (*Client, error) {
 	}
 
 	c := new(Client)
-	c.geo = sphinx.DefaultGeometry()
-	c.sphinx = sphinx.DefaultSphinx()
 	c.cfg = cfg
 	c.displayName = fmt.Sprintf("%x@%s", c.cfg.User, c.cfg.Provider)
 	c.log = cfg.LogBackend.GetLogger("minclient:" + c.displayName)
@@ -32,6 +32,7 @@ import (
 	"github.com/katzenpost/katzenpost/core/epochtime"
 	cpki "github.com/katzenpost/katzenpost/core/pki"
 	"github.com/katzenpost/katzenpost/core/sphinx"
+	"github.com/katzenpost/katzenpost/core/transport"
 	"github.com/katzenpost/katzenpost/core/wire"
 	"github.com/katzenpost/katzenpost/core/wire/commands"
 	"github.com/katzenpost/katzenpost/core/worker"
@@ -46,13 +47,6 @@ var (
 	// a call to Shutdown().
 	ErrShutdown = errors.New("shutdown requested")
 
-	defaultDialer = net.Dialer{
-		KeepAlive: keepAliveInterval,
-		Timeout:   connectTimeout,
-	}
-
-	keepAliveInterval   = 3 * time.Minute
-	connectTimeout      = 1 * time.Minute
 	pkiFallbackInterval = epochtime.Period / 16
 )
 
@@ -111,6 +105,7 @@ type connection struct {
 
 	pkiEpoch   uint64
 	descriptor *cpki.MixDescriptor
+	geo        *sphinx.Geometry
 
 	pkiFetchCh     chan interface{}
 	fetchCh        chan interface{}
@@ -169,6 +164,7 @@ func (c *connection) getDescriptor() error {
 		if !ok {
 			c.pkiEpoch = 0
 			c.descriptor = nil
+			c.geo = nil
 		}
 	}()
 
@@ -192,6 +188,7 @@ func (c *connection) getDescriptor() error {
 
 	c.descriptor = desc
 	c.pkiEpoch = doc.Epoch
+	c.geo = doc.SphinxGeometry
 	ok = true
 
 	return nil
@@ -262,10 +259,9 @@ func (c *connection) doConnect(dialCtx context.Context) {
 		maxRetryDelay  = 2 * time.Minute
 	)
 
+	// The transports connect directly when there is no alternative
+	// dialer.
 	dialFn := c.c.cfg.DialContextFn
-	if dialFn == nil {
-		dialFn = defaultDialer.DialContext
-	}
 
 	var connErr error
 	defer func() {
@@ -285,14 +281,22 @@ func (c *connection) doConnect(dialCtx context.Context) {
 
 		// Build the list of candidate addresses, in decreasing order of
 		// preference, by transport.
-		var dstAddrs []string
+		type dstAddr struct {
+			transport transport.Transport
+			addrPort  string
+		}
+		var dstAddrs []dstAddr
 		transports := c.c.cfg.PreferedTransports
 		if transports == nil {
 			transports = cpki.ClientTransports
 		}
 		for _, t := range transports {
-			if v, ok := c.descriptor.Addresses[t]; ok {
-				dstAddrs = append(dstAddrs, v...)
+			tr, err := transport.Get(t)
+			if err != nil {
+				continue
+			}
+			for _, v := range c.descriptor.Addresses[t] {
+				dstAddrs = append(dstAddrs, dstAddr{tr, v})
 			}
 		}
 		if len(dstAddrs) == 0 {
@@ -302,7 +306,8 @@ func (c *connection) doConnect(dialCtx context.Context) {
 			return
 		}
 
-		for _, addrPort := range dstAddrs {
+		for _, dst := range dstAddrs {
+			addrPort := dst.addrPort
 			select {
 			case <-time.After(time.Duration(atomic.LoadInt64(&c.retryDelay))):
 				// Back off the reconnect delay.
@@ -317,7 +322,7 @@ func (c *connection) doConnect(dialCtx context.Context) {
 			}
 
 			c.log.Debugf("Dialing: %v", addrPort)
-			conn, err := dialFn(dialCtx, "tcp", addrPort)
+			conn, err := dst.transport.Dial(dialCtx, dialFn, addrPort)
 			select {
 			case <-c.HaltCh():
 				if conn != nil {
@@ -334,10 +339,10 @@ func (c *connection) doConnect(dialCtx context.Context) {
 					continue
 				}
 			}
-			c.log.Debugf("TCP connection established.")
+			c.log.Debugf("Connection established.")
 
 			// Do something with the connection.
-			c.onTCPConn(conn)
+			c.onConn(conn)
 
 			// Re-iterate through the address/ports on a sucessful connect.
 			c.log.Debugf("Connection terminated, will reconnect.")
@@ -349,18 +354,18 @@ func (c *connection) doConnect(dialCtx context.Context) {
 	}
 }
 
-func (c *connection) onTCPConn(conn net.Conn) {
+func (c *connection) onConn(conn net.Conn) {
 	const handshakeTimeout = 1 * time.Minute
 	var err error
 
 	defer func() {
-		c.log.Debugf("TCP connection closed.")
+		c.log.Debugf("Connection closed.")
 		conn.Close()
 	}()
 
 	// Allocate the session struct.
 	cfg := &wire.SessionConfig{
-		Geometry:          sphinx.DefaultGeometry(),
+		Geometry:          c.geo,
 		Authenticator:     c,
 		AdditionalData:    []byte(c.c.cfg.User),
 		AuthenticationKey: c.c.cfg.LinkKey,
@@ -466,7 +471,20 @@ func (c *connection) onWireConn(w *wire.Session) {
 		}
 	}()
 
+	pushEnabled := c.c.cfg.EnablePushDelivery
+	pollEnabled := !pushEnabled || !c.c.cfg.DisablePollCover
+
 	var fetchDelay time.Duration
+	if pushEnabled {
+		// The Provider pushes the head of the spool once push delivery
+		// is enabled, so there is no need for an immediate poll.
+		if wireErr = w.SendCommand(&commands.EnablePush{}); wireErr != nil {
+			c.log.Debugf("Failed to send EnablePush: %v", wireErr)
+			return
+		}
+		c.log.Debugf("Sent EnablePush.")
+		fetchDelay = c.c.GetPollInterval()
+	}
 	var selectAt time.Time
 	adjFetchDelay := func() {
 		sendAt := time.Now()
@@ -483,13 +501,46 @@ func (c *connection) onWireConn(w *wire.Session) {
 		}
 		return nil
 	}
+	// isDuplicate returns true if the command is a resend of the message
+	// at the head of the spool, which happens when a poll crosses a pushed
+	// message that was then acknowledged.
+	isDuplicate := func(cmdSeq uint32) bool {
+		return pushEnabled && seq != 0 && cmdSeq == seq-1
+	}
 	nrReqs, nrResps := 0, 0
+	onResponse := func() {
+		// Pushed messages are not replies to a request.
+		if nrResps < nrReqs {
+			nrResps++
+		}
+	}
+	// sendAck acknowledges a message in push mode, which also retrieves
+	// the next one.
+	sendAck := func() error {
+		if !pushEnabled {
+			return nil
+		}
+		cmd := &commands.RetrieveMessage{
+			Sequence: seq,
+		}
+		if err := w.SendCommand(cmd); err != nil {
+			c.log.Debugf("Failed to send RetrieveMessage: %v", err)
+			return err
+		}
+		c.log.Debugf("Sent RetrieveMessage: %d (ACK)", seq)
+		nrReqs++
+		return nil
+	}
 	for {
 		var rawCmd commands.Command
 		var doFetch bool
+		var fetchTimerCh <-chan time.Time
+		if pollEnabled {
+			fetchTimerCh = time.After(fetchDelay)
+		}
 		selectAt = time.Now()
 		select {
-		case <-time.After(fetchDelay):
+		case <-fetchTimerCh:
 			doFetch = true
 		case <-c.fetchCh:
 			doFetch = true
@@ -591,17 +642,22 @@ func (c *connection) onWireConn(w *wire.Session) {
 				c.log.Errorf("MessageEmpty sequence unexpected: %v", cmd.Sequence)
 				return
 			}
-			nrResps++
+			onResponse()
 			if wireErr = dispatchOnEmpty(); wireErr != nil {
 				return
 			}
 		case *commands.Message:
 			c.log.Debugf("Received Message: %v", cmd.Sequence)
+			if isDuplicate(cmd.Sequence) {
+				c.log.Debugf("Dropping duplicate Message: %v", cmd.Sequence)
+				onResponse()
+				continue
+			}
 			if wireErr = checkSeq(cmd.Sequence); wireErr != nil {
 				c.log.Errorf("Message sequence unexpected: %v", cmd.Sequence)
 				return
 			}
-			nrResps++
+			onResponse()
 			if c.c.cfg.OnMessageFn != nil {
 				cbWg.Add(1)
 				go func() {
@@ -613,6 +669,9 @@ func (c *connection) onWireConn(w *wire.Session) {
 				}()
 			}
 			seq++
+			if wireErr = sendAck(); wireErr != nil {
+				return
+			}
 			if cmd.QueueSizeHint == 0 {
 				c.log.Debugf("QueueSizeHint indicates empty queue, calling dispatchOnEmpty.")
 				if wireErr = dispatchOnEmpty(); wireErr != nil {
@@ -622,11 +681,16 @@ func (c *connection) onWireConn(w *wire.Session) {
 			}
 		case *commands.MessageACK:
 			c.log.Debugf("Received MessageACK: %v", cmd.Sequence)
+			if isDuplicate(cmd.Sequence) {
+				c.log.Debugf("Dropping duplicate MessageACK: %v", cmd.Sequence)
+				onResponse()
+				continue
+			}
 			if wireErr = checkSeq(cmd.Sequence); wireErr != nil {
 				c.log.Errorf("MessageACK sequence unexpected: %v", cmd.Sequence)
 				return
 			}
-			nrResps++
+			onResponse()
 			if c.c.cfg.OnACKFn != nil {
 				cbWg.Add(1)
 				go func() {
@@ -638,6 +702,9 @@ func (c *connection) onWireConn(w *wire.Session) {
 				}()
 			}
 			seq++
+			if wireErr = sendAck(); wireErr != nil {
+				return
+			}
 		case *commands.Consensus:
 			if consensusCtx != nil {
 				c.log.Debugf("Received Consensus: ErrorCode: %v, Payload %v bytes", cmd.ErrorCode, len(cmd.Payload))
@@ -26,6 +26,7 @@ import (
 	vServer "github.com/katzenpost/katzenpost/authority/voting/server"
 	"github.com/katzenpost/katzenpost/core/epochtime"
 	cpki "github.com/katzenpost/katzenpost/core/pki"
+	"github.com/katzenpost/katzenpost/core/sphinx"
 	"github.com/katzenpost/katzenpost/core/wire/commands"
 	"github.com/katzenpost/katzenpost/core/worker"
 	"gopkg.in/op/go-logging.v1"
@@ -74,6 +75,17 @@ func (c *Client) CurrentDocument() *cpki.Document {
 	return c.pki.currentDocument()
 }
 
+// SphinxGeometry returns the Sphinx geometry published in the current
+// pki.Document, or nil iff no document exists.  The caller MUST NOT
+// modify the returned object in any way.
+func (c *Client) SphinxGeometry() *sphinx.Geometry {
+	doc := c.CurrentDocument()
+	if doc == nil {
+		return nil
+	}
+	return doc.SphinxGeometry
+}
+
 func (p *pki) setClockSkew(skew int64) {
 	p.log.Debugf("New clock skew: %v sec", skew)
 	p.Lock()
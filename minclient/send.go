@@ -38,12 +38,22 @@ func (c *Client) ComposeSphinxPacket(recipient, provider string, surbID *[sConst
 	if len(recipient) > sConstants.RecipientIDLength {
 		return nil, nil, 0, fmt.Errorf("minclient: invalid recipient: '%v'", recipient)
 	}
-	if len(b) != c.geo.UserForwardPayloadLength {
+
+	doc := c.CurrentDocument()
+	if doc == nil {
+		return nil, nil, 0, newPKIError("minclient: no PKI document for current epoch")
+	}
+	s, err := sphinx.FromGeometry(doc.SphinxGeometry)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	geo := s.Geometry()
+	if len(b) != geo.UserForwardPayloadLength {
 		return nil, nil, 0, fmt.Errorf("minclient: invalid ciphertext size: %v", len(b))
 	}
 
 	// Wrap the ciphertext in a BlockSphinxCiphertext.
-	payload := make([]byte, 2+c.geo.SURBLength, 2+c.geo.SURBLength+len(b))
+	payload := make([]byte, 2+geo.SURBLength, 2+geo.SURBLength+len(b))
 	payload = append(payload, b...)
 
 	for {
@@ -78,22 +88,22 @@ func (c *Client) ComposeSphinxPacket(recipient, provider string, surbID *[sConst
 		// that happens, the path selection must be redone.
 		if then.Sub(now) < epochtime.Period*2 {
 			if surbID != nil {
-				payload := make([]byte, 2, 2+c.geo.SURBLength+len(b))
+				payload := make([]byte, 2, 2+geo.SURBLength+len(b))
 				payload[0] = 1 // Packet has a SURB.
-				surb, k, err := c.sphinx.NewSURB(rand.Reader, revPath)
+				surb, k, err := s.NewSURB(rand.Reader, revPath)
 				if err != nil {
 					return nil, nil, 0, err
 				}
 				payload = append(payload, surb...)
 				payload = append(payload, b...)
 
-				pkt, err := c.sphinx.NewPacket(rand.Reader, fwdPath, payload)
+				pkt, err := s.NewPacket(rand.Reader, fwdPath, payload)
 				if err != nil {
 					return nil, nil, 0, err
 				}
 				return pkt, k, then.Sub(now), err
 			} else {
-				pkt, err := c.sphinx.NewPacket(rand.Reader, fwdPath, payload)
+				pkt, err := s.NewPacket(rand.Reader, fwdPath, payload)
 				if err != nil {
 					return nil, nil, 0, err
 				}
@@ -28,6 +28,7 @@ import (
 	"github.com/katzenpost/katzenpost/core/log"
 	"github.com/katzenpost/katzenpost/panda/server"
 	"github.com/katzenpost/katzenpost/server/cborplugin"
+	"github.com/katzenpost/katzenpost/server/storage"
 	"gopkg.in/op/go-logging.v1"
 )
 
@@ -37,12 +38,16 @@ func main() {
 	var dwellTime string
 	var writeBackInterval string
 	var fileStore string
+	var storageBackend string
+	var dataSourceName string
 
 	flag.StringVar(&logDir, "log_dir", "", "logging directory")
 	flag.StringVar(&logLevel, "log_level", "DEBUG", "logging level could be set to: DEBUG, INFO, NOTICE, WARNING, ERROR, CRITICAL")
 	flag.StringVar(&dwellTime, "dwell_time", "336h", "ciphertext max dwell time before garbage collection")
 	flag.StringVar(&writeBackInterval, "writeBackInterval", "1h", "GC and write-back cache interval")
 	flag.StringVar(&fileStore, "fileStore", "", "The file path of our on disk storage.")
+	flag.StringVar(&storageBackend, "storage", storage.BackendBolt, "storage backend could be set to: bolt, sql, mem")
+	flag.StringVar(&dataSourceName, "dsn", "", "The SQL database connection string, for the sql storage backend.")
 
 	flag.Parse()
 
@@ -54,7 +59,12 @@ func main() {
 	if err != nil {
 		panic(err)
 	}
-	if fileStore == "" {
+	storageCfg := &storage.Config{
+		Backend:        storageBackend,
+		Path:           fileStore,
+		DataSourceName: dataSourceName,
+	}
+	if storageBackend == storage.BackendBolt && fileStore == "" {
 		panic("Invalid fileStore specified.")
 	}
 
@@ -85,7 +95,7 @@ func main() {
 	}
 	socketFile := filepath.Join(tmpDir, fmt.Sprintf("%d.panda.socket", os.Getpid()))
 
-	panda, err := server.New(serverLog, fileStore, dwellDuration, writeBackDuration)
+	panda, err := server.NewWithStorage(serverLog, storageCfg, dwellDuration, writeBackDuration)
 	if err != nil {
 		panic(err)
 	}
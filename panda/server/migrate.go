@@ -0,0 +1,96 @@
+// migrate.go - PANDA bolt storage migration.
+// Copyright (C) 2022  David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"encoding/binary"
+	"errors"
+	"os"
+
+	"github.com/fxamacker/cbor/v2"
+	bolt "go.etcd.io/bbolt"
+)
+
+// The layout of the version 0 bolt database, which kept a bucket per
+// posting in the legacy posts bucket.
+const (
+	legacyPostsBucket = "posts"
+	legacyPostTimeKey = "time"
+	legacyPostAKey    = "A"
+	legacyPostBKey    = "B"
+)
+
+// migrateBolt converts a version 0 bolt database to the layout of the
+// bolt storage backend.
+func migrateBolt(fileStore string) error {
+	if fi, err := os.Stat(fileStore); err != nil || fi.Size() == 0 {
+		// nothing to migrate
+		return nil
+	}
+	db, err := bolt.Open(fileStore, 0600, nil)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return db.Update(func(tx *bolt.Tx) error {
+		metaBucket := tx.Bucket([]byte(metadataBucket))
+		if metaBucket == nil {
+			return nil
+		}
+		version := metaBucket.Get([]byte(versionKey))
+		if len(version) != 1 || version[0] != 0 {
+			return nil
+		}
+		postingsBkt, err := tx.CreateBucketIfNotExists([]byte(postingsBucket))
+		if err != nil {
+			return err
+		}
+		if postsBucket := tx.Bucket([]byte(legacyPostsBucket)); postsBucket != nil {
+			c := postsBucket.Cursor()
+			for tag, value := c.First(); tag != nil; tag, value = c.Next() {
+				if value != nil {
+					return errors.New("posts bucket entry value should be nil")
+				}
+				postingBucket := postsBucket.Bucket(tag)
+				rawTime := postingBucket.Get([]byte(legacyPostTimeKey))
+				if len(rawTime) != 8 {
+					return errors.New("posting time not found")
+				}
+				a := postingBucket.Get([]byte(legacyPostAKey))
+				if a == nil {
+					return errors.New("posting A not found")
+				}
+				stored := &storedPosting{
+					UnixTime: int64(binary.BigEndian.Uint64(rawTime)),
+					A:        a,
+					B:        postingBucket.Get([]byte(legacyPostBKey)),
+				}
+				rawPosting, err := cbor.Marshal(stored)
+				if err != nil {
+					return err
+				}
+				if err := postingsBkt.Put(tag, rawPosting); err != nil {
+					return err
+				}
+			}
+			if err := tx.DeleteBucket([]byte(legacyPostsBucket)); err != nil {
+				return err
+			}
+		}
+		return metaBucket.Put([]byte(versionKey), []byte{PandaStorageVersion})
+	})
+}
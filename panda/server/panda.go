@@ -23,6 +23,7 @@ import (
 	"time"
 
 	"github.com/katzenpost/katzenpost/panda/common"
+	"github.com/katzenpost/katzenpost/server/storage"
 	"github.com/ugorji/go/codec"
 	"gopkg.in/op/go-logging.v1"
 )
@@ -132,7 +133,17 @@ func (k *Panda) encodeResp(resp *common.PandaResponse) []byte {
 
 // New constructs a new Panda server instance
 func New(log *logging.Logger, fileStore string, dwellDuration time.Duration, writeBackInterval time.Duration) (*Panda, error) {
-	store, err := NewPandaStorage(fileStore, dwellDuration, writeBackInterval)
+	storageCfg := &storage.Config{
+		Backend: storage.BackendBolt,
+		Path:    fileStore,
+	}
+	return NewWithStorage(log, storageCfg, dwellDuration, writeBackInterval)
+}
+
+// NewWithStorage constructs a new Panda server instance which persists
+// postings in the storage of the given storage.Config.
+func NewWithStorage(log *logging.Logger, storageCfg *storage.Config, dwellDuration time.Duration, writeBackInterval time.Duration) (*Panda, error) {
+	store, err := NewPandaStorageWithConfig(storageCfg, dwellDuration, writeBackInterval, log)
 	if err != nil {
 		return nil, err
 	}
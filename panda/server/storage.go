@@ -18,28 +18,33 @@ package server
 
 import (
 	"encoding/base64"
-	"encoding/binary"
 	"encoding/hex"
 	"errors"
 	"fmt"
 	"sync"
 	"time"
 
+	"github.com/fxamacker/cbor/v2"
+	"gopkg.in/op/go-logging.v1"
+
 	"github.com/katzenpost/katzenpost/core/worker"
 	"github.com/katzenpost/katzenpost/panda/common"
-	bolt "go.etcd.io/bbolt"
+	"github.com/katzenpost/katzenpost/server/storage"
 )
 
 const (
 	// PandaStorageVersion is the version of our on disk format.
-	PandaStorageVersion = 0
+	PandaStorageVersion = 1
+
+	metadataBucket = "metadata"
+	versionKey     = "version"
+
+	// postingsBucket maps tags to the serialized postings.
+	postingsBucket = "postings"
 
-	metadataBucket  = "metadata"
-	versionKey      = "version"
-	postsBucketName = "posts"
-	postTimeKey     = "time"
-	postAKey        = "A"
-	postBKey        = "B"
+	// storageNamespace is the namespace of the postings in a shared SQL
+	// database.
+	storageNamespace = "panda"
 )
 
 // PandaPosting is the data structure stored on Panda
@@ -81,53 +86,67 @@ func postingFromRequest(req *common.PandaRequest) (*[common.PandaTagLength]byte,
 	return &tag, p, nil
 }
 
-// PandaStorage handles the on disk persistence for the PANDA server.
+// storedPosting is the serialized form of a PandaPosting.
+type storedPosting struct {
+	UnixTime int64
+	A, B     []byte
+}
+
+// PandaStorage handles the persistence for the PANDA server.
 type PandaStorage struct {
 	worker.Worker
 
 	// [common.PandaTagLength]byte -> *PandaPosting
 	postings          *sync.Map
-	db                *bolt.DB
+	db                storage.Storage
 	dwellDuration     time.Duration
 	writeBackInterval time.Duration
 }
 
 // NewPandaStorage creates an in memory store
-// for Panda postings
+// for Panda postings, persisted in the bolt database file.
 func NewPandaStorage(fileStore string, dwellDuration time.Duration, writeBackInterval time.Duration) (*PandaStorage, error) {
+	storageCfg := &storage.Config{
+		Backend: storage.BackendBolt,
+		Path:    fileStore,
+	}
+	return NewPandaStorageWithConfig(storageCfg, dwellDuration, writeBackInterval, nil)
+}
+
+// NewPandaStorageWithConfig creates an in memory store for Panda postings,
+// persisted in the storage of the given storage.Config.
+func NewPandaStorageWithConfig(storageCfg *storage.Config, dwellDuration time.Duration, writeBackInterval time.Duration, log *logging.Logger) (*PandaStorage, error) {
 	s := &PandaStorage{
 		dwellDuration:     dwellDuration,
 		writeBackInterval: writeBackInterval,
 		postings:          new(sync.Map),
 	}
+	if storageCfg.Backend == storage.BackendBolt {
+		if err := migrateBolt(storageCfg.Path); err != nil {
+			return nil, err
+		}
+	}
+	sCfg := *storageCfg
+	sCfg.Namespace = storageNamespace
 	var err error
-	s.db, err = bolt.Open(fileStore, 0600, nil)
+	s.db, err = storage.New(&sCfg, log)
 	if err != nil {
 		return nil, err
 	}
-	if err = s.db.Update(func(tx *bolt.Tx) error {
-		var metaBucket *bolt.Bucket
-		var postsBucket *bolt.Bucket
-		metaBucket, err = tx.CreateBucketIfNotExists([]byte(metadataBucket))
-		if err != nil {
-			return err
-		}
-		if postsBucket, err = tx.CreateBucketIfNotExists([]byte(postsBucketName)); err != nil {
-			return err
-		}
-
-		if b := metaBucket.Get([]byte(versionKey)); b != nil {
-			// database loaded
-			if len(b) != 1 || b[0] != PandaStorageVersion {
-				return fmt.Errorf("spool storage: incompatible version: %d", uint(b[0]))
-			}
-			err = s.load(tx, postsBucket)
-			return err
+	version, err := s.db.Get(metadataBucket, []byte(versionKey))
+	switch err {
+	case nil:
+		// database loaded
+		if len(version) != 1 || version[0] != PandaStorageVersion {
+			err = fmt.Errorf("panda storage: incompatible version: %v", version)
+		} else {
+			err = s.load()
 		}
+	case storage.ErrNotFound:
 		// database created
-		metaBucket.Put([]byte(versionKey), []byte{PandaStorageVersion})
-		return nil
-	}); err != nil {
+		err = s.db.Put(metadataBucket, []byte(versionKey), []byte{PandaStorageVersion})
+	}
+	if err != nil {
 		s.db.Close()
 		return nil, err
 	}
@@ -135,39 +154,26 @@ func NewPandaStorage(fileStore string, dwellDuration time.Duration, writeBackInt
 	return s, nil
 }
 
-func (s *PandaStorage) load(tx *bolt.Tx, postsBucket *bolt.Bucket) error {
-	c := postsBucket.Cursor()
-	for tag, value := c.First(); tag != nil; tag, value = c.Next() {
-		if value != nil {
-			return errors.New("posting entry value should be nil")
-		}
-		postingBucket := postsBucket.Bucket(tag)
-		if postingBucket == nil {
-			return errors.New("posting bucket does not exist")
-		}
-		rawTime := postingBucket.Get([]byte(postTimeKey))
-		if rawTime == nil {
-			return errors.New("time not found")
+func (s *PandaStorage) load() error {
+	return s.db.ForEach(postingsBucket, nil, func(tag, value []byte) error {
+		if len(tag) != common.PandaTagLength {
+			return errors.New("invalid posting tag")
 		}
-		a := postingBucket.Get([]byte(postAKey))
-		if a == nil {
-			return errors.New("posting A not found")
-		}
-		b := postingBucket.Get([]byte(postBKey))
-		if b == nil {
-			return errors.New("posting B not found")
+		stored := new(storedPosting)
+		if err := cbor.Unmarshal(value, stored); err != nil {
+			return err
 		}
-		posting := PandaPosting{
+		posting := &PandaPosting{
 			Dirty:    false,
-			UnixTime: int64(binary.BigEndian.Uint64(rawTime)),
-			A:        a,
-			B:        b,
+			UnixTime: stored.UnixTime,
+			A:        stored.A,
+			B:        stored.B,
 		}
 		tagArray := [common.PandaTagLength]byte{}
 		copy(tagArray[:], tag)
 		s.postings.Store(tagArray, posting)
-	}
-	return nil
+		return nil
+	})
 }
 
 func (s *PandaStorage) worker() {
@@ -198,6 +204,8 @@ func (s *PandaStorage) worker() {
 
 func (s *PandaStorage) doFlush() error {
 	var err error
+	b := new(storage.Batch)
+	flushed := []*PandaPosting{}
 	postingsRange := func(rawTag, rawPosting interface{}) bool {
 		posting, ok := rawPosting.(*PandaPosting)
 		if !ok {
@@ -214,85 +222,55 @@ func (s *PandaStorage) doFlush() error {
 			err = errors.New("malformed tag")
 			return false
 		}
-		if err = s.db.Update(func(tx *bolt.Tx) error {
-			postsBucket := tx.Bucket([]byte(postsBucketName))
-			if postsBucket == nil {
-				return errors.New("posts bucket does not exist")
-			}
-			postingBucket, err := postsBucket.CreateBucketIfNotExists(tag[:])
-			if err != nil {
-				return err
-			}
-			rawTime := [8]byte{}
-			binary.BigEndian.PutUint64(rawTime[:], uint64(posting.UnixTime))
-			err = postingBucket.Put([]byte(postTimeKey), rawTime[:])
-			if err != nil {
-				return err
-			}
-			err = postingBucket.Put([]byte(postAKey), posting.A)
-			if err != nil {
-				return err
-			}
-			err = postingBucket.Put([]byte(postBKey), posting.B)
-			if err != nil {
-				return err
-			}
-			posting.Dirty = false
-			s.postings.Store(tag, posting)
-			return nil
-		}); err != nil {
+		var value []byte
+		value, err = cbor.Marshal(&storedPosting{
+			UnixTime: posting.UnixTime,
+			A:        posting.A,
+			B:        posting.B,
+		})
+		if err != nil {
 			return false
 		}
+		b.Put(postingsBucket, tag[:], value)
+		flushed = append(flushed, posting)
 		return true
 	}
 	s.postings.Range(postingsRange)
-	err = s.doPurge()
-	return err
+	if err != nil {
+		return err
+	}
+	if err = s.db.Write(b); err != nil {
+		return err
+	}
+	for _, posting := range flushed {
+		posting.Lock()
+		posting.Dirty = false
+		posting.Unlock()
+	}
+	return s.doPurge()
 }
 
 func (s *PandaStorage) doPurge() error {
-	var err error
-	if err = s.db.Update(func(tx *bolt.Tx) error {
-		postsBucket := tx.Bucket([]byte(postsBucketName))
-		if postsBucket == nil {
-			return errors.New("posts bucket does not exist")
-		}
-		c := postsBucket.Cursor()
-		for tag, value := c.First(); tag != nil; tag, value = c.Next() {
-			if value != nil {
-				return errors.New("posting entry value should be nil")
-			}
-			postingBucket := postsBucket.Bucket(tag)
-			if postingBucket == nil {
-				return errors.New("posting bucket does not exist")
-			}
-			tagArray := [common.PandaTagLength]byte{}
-			copy(tagArray[:], tag)
-			_, ok := s.postings.Load(tagArray)
-			if !ok {
-				err = postsBucket.DeleteBucket(tag)
-				if err != nil {
-					return err
-				}
-			}
+	b := new(storage.Batch)
+	err := s.db.ForEach(postingsBucket, nil, func(tag, value []byte) error {
+		tagArray := [common.PandaTagLength]byte{}
+		copy(tagArray[:], tag)
+		if _, ok := s.postings.Load(tagArray); !ok {
+			b.Delete(postingsBucket, append([]byte{}, tag...))
 		}
 		return nil
-	}); err != nil {
-		s.db.Close()
+	})
+	if err != nil {
 		return err
 	}
-	return nil
+	return s.db.Write(b)
 }
 
-// Shutdown stops the worker thread and sync the db.
+// Shutdown stops the worker thread and closes the db.
 func (s *PandaStorage) Shutdown() {
 	s.doFlush()
 	s.Halt()
-	err := s.db.Sync()
-	if err != nil {
-		panic(err)
-	}
-	err = s.db.Close()
+	err := s.db.Close()
 	if err != nil {
 		panic(err)
 	}
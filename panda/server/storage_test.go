@@ -17,13 +17,16 @@
 package server
 
 import (
+	"encoding/binary"
 	"os"
 	"testing"
 	"time"
 
 	"github.com/katzenpost/katzenpost/core/crypto/rand"
 	"github.com/katzenpost/katzenpost/panda/common"
+	"github.com/katzenpost/katzenpost/server/storage"
 	"github.com/stretchr/testify/assert"
+	bolt "go.etcd.io/bbolt"
 )
 
 func TestStorageBasics(t *testing.T) {
@@ -173,3 +176,69 @@ func TestStoragePurgeTags(t *testing.T) {
 	err = store.Put(tag1, posting1)
 	assert.NoError(err)
 }
+
+func TestStorageMigration(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	storeFile, err := os.CreateTemp("", "pandaStorageMigration")
+	assert.NoError(err)
+
+	// write a version 0 database
+	tag1 := &[common.PandaTagLength]byte{}
+	_, err = rand.Reader.Read(tag1[:])
+	assert.NoError(err)
+	now := time.Now().Unix()
+	db, err := bolt.Open(storeFile.Name(), 0600, nil)
+	assert.NoError(err)
+	err = db.Update(func(tx *bolt.Tx) error {
+		metaBucket, err := tx.CreateBucket([]byte(metadataBucket))
+		assert.NoError(err)
+		assert.NoError(metaBucket.Put([]byte(versionKey), []byte{0}))
+		postsBucket, err := tx.CreateBucket([]byte(legacyPostsBucket))
+		assert.NoError(err)
+		postingBucket, err := postsBucket.CreateBucket(tag1[:])
+		assert.NoError(err)
+		rawTime := [8]byte{}
+		binary.BigEndian.PutUint64(rawTime[:], uint64(now))
+		assert.NoError(postingBucket.Put([]byte(legacyPostTimeKey), rawTime[:]))
+		assert.NoError(postingBucket.Put([]byte(legacyPostAKey), []byte("A")))
+		return postingBucket.Put([]byte(legacyPostBKey), []byte("B"))
+	})
+	assert.NoError(err)
+	assert.NoError(db.Close())
+
+	store, err := NewPandaStorage(storeFile.Name(), time.Hour, time.Second*30)
+	assert.NoError(err)
+	posting, err := store.Get(tag1)
+	assert.NoError(err)
+	assert.Equal(now, posting.UnixTime)
+	assert.Equal([]byte("A"), posting.A)
+	assert.Equal([]byte("B"), posting.B)
+	store.Shutdown()
+}
+
+func TestStorageMem(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	storageCfg := &storage.Config{Backend: storage.BackendMem}
+	store, err := NewPandaStorageWithConfig(storageCfg, time.Hour, time.Second*30, nil)
+	assert.NoError(err)
+	tag1 := &[common.PandaTagLength]byte{}
+	posting1 := &PandaPosting{
+		UnixTime: time.Now().Unix(),
+		A:        []byte("A"),
+	}
+	assert.NoError(store.Put(tag1, posting1))
+	assert.NoError(store.doFlush())
+	stored, err := store.db.Get(postingsBucket, tag1[:])
+	assert.NoError(err)
+	assert.NotEmpty(stored)
+
+	store.postings.Delete(*tag1)
+	assert.NoError(store.doFlush())
+	_, err = store.db.Get(postingsBucket, tag1[:])
+	assert.Equal(storage.ErrNotFound, err)
+	store.Shutdown()
+}
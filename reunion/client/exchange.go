@@ -111,6 +111,9 @@ type Exchange struct {
 
 	// t1 hash -> beta
 	decryptedT1Betas map[ExchangeHash]*crypto.PublicKey
+
+	// cursor is the cursor of the last fetched state.
+	cursor uint64
 }
 
 // NewExchangeFromSnapshot creates a new Exchange given a snapshot blob.
@@ -229,6 +232,7 @@ func (e *Exchange) Unmarshal(data []byte) error {
 	e.repliedT2s = state.RepliedT2s
 	e.receivedT1Alphas = state.ReceivedT1Alphas
 	e.decryptedT1Betas = state.DecryptedT1Betas
+	e.cursor = state.Cursor
 	return nil
 }
 
@@ -248,6 +252,7 @@ func (e *Exchange) Marshal() ([]byte, error) {
 		RepliedT2s:       e.repliedT2s,
 		ReceivedT1Alphas: e.receivedT1Alphas,
 		DecryptedT1Betas: e.decryptedT1Betas,
+		Cursor:           e.cursor,
 	}
 	return ex.Marshal()
 }
@@ -312,31 +317,44 @@ func (e *Exchange) fetchState() error {
 	t1HashAr := [sha256.Size]byte{}
 	copy(t1HashAr[:], t1Hash)
 
-	fetchStateCmd := new(commands.FetchState)
-	fetchStateCmd.Epoch = e.session.Epoch()
-	fetchStateCmd.T1Hash = t1HashAr
+	// Fetch the state newer than our cursor, a page at a time.
+	for {
+		fetchStateCmd := new(commands.FetchState)
+		fetchStateCmd.Epoch = e.session.Epoch()
+		fetchStateCmd.T1Hash = t1HashAr
+		fetchStateCmd.Cursor = e.cursor
 
-	rawResponse, err := e.db.Query(fetchStateCmd)
-	if err != nil {
-		return err
-	}
-	response, ok := rawResponse.(*commands.StateResponse)
-	if !ok {
-		return errors.New("fetch state: wrong response command received")
-	}
-	if response.ErrorCode != commands.ResponseStatusOK {
-		return fmt.Errorf("fetch state: received an error status code from the reunion db: %d", response.ErrorCode)
-	}
-	state := new(server.RequestedReunionState)
-	err = state.Unmarshal(response.Payload)
-	if err != nil {
-		return err
-	}
-	if response.Truncated {
-		return errors.New("truncated Reunion DB state not yet supported")
+		rawResponse, err := e.db.Query(fetchStateCmd)
+		if err != nil {
+			return err
+		}
+		response, ok := rawResponse.(*commands.StateResponse)
+		if !ok {
+			return errors.New("fetch state: wrong response command received")
+		}
+		if response.ErrorCode != commands.ResponseStatusOK {
+			return fmt.Errorf("fetch state: received an error status code from the reunion db: %d", response.ErrorCode)
+		}
+		state := new(server.RequestedReunionState)
+		err = state.Unmarshal(response.Payload)
+		if err != nil {
+			return err
+		}
+		_, err = e.processState(state)
+		if err != nil {
+			return err
+		}
+		if state.Cursor <= e.cursor && response.Truncated {
+			return errors.New("fetch state: truncated state did not advance the cursor")
+		}
+		e.cursor = state.Cursor
+		if !response.Truncated {
+			return nil
+		}
+		if e.shouldStop() {
+			return ErrShutdown
+		}
 	}
-	_, err = e.processState(state)
-	return err
 }
 
 func (e *Exchange) sendT1() error {
@@ -412,6 +412,8 @@ func TestClientServerBasics4(t *testing.T) {
 	dblog := logBackend.GetLogger("Reunion_DB")
 	reunionDB, err := NewMockReunionDB(dblog, clock)
 	require.NoError(err)
+	// fetch the state a message at a time
+	reunionDB.server.SetMaxFetchSize(1)
 
 	srv := []byte{1, 2, 3}
 	passphrase1 := []byte("blah blah motorcycle pencil sharpening gas tank")
@@ -36,6 +36,7 @@ type serializableExchange struct {
 	RepliedT2s       map[ExchangeHash][]byte
 	ReceivedT1Alphas map[ExchangeHash]*crypto.PublicKey
 	DecryptedT1Betas map[ExchangeHash]*crypto.PublicKey
+	Cursor           uint64
 }
 
 func (s *serializableExchange) Unmarshal(data []byte) error {
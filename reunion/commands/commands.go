@@ -39,7 +39,8 @@ const (
 	ResponseInvalidCommand = 0xFF
 
 	cmdOverhead           = 1
-	fetchStateLength      = cmdOverhead + 8 + 32
+	fetchStateLength      = cmdOverhead + 8 + 32 + 8
+	fetchStateV0Length    = cmdOverhead + 8 + 32
 	stateResponseLength   = cmdOverhead + 1 + 1 + 4 + crypto.PayloadSize
 	sendT1Length          = cmdOverhead + 8 + crypto.Type1MessageSize
 	sendT2Length          = cmdOverhead + 8 + 32 + 32 + crypto.Type2MessageSize
@@ -68,6 +69,10 @@ type FetchState struct {
 
 	// T1Hash is the hash of the T1 message which is linked with a set of received messages.
 	T1Hash [sha256.Size]byte
+
+	// Cursor is the cursor of the last state received by the client,
+	// only state newer than which is fetched. Zero fetches the whole state.
+	Cursor uint64
 }
 
 // ToBytes serializes the SendT1 command and returns the resulting slice.
@@ -75,19 +80,24 @@ func (s *FetchState) ToBytes() []byte {
 	out := make([]byte, fetchStateLength)
 	out[0] = byte(fetchState)
 	binary.BigEndian.PutUint64(out[1:9], s.Epoch)
-	copy(out[9:], s.T1Hash[:])
+	copy(out[9:41], s.T1Hash[:])
+	binary.BigEndian.PutUint64(out[41:49], s.Cursor)
 	return out
 }
 
 func fetchStateFromBytes(b []byte) (Command, error) {
-	if len(b) != fetchStateLength {
+	// Commands without a cursor, sent by older clients, fetch the whole state.
+	if len(b) != fetchStateLength && len(b) != fetchStateV0Length {
 		return nil, errInvalidCommand
 	}
 	s := new(FetchState)
 	s.Epoch = binary.BigEndian.Uint64(b[1:9])
 	t1Hash := [sha256.Size]byte{}
-	copy(t1Hash[:], b[9:])
+	copy(t1Hash[:], b[9:41])
 	s.T1Hash = t1Hash
+	if len(b) == fetchStateLength {
+		s.Cursor = binary.BigEndian.Uint64(b[41:49])
+	}
 	return s, nil
 }
 
@@ -95,7 +105,8 @@ func fetchStateFromBytes(b []byte) (Command, error) {
 type StateResponse struct {
 	// ErrorCode indicates a specific error or status OK.
 	ErrorCode uint8
-	// Truncated indicates if the payload was truncated or not.
+	// Truncated indicates if the payload was truncated or not, in which
+	// case the rest of the state is fetched with the cursor of the payload.
 	Truncated bool
 	// LeftOverChunksHint is the number of left over chunks if
 	// the payload is truncated.
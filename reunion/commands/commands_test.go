@@ -38,6 +38,7 @@ func TestFetchStateCommand(t *testing.T) {
 	cmd.Epoch = 1234
 	cmd.T1Hash = [sha256.Size]byte{}
 	fillRand(require, cmd.T1Hash[:])
+	cmd.Cursor = 5678
 
 	b := cmd.ToBytes()
 	require.Equal(len(b), fetchStateLength)
@@ -48,6 +49,14 @@ func TestFetchStateCommand(t *testing.T) {
 	cmd2 := c.(*FetchState)
 	require.Equal(cmd.Epoch, cmd2.Epoch)
 	require.Equal(cmd.T1Hash[:], cmd2.T1Hash[:])
+	require.Equal(cmd.Cursor, cmd2.Cursor)
+
+	// commands without a cursor fetch the whole state
+	c, err = FromBytes(b[:fetchStateV0Length])
+	require.NoError(err)
+	cmd2 = c.(*FetchState)
+	require.Equal(cmd.T1Hash[:], cmd2.T1Hash[:])
+	require.Equal(uint64(0), cmd2.Cursor)
 }
 
 func TestStateResponseCommand(t *testing.T) {
@@ -19,8 +19,9 @@ package server
 
 import (
 	"errors"
+	"fmt"
+	"os"
 	"sync"
-	"sync/atomic"
 	"time"
 
 	"github.com/katzenpost/katzenpost/core/log"
@@ -28,160 +29,172 @@ import (
 	"github.com/katzenpost/katzenpost/reunion/commands"
 	"github.com/katzenpost/katzenpost/reunion/epochtime"
 	"github.com/katzenpost/katzenpost/server/cborplugin"
+	"github.com/katzenpost/katzenpost/server/storage"
+	bolt "go.etcd.io/bbolt"
 	"gopkg.in/op/go-logging.v1"
 )
 
 // Tune me.
 const (
-	writeBackInterval = 10 * time.Second
-	epochGracePeriod  = 3 * time.Minute
+	epochGracePeriod = 3 * time.Minute
 )
 
+// storageNamespace is the namespace of the state in a shared SQL database.
+const storageNamespace = "reunion"
+
 // Server is a reunion server.
 type Server struct {
 	sync.RWMutex
 	worker.Worker
 
-	stateFilePath string
-	states        *ReunionStates
-	nDirtyEntries uint64
-	epochClock    epochtime.EpochClock
-	log           *logging.Logger
-	logBackend    *log.Backend
+	db           storage.Storage
+	states       *ReunionStates
+	epochClock   epochtime.EpochClock
+	maxFetchSize int
+	log          *logging.Logger
+	logBackend   *log.Backend
+}
+
+// IsStatefile returns true if the file at stateFilePath is a CBOR state
+// file written by earlier versions of the server rather than a bolt
+// database, which NewServerFromStatefile migrates.
+func IsStatefile(stateFilePath string) (bool, error) {
+	info, err := os.Stat(stateFilePath)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if info.Size() == 0 {
+		// An empty file is made into a new bolt database.
+		return false, nil
+	}
+	db, err := bolt.Open(stateFilePath, 0600, &bolt.Options{ReadOnly: true, Timeout: time.Second})
+	switch err {
+	case nil:
+		return false, db.Close()
+	case bolt.ErrInvalid, bolt.ErrVersionMismatch, bolt.ErrChecksum:
+		return true, nil
+	default:
+		return false, err
+	}
 }
 
-// NewServerFromStatefile loads the state from a file.
+// NewServerFromStatefile loads the state from a CBOR state file written by
+// earlier versions of the server. Once the state file is read, it is moved
+// aside and the state is migrated to a bolt database at stateFilePath. If
+// the migration fails, the state file is moved back.
 func NewServerFromStatefile(epochClock epochtime.EpochClock, stateFilePath, logPath, logLevel string) (*Server, error) {
-	logBackend, err := log.New(logPath, logLevel, false)
+	ss, err := readStateFile(stateFilePath)
 	if err != nil {
 		return nil, err
 	}
-	s := &Server{
-		stateFilePath: stateFilePath,
-		states:        NewReunionStates(),
-		nDirtyEntries: 0,
-		epochClock:    epochClock,
-		logBackend:    logBackend,
-		log:           logBackend.GetLogger("reunion_server_core"),
+	legacyPath := stateFilePath + ".legacy"
+	if err := os.Rename(stateFilePath, legacyPath); err != nil {
+		return nil, err
+	}
+	s, err := NewServer(epochClock, stateFilePath, logPath, logLevel)
+	if err == nil {
+		if err = s.states.load(ss); err == nil {
+			err = s.states.GarbageCollectOldEpochs(epochClock)
+		}
+		if err != nil {
+			s.Shutdown()
+		}
 	}
-	err = s.states.LoadFromFile(stateFilePath)
 	if err != nil {
+		os.Remove(stateFilePath)
+		if rErr := os.Rename(legacyPath, stateFilePath); rErr != nil {
+			return nil, fmt.Errorf("%v, and failed to restore the state file: %v", err, rErr)
+		}
 		return nil, err
 	}
-	s.states.MaybeAddEpochs(s.epochClock)
-	s.states.GarbageCollectOldEpochs(epochClock)
-	s.Go(s.worker)
 	return s, nil
 }
 
-// NewServer returns a new Server with a new ReunionState.
+// NewServer returns a new Server which keeps its state
+// in a bolt database at stateFilePath.
 func NewServer(epochClock epochtime.EpochClock, stateFilePath, logPath, logLevel string) (*Server, error) {
+	storageCfg := &storage.Config{
+		Backend: storage.BackendBolt,
+		Path:    stateFilePath,
+	}
+	return NewServerWithStorage(epochClock, storageCfg, logPath, logLevel)
+}
+
+// NewServerWithStorage returns a new Server which keeps its state in the
+// storage of the given storage.Config.
+func NewServerWithStorage(epochClock epochtime.EpochClock, storageCfg *storage.Config, logPath, logLevel string) (*Server, error) {
 	logBackend, err := log.New(logPath, logLevel, false)
 	if err != nil {
 		return nil, err
 	}
+	sCfg := *storageCfg
+	sCfg.Namespace = storageNamespace
+	db, err := storage.New(&sCfg, logBackend.GetLogger("reunion_storage"))
+	if err != nil {
+		return nil, err
+	}
 	s := &Server{
-		stateFilePath: stateFilePath,
-		states:        NewReunionStates(),
-		nDirtyEntries: 0,
-		epochClock:    epochClock,
-		logBackend:    logBackend,
-		log:           logBackend.GetLogger("reunion_server_core"),
+		db:         db,
+		states:     NewReunionStates(db),
+		epochClock: epochClock,
+		logBackend: logBackend,
+		log:        logBackend.GetLogger("reunion_server_core"),
+	}
+	if err = s.states.MaybeAddEpochs(s.epochClock); err == nil {
+		err = s.states.GarbageCollectOldEpochs(s.epochClock)
+	}
+	if err != nil {
+		db.Close()
+		return nil, err
 	}
-	s.states.MaybeAddEpochs(s.epochClock)
 	s.Go(s.worker)
 	return s, nil
 }
 
+// SetMaxFetchSize sets the approximate maximum size of the messages in a
+// StateResponse, beyond which the state is truncated and fetched in pages.
+// Zero, the default, is unlimited.
+func (s *Server) SetMaxFetchSize(maxFetchSize int) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.maxFetchSize = maxFetchSize
+}
+
 // GetNewLogger returns a logger for the given subsystem name.
 func (s *Server) GetNewLogger(name string) *logging.Logger {
 	return s.logBackend.GetLogger(name)
 }
 
-func (s *Server) incrementDirtyEntryCount() {
-	atomic.AddUint64(&s.nDirtyEntries, 1)
-}
-
 func (s *Server) fetchState(fetchCmd *commands.FetchState) (*commands.StateResponse, error) {
-	state, err := s.states.GetStateFromEpoch(fetchCmd.Epoch)
+	s.RLock()
+	maxFetchSize := s.maxFetchSize
+	s.RUnlock()
+	requested, truncated, err := s.states.FetchState(fetchCmd.Epoch, &fetchCmd.T1Hash, fetchCmd.Cursor, maxFetchSize)
 	if err != nil {
 		return nil, err
 	}
-	messages, ok := state.messageMap.Load(fetchCmd.T1Hash)
-	if !ok {
-		return nil, errors.New("invalid message map value")
-	}
-	messageList, ok := messages.(*LockedList)
-	if !ok {
-		return nil, errors.New("invalid message list")
-	}
-	t2t3messages, err := messageList.Serializable()
-	if err != nil {
-		return nil, err
-	}
-	t1Map, err := state.SerializableT1Map()
-	if err != nil {
-		return nil, err
-	}
-	requested := &RequestedReunionState{
-		T1Map:    t1Map,
-		Messages: t2t3messages,
-	}
 	serialized, err := requested.Marshal()
 	if err != nil {
 		return nil, err
 	}
 	response := &commands.StateResponse{
 		ErrorCode:          commands.ResponseStatusOK,
-		Truncated:          false,
+		Truncated:          truncated,
 		LeftOverChunksHint: 0,
 		Payload:            serialized,
 	}
 	return response, nil
 }
 
-func (s *Server) sendT1(sendT1 *commands.SendT1) (*commands.MessageResponse, error) {
-	state, err := s.states.GetStateFromEpoch(sendT1.Epoch)
-	if err != nil {
-		return nil, err
-	}
-	err = state.AppendMessage(sendT1)
-	if err != nil {
-		return nil, err
-	}
-	s.incrementDirtyEntryCount()
-	response := &commands.MessageResponse{
-		ErrorCode: commands.ResponseStatusOK,
-	}
-	return response, nil
-}
-
-func (s *Server) sendT2(sendT2 *commands.SendT2) (*commands.MessageResponse, error) {
-	state, err := s.states.GetStateFromEpoch(sendT2.Epoch)
-	if err != nil {
-		return nil, err
-	}
-	err = state.AppendMessage(sendT2)
-	if err != nil {
-		return nil, err
-	}
-	s.incrementDirtyEntryCount()
-	response := &commands.MessageResponse{
-		ErrorCode: commands.ResponseStatusOK,
-	}
-	return response, nil
-}
-
-func (s *Server) sendT3(sendT3 *commands.SendT3) (*commands.MessageResponse, error) {
-	state, err := s.states.GetStateFromEpoch(sendT3.Epoch)
+func (s *Server) sendMessage(message commands.Command) (*commands.MessageResponse, error) {
+	err := s.states.AppendMessage(message)
 	if err != nil {
 		return nil, err
 	}
-	err = state.AppendMessage(sendT3)
-	if err != nil {
-		return nil, err
-	}
-	s.incrementDirtyEntryCount()
 	response := &commands.MessageResponse{
 		ErrorCode: commands.ResponseStatusOK,
 	}
@@ -233,19 +246,19 @@ func (s *Server) ProcessQuery(command commands.Command) (commands.Command, error
 		}
 	case *commands.SendT1:
 		s.log.Debug("send t1")
-		response, err = s.sendT1(cmd)
+		response, err = s.sendMessage(cmd)
 		if err != nil {
 			return nil, err
 		}
 	case *commands.SendT2:
 		s.log.Debug("send t2")
-		response, err = s.sendT2(cmd)
+		response, err = s.sendMessage(cmd)
 		if err != nil {
 			return nil, err
 		}
 	case *commands.SendT3:
 		s.log.Debug("send t3")
-		response, err = s.sendT3(cmd)
+		response, err = s.sendMessage(cmd)
 		if err != nil {
 			return nil, err
 		}
@@ -256,46 +269,32 @@ func (s *Server) ProcessQuery(command commands.Command) (commands.Command, error
 	return response, nil
 }
 
-func (s *Server) doFlush() error {
-	return s.states.AtomicWriteToFile(s.stateFilePath)
-}
-
-func (s *Server) maybeFlush() {
-	nEntries := atomic.LoadUint64(&s.nDirtyEntries)
-	if nEntries == 0 {
-		return
-	}
-	err := s.doFlush()
-	if err != nil {
-		panic("flush to disk failure, aborting...") // XXX should we panic here or what?
-	}
-	atomic.StoreUint64(&s.nDirtyEntries, 0)
+// Shutdown stops the server and closes the storage.
+func (s *Server) Shutdown() {
+	s.Halt()
+	s.db.Close()
 }
 
 func (s *Server) worker() {
-	defer s.doFlush()
-
-	flushTicker := time.NewTicker(writeBackInterval)
-	defer flushTicker.Stop()
-
 	gcTicker := time.NewTicker(s.epochClock.Period() / 2)
 	defer gcTicker.Stop()
 
 	newEpochTicker := time.NewTicker(s.epochClock.Period() / 8)
-	defer flushTicker.Stop()
+	defer newEpochTicker.Stop()
 
 	for {
 		select {
 		case <-s.HaltCh():
 			return
-		case <-flushTicker.C:
-			s.maybeFlush()
-			continue
 		case <-gcTicker.C:
-			s.states.GarbageCollectOldEpochs(s.epochClock)
+			if err := s.states.GarbageCollectOldEpochs(s.epochClock); err != nil {
+				s.log.Errorf("failed to garbage collect old epochs: %s", err)
+			}
 			continue
 		case <-newEpochTicker.C:
-			s.states.MaybeAddEpochs(s.epochClock)
+			if err := s.states.MaybeAddEpochs(s.epochClock); err != nil {
+				s.log.Errorf("failed to add epochs: %s", err)
+			}
 			continue
 		}
 	}
@@ -17,11 +17,14 @@
 package server
 
 import (
+	"crypto/sha256"
 	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/katzenpost/katzenpost/reunion/commands"
 	"github.com/katzenpost/katzenpost/reunion/epochtime/katzenpost"
+	"github.com/katzenpost/katzenpost/server/storage"
 	"github.com/stretchr/testify/require"
 )
 
@@ -48,3 +51,106 @@ func TestServer(t *testing.T) {
 
 	// XXX ...
 }
+
+func TestServerWithStorage(t *testing.T) {
+	require := require.New(t)
+
+	clock := new(katzenpost.Clock)
+	epoch, _, _ := clock.Now()
+	storageCfg := &storage.Config{
+		Backend: storage.BackendBolt,
+		Path:    filepath.Join(t.TempDir(), "reunion.db"),
+	}
+	server, err := NewServerWithStorage(clock, storageCfg, "", "DEBUG")
+	require.NoError(err)
+
+	sendt1 := commands.SendT1{
+		Epoch:   epoch,
+		Payload: []byte{0xDE, 0xAD, 0xBE, 0xEF},
+	}
+	_, err = server.ProcessQuery(&sendt1)
+	require.NoError(err)
+	server.Shutdown()
+
+	// the state is loaded from the storage
+	server, err = NewServerWithStorage(clock, storageCfg, "", "DEBUG")
+	require.NoError(err)
+	defer server.Shutdown()
+	reply, err := server.ProcessQuery(&commands.FetchState{
+		Epoch:  epoch,
+		T1Hash: sha256.Sum256(sendt1.Payload),
+	})
+	require.NoError(err)
+	stateResponse, ok := reply.(*commands.StateResponse)
+	require.True(ok)
+	state := new(RequestedReunionState)
+	require.NoError(state.Unmarshal(stateResponse.Payload))
+	require.Len(state.T1Map, 1)
+}
+
+func TestServerFromStatefile(t *testing.T) {
+	require := require.New(t)
+
+	clock := new(katzenpost.Clock)
+	epoch, _, _ := clock.Now()
+	dir := t.TempDir()
+	stateFile := filepath.Join(dir, "statefile")
+
+	// a state file which fails to load is left in place
+	require.NoError(os.WriteFile(stateFile, []byte("not a state file"), 0600))
+	isStatefile, err := IsStatefile(stateFile)
+	require.NoError(err)
+	require.True(isStatefile)
+	_, err = NewServerFromStatefile(clock, stateFile, "", "DEBUG")
+	require.Error(err)
+	_, err = os.Stat(stateFile + ".legacy")
+	require.True(os.IsNotExist(err))
+
+	// a valid state file is migrated and moved aside
+	state := NewReunionState()
+	t1 := &commands.SendT1{
+		Epoch:   epoch,
+		Payload: []byte{0xDE, 0xAD, 0xBE, 0xEF},
+	}
+	require.NoError(state.AppendMessage(t1))
+	serializable, err := state.Serializable()
+	require.NoError(err)
+	legacy := &SerializableReunionStates{
+		States: map[uint64]*SerializableReunionState{epoch: serializable},
+	}
+	rawLegacy, err := legacy.Marshal()
+	require.NoError(err)
+	require.NoError(os.WriteFile(stateFile, rawLegacy, 0600))
+	isStatefile, err = IsStatefile(stateFile)
+	require.NoError(err)
+	require.True(isStatefile)
+	server, err := NewServerFromStatefile(clock, stateFile, "", "DEBUG")
+	require.NoError(err)
+	server.Shutdown()
+	rawMoved, err := os.ReadFile(stateFile + ".legacy")
+	require.NoError(err)
+	require.Equal(rawLegacy, rawMoved)
+
+	// the bolt database is not migrated again
+	isStatefile, err = IsStatefile(stateFile)
+	require.NoError(err)
+	require.False(isStatefile)
+	server, err = NewServer(clock, stateFile, "", "DEBUG")
+	require.NoError(err)
+	defer server.Shutdown()
+	reply, err := server.ProcessQuery(&commands.FetchState{
+		Epoch:  epoch,
+		T1Hash: sha256.Sum256(t1.Payload),
+	})
+	require.NoError(err)
+	stateResponse, ok := reply.(*commands.StateResponse)
+	require.True(ok)
+	requested := new(RequestedReunionState)
+	require.NoError(requested.Unmarshal(stateResponse.Payload))
+	require.Len(requested.T1Map, 1)
+
+	// there is no state file to migrate without a file
+	isStatefile, err = IsStatefile(filepath.Join(dir, "missing"))
+	require.NoError(err)
+	require.False(isStatefile)
+}
@@ -20,16 +20,33 @@ package server
 import (
 	"container/list"
 	"crypto/sha256"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"github.com/fxamacker/cbor/v2"
 	"os"
+	"sort"
 	"sync"
 
 	"github.com/katzenpost/katzenpost/reunion/commands"
 	"github.com/katzenpost/katzenpost/reunion/epochtime"
+	"github.com/katzenpost/katzenpost/server/storage"
 )
 
+// The storage buckets of the Reunion state. The messages of each epoch
+// are numbered in the order they are received. T1 messages are keyed by
+// epoch and sequence number, and T2 and T3 messages by epoch, destination
+// T1 hash and sequence number. The hash buckets index them by hash.
+const (
+	epochsBucket        = "epochs" // epoch -> last sequence number
+	t1Bucket            = "t1"
+	t1HashesBucket      = "t1_hashes"
+	messagesBucket      = "messages"
+	messageHashesBucket = "message_hashes"
+)
+
+var errStopIteration = errors.New("stop iteration")
+
 // ReunionDatabase is an interface which represents the
 // Reunion DB that protocol clients interact with.
 type ReunionDatabase interface {
@@ -166,6 +183,10 @@ type RequestedReunionState struct {
 
 	// Messages is a slice of *T2T3Message.
 	Messages []*T2T3Message
+
+	// Cursor is the cursor of this state, which is sent in the FetchState
+	// command to fetch only newer state.
+	Cursor uint64
 }
 
 // Marshal returns a CBOR serialization of the state.
@@ -199,10 +220,10 @@ func (s *SerializableReunionState) Marshal() ([]byte, error) {
 	return cbor.Marshal(s)
 }
 
-// SerializableReunionStates represents the serializable
-// form of the ReunionStates type.
+// SerializableReunionStates represents the state file
+// written by earlier versions of the server.
 type SerializableReunionStates struct {
-	states map[uint64]*ReunionState
+	States map[uint64]*SerializableReunionState
 }
 
 // Unmarshal deserializes the state CBOR blob.
@@ -215,73 +236,92 @@ func (s *SerializableReunionStates) Marshal() ([]byte, error) {
 	return cbor.Marshal(s)
 }
 
-// ReunionStates is a type encapsulating sync.Map of uint64 -> *ReunionState.
+// ReunionStates is the multi-epoch state of the Reunion DB, kept in a
+// storage.Storage. Each T1, T2 and T3 message is stored as it is received,
+// so that epochs can be garbage collected individually and the state is
+// never held in memory as a whole.
 type ReunionStates struct {
-	states *sync.Map // uint64 -> *ReunionState
+	// Mutex serializes appends, which allocate sequence numbers.
+	sync.Mutex
+
+	db storage.Storage
 }
 
-// NewReunionStates creates a new ReunionStates.
-func NewReunionStates() *ReunionStates {
-	s := &ReunionStates{
-		states: new(sync.Map),
+// NewReunionStates creates a new ReunionStates kept in the given storage.
+func NewReunionStates(db storage.Storage) *ReunionStates {
+	return &ReunionStates{
+		db: db,
 	}
-	return s
 }
 
-// Marshal returns a CBOR serialization of the state.
-func (s *ReunionStates) Unmarshal(data []byte) error {
-	ss := new(SerializableReunionStates)
-	ss.states = make(map[uint64]*ReunionState)
-	err := cbor.Unmarshal(data, ss)
-	if err != nil {
-		return err
+func uint64Bytes(v uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+	return b
+}
+
+func epochKey(epoch uint64) []byte {
+	return uint64Bytes(epoch)
+}
+
+func messagesPrefix(epoch uint64, dstT1Hash *[sha256.Size]byte) []byte {
+	return append(epochKey(epoch), dstT1Hash[:]...)
+}
+
+func (s *ReunionStates) addEpoch(epoch uint64) error {
+	s.Lock()
+	defer s.Unlock()
+
+	_, err := s.db.Get(epochsBucket, epochKey(epoch))
+	if err == storage.ErrNotFound {
+		return s.db.Put(epochsBucket, epochKey(epoch), uint64Bytes(0))
 	}
-	for k, v := range ss.states {
-		s.states.Store(k, v)
+	return err
+}
+
+// lastSequence returns the sequence number of the last message of the
+// epoch.  As it is written along with the message, every message up to it
+// is stored.
+func (s *ReunionStates) lastSequence(epoch uint64) (uint64, error) {
+	rawSeq, err := s.db.Get(epochsBucket, epochKey(epoch))
+	switch {
+	case err == storage.ErrNotFound:
+		return 0, fmt.Errorf("epoch %d not found", epoch)
+	case err != nil:
+		return 0, err
+	case len(rawSeq) != 8:
+		return 0, errors.New("invalid epoch sequence number")
 	}
-	return nil
+	return binary.BigEndian.Uint64(rawSeq), nil
 }
 
-// Marshal returns a CBOR serialization of the state.
-func (s *ReunionStates) Marshal() ([]byte, error) {
-	ss := new(SerializableReunionStates)
-	ss.states = make(map[uint64]*ReunionState)
-	var err error
-	s.states.Range(func(k, v interface{}) bool {
-		key, ok := k.(uint64)
-		if !ok {
-			err = errors.New("invalid sync.Map entry")
-			return false
-		}
-		value, ok := v.(*ReunionState)
-		if !ok {
-			err = errors.New("invalid sync.Map entry")
-			return false
-		}
-		ss.states[key] = value
-		return true
-	})
+// nextSequence returns the sequence number of the next message of the
+// epoch, and must be called with the lock held.
+func (s *ReunionStates) nextSequence(epoch uint64) (uint64, error) {
+	seq, err := s.lastSequence(epoch)
 	if err != nil {
-		return nil, err
+		return 0, err
 	}
-	return cbor.Marshal(ss)
+	return seq + 1, nil
 }
 
-// MaybeAddEpochs adds sync.Map entries for the currenlty valid epochs.
-func (s *ReunionStates) MaybeAddEpochs(epochClock epochtime.EpochClock) {
+// MaybeAddEpochs adds the currently valid epochs.
+func (s *ReunionStates) MaybeAddEpochs(epochClock epochtime.EpochClock) error {
 	epoch, elapsed, till := epochClock.Now()
-	_, _ = s.states.LoadOrStore(epoch, NewReunionState())
+	if err := s.addEpoch(epoch); err != nil {
+		return err
+	}
 	if till <= epochGracePeriod {
-		_, _ = s.states.LoadOrStore(epoch-1, NewReunionState())
-	} else {
-		if elapsed <= epochGracePeriod {
-			_, _ = s.states.LoadOrStore(epoch+1, NewReunionState())
-		}
+		return s.addEpoch(epoch - 1)
 	}
+	if elapsed <= epochGracePeriod {
+		return s.addEpoch(epoch + 1)
+	}
+	return nil
 }
 
-// GarbageCollectOldEpochs remove old epochs from our epochs sync.Map.
-func (s *ReunionStates) GarbageCollectOldEpochs(epochClock epochtime.EpochClock) {
+// GarbageCollectOldEpochs removes the messages of old epochs.
+func (s *ReunionStates) GarbageCollectOldEpochs(epochClock epochtime.EpochClock) error {
 	epoch, elapsed, till := epochClock.Now()
 	validEpochs := make(map[uint64]bool)
 	validEpochs[epoch] = true
@@ -292,69 +332,89 @@ func (s *ReunionStates) GarbageCollectOldEpochs(epochClock epochtime.EpochClock)
 			validEpochs[epoch+1] = true
 		}
 	}
-	s.states.Range(func(key, value interface{}) bool {
-		k, ok := key.(uint64)
-		if !ok {
-			panic("impossible error")
+	oldEpochs := []uint64{}
+	err := s.db.ForEach(epochsBucket, nil, func(k, v []byte) error {
+		if len(k) != 8 {
+			return errors.New("invalid epoch key")
 		}
-		if _, ok := validEpochs[k]; !ok {
-			s.states.Delete(k)
+		if e := binary.BigEndian.Uint64(k); !validEpochs[e] {
+			oldEpochs = append(oldEpochs, e)
 		}
-		return true
+		return nil
 	})
-}
-
-// LoadFromFile loads a ReunionStates from then given file
-// if it exists.
-func (s *ReunionStates) LoadFromFile(filePath string) error {
-	inBytes, err := os.ReadFile(filePath)
 	if err != nil {
 		return err
 	}
-	return s.Unmarshal(inBytes)
+	for _, e := range oldEpochs {
+		if err := s.deleteEpoch(e); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-// AtomicWriteToFile atomically writes our state to the file.
-func (s *ReunionStates) AtomicWriteToFile(filePath string) error {
-	out, err := os.OpenFile(filePath+".tmp", os.O_TRUNC|os.O_CREATE|os.O_WRONLY, 0600)
-	if err != nil {
-		return err
+func (s *ReunionStates) deleteEpoch(epoch uint64) error {
+	b := new(storage.Batch)
+	prefix := epochKey(epoch)
+	for _, bucket := range []string{t1Bucket, t1HashesBucket, messagesBucket, messageHashesBucket} {
+		bucket := bucket
+		err := s.db.ForEach(bucket, prefix, func(k, v []byte) error {
+			b.Delete(bucket, append([]byte{}, k...))
+			return nil
+		})
+		if err != nil {
+			return err
+		}
 	}
-	outBytes, err := s.Marshal()
+	b.Delete(epochsBucket, prefix)
+	return s.db.Write(b)
+}
+
+// LoadFromFile loads the state from a CBOR state file written by
+// earlier versions of the server.
+func (s *ReunionStates) LoadFromFile(filePath string) error {
+	ss, err := readStateFile(filePath)
 	if err != nil {
 		return err
 	}
-	_, err = out.Write(outBytes)
+	return s.load(ss)
+}
+
+// readStateFile reads a CBOR state file written by earlier versions of
+// the server.
+func readStateFile(filePath string) (*SerializableReunionStates, error) {
+	inBytes, err := os.ReadFile(filePath)
 	if err != nil {
-		return err
-	}
-	if err := os.Remove(filePath + "~"); err != nil && !os.IsNotExist(err) {
-		return err
-	}
-	if err := os.Rename(filePath, filePath+"~"); err != nil && !os.IsNotExist(err) {
-		return err
-	}
-	if err := os.Rename(filePath+".tmp", filePath); err != nil {
-		return err
+		return nil, err
 	}
-	if err := os.Remove(filePath + "~"); err != nil && !os.IsNotExist(err) {
-		return err
+	ss := new(SerializableReunionStates)
+	if err := ss.Unmarshal(inBytes); err != nil {
+		return nil, err
 	}
-	return nil
+	return ss, nil
 }
 
-// GetStateFromEpoch returns a state given an epoch if such an entry
-// if found in the sync.Map.
-func (s *ReunionStates) GetStateFromEpoch(epoch uint64) (*ReunionState, error) {
-	rawState, ok := s.states.Load(epoch)
-	if !ok {
-		return nil, fmt.Errorf("epoch %d not found in state map", epoch)
-	}
-	state, ok := rawState.(*ReunionState)
-	if !ok {
-		return nil, errors.New("Bug, invalid state found in epochs sync.Map")
+// load stores the messages of the serialized state.
+func (s *ReunionStates) load(ss *SerializableReunionStates) error {
+	for epoch, state := range ss.States {
+		if err := s.addEpoch(epoch); err != nil {
+			return err
+		}
+		for _, t1 := range state.T1Map {
+			if err := s.appendT1(epoch, t1); err != nil {
+				return err
+			}
+		}
+		for dstT1Hash, messages := range state.MessageMap {
+			dstT1Hash := dstT1Hash
+			for _, message := range messages {
+				if err := s.appendT2T3(epoch, &dstT1Hash, message); err != nil {
+					return err
+				}
+			}
+		}
 	}
-	return state, nil
+	return nil
 }
 
 // AppendMessage receives a message which can be one of these types:
@@ -362,26 +422,189 @@ func (s *ReunionStates) GetStateFromEpoch(epoch uint64) (*ReunionState, error) {
 // *commands.SendT2
 // *commands.SendT3
 func (s *ReunionStates) AppendMessage(message commands.Command) error {
-	var epoch uint64
 	switch mesg := message.(type) {
 	case *commands.SendT1:
-		epoch = mesg.Epoch
+		return s.appendT1(mesg.Epoch, mesg.Payload)
 	case *commands.SendT2:
-		epoch = mesg.Epoch
+		return s.appendT2T3(mesg.Epoch, &mesg.DstT1Hash, &T2T3Message{
+			SrcT1Hash: mesg.SrcT1Hash,
+			T2Payload: mesg.Payload,
+		})
 	case *commands.SendT3:
-		epoch = mesg.Epoch
+		return s.appendT2T3(mesg.Epoch, &mesg.DstT1Hash, &T2T3Message{
+			SrcT1Hash: mesg.SrcT1Hash,
+			T3Payload: mesg.Payload,
+		})
 	default:
-		return errors.New("ReunionStates.AppendMessage failued: unknown message type")
+		return errors.New("ReunionStates.AppendMessage failure: unknown message type")
 	}
-	rawState, ok := s.states.Load(epoch)
-	if ok {
-		state, ok := rawState.(*ReunionState)
-		if !ok {
-			return errors.New("Bug, invalid state found in epochs sync.Map")
+}
+
+func (s *ReunionStates) appendT1(epoch uint64, t1 []byte) error {
+	s.Lock()
+	defer s.Unlock()
+
+	seq, err := s.nextSequence(epoch)
+	if err != nil {
+		return err
+	}
+	t1Hash := sha256.Sum256(t1)
+	hashKey := append(epochKey(epoch), t1Hash[:]...)
+	_, err = s.db.Get(t1HashesBucket, hashKey)
+	switch err {
+	case nil:
+		return errors.New("cannot append T1, already present")
+	case storage.ErrNotFound:
+	default:
+		return err
+	}
+	b := new(storage.Batch)
+	b.Put(epochsBucket, epochKey(epoch), uint64Bytes(seq))
+	b.Put(t1Bucket, append(epochKey(epoch), uint64Bytes(seq)...), t1)
+	b.Put(t1HashesBucket, hashKey, uint64Bytes(seq))
+	return s.db.Write(b)
+}
+
+func (s *ReunionStates) appendT2T3(epoch uint64, dstT1Hash *[sha256.Size]byte, message *T2T3Message) error {
+	s.Lock()
+	defer s.Unlock()
+
+	seq, err := s.nextSequence(epoch)
+	if err != nil {
+		return err
+	}
+	value, err := cbor.Marshal(message)
+	if err != nil {
+		return err
+	}
+	h := sha256.New()
+	h.Write(dstT1Hash[:])
+	h.Write(value)
+	hashKey := append(epochKey(epoch), h.Sum(nil)...)
+	_, err = s.db.Get(messageHashesBucket, hashKey)
+	switch err {
+	case nil:
+		// already present
+		return nil
+	case storage.ErrNotFound:
+	default:
+		return err
+	}
+	b := new(storage.Batch)
+	b.Put(epochsBucket, epochKey(epoch), uint64Bytes(seq))
+	b.Put(messagesBucket, append(messagesPrefix(epoch, dstT1Hash), uint64Bytes(seq)...), value)
+	b.Put(messageHashesBucket, hashKey, uint64Bytes(seq))
+	return s.db.Write(b)
+}
+
+// fetchEntry is a T1 message or a T2 or T3 message in a fetched state.
+type fetchEntry struct {
+	seq     uint64
+	t1      []byte
+	message *T2T3Message
+	size    int
+}
+
+// fetchEntries returns the entries of the bucket under the prefix which
+// are newer than cursor and not newer than last, in order, up to at least
+// maxSize bytes, and whether there are more of them.
+func (s *ReunionStates) fetchEntries(bucket string, prefix []byte, cursor, last uint64, maxSize int, decode func(v []byte) (*fetchEntry, error)) ([]*fetchEntry, bool, error) {
+	entries := []*fetchEntry{}
+	size := 0
+	more := false
+	if cursor >= last {
+		return entries, false, nil
+	}
+	// start at the first entry newer than cursor
+	start := append(append([]byte{}, prefix...), uint64Bytes(cursor+1)...)
+	err := s.db.ForEachFrom(bucket, prefix, start, func(k, v []byte) error {
+		seq := binary.BigEndian.Uint64(k[len(prefix):])
+		if seq > last {
+			return errStopIteration
+		}
+		if maxSize > 0 && size >= maxSize {
+			more = true
+			return errStopIteration
+		}
+		entry, err := decode(v)
+		if err != nil {
+			return err
+		}
+		entry.seq = seq
+		size += entry.size
+		entries = append(entries, entry)
+		return nil
+	})
+	if err != nil && err != errStopIteration {
+		return nil, false, err
+	}
+	return entries, more, nil
+}
+
+// FetchState returns the T1 messages of the given epoch and the T2 and T3
+// messages sent to the given T1 hash which are newer than cursor, up to
+// approximately maxSize bytes of messages unless maxSize is zero. It also
+// returns whether the state was truncated, in which case the rest of it is
+// fetched with the cursor of the returned state. Only the returned state
+// is read into memory.
+func (s *ReunionStates) FetchState(epoch uint64, t1Hash *[sha256.Size]byte, cursor uint64, maxSize int) (*RequestedReunionState, bool, error) {
+	// Only the messages stored before the state is fetched are returned,
+	// lest a message stored between the reads of the T1 messages and the
+	// T2 and T3 messages be older than the returned cursor, but not
+	// returned.
+	last, err := s.lastSequence(epoch)
+	if err != nil {
+		return nil, false, err
+	}
+	t1s, moreT1s, err := s.fetchEntries(t1Bucket, epochKey(epoch), cursor, last, maxSize, func(v []byte) (*fetchEntry, error) {
+		t1 := append([]byte{}, v...)
+		return &fetchEntry{t1: t1, size: sha256.Size + len(t1)}, nil
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	messages, moreMessages, err := s.fetchEntries(messagesBucket, messagesPrefix(epoch, t1Hash), cursor, last, maxSize, func(v []byte) (*fetchEntry, error) {
+		message := new(T2T3Message)
+		if err := cbor.Unmarshal(v, message); err != nil {
+			return nil, err
+		}
+		return &fetchEntry{message: message, size: sha256.Size + len(message.T2Payload) + len(message.T3Payload)}, nil
+	})
+	if err != nil {
+		return nil, false, err
+	}
+
+	// Take the entries of both in order, up to maxSize.
+	entries := append(t1s, messages...)
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].seq < entries[j].seq
+	})
+	requested := &RequestedReunionState{
+		T1Map:    make(map[[32]byte][]byte),
+		Messages: make([]*T2T3Message, 0),
+		Cursor:   cursor,
+	}
+	size := 0
+	n := 0
+	for _, entry := range entries {
+		if maxSize > 0 && n > 0 && size+entry.size > maxSize {
+			break
 		}
-		return state.AppendMessage(message)
+		if entry.message != nil {
+			requested.Messages = append(requested.Messages, entry.message)
+		} else {
+			requested.T1Map[sha256.Sum256(entry.t1)] = entry.t1
+		}
+		requested.Cursor = entry.seq
+		size += entry.size
+		n++
+	}
+	truncated := moreT1s || moreMessages || n < len(entries)
+	if !truncated && last > cursor {
+		// The state up to the last message is returned.
+		requested.Cursor = last
 	}
-	return fmt.Errorf("AppendMessage failure, %d epoch not found in sync.Map", epoch)
+	return requested, truncated, nil
 }
 
 // ReunionState is the state of the Reunion DB.
@@ -481,6 +704,10 @@ func (s *ReunionState) Unmarshal(data []byte) error {
 	if err != nil {
 		return err
 	}
+	return s.fromSerializable(&state)
+}
+
+func (s *ReunionState) fromSerializable(state *SerializableReunionState) error {
 	for _, t1 := range state.T1Map {
 		err := s.AppendMessage(&commands.SendT1{
 			Payload: t1,
@@ -17,10 +17,16 @@
 package server
 
 import (
+	"crypto/sha256"
+	"errors"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/katzenpost/katzenpost/core/crypto/rand"
 	"github.com/katzenpost/katzenpost/reunion/commands"
+	"github.com/katzenpost/katzenpost/server/storage"
 	"github.com/stretchr/testify/require"
 )
 
@@ -147,3 +153,300 @@ func TestStateSerialization3(t *testing.T) {
 	require.NoError(err)
 	require.Equal(b1, b2)
 }
+
+type testClock struct {
+	epoch uint64
+}
+
+func (c *testClock) Now() (uint64, time.Duration, time.Duration) {
+	return c.epoch, time.Hour, time.Hour
+}
+
+func (c *testClock) Period() time.Duration {
+	return 2 * time.Hour
+}
+
+func TestReunionStates(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	db, err := storage.New(&storage.Config{Backend: storage.BackendMem}, nil)
+	require.NoError(err)
+	clock := &testClock{epoch: 123}
+	states := NewReunionStates(db)
+	require.NoError(states.MaybeAddEpochs(clock))
+
+	t1 := &commands.SendT1{
+		Epoch:   123,
+		Payload: []byte{0xDE, 0xAD, 0xBE, 0xEF},
+	}
+	require.NoError(states.AppendMessage(t1))
+	require.Error(states.AppendMessage(t1))
+	t1.Epoch = 124
+	require.Error(states.AppendMessage(t1))
+
+	t1Hash := sha256.Sum256(t1.Payload)
+	t2 := &commands.SendT2{
+		Epoch:     123,
+		DstT1Hash: t1Hash,
+		Payload:   []byte{0x01},
+	}
+	require.NoError(states.AppendMessage(t2))
+	t3 := &commands.SendT3{
+		Epoch:   123,
+		Payload: []byte{0x02},
+	}
+	_, err = rand.Reader.Read(t3.DstT1Hash[:])
+	require.NoError(err)
+	require.NoError(states.AppendMessage(t3))
+
+	// only the messages sent to the requested T1 hash are fetched
+	requested, truncated, err := states.FetchState(123, &t1Hash, 0, 0)
+	require.NoError(err)
+	require.False(truncated)
+	require.Len(requested.T1Map, 1)
+	require.Equal(t1.Payload, requested.T1Map[t1Hash])
+	require.Len(requested.Messages, 1)
+	require.Equal(t2.Payload, requested.Messages[0].T2Payload)
+
+	// old epochs are garbage collected
+	clock.epoch = 124
+	require.NoError(states.MaybeAddEpochs(clock))
+	require.NoError(states.GarbageCollectOldEpochs(clock))
+	_, _, err = states.FetchState(123, &t1Hash, 0, 0)
+	require.Error(err)
+	for _, bucket := range []string{t1Bucket, messagesBucket} {
+		require.NoError(db.ForEach(bucket, nil, func(k, v []byte) error {
+			return errors.New("garbage collected message found")
+		}))
+	}
+}
+
+func TestReunionStatesLoadFromFile(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	state := NewReunionState()
+	t1 := &commands.SendT1{
+		Payload: []byte{0xDE, 0xAD, 0xBE, 0xEF},
+	}
+	require.NoError(state.AppendMessage(t1))
+	serializable, err := state.Serializable()
+	require.NoError(err)
+	legacy := &SerializableReunionStates{
+		States: map[uint64]*SerializableReunionState{123: serializable},
+	}
+	rawLegacy, err := legacy.Marshal()
+	require.NoError(err)
+	stateFile := filepath.Join(t.TempDir(), "statefile")
+	require.NoError(os.WriteFile(stateFile, rawLegacy, 0600))
+
+	db, err := storage.New(&storage.Config{Backend: storage.BackendMem}, nil)
+	require.NoError(err)
+	states := NewReunionStates(db)
+	require.NoError(states.LoadFromFile(stateFile))
+	t1Hash := sha256.Sum256(t1.Payload)
+	requested, _, err := states.FetchState(123, &t1Hash, 0, 0)
+	require.NoError(err)
+	require.Equal(t1.Payload, requested.T1Map[t1Hash])
+}
+
+func TestReunionStatesFetchPages(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	db, err := storage.New(&storage.Config{Backend: storage.BackendMem}, nil)
+	require.NoError(err)
+	clock := &testClock{epoch: 123}
+	states := NewReunionStates(db)
+	require.NoError(states.MaybeAddEpochs(clock))
+
+	ourT1Hash := [32]byte{}
+	_, err = rand.Reader.Read(ourT1Hash[:])
+	require.NoError(err)
+	for i := 0; i < 10; i++ {
+		t1 := &commands.SendT1{
+			Epoch:   123,
+			Payload: make([]byte, 100),
+		}
+		_, err = rand.Reader.Read(t1.Payload)
+		require.NoError(err)
+		require.NoError(states.AppendMessage(t1))
+		t2 := &commands.SendT2{
+			Epoch:     123,
+			SrcT1Hash: sha256.Sum256(t1.Payload),
+			DstT1Hash: ourT1Hash,
+			Payload:   make([]byte, 100),
+		}
+		require.NoError(states.AppendMessage(t2))
+	}
+
+	// all of the state is fetched in pages
+	t1Map := make(map[[32]byte][]byte)
+	messages := []*T2T3Message{}
+	cursor := uint64(0)
+	pages := 0
+	for {
+		requested, truncated, err := states.FetchState(123, &ourT1Hash, cursor, 500)
+		require.NoError(err)
+		require.True(requested.Cursor > cursor)
+		for k, v := range requested.T1Map {
+			t1Map[k] = v
+		}
+		messages = append(messages, requested.Messages...)
+		cursor = requested.Cursor
+		pages++
+		if !truncated {
+			break
+		}
+	}
+	require.True(pages > 1)
+	require.Len(t1Map, 10)
+	require.Len(messages, 10)
+
+	// only newer state is fetched
+	requested, truncated, err := states.FetchState(123, &ourT1Hash, cursor, 500)
+	require.NoError(err)
+	require.False(truncated)
+	require.Equal(cursor, requested.Cursor)
+	require.Len(requested.T1Map, 0)
+	require.Len(requested.Messages, 0)
+	t1 := &commands.SendT1{
+		Epoch:   123,
+		Payload: []byte{0xDE, 0xAD, 0xBE, 0xEF},
+	}
+	require.NoError(states.AppendMessage(t1))
+	requested, _, err = states.FetchState(123, &ourT1Hash, cursor, 500)
+	require.NoError(err)
+	require.Len(requested.T1Map, 1)
+	require.Equal(t1.Payload, requested.T1Map[sha256.Sum256(t1.Payload)])
+}
+
+// appendingStorage is a Storage which calls a hook after each ForEachFrom,
+// and counts the keys it visits.
+type appendingStorage struct {
+	storage.Storage
+
+	afterForEach func(bucket string)
+	visited      int
+}
+
+func (s *appendingStorage) ForEachFrom(bucket string, prefix, start []byte, fn func(key, value []byte) error) error {
+	err := s.Storage.ForEachFrom(bucket, prefix, start, func(key, value []byte) error {
+		s.visited++
+		return fn(key, value)
+	})
+	if s.afterForEach != nil {
+		s.afterForEach(bucket)
+	}
+	return err
+}
+
+func TestReunionStatesFetchConcurrentAppend(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	mem, err := storage.New(&storage.Config{Backend: storage.BackendMem}, nil)
+	require.NoError(err)
+	db := &appendingStorage{Storage: mem}
+	clock := &testClock{epoch: 123}
+	states := NewReunionStates(db)
+	require.NoError(states.MaybeAddEpochs(clock))
+
+	ourT1Hash := [32]byte{}
+	_, err = rand.Reader.Read(ourT1Hash[:])
+	require.NoError(err)
+	sent := make(map[[32]byte][]byte)
+	appendT1T2 := func() {
+		t1 := &commands.SendT1{
+			Epoch:   123,
+			Payload: make([]byte, 100),
+		}
+		_, err := rand.Reader.Read(t1.Payload)
+		require.NoError(err)
+		require.NoError(states.AppendMessage(t1))
+		sent[sha256.Sum256(t1.Payload)] = t1.Payload
+		t2 := &commands.SendT2{
+			Epoch:     123,
+			SrcT1Hash: sha256.Sum256(t1.Payload),
+			DstT1Hash: ourT1Hash,
+			Payload:   make([]byte, 100),
+		}
+		require.NoError(states.AppendMessage(t2))
+	}
+	for i := 0; i < 5; i++ {
+		appendT1T2()
+	}
+
+	// A T1 and a T2 message are appended between the reads of the T1
+	// messages and of the T2 messages of every page, the last of which
+	// isn't truncated, and are still fetched by the following pages.
+	db.afterForEach = func(bucket string) {
+		if bucket == t1Bucket && len(sent) < 11 {
+			appendT1T2()
+		}
+	}
+	t1Map := make(map[[32]byte][]byte)
+	messages := []*T2T3Message{}
+	cursor := uint64(0)
+	for len(sent) < 11 {
+		maxSize := 500
+		if len(sent) == 10 {
+			maxSize = 0
+		}
+		requested, _, err := states.FetchState(123, &ourT1Hash, cursor, maxSize)
+		require.NoError(err)
+		for k, v := range requested.T1Map {
+			t1Map[k] = v
+		}
+		messages = append(messages, requested.Messages...)
+		cursor = requested.Cursor
+	}
+	db.afterForEach = nil
+	requested, truncated, err := states.FetchState(123, &ourT1Hash, cursor, 0)
+	require.NoError(err)
+	require.False(truncated)
+	for k, v := range requested.T1Map {
+		t1Map[k] = v
+	}
+	messages = append(messages, requested.Messages...)
+	require.Equal(sent, t1Map)
+	require.Len(messages, 11)
+}
+
+func TestReunionStatesFetchFromCursor(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	mem, err := storage.New(&storage.Config{Backend: storage.BackendMem}, nil)
+	require.NoError(err)
+	db := &appendingStorage{Storage: mem}
+	clock := &testClock{epoch: 123}
+	states := NewReunionStates(db)
+	require.NoError(states.MaybeAddEpochs(clock))
+
+	appendT1 := func() {
+		t1 := &commands.SendT1{
+			Epoch:   123,
+			Payload: make([]byte, 100),
+		}
+		_, err := rand.Reader.Read(t1.Payload)
+		require.NoError(err)
+		require.NoError(states.AppendMessage(t1))
+	}
+	for i := 0; i < 10; i++ {
+		appendT1()
+	}
+	ourT1Hash := [32]byte{}
+	requested, _, err := states.FetchState(123, &ourT1Hash, 0, 0)
+	require.NoError(err)
+	require.Len(requested.T1Map, 10)
+
+	// fetching from the cursor doesn't visit the older entries
+	appendT1()
+	db.visited = 0
+	requested, _, err = states.FetchState(123, &ourT1Hash, requested.Cursor, 0)
+	require.NoError(err)
+	require.Len(requested.T1Map, 1)
+	require.Equal(1, db.visited)
+}
@@ -25,8 +25,14 @@ import (
 	"github.com/katzenpost/katzenpost/reunion/epochtime/katzenpost"
 	"github.com/katzenpost/katzenpost/reunion/server"
 	"github.com/katzenpost/katzenpost/server/cborplugin"
+	"github.com/katzenpost/katzenpost/server/storage"
 )
 
+// defaultMaxFetchSize is the default maximum size of the messages in a
+// state response, which keeps the responses within the reply payload of
+// the default Sphinx geometry.
+const defaultMaxFetchSize = 1024
+
 func parametersHandler(clock *katzenpost.Clock) cborplugin.Parameters {
 	params := make(cborplugin.Parameters)
 	epoch, _, _ := clock.Now()
@@ -37,7 +43,10 @@ func parametersHandler(clock *katzenpost.Clock) cborplugin.Parameters {
 func main() {
 	logPath := flag.String("log", "", "Log file path. Default STDOUT.")
 	logLevel := flag.String("log_level", "DEBUG", "logging level could be set to: DEBUG, INFO, NOTICE, WARNING, ERROR, CRITICAL")
-	stateFilePath := flag.String("s", "statefile", "State file path.")
+	stateFilePath := flag.String("s", "statefile", "State file path, for the bolt storage backend. A CBOR state file of earlier versions is migrated.")
+	storageBackend := flag.String("storage", storage.BackendBolt, "storage backend could be set to: bolt, sql, mem")
+	dataSourceName := flag.String("dsn", "", "The SQL database connection string, for the sql storage backend.")
+	maxFetchSize := flag.Int("max_fetch_size", defaultMaxFetchSize, "Maximum size of the messages in a state response, beyond which the state is fetched in pages, or 0 for unlimited.")
 	epochClockName := flag.String("epochClock", "katzenpost", "The epoch-clock to use.")
 	flag.Parse()
 
@@ -51,17 +60,35 @@ func main() {
 		panic(err)
 	}
 	socketFile := filepath.Join(tmpDir, fmt.Sprintf("%d.reunion.socket", os.Getpid()))
-	reunionServer, err := server.NewServer(new(katzenpost.Clock), *stateFilePath, *logPath, *logLevel)
-
+	isStatefile := false
+	if *storageBackend == storage.BackendBolt {
+		isStatefile, err = server.IsStatefile(*stateFilePath)
+		if err != nil {
+			panic(err)
+		}
+	}
+	var reunionServer *server.Server
+	if isStatefile {
+		reunionServer, err = server.NewServerFromStatefile(new(katzenpost.Clock), *stateFilePath, *logPath, *logLevel)
+	} else {
+		storageCfg := &storage.Config{
+			Backend:        *storageBackend,
+			Path:           *stateFilePath,
+			DataSourceName: *dataSourceName,
+		}
+		reunionServer, err = server.NewServerWithStorage(new(katzenpost.Clock), storageCfg, *logPath, *logLevel)
+	}
 	if err != nil {
 		panic(err)
 	}
+	reunionServer.SetMaxFetchSize(*maxFetchSize)
 
 	var server *cborplugin.Server
 	server = cborplugin.NewServer(reunionServer.GetNewLogger("reunion_cbor_listener"), socketFile, new(cborplugin.RequestFactory), reunionServer)
 	fmt.Printf("%s\n", socketFile)
 	server.Accept()
 	server.Wait()
+	reunionServer.Shutdown()
 	os.Remove(socketFile)
 
 	if err != nil {
@@ -34,6 +34,7 @@ import (
 	"github.com/katzenpost/katzenpost/authority/voting/server/config"
 	"github.com/katzenpost/katzenpost/core/crypto/sign"
 	"github.com/katzenpost/katzenpost/core/pki"
+	"github.com/katzenpost/katzenpost/core/sphinx"
 	"github.com/katzenpost/katzenpost/core/utils"
 	"github.com/katzenpost/katzenpost/core/wire"
 	"golang.org/x/net/idna"
@@ -50,6 +51,8 @@ const (
 	defaultSchedulerMaxBurst   = 16
 	defaultSendSlack           = 50        // 50 ms.
 	defaultDecoySlack          = 15 * 1000 // 15 sec.
+	defaultDecoyLossThreshold  = 0.3
+	defaultDecoyLossMinSamples = 20
 	defaultConnectTimeout      = 60 * 1000 // 60 sec.
 	defaultHandshakeTimeout    = 30 * 1000 // 30 sec.
 	defaultReauthInterval      = 30 * 1000 // 30 sec.
@@ -95,11 +98,30 @@ type Server struct {
 	// and do NOT send any of the Addresses.
 	OnlyAdvertiseAltAddresses bool
 
+	// TransportAddresses is the map of client link transports other than
+	// TCP ("quic", "ws" or "wss") to the IP address/port combinations at which a
+	// Provider listens for clients using them.  They are advertised to
+	// the PKI, unless AltAddresses lists addresses for the same transport.
+	TransportAddresses map[string][]string
+
 	// DataDir is the absolute path to the server's state files.
 	DataDir string
 
 	// IsProvider specifies if the server is a provider (vs a mix).
 	IsProvider bool
+
+	// SphinxNIKE is the name of the NIKE scheme used for the mix keys,
+	// (eg: "x25519" or "ctidh"), which is advertised in the descriptor.
+	// It must match the network's SphinxGeometry, and if the geometry
+	// does not name a NIKE or KEM, this selects the geometry's NIKE.
+	SphinxNIKE string
+
+	// LoadWeight is the load balancing weight declared in the mix's
+	// descriptor, which should be proportional to its bandwidth.  It
+	// informs the directory authority operators, as clients only select
+	// mixes in proportion to the weights the authorities assign.  0
+	// declares no weight.
+	LoadWeight uint8
 }
 
 func (sCfg *Server) applyDefaults() {
@@ -136,6 +158,22 @@ func (sCfg *Server) validate() error {
 		internalTransports[strings.ToLower(string(v))] = true
 	}
 
+	for k, v := range sCfg.TransportAddresses {
+		switch pki.Transport(strings.ToLower(k)) {
+		case pki.TransportQUIC, pki.TransportWebSocket, pki.TransportWebSocketTLS:
+		default:
+			return fmt.Errorf("config: Server: TransportAddresses has unsupported transport: '%v'", k)
+		}
+		if !sCfg.IsProvider && len(v) > 0 {
+			return fmt.Errorf("config: Server: TransportAddresses is only supported by Providers")
+		}
+		for _, a := range v {
+			if err := utils.EnsureAddrIPPort(a); err != nil {
+				return fmt.Errorf("config: Server: TransportAddress '%v' is invalid: %v", a, err)
+			}
+		}
+	}
+
 	for k, v := range sCfg.AltAddresses {
 		lowkey := strings.ToLower(k)
 		switch pki.Transport(lowkey) {
@@ -216,6 +254,14 @@ type Debug struct {
 	// be considered lost.
 	DecoySlack int
 
+	// DecoyLossThreshold is the ratio of lost loop decoy packets above
+	// which an alert is raised, and nodes are suspected of dropping them.
+	DecoyLossThreshold float64
+
+	// DecoyLossMinSamples is the minimum number of loop decoy packets, in
+	// total or through a node, before loss alerts are raised.
+	DecoyLossMinSamples int
+
 	// ConnectTimeout specifies the maximum time a connection can take to
 	// establish a TCP/IP connection in milliseconds.
 	ConnectTimeout int
@@ -284,6 +330,12 @@ func (dCfg *Debug) applyDefaults() {
 	if dCfg.DecoySlack <= 0 {
 		dCfg.DecoySlack = defaultDecoySlack
 	}
+	if dCfg.DecoyLossThreshold <= 0 || dCfg.DecoyLossThreshold >= 1 {
+		dCfg.DecoyLossThreshold = defaultDecoyLossThreshold
+	}
+	if dCfg.DecoyLossMinSamples <= 0 {
+		dCfg.DecoyLossMinSamples = defaultDecoyLossMinSamples
+	}
 	if dCfg.ConnectTimeout <= 0 {
 		dCfg.ConnectTimeout = defaultConnectTimeout
 	}
@@ -744,11 +796,12 @@ func (mCfg *Management) validate() error {
 
 // Config is the top level Katzenpost server configuration.
 type Config struct {
-	Server     *Server
-	Logging    *Logging
-	Provider   *Provider
-	PKI        *PKI
-	Management *Management
+	Server         *Server
+	Logging        *Logging
+	Provider       *Provider
+	PKI            *PKI
+	Management     *Management
+	SphinxGeometry *sphinx.Geometry
 
 	Debug *Debug
 }
@@ -773,6 +826,12 @@ func (cfg *Config) FixupAndValidate() error {
 	if cfg.Management == nil {
 		cfg.Management = &Management{}
 	}
+	if cfg.SphinxGeometry == nil {
+		cfg.SphinxGeometry = &sphinx.Geometry{}
+	}
+	if cfg.SphinxGeometry.NIKEName == "" && cfg.SphinxGeometry.KEMName == "" {
+		cfg.SphinxGeometry.NIKEName = cfg.Server.SphinxNIKE
+	}
 
 	// Perform basic validation.
 	cfg.Server.applyDefaults()
@@ -803,6 +862,19 @@ func (cfg *Config) FixupAndValidate() error {
 	cfg.Debug.applyDefaults()
 
 	var err error
+	if cfg.SphinxGeometry, err = sphinx.FixupGeometry(cfg.SphinxGeometry); err != nil {
+		return fmt.Errorf("config: SphinxGeometry: %v", err)
+	}
+	switch {
+	case cfg.Server.SphinxNIKE == "":
+		cfg.Server.SphinxNIKE = cfg.SphinxGeometry.NIKEName
+	case cfg.SphinxGeometry.KEMName != "":
+		return fmt.Errorf("config: Server: SphinxNIKE '%v' is set but SphinxGeometry uses KEM '%v'", cfg.Server.SphinxNIKE, cfg.SphinxGeometry.KEMName)
+	case !strings.EqualFold(cfg.Server.SphinxNIKE, cfg.SphinxGeometry.NIKEName):
+		return fmt.Errorf("config: Server: SphinxNIKE '%v' does not match SphinxGeometry NIKE '%v'", cfg.Server.SphinxNIKE, cfg.SphinxGeometry.NIKEName)
+	default:
+		cfg.Server.SphinxNIKE = cfg.SphinxGeometry.NIKEName
+	}
 	cfg.Server.Identifier, err = idna.Lookup.ToASCII(cfg.Server.Identifier)
 	if err != nil {
 		return fmt.Errorf("config: Failed to normalize Identifier: %v", err)
@@ -64,6 +64,75 @@ PublicKeyPem = "id_pub_key.pem"
 
 	_, err = json.Marshal(cfg)
 	require.NoError(err)
+	require.Equal(cfg.SphinxGeometry.NIKEName, cfg.Server.SphinxNIKE)
+}
+
+func TestSphinxNIKEConfig(t *testing.T) {
+	require := require.New(t)
+
+	const nikeConfig = `# A SphinxNIKE configuration example.
+[server]
+Identifier = "katzenpost.example.com"
+Addresses = [ "127.0.0.1:29483" ]
+DataDir = "/var/lib/katzenpost"
+SphinxNIKE = "%s"
+
+[PKI]
+[PKI.Nonvoting]
+Address = "127.0.0.1:6999"
+PublicKeyPem = "id_pub_key.pem"
+`
+
+	cfg, err := Load([]byte(fmt.Sprintf(nikeConfig, "X25519")))
+	require.NoError(err, "Load() with SphinxNIKE")
+	require.Equal("x25519", cfg.Server.SphinxNIKE)
+	require.Equal("x25519", cfg.SphinxGeometry.NIKEName)
+
+	_, err = Load([]byte(fmt.Sprintf(nikeConfig, "bogus")))
+	require.Error(err, "Load() with unknown SphinxNIKE")
+
+	const mismatchConfig = nikeConfig + `
+[SphinxGeometry]
+KEMName = "Kyber768-X25519"
+`
+	_, err = Load([]byte(fmt.Sprintf(mismatchConfig, "x25519")))
+	require.Error(err, "Load() with SphinxNIKE and a KEM geometry")
+}
+
+func TestTransportAddressesConfig(t *testing.T) {
+	require := require.New(t)
+
+	const transportConfig = `# A TransportAddresses configuration example.
+[server]
+Identifier = "katzenpost.example.com"
+Addresses = [ "127.0.0.1:29483" ]
+DataDir = "/var/lib/katzenpost"
+IsProvider = %v
+
+[server.TransportAddresses]
+%s = [ "%s" ]
+
+[PKI]
+[PKI.Nonvoting]
+Address = "127.0.0.1:6999"
+PublicKeyPem = "id_pub_key.pem"
+`
+
+	cfg, err := Load([]byte(fmt.Sprintf(transportConfig, true, "quic", "127.0.0.1:29484")))
+	require.NoError(err, "Load() with a QUIC address")
+	require.Equal([]string{"127.0.0.1:29484"}, cfg.Server.TransportAddresses["quic"])
+
+	_, err = Load([]byte(fmt.Sprintf(transportConfig, true, "ws", "127.0.0.1:8080")))
+	require.NoError(err, "Load() with a WebSocket address")
+
+	_, err = Load([]byte(fmt.Sprintf(transportConfig, true, "carrier-pigeon", "127.0.0.1:29484")))
+	require.Error(err, "Load() with an unknown transport")
+
+	_, err = Load([]byte(fmt.Sprintf(transportConfig, true, "quic", "example.com:29484")))
+	require.Error(err, "Load() with a host name")
+
+	_, err = Load([]byte(fmt.Sprintf(transportConfig, false, "quic", "127.0.0.1:29484")))
+	require.Error(err, "Load() with TransportAddresses for a mix")
 }
 
 func TestIncompleteConfig(t *testing.T) {
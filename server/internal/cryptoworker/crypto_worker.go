@@ -25,6 +25,7 @@ import (
 	"github.com/katzenpost/katzenpost/core/epochtime"
 	"github.com/katzenpost/katzenpost/core/monotime"
 	"github.com/katzenpost/katzenpost/core/sphinx"
+	"github.com/katzenpost/katzenpost/core/sphinx/commands"
 	"github.com/katzenpost/katzenpost/core/worker"
 	"github.com/katzenpost/katzenpost/server/internal/constants"
 	"github.com/katzenpost/katzenpost/server/internal/glue"
@@ -98,7 +99,14 @@ func (w *Worker) doUnwrap(pkt *packet.Packet) error {
 
 		// TODO/perf: payload is a new heap allocation if it's returned,
 		// though that should only happen if this is a provider.
-		payload, tag, cmds, err := w.sphinx.Unwrap(k.PrivateKey(), pkt.Raw)
+		var payload, tag []byte
+		var cmds []commands.RoutingCommand
+		var err error
+		if kemKey := k.KEMPrivateKey(); kemKey != nil {
+			payload, tag, cmds, err = w.sphinx.KEMUnwrap(kemKey, pkt.Raw)
+		} else {
+			payload, tag, cmds, err = w.sphinx.Unwrap(k.PrivateKey(), pkt.Raw)
+		}
 		unwrapAt := monotime.Now()
 
 		w.log.Debugf("Packet: %v (Unwrap took: %v)", pkt.ID, unwrapAt-startAt)
@@ -314,17 +322,21 @@ func (w *Worker) derefKeys() {
 }
 
 // New constructs a new Worker instance.
-func New(glue glue.Glue, incomingCh <-chan interface{}, id int) *Worker {
+func New(glue glue.Glue, incomingCh <-chan interface{}, id int) (*Worker, error) {
+	s, err := sphinx.FromGeometry(glue.Config().SphinxGeometry)
+	if err != nil {
+		return nil, err
+	}
 	w := &Worker{
 		glue:       glue,
 		log:        glue.LogBackend().GetLogger(fmt.Sprintf("crypto:%d", id)),
 		mixKeys:    make(map[uint64]*mixkey.MixKey),
 		incomingCh: incomingCh,
 		updateCh:   make(chan bool),
-		sphinx:     sphinx.DefaultSphinx(),
+		sphinx:     s,
 	}
 
 	w.glue.MixKeys().Shadow(w.mixKeys)
 	w.Go(w.worker)
-	return w
+	return w, nil
 }
@@ -36,6 +36,7 @@ import (
 	"github.com/katzenpost/katzenpost/core/sphinx/commands"
 	sConstants "github.com/katzenpost/katzenpost/core/sphinx/constants"
 	"github.com/katzenpost/katzenpost/core/sphinx/path"
+	"github.com/katzenpost/katzenpost/core/thwack"
 	"github.com/katzenpost/katzenpost/core/worker"
 	"github.com/katzenpost/katzenpost/server/internal/glue"
 	"github.com/katzenpost/katzenpost/server/internal/instrument"
@@ -46,14 +47,21 @@ import (
 	"gopkg.in/op/go-logging.v1"
 )
 
-const maxAttempts = 3
+const (
+	maxAttempts = 3
+
+	// maxReportPaths is the maximum number of paths in a loop report.
+	maxReportPaths = 10
+)
 
 var errMaxAttempts = errors.New("decoy: max path selection attempts exceeded")
 
 type surbCtx struct {
 	id      uint64
 	eta     time.Duration
+	sentAt  time.Duration
 	sprpKey []byte
+	hops    [][32]byte
 
 	etaNode *avl.Node
 }
@@ -75,12 +83,21 @@ type decoy struct {
 	surbETAs   *avl.Tree
 	surbStore  map[uint64]*surbCtx
 	surbIDBase uint64
+
+	stats   *loopStats
+	alerted bool
 }
 
 func (d *decoy) OnNewDocument(ent *pkicache.Entry) {
 	d.docCh <- ent
 }
 
+// LoopReport returns the loops sent through each peer during the last
+// epoch, for publication in the descriptor.
+func (d *decoy) LoopReport() *pki.LoopReport {
+	return d.stats.loopReport()
+}
+
 func (d *decoy) OnPacket(pkt *packet.Packet) {
 	// Note: This is called from the crypto worker context, which is "fine".
 	defer pkt.Dispose()
@@ -120,8 +137,56 @@ func (d *decoy) OnPacket(pkt *packet.Packet) {
 		return
 	}
 
-	// TODO: At some point, this should do more than just log.
 	d.log.Debugf("Response packet: %v (SURB ID: 0x%08x): ETA: %v, Actual: %v (DeltaT: %v)", pkt.ID, id, ctx.eta, pkt.RecvAt, pkt.RecvAt-ctx.eta)
+	d.onLoopDone(ctx, false, pkt.RecvAt-ctx.sentAt)
+}
+
+// onLoopDone accounts for a loop which has returned or has been lost.
+func (d *decoy) onLoopDone(ctx *surbCtx, lost bool, latency time.Duration) {
+	d.stats.add(ctx.hops, lost, latency)
+	instrument.DecoyLoop(lost, latency)
+	for _, name := range d.stats.hopNames(ctx.hops) {
+		instrument.DecoyHopLoop(name, lost)
+	}
+}
+
+// checkLoopStats raises an alert when the loss of loops exceeds the
+// threshold, which may be caused by an n-1 attack, and attributes the
+// losses to the nodes most likely to be dropping them.
+func (d *decoy) checkLoopStats() {
+	alert, counts := d.stats.lossAlert()
+	instrument.DecoyLoopsLoss(counts.lossRatio(), alert)
+	if !alert {
+		if d.alerted {
+			d.log.Noticef("Loop loss is back under the threshold: %v", &counts)
+			instrument.DecoySuspectNodes(nil)
+		}
+		d.alerted = false
+		return
+	}
+
+	suspects := d.stats.suspects()
+	ratios := make(map[string]float64)
+	for _, v := range suspects {
+		ratios[v.name] = v.counts.lossRatio()
+	}
+	instrument.DecoySuspectNodes(ratios)
+	if !d.alerted {
+		d.log.Warningf("Loop loss exceeds the threshold, possible n-1 attack: %v", &counts)
+		for _, v := range suspects {
+			d.log.Warningf("Suspected node: %v (%v)", v.name, &v.counts)
+		}
+	}
+	d.alerted = true
+}
+
+func (d *decoy) onLoopStats(c *thwack.Conn, l string) error {
+	for _, v := range d.stats.report(maxReportPaths) {
+		if err := c.Writer().PrintfLine("%v-%v", thwack.StatusOk, v); err != nil {
+			return err
+		}
+	}
+	return c.WriteReply(thwack.StatusOk)
 }
 
 func (d *decoy) worker() {
@@ -158,6 +223,10 @@ func (d *decoy) worker() {
 			}
 			d.log.Debugf("Received new PKI document for epoch: %v", now)
 			instrument.PKIDocs(fmt.Sprintf("%v", now))
+			if docCache != nil && docCache.Epoch() != now {
+				counts := d.stats.rotate(docCache.Epoch())
+				d.log.Noticef("Loops in the last epoch: %v", &counts)
+			}
 			docCache = newEnt
 		case <-timer.C:
 			timerFired = true
@@ -272,13 +341,12 @@ func (d *decoy) sendLoopPacket(doc *pki.Document, recipient []byte, src, dst *pk
 			payload = append(payload, surb...)
 			payload = append(payload, zeroBytes...)
 
-			// TODO: This should probably also store path information,
-			// so that it's possible to figure out which links/nodes
-			// are causing issues.
 			ctx := &surbCtx{
 				id:      binary.BigEndian.Uint64(surbID[8:]),
 				eta:     monotime.Now() + deltaT,
+				sentAt:  monotime.Now(),
 				sprpKey: k,
+				hops:    d.loopHops(doc, src, fwdPath, revPath),
 			}
 			d.storeSURBCtx(ctx)
 
@@ -300,6 +368,25 @@ func (d *decoy) sendLoopPacket(doc *pki.Document, recipient []byte, src, dst *pk
 	d.log.Debugf("Failed to generate loop packet: %v", errMaxAttempts)
 }
 
+// loopHops returns the identities of the hops of a loop, other than
+// this node.
+func (d *decoy) loopHops(doc *pki.Document, self *pki.MixDescriptor, paths ...[]*sphinx.PathHop) [][32]byte {
+	selfID := self.IdentityKey.Sum256()
+	hops := [][32]byte{}
+	for _, p := range paths {
+		for _, hop := range p {
+			if hop.ID == selfID {
+				continue
+			}
+			if desc, err := doc.GetNodeByKeyHash(&hop.ID); err == nil {
+				d.stats.setName(&hop.ID, desc.Name)
+			}
+			hops = append(hops, hop.ID)
+		}
+	}
+	return hops
+}
+
 func (d *decoy) sendDiscardPacket(doc *pki.Document, recipient []byte, src, dst *pki.MixDescriptor) {
 	payload := make([]byte, 2+d.geo.SURBLength+d.geo.UserForwardPayloadLength)
 
@@ -328,7 +415,7 @@ func (d *decoy) sendDiscardPacket(doc *pki.Document, recipient []byte, src, dst
 }
 
 func (d *decoy) dispatchPacket(fwdPath []*sphinx.PathHop, raw []byte) {
-	pkt, err := packet.New(raw)
+	pkt, err := packet.New(raw, d.geo)
 	if err != nil {
 		d.log.Debugf("Failed to allocate packet: %v", err)
 		return
@@ -414,8 +501,8 @@ func (d *decoy) sweepSURBCtxs() {
 
 		delete(d.surbStore, ctx.id)
 
-		// TODO: At some point, this should do more than just log.
 		d.log.Debugf("Sweep: Lost SURB ID: 0x%08x ETA: %v (DeltaT: %v)", ctx.id, ctx.eta, now-ctx.eta)
+		d.onLoopDone(ctx, true, 0)
 		swept++
 		// modification is unsupported EXCEPT "removing the current
 		// Node", see godoc for avl/avl.go:Iterator
@@ -423,13 +510,18 @@ func (d *decoy) sweepSURBCtxs() {
 	}
 
 	d.log.Debugf("Sweep: Count: %v (Removed: %v, Elapsed: %v)", len(d.surbStore), swept, monotime.Now()-now)
+	d.checkLoopStats()
 }
 
 // New constructs a new decoy instance.
 func New(glue glue.Glue) (glue.Decoy, error) {
+	s, err := sphinx.FromGeometry(glue.Config().SphinxGeometry)
+	if err != nil {
+		return nil, err
+	}
 	d := &decoy{
-		geo:       sphinx.DefaultGeometry(),
-		sphinx:    sphinx.DefaultSphinx(),
+		geo:       s.Geometry(),
+		sphinx:    s,
 		glue:      glue,
 		log:       glue.LogBackend().GetLogger("decoy"),
 		recipient: make([]byte, sConstants.RecipientIDLength),
@@ -452,11 +544,18 @@ func New(glue glue.Glue) (glue.Decoy, error) {
 		}),
 		surbStore:  make(map[uint64]*surbCtx),
 		surbIDBase: uint64(time.Now().Unix()),
+		stats:      newLoopStats(glue.Config().Debug.DecoyLossThreshold, uint64(glue.Config().Debug.DecoyLossMinSamples)),
 	}
 	if _, err := io.ReadFull(rand.Reader, d.recipient); err != nil {
 		return nil, err
 	}
 
+	// Wire in the management related commands.
+	if glue.Config().Management.Enable {
+		const cmdLoopStats = "LOOP_STATS"
+		glue.Management().RegisterCommand(cmdLoopStats, d.onLoopStats)
+	}
+
 	d.Go(d.worker)
 	return d, nil
 }
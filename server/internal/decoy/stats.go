@@ -0,0 +1,345 @@
+// stats.go - Katzenpost server decoy loop statistics.
+// Copyright (C) 2022  David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package decoy
+
+import (
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/katzenpost/katzenpost/core/pki"
+)
+
+// maxLoopRecords is the maximum number of loops, and of paths, kept per
+// window for the attribution of losses to nodes.
+const maxLoopRecords = 8192
+
+// loopCounts is the number of returned and lost loops, and the total
+// latency of the returned ones.
+type loopCounts struct {
+	returned uint64
+	lost     uint64
+	latency  time.Duration
+}
+
+func (c *loopCounts) add(lost bool, latency time.Duration) {
+	if lost {
+		c.lost++
+		return
+	}
+	c.returned++
+	c.latency += latency
+}
+
+func (c *loopCounts) total() uint64 {
+	return c.returned + c.lost
+}
+
+// lossRatio returns the ratio of the lost loops.
+func (c *loopCounts) lossRatio() float64 {
+	if c.total() == 0 {
+		return 0
+	}
+	return float64(c.lost) / float64(c.total())
+}
+
+// meanLatency returns the mean latency of the returned loops.
+func (c *loopCounts) meanLatency() time.Duration {
+	if c.returned == 0 {
+		return 0
+	}
+	return c.latency / time.Duration(c.returned)
+}
+
+func (c *loopCounts) String() string {
+	return fmt.Sprintf("returned %d lost %d loss %.2f latency %v", c.returned, c.lost, c.lossRatio(), c.meanLatency())
+}
+
+// loopRecord is a completed loop, with the hops it went through.
+type loopRecord struct {
+	hops [][32]byte
+	lost bool
+}
+
+// suspect is a node to which loop losses are attributed.
+type suspect struct {
+	id     [32]byte
+	name   string
+	counts loopCounts
+}
+
+// loopStats accounts for the loss and latency of decoy loops, per path and
+// per hop, over a window of time.
+type loopStats struct {
+	sync.Mutex
+
+	threshold  float64
+	minSamples uint64
+
+	counts  loopCounts
+	hops    map[[32]byte]*loopCounts
+	paths   map[string]*loopCounts
+	records []*loopRecord
+	names   map[[32]byte]string
+
+	lastReport *pki.LoopReport
+}
+
+func newLoopStats(threshold float64, minSamples uint64) *loopStats {
+	s := &loopStats{
+		threshold:  threshold,
+		minSamples: minSamples,
+		names:      make(map[[32]byte]string),
+	}
+	s.reset()
+	return s
+}
+
+func (s *loopStats) reset() {
+	s.counts = loopCounts{}
+	s.hops = make(map[[32]byte]*loopCounts)
+	s.paths = make(map[string]*loopCounts)
+	s.records = nil
+}
+
+// rotate starts a new window, returning the counts of the last one, which
+// was the given epoch.
+func (s *loopStats) rotate(epoch uint64) loopCounts {
+	s.Lock()
+	defer s.Unlock()
+
+	s.lastReport = &pki.LoopReport{
+		Epoch: epoch,
+		Peers: make(map[[pki.PublicKeyHashSize]byte]*pki.LoopCounts),
+	}
+	for id, c := range s.hops {
+		s.lastReport.Peers[id] = &pki.LoopCounts{
+			Sent:     c.total(),
+			Returned: c.returned,
+		}
+	}
+
+	counts := s.counts
+	s.reset()
+	return counts
+}
+
+// loopReport returns the loops sent through each peer during the last
+// complete window, or nil if there is none.
+func (s *loopStats) loopReport() *pki.LoopReport {
+	s.Lock()
+	defer s.Unlock()
+
+	return s.lastReport
+}
+
+// setName sets the name of a node, for reporting.
+func (s *loopStats) setName(id *[32]byte, name string) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.names[*id] = name
+}
+
+// hopNames returns the names of the hops of a loop.
+func (s *loopStats) hopNames(hops [][32]byte) []string {
+	s.Lock()
+	defer s.Unlock()
+
+	names := make([]string, 0, len(hops))
+	for i := range hops {
+		names = append(names, s.name(&hops[i]))
+	}
+	return names
+}
+
+func (s *loopStats) name(id *[32]byte) string {
+	if name, ok := s.names[*id]; ok {
+		return name
+	}
+	return hex.EncodeToString(id[:])
+}
+
+func pathKey(hops [][32]byte) string {
+	b := make([]byte, 0, len(hops)*32)
+	for _, id := range hops {
+		b = append(b, id[:]...)
+	}
+	return string(b)
+}
+
+// add accounts for a loop which has returned or has been lost.
+func (s *loopStats) add(hops [][32]byte, lost bool, latency time.Duration) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.counts.add(lost, latency)
+
+	key := pathKey(hops)
+	pc, ok := s.paths[key]
+	if !ok && len(s.paths) < maxLoopRecords {
+		pc = new(loopCounts)
+		s.paths[key] = pc
+	}
+	if pc != nil {
+		pc.add(lost, latency)
+	}
+
+	// Nodes may appear more than once in a loop, but are only accounted
+	// for once per loop.
+	seen := make(map[[32]byte]bool)
+	unique := make([][32]byte, 0, len(hops))
+	for _, id := range hops {
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		unique = append(unique, id)
+		hc, ok := s.hops[id]
+		if !ok {
+			hc = new(loopCounts)
+			s.hops[id] = hc
+		}
+		hc.add(lost, latency)
+	}
+
+	if len(s.records) < maxLoopRecords {
+		s.records = append(s.records, &loopRecord{hops: unique, lost: lost})
+	}
+}
+
+// lossAlert returns if the loss ratio of the window exceeds the threshold,
+// once there are enough samples.
+func (s *loopStats) lossAlert() (bool, loopCounts) {
+	s.Lock()
+	defer s.Unlock()
+
+	return s.counts.total() >= s.minSamples && s.counts.lossRatio() > s.threshold, s.counts
+}
+
+// suspects attributes the lost loops of the window to the nodes which are
+// the most likely to have caused them. The node through which the loops
+// are lost the most is attributed the losses of the loops it was in, and
+// the remaining loops are considered again, until no node has a loss
+// ratio above the threshold. Innocent nodes which shared loops with a
+// faulty or malicious node are thus not suspected.
+func (s *loopStats) suspects() []*suspect {
+	s.Lock()
+	defer s.Unlock()
+
+	suspects := []*suspect{}
+	records := s.records
+	for {
+		counts := make(map[[32]byte]*loopCounts)
+		for _, r := range records {
+			for _, id := range r.hops {
+				c, ok := counts[id]
+				if !ok {
+					c = new(loopCounts)
+					counts[id] = c
+				}
+				c.add(r.lost, 0)
+			}
+		}
+
+		var worst *suspect
+		for id, c := range counts {
+			if c.total() < s.minSamples || c.lossRatio() <= s.threshold {
+				continue
+			}
+			if worst == nil || c.lossRatio() > worst.counts.lossRatio() ||
+				(c.lossRatio() == worst.counts.lossRatio() && c.lost > worst.counts.lost) {
+				worst = &suspect{id: id, name: s.name(&id), counts: *c}
+			}
+		}
+		if worst == nil {
+			return suspects
+		}
+		suspects = append(suspects, worst)
+
+		remaining := make([]*loopRecord, 0, len(records))
+		for _, r := range records {
+			through := false
+			for _, id := range r.hops {
+				if id == worst.id {
+					through = true
+					break
+				}
+			}
+			if !through {
+				remaining = append(remaining, r)
+			}
+		}
+		records = remaining
+	}
+}
+
+// report returns a human readable report of the window, with the stats of
+// every hop, of the paths with the most losses, and the suspected nodes.
+func (s *loopStats) report(maxPaths int) []string {
+	suspects := s.suspects()
+
+	s.Lock()
+	defer s.Unlock()
+
+	lines := []string{fmt.Sprintf("loops %v", &s.counts)}
+
+	ids := make([][32]byte, 0, len(s.hops))
+	for id := range s.hops {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return s.name(&ids[i]) < s.name(&ids[j])
+	})
+	for _, id := range ids {
+		id := id
+		lines = append(lines, fmt.Sprintf("hop %v %v", s.name(&id), s.hops[id]))
+	}
+
+	keys := make([]string, 0, len(s.paths))
+	for k := range s.paths {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if s.paths[keys[i]].lost != s.paths[keys[j]].lost {
+			return s.paths[keys[i]].lost > s.paths[keys[j]].lost
+		}
+		return keys[i] < keys[j]
+	})
+	if len(keys) > maxPaths {
+		keys = keys[:maxPaths]
+	}
+	for _, k := range keys {
+		names := ""
+		for i := 0; i+32 <= len(k); i += 32 {
+			id := [32]byte{}
+			copy(id[:], k[i:])
+			if names != "" {
+				names += ","
+			}
+			names += s.name(&id)
+		}
+		lines = append(lines, fmt.Sprintf("path %v %v", names, s.paths[k]))
+	}
+
+	for _, v := range suspects {
+		lines = append(lines, fmt.Sprintf("suspect %v %v", v.name, &v.counts))
+	}
+	return lines
+}
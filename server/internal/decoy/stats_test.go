@@ -0,0 +1,83 @@
+// stats_test.go - Katzenpost server decoy loop statistics tests.
+// Copyright (C) 2022  David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package decoy
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoopStats(t *testing.T) {
+	require := require.New(t)
+
+	nodes := make([][32]byte, 6)
+	s := newLoopStats(0.3, 10)
+	for i := range nodes {
+		nodes[i][0] = byte(i)
+		s.setName(&nodes[i], string(rune('a'+i)))
+	}
+
+	// Node 0 drops every loop through it, and loops go through every
+	// pair of the nodes.
+	for n := 0; n < 10; n++ {
+		for i := range nodes {
+			for j := range nodes {
+				if i == j {
+					continue
+				}
+				lost := i == 0 || j == 0
+				s.add([][32]byte{nodes[i], nodes[j]}, lost, time.Second)
+			}
+		}
+	}
+	alert, counts := s.lossAlert()
+	require.True(alert)
+	require.Equal(uint64(200), counts.returned)
+	require.Equal(uint64(100), counts.lost)
+	require.Equal(time.Second, counts.meanLatency())
+
+	// Only node 0 is suspected, although the loops through the other nodes
+	// were lost more than the threshold.
+	s.Lock()
+	require.Equal(uint64(20), s.hops[nodes[1]].lost)
+	s.Unlock()
+	suspects := s.suspects()
+	require.Len(suspects, 1)
+	require.Equal(nodes[0], suspects[0].id)
+	require.Equal("a", suspects[0].name)
+	require.Equal(1.0, suspects[0].counts.lossRatio())
+
+	report := s.report(3)
+	require.Len(report, 1+len(nodes)+3+1)
+	require.True(strings.HasPrefix(report[1], "hop a "))
+	require.True(strings.HasPrefix(report[len(report)-1], "suspect a "))
+
+	require.Nil(s.loopReport())
+	counts = s.rotate(7)
+	require.Equal(uint64(100), counts.lost)
+	lr := s.loopReport()
+	require.Equal(uint64(7), lr.Epoch)
+	require.Len(lr.Peers, len(nodes))
+	require.Equal(s.hops, map[[32]byte]*loopCounts{})
+	require.Equal(uint64(0), lr.Peers[nodes[0]].Returned)
+	alert, _ = s.lossAlert()
+	require.False(alert)
+	require.Len(s.suspects(), 0)
+}
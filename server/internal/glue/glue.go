@@ -19,7 +19,6 @@
 package glue
 
 import (
-	"github.com/katzenpost/katzenpost/core/crypto/ecdh"
 	"github.com/katzenpost/katzenpost/core/crypto/sign"
 	"github.com/katzenpost/katzenpost/core/log"
 	"github.com/katzenpost/katzenpost/core/pki"
@@ -41,6 +40,7 @@ type Glue interface {
 	IdentityKey() sign.PrivateKey
 	IdentityPublicKey() sign.PublicKey
 	LinkKey() wire.PrivateKey
+	KeyRotation() []byte
 
 	Management() *thwack.Server
 	MixKeys() MixKeys
@@ -58,7 +58,7 @@ type MixKeys interface {
 	Halt()
 	Generate(uint64) (bool, error)
 	Prune() bool
-	Get(uint64) (*ecdh.PublicKey, bool)
+	Get(uint64) ([]byte, bool)
 	Shadow(map[uint64]*mixkey.MixKey)
 }
 
@@ -98,10 +98,12 @@ type Listener interface {
 	GetConnIdentities() (map[[constants.RecipientIDLength]byte]interface{}, error)
 	OnNewSendRatePerMinute(uint64)
 	OnNewSendBurst(uint64)
+	OnMessageStored([]byte)
 }
 
 type Decoy interface {
 	Halt()
 	OnNewDocument(*pkicache.Entry)
 	OnPacket(*packet.Packet)
+	LoopReport() *pki.LoopReport
 }
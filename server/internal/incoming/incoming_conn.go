@@ -60,7 +60,11 @@ type incomingConn struct {
 	fromMix       bool
 	canSend       bool
 
+	pushEnabled  bool // Set by worker.
+	pushInFlight bool // Set by worker.
+
 	closeConnectionCh chan bool
+	pushCh            chan struct{}
 }
 
 func (c *incomingConn) IsPeerValid(creds *wire.PeerCredentials) bool {
@@ -150,6 +154,15 @@ func (c *incomingConn) Close() {
 	c.closeConnectionCh <- true
 }
 
+func (c *incomingConn) onMessageStored() {
+	// Never block the provider, a pending wake up covers any number of
+	// stored messages.
+	select {
+	case c.pushCh <- struct{}{}:
+	default:
+	}
+}
+
 func (c *incomingConn) worker() {
 	defer func() {
 		c.log.Debugf("Closing.")
@@ -160,7 +173,7 @@ func (c *incomingConn) worker() {
 	// Allocate the session struct.
 	identityHash := c.l.glue.IdentityPublicKey().Sum256()
 	cfg := &wire.SessionConfig{
-		Geometry:          sphinx.DefaultGeometry(),
+		Geometry:          c.geo,
 		Authenticator:     c,
 		AdditionalData:    identityHash[:],
 		AuthenticationKey: c.l.glue.LinkKey(),
@@ -259,6 +272,12 @@ func (c *incomingConn) worker() {
 		case <-c.closeConnectionCh:
 			c.log.Debugf("Disconnecting to make room for a newer connection from the same peer.")
 			return
+		case <-c.pushCh:
+			if err := c.onPush(); err != nil {
+				c.log.Debugf("Failed to push message: %v", err)
+				return
+			}
+			continue
 		case rawCmd, ok = <-commandCh:
 			if !ok {
 				return
@@ -286,6 +305,14 @@ func (c *incomingConn) worker() {
 					return
 				}
 				continue
+			case *commands.EnablePush:
+				c.log.Debugf("Received EnablePush from peer.")
+				c.pushEnabled = true
+				if err := c.onPush(); err != nil {
+					c.log.Debugf("Failed to push message: %v", err)
+					return
+				}
+				continue
 			case *commands.GetConsensus:
 				c.log.Debugf("Received GetConsensus from peer.")
 				if err := c.onGetConsensus(cmd); err != nil {
@@ -355,14 +382,47 @@ func (c *incomingConn) onRetrieveMessage(cmd *commands.RetrieveMessage) error {
 		return fmt.Errorf("provider: RetrieveMessage out of sequence: %d", cmd.Sequence)
 	}
 
-	// Get the message from the user's spool, advancing as appropriate.
-	creds, err := c.w.PeerCredentials()
+	respCmd, isEmpty, err := c.spoolHead(cmd.Sequence, advance)
 	if err != nil {
 		return err
 	}
+
+	// In push mode, the next stored message is pushed once the client
+	// has been told that the spool is empty, and otherwise the client
+	// will acknowledge this message to retrieve the next one.
+	c.pushInFlight = !isEmpty
+
+	return c.w.SendCommand(respCmd)
+}
+
+// onPush sends the head of the spool to a client that enabled push
+// delivery, unless it has yet to acknowledge a message.
+func (c *incomingConn) onPush() error {
+	if !c.pushEnabled || c.pushInFlight {
+		return nil
+	}
+
+	respCmd, isEmpty, err := c.spoolHead(c.retrSeq, false)
+	if err != nil || isEmpty {
+		return err
+	}
+	c.log.Debugf("Pushing message: %d", c.retrSeq)
+	c.pushInFlight = true
+
+	return c.w.SendCommand(respCmd)
+}
+
+// spoolHead returns the command carrying the message at the head of the
+// user's spool with the given sequence number, advancing the spool first
+// as appropriate, and whether the spool is empty.
+func (c *incomingConn) spoolHead(seq uint32, advance bool) (commands.Command, bool, error) {
+	creds, err := c.w.PeerCredentials()
+	if err != nil {
+		return nil, false, err
+	}
 	msg, surbID, remaining, err := c.l.glue.Provider().Spool().Get(creds.AdditionalData, advance)
 	if err != nil {
-		return err
+		return nil, false, err
 	}
 	if remaining > math.MaxUint8 {
 		// The count hint is an 8 bit value and is clamped.
@@ -378,14 +438,14 @@ func (c *incomingConn) onRetrieveMessage(cmd *commands.RetrieveMessage) error {
 			Geo: c.geo,
 
 			QueueSizeHint: hint,
-			Sequence:      cmd.Sequence,
+			Sequence:      seq,
 			Payload:       msg,
 		}
 		copy(surbCmd.ID[:], surbID)
 		respCmd = surbCmd
 
 		if len(msg) != c.geo.PayloadTagLength+c.geo.ForwardPayloadLength {
-			return fmt.Errorf("stored SURBReply payload is mis-sized: %v", len(msg))
+			return nil, false, fmt.Errorf("stored SURBReply payload is mis-sized: %v", len(msg))
 		}
 	} else if msg != nil {
 		// This was a message.
@@ -394,11 +454,11 @@ func (c *incomingConn) onRetrieveMessage(cmd *commands.RetrieveMessage) error {
 			Cmds: commands.NewCommands(c.geo),
 
 			QueueSizeHint: hint,
-			Sequence:      cmd.Sequence,
+			Sequence:      seq,
 			Payload:       msg,
 		}
 		if len(msg) != c.geo.UserForwardPayloadLength {
-			return fmt.Errorf("stored user payload is mis-sized: %v", len(msg))
+			return nil, false, fmt.Errorf("stored user payload is mis-sized: %v", len(msg))
 		}
 	} else {
 		// Queue must be empty.
@@ -407,17 +467,17 @@ func (c *incomingConn) onRetrieveMessage(cmd *commands.RetrieveMessage) error {
 			// the server over if it does.
 			c.log.Errorf("BUG: Get() failed to return a message, and the queue is not empty.")
 		}
-		respCmd = &commands.MessageEmpty{
+		return &commands.MessageEmpty{
 			Cmds:     commands.NewCommands(c.geo),
-			Sequence: cmd.Sequence,
-		}
+			Sequence: seq,
+		}, true, nil
 	}
 
-	return c.w.SendCommand(respCmd)
+	return respCmd, false, nil
 }
 
 func (c *incomingConn) onSendPacket(cmd *commands.SendPacket) error {
-	pkt, err := packet.New(cmd.SphinxPacket)
+	pkt, err := packet.New(cmd.SphinxPacket, c.geo)
 	if err != nil {
 		return err
 	}
@@ -475,7 +535,8 @@ func newIncomingConn(l *listener, conn net.Conn) *incomingConn {
 		sendTokenLast:     monotime.Now(),
 		maxSendTokens:     4, // Reasonable burst to avoid some unnecessary rate limiting.
 		closeConnectionCh: make(chan bool),
-		geo:               sphinx.DefaultGeometry(),
+		pushCh:            make(chan struct{}, 1),
+		geo:               l.glue.Config().SphinxGeometry,
 	}
 	c.log = l.glue.LogBackend().GetLogger(fmt.Sprintf("incoming:%d", c.id))
 
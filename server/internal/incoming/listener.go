@@ -26,7 +26,9 @@ import (
 	"sync"
 	"sync/atomic"
 
+	"github.com/katzenpost/katzenpost/core/pki"
 	sConstants "github.com/katzenpost/katzenpost/core/sphinx/constants"
+	"github.com/katzenpost/katzenpost/core/transport"
 	"github.com/katzenpost/katzenpost/core/worker"
 	"github.com/katzenpost/katzenpost/server/internal/constants"
 	"github.com/katzenpost/katzenpost/server/internal/glue"
@@ -89,9 +91,10 @@ func (l *listener) worker() {
 			continue
 		}
 
-		tcpConn := conn.(*net.TCPConn)
-		tcpConn.SetKeepAlive(true)
-		tcpConn.SetKeepAlivePeriod(constants.KeepAliveInterval)
+		if tcpConn, ok := conn.(*net.TCPConn); ok {
+			tcpConn.SetKeepAlive(true)
+			tcpConn.SetKeepAlivePeriod(constants.KeepAliveInterval)
+		}
 
 		l.log.Debugf("Accepted new connection: %v", conn.RemoteAddr())
 
@@ -156,6 +159,30 @@ func (l *listener) GetConnIdentities() (map[[sConstants.RecipientIDLength]byte]i
 	return identitySet, nil
 }
 
+// OnMessageStored wakes up the connection of the client with the given
+// identity, if any, so that it may push the newly stored message.
+func (l *listener) OnMessageStored(recipient []byte) {
+	l.Lock()
+	defer l.Unlock()
+
+	for e := l.conns.Front(); e != nil; e = e.Next() {
+		cc := e.Value.(*incomingConn)
+
+		// Skip checking against pre-handshake conns.
+		if cc.w == nil || !cc.isInitialized {
+			continue
+		}
+
+		b, err := cc.w.PeerCredentials()
+		if err != nil {
+			continue
+		}
+		if hmac.Equal(recipient, b.AdditionalData) {
+			cc.onMessageStored()
+		}
+	}
+}
+
 func (l *listener) CloseOldConns(ptr interface{}) error {
 	c := ptr.(*incomingConn)
 
@@ -194,8 +221,8 @@ func (l *listener) CloseOldConns(ptr interface{}) error {
 	return nil
 }
 
-// New creates a new listener.
-func New(glue glue.Glue, incomingCh chan<- interface{}, id int, addr string) (glue.Listener, error) {
+// New creates a new listener for the link transport.
+func New(glue glue.Glue, incomingCh chan<- interface{}, id int, t pki.Transport, addr string) (glue.Listener, error) {
 	var err error
 
 	l := &listener{
@@ -206,7 +233,11 @@ func New(glue glue.Glue, incomingCh chan<- interface{}, id int, addr string) (gl
 		closeAllCh: make(chan interface{}),
 	}
 
-	l.l, err = net.Listen("tcp", addr)
+	tr, err := transport.Get(t)
+	if err != nil {
+		return nil, err
+	}
+	l.l, err = tr.Listen(addr)
 	if err != nil {
 		return nil, err
 	}
@@ -6,6 +6,7 @@ package instrument
 import (
 	"fmt"
 	"net/http"
+	"time"
 
 	"github.com/katzenpost/katzenpost/core/wire/commands"
 	"github.com/prometheus/client_golang/prometheus"
@@ -139,6 +140,45 @@ var (
 		},
 		[]string{"epoch"},
 	)
+	decoyLoops = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "katzenpost_decoy_loops_total",
+			Help: "Number of returned and lost decoy loops",
+		},
+		[]string{"status"},
+	)
+	decoyLoopsLatency = prometheus.NewSummary(
+		prometheus.SummaryOpts{
+			Name: "katzenpost_decoy_loops_latency_seconds",
+			Help: "Round trip latency of returned decoy loops in seconds",
+		},
+	)
+	decoyHopLoops = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "katzenpost_decoy_hop_loops_total",
+			Help: "Number of returned and lost decoy loops per hop",
+		},
+		[]string{"node", "status"},
+	)
+	decoyLoopsLossRatio = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "katzenpost_decoy_loops_loss_ratio",
+			Help: "Ratio of lost decoy loops in the current epoch",
+		},
+	)
+	decoyLoopsLossAlert = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "katzenpost_decoy_loops_loss_alert",
+			Help: "Whether the decoy loop loss exceeds the alert threshold",
+		},
+	)
+	decoySuspectNodes = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "katzenpost_decoy_suspect_nodes",
+			Help: "Loss ratio of the decoy loops attributed to suspected nodes",
+		},
+		[]string{"node"},
+	)
 )
 
 var kaetzchenRequestsTimer *prometheus.Timer
@@ -167,6 +207,12 @@ func Init() {
 	prometheus.MustRegister(failedFetchPKIDocs)
 	prometheus.MustRegister(failedPKICacheGeneration)
 	prometheus.MustRegister(invalidPKICache)
+	prometheus.MustRegister(decoyLoops)
+	prometheus.MustRegister(decoyLoopsLatency)
+	prometheus.MustRegister(decoyHopLoops)
+	prometheus.MustRegister(decoyLoopsLossRatio)
+	prometheus.MustRegister(decoyLoopsLossAlert)
+	prometheus.MustRegister(decoySuspectNodes)
 
 	// Expose registered metrics via HTTP
 	http.Handle("/metrics", promhttp.Handler())
@@ -284,3 +330,42 @@ func FailedPKICacheGeneration(epoch string) {
 func InvalidPKICache(epoch string) {
 	invalidPKICache.With(prometheus.Labels{"epoch": epoch})
 }
+
+func decoyLoopStatus(lost bool) string {
+	if lost {
+		return "lost"
+	}
+	return "returned"
+}
+
+// DecoyLoop increments the counters for returned or lost decoy loops, and
+// observes the latency of the returned ones
+func DecoyLoop(lost bool, latency time.Duration) {
+	decoyLoops.With(prometheus.Labels{"status": decoyLoopStatus(lost)}).Inc()
+	if !lost {
+		decoyLoopsLatency.Observe(latency.Seconds())
+	}
+}
+
+// DecoyHopLoop increments the counter for returned or lost decoy loops through a node
+func DecoyHopLoop(node string, lost bool) {
+	decoyHopLoops.With(prometheus.Labels{"node": node, "status": decoyLoopStatus(lost)}).Inc()
+}
+
+// DecoyLoopsLoss sets the decoy loop loss ratio, and whether it raised an alert
+func DecoyLoopsLoss(ratio float64, alert bool) {
+	decoyLoopsLossRatio.Set(ratio)
+	if alert {
+		decoyLoopsLossAlert.Set(1)
+	} else {
+		decoyLoopsLossAlert.Set(0)
+	}
+}
+
+// DecoySuspectNodes sets the loss ratios of the nodes suspected of dropping decoy loops
+func DecoySuspectNodes(suspects map[string]float64) {
+	decoySuspectNodes.Reset()
+	for node, ratio := range suspects {
+		decoySuspectNodes.With(prometheus.Labels{"node": node}).Set(ratio)
+	}
+}
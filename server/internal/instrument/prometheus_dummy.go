@@ -4,6 +4,8 @@
 package instrument
 
 import (
+	"time"
+
 	"github.com/katzenpost/katzenpost/core/wire/commands"
 )
 
@@ -75,3 +77,15 @@ func FailedPKICacheGeneration(epoch string) {}
 
 // InvalidPKICache increments the counter for the number of invalid cached PKI docs per epoch
 func InvalidPKICache(epoch string) {}
+
+// DecoyLoop increments the counters for returned or lost decoy loops
+func DecoyLoop(lost bool, latency time.Duration) {}
+
+// DecoyHopLoop increments the counter for returned or lost decoy loops through a node
+func DecoyHopLoop(node string, lost bool) {}
+
+// DecoyLoopsLoss sets the decoy loop loss ratio, and whether it raised an alert
+func DecoyLoopsLoss(ratio float64, alert bool) {}
+
+// DecoySuspectNodes sets the loss ratios of the nodes suspected of dropping decoy loops
+func DecoySuspectNodes(suspects map[string]float64) {}
@@ -28,9 +28,13 @@ import (
 	"sync/atomic"
 	"time"
 
-	"github.com/katzenpost/katzenpost/core/crypto/ecdh"
+	"github.com/cloudflare/circl/kem"
+	kemschemes "github.com/cloudflare/circl/kem/schemes"
+	"github.com/katzenpost/katzenpost/core/crypto/nike"
+	nikeschemes "github.com/katzenpost/katzenpost/core/crypto/nike/schemes"
 	"github.com/katzenpost/katzenpost/core/crypto/rand"
 	"github.com/katzenpost/katzenpost/core/epochtime"
+	"github.com/katzenpost/katzenpost/core/sphinx"
 	"github.com/katzenpost/katzenpost/core/worker"
 	"github.com/yawning/bloom"
 	bolt "go.etcd.io/bbolt"
@@ -57,6 +61,10 @@ const (
 	// KeyFmt is the format string corresponding to filenames for keys that
 	// have been persisted to disk.
 	KeyFmt = "mixkey-%d.db"
+
+	// legacyScheme is the scheme of keys persisted before the scheme
+	// was recorded in the database.
+	legacyScheme = "x25519"
 )
 
 var dbOptions = &bolt.Options{
@@ -68,9 +76,15 @@ type MixKey struct {
 	sync.Mutex
 	worker.Worker
 
-	db      *bolt.DB
-	keypair *ecdh.PrivateKey
-	epoch   uint64
+	db    *bolt.DB
+	epoch uint64
+
+	// Exactly one of the NIKE or KEM keypairs is set, depending on the
+	// Sphinx geometry the key was created for.
+	nikePrivateKey nike.PrivateKey
+	nikePublicKey  nike.PublicKey
+	kemPrivateKey  kem.PrivateKey
+	kemPublicKey   kem.PublicKey
 
 	f         *bloom.Filter
 	writeBack map[[TagLength]byte]bool
@@ -86,14 +100,41 @@ func (k *MixKey) SetUnlinkIfExpired(b bool) {
 	k.unlinkIfExpired = b
 }
 
-// PublicKey returns the public component of the key.
-func (k *MixKey) PublicKey() *ecdh.PublicKey {
-	return k.keypair.PublicKey()
+// PublicKey returns the public component of the NIKE key, or nil iff
+// the key is a KEM key.
+func (k *MixKey) PublicKey() nike.PublicKey {
+	return k.nikePublicKey
+}
+
+// PrivateKey returns the private component of the NIKE key, or nil iff
+// the key is a KEM key.
+func (k *MixKey) PrivateKey() nike.PrivateKey {
+	return k.nikePrivateKey
+}
+
+// KEMPublicKey returns the public component of the KEM key, or nil iff
+// the key is a NIKE key.
+func (k *MixKey) KEMPublicKey() kem.PublicKey {
+	return k.kemPublicKey
+}
+
+// KEMPrivateKey returns the private component of the KEM key, or nil iff
+// the key is a NIKE key.
+func (k *MixKey) KEMPrivateKey() kem.PrivateKey {
+	return k.kemPrivateKey
 }
 
-// PrivateKey returns the private component of the key.
-func (k *MixKey) PrivateKey() *ecdh.PrivateKey {
-	return k.keypair
+// PublicBytes returns the serialized public component of the key, suitable
+// for publication in a descriptor.
+func (k *MixKey) PublicBytes() []byte {
+	if k.kemPublicKey != nil {
+		b, err := k.kemPublicKey.MarshalBinary()
+		if err != nil {
+			panic("BUG: mixkey: Failed to serialize KEM public key: " + err.Error())
+		}
+		return b
+	}
+	return k.nikePublicKey.Bytes()
 }
 
 // Epoch returns the Katzenpost epoch associated with the keypair.
@@ -286,22 +327,70 @@ func (k *MixKey) forceClose() {
 			os.Remove(f)
 		}
 	}
-	if k.keypair != nil {
-		k.keypair.Reset()
-		k.keypair = nil
+	if k.nikePrivateKey != nil {
+		k.nikePrivateKey.Reset()
+		k.nikePrivateKey = nil
+	}
+	k.kemPrivateKey = nil
+}
+
+func (k *MixKey) privateBytes() ([]byte, error) {
+	if k.kemPrivateKey != nil {
+		return k.kemPrivateKey.MarshalBinary()
+	}
+	return k.nikePrivateKey.Bytes(), nil
+}
+
+func (k *MixKey) generate(nikeScheme nike.Nike, kemScheme kem.Scheme) error {
+	if kemScheme != nil {
+		var err error
+		k.kemPublicKey, k.kemPrivateKey, err = kemScheme.GenerateKeyPair()
+		return err
+	}
+	k.nikePrivateKey, k.nikePublicKey = nikeScheme.NewKeypair()
+	return nil
+}
+
+func (k *MixKey) load(nikeScheme nike.Nike, kemScheme kem.Scheme, b []byte) error {
+	if kemScheme != nil {
+		var err error
+		if k.kemPrivateKey, err = kemScheme.UnmarshalBinaryPrivateKey(b); err != nil {
+			return err
+		}
+		k.kemPublicKey = k.kemPrivateKey.Public()
+		return nil
+	}
+	k.nikePrivateKey = nikeScheme.NewEmptyPrivateKey()
+	if err := k.nikePrivateKey.FromBytes(b); err != nil {
+		return err
 	}
+	k.nikePublicKey = nikeScheme.DerivePublicKey(k.nikePrivateKey)
+	return nil
 }
 
 // New creates (or loads) a mix key in the provided data directory, for the
-// given epoch.
-func New(dataDir string, epoch uint64) (*MixKey, error) {
+// given epoch, using the NIKE or KEM scheme named by the Sphinx geometry.
+func New(dataDir string, epoch uint64, geo *sphinx.Geometry) (*MixKey, error) {
 	const (
 		versionKey = "version"
 		pkKey      = "privateKey"
 		epochKey   = "epochKey"
+		schemeKey  = "scheme"
 	)
 	var err error
 
+	var nikeScheme nike.Nike
+	var kemScheme kem.Scheme
+	schemeName := geo.NIKEName
+	if geo.KEMName != "" {
+		schemeName = geo.KEMName
+		if kemScheme = kemschemes.ByName(geo.KEMName); kemScheme == nil {
+			return nil, fmt.Errorf("mixkey: unknown KEM: '%v'", geo.KEMName)
+		}
+	} else if nikeScheme = nikeschemes.ByName(geo.NIKEName); nikeScheme == nil {
+		return nil, fmt.Errorf("mixkey: unknown NIKE: '%v'", geo.NIKEName)
+	}
+
 	// Initialize the structure and create or open the database.
 	k := &MixKey{
 		epoch:     epoch,
@@ -338,12 +427,20 @@ func New(dataDir string, epoch uint64) (*MixKey, error) {
 				return fmt.Errorf("mixkey: incompatible version: %d", uint(b[0]))
 			}
 
+			// Ensure the key is for the expected scheme.
+			dbScheme := legacyScheme
+			if b = bkt.Get([]byte(schemeKey)); b != nil {
+				dbScheme = string(b)
+			}
+			if dbScheme != schemeName {
+				return fmt.Errorf("mixkey: db scheme mismatch: '%v'", dbScheme)
+			}
+
 			// Deserialize the key.
 			if b = bkt.Get([]byte(pkKey)); b == nil {
 				return fmt.Errorf("mixkey: db missing privateKey entry")
 			}
-			k.keypair = new(ecdh.PrivateKey)
-			if err = k.keypair.FromBytes(b); err != nil {
+			if err = k.load(nikeScheme, kemScheme, b); err != nil {
 				return err
 			}
 
@@ -378,17 +475,21 @@ func New(dataDir string, epoch uint64) (*MixKey, error) {
 
 		// If control reaches here, then a new key needs to be created.
 		didCreate = true
-		k.keypair, err = ecdh.NewKeypair(rand.Reader)
+		if err = k.generate(nikeScheme, kemScheme); err != nil {
+			return err
+		}
+		rawPrivateKey, err := k.privateBytes()
 		if err != nil {
 			return err
 		}
 		var epochBytes [8]byte
 		binary.LittleEndian.PutUint64(epochBytes[:], epoch)
 
-		// Stash the version/key/epoch in the metadata bucket.
+		// Stash the version/key/epoch/scheme in the metadata bucket.
 		bkt.Put([]byte(versionKey), []byte{0})
-		bkt.Put([]byte(pkKey), k.keypair.Bytes())
+		bkt.Put([]byte(pkKey), rawPrivateKey)
 		bkt.Put([]byte(epochKey), epochBytes[:])
+		bkt.Put([]byte(schemeKey), []byte(schemeName))
 
 		return nil
 	}); err != nil {
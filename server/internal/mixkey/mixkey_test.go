@@ -23,6 +23,7 @@ import (
 	"testing"
 
 	"github.com/katzenpost/katzenpost/core/crypto/ecdh"
+	"github.com/katzenpost/katzenpost/core/sphinx"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -53,11 +54,39 @@ func TestMixKey(t *testing.T) {
 	os.RemoveAll(tmpDir)
 }
 
+func TestKEMMixKey(t *testing.T) {
+	require := require.New(t)
+
+	dir, err := os.MkdirTemp("", "mixkey_kem_tests")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+
+	def := sphinx.DefaultGeometry()
+	geo, err := sphinx.NewGeometry("", "Kyber768", def.UserForwardPayloadLength, def.NrHops)
+	require.NoError(err)
+
+	k, err := New(dir, testEpoch, geo)
+	require.NoError(err, "New()")
+	require.Nil(k.PrivateKey(), "NIKE private key")
+	require.NotNil(k.KEMPrivateKey(), "KEM private key")
+	pub := k.PublicBytes()
+	k.Deref()
+
+	k, err = New(dir, testEpoch, geo)
+	require.NoError(err, "New() load")
+	require.Equal(pub, k.PublicBytes(), "Serialized public key")
+	k.Deref()
+
+	// Keys must not be reused with a different scheme.
+	_, err = New(dir, testEpoch, def)
+	require.Error(err, "New() scheme mismatch")
+}
+
 func doTestCreate(t *testing.T) {
 	require := require.New(t)
 	assert := assert.New(t)
 
-	k, err := New(tmpDir, testEpoch)
+	k, err := New(tmpDir, testEpoch, sphinx.DefaultGeometry())
 	require.NoError(err, "New()")
 	testKeyPath = k.db.Path()
 	defer k.Deref()
@@ -85,7 +114,7 @@ func doTestLoad(t *testing.T) {
 	require := require.New(t)
 	assert := assert.New(t)
 
-	k, err := New(tmpDir, testEpoch)
+	k, err := New(tmpDir, testEpoch, sphinx.DefaultGeometry())
 	require.NoError(err, "New() load")
 	k.SetUnlinkIfExpired(true)
 	defer k.Deref()
@@ -127,7 +156,7 @@ func BenchmarkMixKey(b *testing.B) {
 }
 
 func doBenchIsReplayMiss(b *testing.B) {
-	k, err := New(tmpDir, testEpoch)
+	k, err := New(tmpDir, testEpoch, sphinx.DefaultGeometry())
 	if err != nil {
 		b.Fatalf("Failed to open key: %v", err)
 	}
@@ -154,7 +183,7 @@ func doBenchIsReplayMiss(b *testing.B) {
 }
 
 func doBenchIsReplayHit(b *testing.B) {
-	k, err := New(tmpDir, testEpoch)
+	k, err := New(tmpDir, testEpoch, sphinx.DefaultGeometry())
 	if err != nil {
 		b.Fatalf("Failed to open key: %v", err)
 	}
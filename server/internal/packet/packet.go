@@ -34,14 +34,8 @@ var (
 			return new(Packet)
 		},
 	}
-	rawPacketPool = sync.Pool{
-		New: func() interface{} {
-			geo := sphinx.DefaultGeometry()
-			b := make([]byte, geo.PacketLength)
-			return b
-		},
-	}
-	pktID uint64
+	rawPacketPool sync.Pool
+	pktID         uint64
 )
 
 type Packet struct {
@@ -159,6 +153,7 @@ func (pkt *Packet) Dispose() {
 	pkt.DispatchAt = 0
 	pkt.MustForward = false
 	pkt.MustTerminate = false
+	pkt.Geometry = nil
 
 	// Return the packet struct to the pool.
 	pktPool.Put(pkt)
@@ -171,12 +166,12 @@ func (pkt *Packet) copyToRaw(b []byte) error {
 	}
 
 	// The common case of standard packet sizes uses a pool allocator
-	// to store the raw packets.
-	pkt.Raw = rawPacketPool.Get().([]byte)
-
-	// Sanity check, just in case the pool allocator is doing something dumb.
-	if len(pkt.Raw) != len(b) {
-		panic("BUG: Pool allocated rawPkt has incorrect size")
+	// to store the raw packets, though the pool may hold buffers sized
+	// for a different geometry if the network's geometry changed.
+	if v, ok := rawPacketPool.Get().([]byte); ok && len(v) == len(b) {
+		pkt.Raw = v
+	} else {
+		pkt.Raw = make([]byte, len(b))
 	}
 
 	// Copy the raw packet into pkt's buffer.
@@ -186,26 +181,27 @@ func (pkt *Packet) copyToRaw(b []byte) error {
 }
 
 func (pkt *Packet) disposeRaw() {
-	if len(pkt.Raw) == pkt.Geometry.PacketLength {
+	if pkt.Geometry != nil && len(pkt.Raw) == pkt.Geometry.PacketLength {
 		utils.ExplicitBzero(pkt.Raw)
 		rawPacketPool.Put(pkt.Raw) // nolint: megacheck
 	}
 	pkt.Raw = nil
 }
 
-// New allocates a new Packet, with the specified raw payload.
-func New(raw []byte) (*Packet, error) {
+// New allocates a new Packet, with the specified raw payload and
+// Sphinx geometry.
+func New(raw []byte, geo *sphinx.Geometry) (*Packet, error) {
 	id := atomic.AddUint64(&pktID, 1)
-	return NewWithID(raw, id)
+	return NewWithID(raw, id, geo)
 }
 
 // NewWithID allocates a new Packet, with the specified raw payload and ID.
 // Most callers should use New, this exists to support serializing packets
 // to external memory.
-func NewWithID(raw []byte, id uint64) (*Packet, error) {
+func NewWithID(raw []byte, id uint64, geo *sphinx.Geometry) (*Packet, error) {
 	v := pktPool.Get()
 	pkt := v.(*Packet)
-	pkt.Geometry = sphinx.DefaultGeometry()
+	pkt.Geometry = geo
 	pkt.ID = id
 	if err := pkt.copyToRaw(raw); err != nil {
 		pkt.Dispose()
@@ -279,7 +275,10 @@ func NewPacketFromSURB(pkt *Packet, surb, payload []byte) (*Packet, error) {
 	// packet processing doesn't constantly utilize the AES-NI units due
 	// to the non-AEZ components of a Sphinx Unwrap operation.
 
-	s := sphinx.DefaultSphinx()
+	s, err := sphinx.FromGeometry(pkt.Geometry)
+	if err != nil {
+		return nil, err
+	}
 	rawRespPkt, firstHop, err := s.NewPacketFromSURB(surb, respPayload)
 	if err != nil {
 		return nil, err
@@ -297,8 +296,7 @@ func NewPacketFromSURB(pkt *Packet, surb, payload []byte) (*Packet, error) {
 	cmds = append(cmds, nodeDelayCmd)
 
 	// Assemble the response packet.
-	respPkt, _ := New(rawRespPkt)
-	respPkt.Geometry = pkt.Geometry
+	respPkt, _ := New(rawRespPkt, pkt.Geometry)
 	respPkt.Set(nil, cmds)
 
 	respPkt.RecvAt = pkt.RecvAt
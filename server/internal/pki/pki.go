@@ -30,7 +30,6 @@ import (
 	nClient "github.com/katzenpost/katzenpost/authority/nonvoting/client"
 	vClient "github.com/katzenpost/katzenpost/authority/voting/client"
 	vServer "github.com/katzenpost/katzenpost/authority/voting/server"
-	"github.com/katzenpost/katzenpost/core/crypto/ecdh"
 	"github.com/katzenpost/katzenpost/core/epochtime"
 	cpki "github.com/katzenpost/katzenpost/core/pki"
 	sConstants "github.com/katzenpost/katzenpost/core/sphinx/constants"
@@ -269,6 +268,9 @@ func (p *pki) validateCacheEntry(ent *pkicache.Entry) error {
 	if !desc.LinkKey.Equal(p.glue.LinkKey().PublicKey()) {
 		return fmt.Errorf("self link key mismatch")
 	}
+	if !ent.Document().SphinxGeometry.Equal(p.glue.Config().SphinxGeometry) {
+		return fmt.Errorf("sphinx geometry mismatch")
+	}
 	return nil
 }
 
@@ -368,6 +370,14 @@ func (p *pki) publishDescriptorIfNeeded(pkiCtx context.Context) error {
 		LinkKey:     p.glue.LinkKey().PublicKey(),
 		Addresses:   p.descAddrMap,
 		Epoch:       epoch,
+		LoadWeight:  p.glue.Config().Server.LoadWeight,
+		LoopReport:  p.glue.Decoy().LoopReport(),
+	}
+	if rotation := p.glue.KeyRotation(); rotation != nil {
+		// Publish the key rotation statement for as long as it is valid.
+		if _, _, err := cpki.VerifyKeyRotation(rotation); err == nil {
+			desc.KeyRotation = rotation
+		}
 	}
 	if p.glue.Config().Server.IsProvider {
 		// Only set the layer if the node is a provider.  Otherwise, nodes
@@ -388,7 +398,11 @@ func (p *pki) publishDescriptorIfNeeded(pkiCtx context.Context) error {
 			desc.AuthenticationType = cpki.OutOfBandAuth
 		}
 	}
-	desc.MixKeys = make(map[uint64]*ecdh.PublicKey)
+	desc.MixKeys = make(map[uint64][]byte)
+	desc.MixKeyScheme = p.glue.Config().Server.SphinxNIKE
+	if geo := p.glue.Config().SphinxGeometry; geo.KEMName != "" {
+		desc.MixKeyScheme = geo.KEMName
+	}
 
 	// Ensure that there are mix keys for the epochs [e, ..., e+2],
 	// assuming that key rotation isn't disabled, and fill them into
@@ -672,6 +686,15 @@ func New(glue glue.Glue) (glue.PKI, error) {
 		p.descAddrMap[kTransport] = v
 	}
 
+	for k, v := range glue.Config().Server.TransportAddresses {
+		kTransport := cpki.Transport(strings.ToLower(k))
+		if _, ok := p.descAddrMap[kTransport]; ok || len(v) == 0 {
+			// Advertise the AltAddresses of the transport instead.
+			continue
+		}
+		p.descAddrMap[kTransport] = v
+	}
+
 	if len(p.descAddrMap) == 0 {
 		return nil, errors.New("Descriptor address map is zero size.")
 	}
@@ -683,6 +706,7 @@ func New(glue glue.Glue) (glue.PKI, error) {
 			Address:              glue.Config().PKI.Nonvoting.Address,
 			AuthorityIdentityKey: glue.Config().PKI.Nonvoting.PublicKey,
 			AuthorityLinkKey:     glue.Config().PKI.Nonvoting.LinkPublicKey,
+			SphinxGeometry:       glue.Config().SphinxGeometry,
 		}
 		p.impl, err = nClient.New(pkiCfg)
 		if err != nil {
@@ -690,9 +714,10 @@ func New(glue glue.Glue) (glue.PKI, error) {
 		}
 	} else {
 		pkiCfg := &vClient.Config{
-			LinkKey:     glue.LinkKey(),
-			LogBackend:  glue.LogBackend(),
-			Authorities: glue.Config().PKI.Voting.Authorities,
+			LinkKey:        glue.LinkKey(),
+			LogBackend:     glue.LogBackend(),
+			Authorities:    glue.Config().PKI.Voting.Authorities,
+			SphinxGeometry: glue.Config().SphinxGeometry,
 		}
 		p.impl, err = vClient.New(pkiCfg)
 		if err != nil {
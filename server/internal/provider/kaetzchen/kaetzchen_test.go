@@ -30,6 +30,7 @@ import (
 	"github.com/katzenpost/katzenpost/core/crypto/sign"
 	"github.com/katzenpost/katzenpost/core/log"
 	"github.com/katzenpost/katzenpost/core/monotime"
+	"github.com/katzenpost/katzenpost/core/pki"
 	"github.com/katzenpost/katzenpost/core/sphinx"
 	"github.com/katzenpost/katzenpost/core/sphinx/commands"
 	"github.com/katzenpost/katzenpost/core/sphinx/constants"
@@ -127,6 +128,10 @@ func (d *mockDecoy) OnNewDocument(*pkicache.Entry) {}
 
 func (d *mockDecoy) OnPacket(*packet.Packet) {}
 
+func (d *mockDecoy) LoopReport() *pki.LoopReport {
+	return nil
+}
+
 type mockServer struct {
 	cfg               *config.Config
 	logBackend        *log.Backend
@@ -166,6 +171,10 @@ func (g *mockGlue) LinkKey() wire.PrivateKey {
 	return g.s.linkKey
 }
 
+func (g *mockGlue) KeyRotation() []byte {
+	return nil
+}
+
 func (g *mockGlue) Management() *thwack.Server {
 	return g.s.management
 }
@@ -297,7 +306,7 @@ func TestKaetzchenWorker(t *testing.T) {
 
 	// invalid packet test case
 	payload := make([]byte, geo.PacketLength)
-	testPacket, err := packet.New(payload)
+	testPacket, err := packet.New(payload, geo)
 	require.NoError(t, err)
 	testPacket.Recipient = &commands.Recipient{
 		ID: recipient,
@@ -309,7 +318,7 @@ func TestKaetzchenWorker(t *testing.T) {
 
 	// timeout test case
 	payload = make([]byte, geo.PacketLength)
-	testPacket, err = packet.New(payload)
+	testPacket, err = packet.New(payload, geo)
 	require.NoError(t, err)
 	testPacket.Recipient = &commands.Recipient{
 		ID: recipient,
@@ -320,7 +329,7 @@ func TestKaetzchenWorker(t *testing.T) {
 
 	// working test case
 	payload = make([]byte, geo.PacketLength)
-	testPacket, err = packet.New(payload)
+	testPacket, err = packet.New(payload, geo)
 	require.NoError(t, err)
 	testPacket.Recipient = &commands.Recipient{
 		ID: recipient,
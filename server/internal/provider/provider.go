@@ -28,7 +28,6 @@ import (
 	"github.com/katzenpost/katzenpost/core/crypto/rand"
 	"github.com/katzenpost/katzenpost/core/epochtime"
 	"github.com/katzenpost/katzenpost/core/monotime"
-	"github.com/katzenpost/katzenpost/core/sphinx"
 	sConstants "github.com/katzenpost/katzenpost/core/sphinx/constants"
 	"github.com/katzenpost/katzenpost/core/thwack"
 	"github.com/katzenpost/katzenpost/core/wire"
@@ -259,7 +258,7 @@ func (p *provider) worker() {
 }
 
 func (p *provider) onSURBReply(pkt *packet.Packet, recipient []byte) {
-	geo := sphinx.DefaultGeometry()
+	geo := pkt.Geometry
 	if len(pkt.Payload) != geo.PayloadTagLength+geo.ForwardPayloadLength {
 		p.log.Debugf("Refusing to store mis-sized SURB-Reply: %v (%v)", pkt.ID, len(pkt.Payload))
 		return
@@ -270,6 +269,15 @@ func (p *provider) onSURBReply(pkt *packet.Packet, recipient []byte) {
 		p.log.Debugf("Failed to store SURB-Reply: %v (%v)", pkt.ID, err)
 	} else {
 		p.log.Debugf("Stored SURB-Reply: %v", pkt.ID)
+		p.notifyListeners(recipient)
+	}
+}
+
+// notifyListeners informs the listeners that a message was stored in the
+// recipient's spool, so that it can be pushed to a connected client.
+func (p *provider) notifyListeners(recipient []byte) {
+	for _, l := range p.glue.Listeners() {
+		l.OnMessageStored(recipient)
 	}
 }
 
@@ -286,6 +294,7 @@ func (p *provider) onToUser(pkt *packet.Packet, recipient []byte) {
 		p.log.Debugf("Failed to store message payload: %v (%v)", pkt.ID, err)
 		return
 	}
+	p.notifyListeners(recipient)
 
 	// Iff there is a SURB, generate a SURB-ACK and schedule.
 	if surb != nil {
@@ -25,6 +25,7 @@ import (
 	"time"
 
 	"github.com/katzenpost/katzenpost/core/monotime"
+	"github.com/katzenpost/katzenpost/core/sphinx"
 	"github.com/katzenpost/katzenpost/core/sphinx/commands"
 	"github.com/katzenpost/katzenpost/server/internal/glue"
 	"github.com/katzenpost/katzenpost/server/internal/packet"
@@ -108,13 +109,13 @@ func packetToBoltBkt(parentBkt *bolt.Bucket, pkt *packet.Packet, prio time.Durat
 	return nil
 }
 
-func packetFromBoltBkt(parentBkt *bolt.Bucket, k []byte) (*packet.Packet, error) {
+func packetFromBoltBkt(parentBkt *bolt.Bucket, k []byte, geo *sphinx.Geometry) (*packet.Packet, error) {
 	bkt := parentBkt.Bucket(k)
 	if bkt == nil {
 		panic("BUG: packet does not exist")
 	}
 
-	pkt, err := packet.NewWithID(bkt.Get([]byte(boltPacketRawKey)), binary.BigEndian.Uint64(k[8:]))
+	pkt, err := packet.NewWithID(bkt.Get([]byte(boltPacketRawKey)), binary.BigEndian.Uint64(k[8:]), geo)
 	if err != nil {
 		return nil, err
 	}
@@ -230,7 +231,7 @@ func (q *boltQueue) Pop() {
 			var err error
 			if deltaT := now - prio; deltaT > timerSlack {
 				q.log.Debugf("Dropping packet: %v (Deadline blown by %v)", id, deltaT)
-			} else if pkt, err = packetFromBoltBkt(packetsBkt, k); err != nil {
+			} else if pkt, err = packetFromBoltBkt(packetsBkt, k, q.glue.Config().SphinxGeometry); err != nil {
 				q.log.Debugf("Dropping packet: %v (s11n failure: %v)", id, err)
 			}
 
@@ -60,6 +60,9 @@ func (m *mockGlue) IdentityPublicKey() sign.PublicKey {
 func (m *mockGlue) LinkKey() wire.PrivateKey {
 	return nil
 }
+func (m *mockGlue) KeyRotation() []byte {
+	return nil
+}
 func (m *mockGlue) Listeners() []glue.Listener {
 	return make([]glue.Listener, 0)
 }
@@ -97,7 +100,7 @@ func TestMemoryQueueBulkEnqueue(t *testing.T) {
 	payload := make([]byte, geo.PacketLength)
 	for i := 0; i < 100; i++ {
 		// create a set of packets with out-of-order delays
-		pkts[i], err = packet.New(payload)
+		pkts[i], err = packet.New(payload, geo)
 		require.NoError(err)
 		pkts[i].Delay = time.Millisecond * time.Duration((i%2)*400+i*5+40)
 	}
@@ -19,7 +19,6 @@ package sqldb
 import (
 	"errors"
 	"fmt"
-	"strings"
 
 	"github.com/jackc/pgx"
 	"github.com/katzenpost/katzenpost/core/crypto/rand"
@@ -27,6 +26,7 @@ import (
 	"github.com/katzenpost/katzenpost/core/utils"
 	"github.com/katzenpost/katzenpost/core/wire"
 	"github.com/katzenpost/katzenpost/server/spool"
+	"github.com/katzenpost/katzenpost/server/storage"
 	"github.com/katzenpost/katzenpost/server/userdb"
 )
 
@@ -71,30 +71,6 @@ func (p *pgxImpl) Close() {
 	p.pool.Close()
 }
 
-func (p *pgxImpl) Log(level pgx.LogLevel, msg string, data map[string]interface{}) {
-	if level == pgx.LogLevelNone {
-		return
-	}
-
-	argVec := make([]interface{}, 0, 1+len(data))
-	argVec = append(argVec, msg+" ")
-	for k, v := range data {
-		argVec = append(argVec, fmt.Sprintf("%s=%v ", k, v))
-	}
-	mStr := strings.TrimSpace(fmt.Sprint(argVec...))
-
-	switch level {
-	case pgx.LogLevelDebug:
-		p.d.log.Debug(mStr)
-	case pgx.LogLevelInfo:
-		p.d.log.Info(mStr)
-	case pgx.LogLevelWarn:
-		p.d.log.Warning(mStr)
-	case pgx.LogLevelError:
-		p.d.log.Error(mStr)
-	}
-}
-
 func (p *pgxImpl) initMetadata() error {
 	const (
 		metadataQuery    = "SELECT * FROM metadata_get() AS (schema_version smallint, spool_only boolean);"
@@ -159,17 +135,7 @@ func newPgxImpl(db *SQLDB, dataSourceName string) (dbImpl, error) {
 		d: db,
 	}
 
-	connCfg, err := pgx.ParseConnectionString(dataSourceName)
-	if err != nil {
-		return nil, err
-	}
-	connCfg.Logger = p
-	connCfg.LogLevel = toPgxLogLevel(p.d.glue.Config().Logging.Level)
-	poolCfg := pgx.ConnPoolConfig{
-		ConnConfig:     connCfg,
-		MaxConnections: numConns,
-	}
-
+	var err error
 	isOk := false
 	defer func() {
 		if !isOk {
@@ -179,7 +145,7 @@ func newPgxImpl(db *SQLDB, dataSourceName string) (dbImpl, error) {
 		}
 	}()
 
-	if p.pool, err = pgx.NewConnPool(poolCfg); err != nil {
+	if p.pool, err = storage.NewPgxConnPool(dataSourceName, numConns, p.d.log, p.d.glue.Config().Logging.Level); err != nil {
 		return nil, err
 	}
 	if err = p.initMetadata(); err != nil {
@@ -359,21 +325,6 @@ func newPgxSpool(p *pgxImpl) *pgxSpool {
 	}
 }
 
-func toPgxLogLevel(cfgLevel string) pgx.LogLevel {
-	switch cfgLevel {
-	case "ERROR":
-		return pgx.LogLevelError
-	case "WARNING", "NOTICE", "INFO":
-		// pgx.LogLevelInfo is unsafe for user privacy, so don't expose that
-		// unless debugging is enabled.
-		return pgx.LogLevelWarn
-	case "DEBUG":
-		return pgx.LogLevelDebug
-	default:
-		panic("BUG: Invalid log level in toPgxLogLevel()")
-	}
-}
-
 func isPgNoDataFound(err error) bool {
 	if pgxErr, ok := err.(pgx.PgError); ok {
 		if pgxErr.Code == pgCodeNoDataFound {
@@ -0,0 +1,148 @@
+// keyrotation.go - Katzenpost server identity and link key rotation.
+// Copyright (C) 2022  David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/katzenpost/katzenpost/core/crypto/cert"
+	"github.com/katzenpost/katzenpost/core/crypto/pem"
+	"github.com/katzenpost/katzenpost/core/crypto/rand"
+	"github.com/katzenpost/katzenpost/core/crypto/sign"
+	cpki "github.com/katzenpost/katzenpost/core/pki"
+	"github.com/katzenpost/katzenpost/core/utils"
+	"github.com/katzenpost/katzenpost/core/wire"
+	"github.com/katzenpost/katzenpost/server/config"
+)
+
+const (
+	identityPrivateKeyFile = "identity.private.pem"
+	identityPublicKeyFile  = "identity.public.pem"
+	linkPrivateKeyFile     = "link.private.pem"
+	linkPublicKeyFile      = "link.public.pem"
+	keyRotationFile        = "key_rotation.cbor"
+)
+
+var keyFiles = []string{
+	identityPrivateKeyFile,
+	identityPublicKeyFile,
+	linkPrivateKeyFile,
+	linkPublicKeyFile,
+}
+
+// RotateKeys replaces the identity and link keys in the data directory of
+// the server by new ones, and writes the key rotation statement from the
+// old identity key to the new one.  The server publishes the statement in
+// its descriptor, so that the directory authorities transfer its
+// authorization to the new key.  The old keys are kept with the ".old"
+// suffix.  The server must not be running.
+//
+// The statement is written before the keys are replaced, and a rotation
+// interrupted after it was written is completed by running RotateKeys
+// again.  A new rotation is refused as long as the statement of the
+// previous one is valid or the old keys of the previous one are kept, as
+// the directory authorities may not have followed it yet.
+func RotateKeys(cfg *config.Config) error {
+	path := func(f string) string {
+		return filepath.Join(cfg.Server.DataDir, f)
+	}
+
+	if statement, err := os.ReadFile(path(keyRotationFile)); err == nil {
+		_, newKey, err := cpki.VerifyKeyRotation(statement)
+		switch err {
+		case nil:
+			// Complete an interrupted rotation to the new keys.
+			_, pendingKey := cert.Scheme.NewKeypair()
+			if err := pem.FromFile(path(identityPublicKeyFile+".new"), pendingKey); err == nil && pendingKey.Equal(newKey) {
+				return utils.SwapFiles(cfg.Server.DataDir, keyFiles)
+			}
+			return errors.New("server: the previous key rotation statement is still valid, remove it once the directory authorities have followed the rotation")
+		case cert.ErrCertificateExpired:
+		default:
+			return fmt.Errorf("server: invalid key rotation statement: %v", err)
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	for _, f := range keyFiles {
+		if pem.Exists(path(f + ".old")) {
+			return errors.New("server: the keys of a previous rotation exist, remove the .old keys once the directory authorities have followed the rotation")
+		}
+	}
+
+	oldPrivateKey, oldPublicKey := cert.Scheme.NewKeypair()
+	if !pem.BothExists(path(identityPrivateKeyFile), path(identityPublicKeyFile)) {
+		return errors.New("server: no identity key to rotate")
+	}
+	if err := pem.FromFile(path(identityPrivateKeyFile), oldPrivateKey); err != nil {
+		return err
+	}
+	if err := pem.FromFile(path(identityPublicKeyFile), oldPublicKey); err != nil {
+		return err
+	}
+
+	newPrivateKey, newPublicKey := cert.Scheme.NewKeypair()
+	statement, err := cpki.SignKeyRotation(oldPrivateKey, oldPublicKey, newPrivateKey, newPublicKey)
+	if err != nil {
+		return err
+	}
+	linkPrivateKey, linkPublicKey := wire.DefaultScheme.GenerateKeypair(rand.Reader)
+
+	// Write the new keys aside, then the statement, so that the keys are
+	// only replaced once the statement is persisted, and the data
+	// directory never holds a partial key.
+	newKeys := map[string]pem.KeyMaterial{
+		identityPrivateKeyFile: newPrivateKey,
+		identityPublicKeyFile:  newPublicKey,
+		linkPrivateKeyFile:     linkPrivateKey,
+		linkPublicKeyFile:      linkPublicKey,
+	}
+	for _, f := range keyFiles {
+		os.Remove(path(f + ".new"))
+		if err := pem.ToFile(path(f+".new"), newKeys[f]); err != nil {
+			return err
+		}
+	}
+	if err := utils.WriteFileSync(path(keyRotationFile), statement); err != nil {
+		return err
+	}
+	return utils.SwapFiles(cfg.Server.DataDir, keyFiles)
+}
+
+// loadKeyRotation returns the key rotation statement to the identity key
+// from the data directory, or nil if there is none or it has expired.
+func loadKeyRotation(dataDir string, identityKey sign.PublicKey) ([]byte, error) {
+	statement, err := os.ReadFile(filepath.Join(dataDir, keyRotationFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	_, newKey, err := cpki.VerifyKeyRotation(statement)
+	if err == cert.ErrCertificateExpired {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("server: invalid key rotation statement: %v", err)
+	}
+	if !newKey.Equal(identityKey) {
+		return nil, errors.New("server: key rotation statement is not to the identity key")
+	}
+	return statement, nil
+}
@@ -0,0 +1,97 @@
+// keyrotation_test.go - Katzenpost server key rotation tests.
+// Copyright (C) 2022  David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/katzenpost/katzenpost/core/crypto/cert"
+	"github.com/katzenpost/katzenpost/core/crypto/pem"
+	cpki "github.com/katzenpost/katzenpost/core/pki"
+	"github.com/katzenpost/katzenpost/server/config"
+)
+
+func TestRotateKeys(t *testing.T) {
+	require := require.New(t)
+
+	cfg := &config.Config{Server: &config.Server{DataDir: t.TempDir()}}
+	path := func(f string) string {
+		return filepath.Join(cfg.Server.DataDir, f)
+	}
+	require.Error(RotateKeys(cfg))
+
+	oldKey, oldPub := cert.Scheme.NewKeypair()
+	require.NoError(pem.ToFile(path(identityPrivateKeyFile), oldKey))
+	require.NoError(pem.ToFile(path(identityPublicKeyFile), oldPub))
+	statement, err := loadKeyRotation(cfg.Server.DataDir, oldPub)
+	require.NoError(err)
+	require.Nil(statement)
+
+	require.NoError(RotateKeys(cfg))
+	_, retiredPub := cert.Scheme.NewKeypair()
+	require.NoError(pem.FromFile(path(identityPublicKeyFile+".old"), retiredPub))
+	require.True(retiredPub.Equal(oldPub))
+	_, newPub := cert.Scheme.NewKeypair()
+	require.NoError(pem.FromFile(path(identityPublicKeyFile), newPub))
+	require.False(newPub.Equal(oldPub))
+	require.True(pem.BothExists(path(linkPrivateKeyFile), path(linkPublicKeyFile)))
+
+	statement, err = loadKeyRotation(cfg.Server.DataDir, newPub)
+	require.NoError(err)
+	fromKey, toKey, err := cpki.VerifyKeyRotation(statement)
+	require.NoError(err)
+	require.True(fromKey.Equal(oldPub))
+	require.True(toKey.Equal(newPub))
+
+	// The statement must be to the identity key.
+	_, err = loadKeyRotation(cfg.Server.DataDir, oldPub)
+	require.Error(err)
+
+	// A new rotation waits for the previous one to be followed.
+	require.Error(RotateKeys(cfg))
+	require.NoError(os.Remove(path(keyRotationFile)))
+	require.Error(RotateKeys(cfg))
+	for _, f := range keyFiles {
+		os.Remove(path(f + ".old"))
+	}
+
+	// A rotation interrupted after its statement was written is completed
+	// by running it again.
+	nextKey, nextPub := cert.Scheme.NewKeypair()
+	newKey, _ := cert.Scheme.NewKeypair()
+	require.NoError(pem.FromFile(path(identityPrivateKeyFile), newKey))
+	statement, err = cpki.SignKeyRotation(newKey, newPub, nextKey, nextPub)
+	require.NoError(err)
+	require.NoError(os.WriteFile(path(keyRotationFile), statement, 0600))
+	require.NoError(pem.ToFile(path(identityPrivateKeyFile+".new"), nextKey))
+	require.NoError(pem.ToFile(path(identityPublicKeyFile+".new"), nextPub))
+	require.NoError(os.Rename(path(identityPublicKeyFile), path(identityPublicKeyFile+".old")))
+	require.NoError(RotateKeys(cfg))
+	_, currentPub := cert.Scheme.NewKeypair()
+	require.NoError(pem.FromFile(path(identityPublicKeyFile), currentPub))
+	require.True(currentPub.Equal(nextPub))
+	require.NoError(pem.FromFile(path(identityPublicKeyFile+".old"), retiredPub))
+	require.True(retiredPub.Equal(newPub))
+	require.NoError(pem.FromFile(path(identityPrivateKeyFile+".old"), newKey))
+	statement, err = loadKeyRotation(cfg.Server.DataDir, nextPub)
+	require.NoError(err)
+	require.NotNil(statement)
+}
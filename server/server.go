@@ -22,6 +22,7 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
 
 	"gitlab.com/yawning/aez.git"
@@ -33,6 +34,7 @@ import (
 	"github.com/katzenpost/katzenpost/core/crypto/rand"
 	"github.com/katzenpost/katzenpost/core/crypto/sign"
 	"github.com/katzenpost/katzenpost/core/log"
+	cpki "github.com/katzenpost/katzenpost/core/pki"
 	"github.com/katzenpost/katzenpost/core/thwack"
 	"github.com/katzenpost/katzenpost/core/utils"
 	"github.com/katzenpost/katzenpost/core/wire"
@@ -58,6 +60,7 @@ type Server struct {
 
 	identityPrivateKey sign.PrivateKey
 	identityPublicKey  sign.PublicKey
+	keyRotation        []byte
 	linkKey            wire.PrivateKey
 
 	logBackend *log.Backend
@@ -247,8 +250,8 @@ func New(cfg *config.Config) (*Server, error) {
 	s.log.Noticef("Server identifier is: '%v'", s.cfg.Server.Identifier)
 
 	// Initialize the server identity and link keys.
-	identityPrivateKeyFile := filepath.Join(s.cfg.Server.DataDir, "identity.private.pem")
-	identityPublicKeyFile := filepath.Join(s.cfg.Server.DataDir, "identity.public.pem")
+	identityPrivateKeyFile := filepath.Join(s.cfg.Server.DataDir, identityPrivateKeyFile)
+	identityPublicKeyFile := filepath.Join(s.cfg.Server.DataDir, identityPublicKeyFile)
 
 	s.identityPrivateKey, s.identityPublicKey = cert.Scheme.NewKeypair()
 
@@ -277,8 +280,13 @@ func New(cfg *config.Config) (*Server, error) {
 	var err error
 	idPubKeyHash := s.identityPublicKey.Sum256()
 	s.log.Noticef("Server identity public key hash is: %x", idPubKeyHash[:])
-	linkPrivateKeyFile := filepath.Join(s.cfg.Server.DataDir, "link.private.pem")
-	linkPublicKeyFile := filepath.Join(s.cfg.Server.DataDir, "link.public.pem")
+	if s.keyRotation, err = loadKeyRotation(s.cfg.Server.DataDir, s.identityPublicKey); err != nil {
+		return nil, err
+	} else if s.keyRotation != nil {
+		s.log.Noticef("Server identity key was rotated, publishing the key rotation statement.")
+	}
+	linkPrivateKeyFile := filepath.Join(s.cfg.Server.DataDir, linkPrivateKeyFile)
+	linkPublicKeyFile := filepath.Join(s.cfg.Server.DataDir, linkPublicKeyFile)
 	scheme := wire.DefaultScheme
 
 	linkPrivateKey, linkPublicKey := scheme.GenerateKeypair(rand.Reader)
@@ -396,7 +404,11 @@ func New(cfg *config.Config) (*Server, error) {
 	s.inboundPackets = channels.NewInfiniteChannel()
 	s.cryptoWorkers = make([]*cryptoworker.Worker, 0, s.cfg.Debug.NumSphinxWorkers)
 	for i := 0; i < s.cfg.Debug.NumSphinxWorkers; i++ {
-		w := cryptoworker.New(goo, s.inboundPackets.Out(), i)
+		w, err := cryptoworker.New(goo, s.inboundPackets.Out(), i)
+		if err != nil {
+			s.log.Errorf("Failed to initialize crypto worker: %v", err)
+			return nil, err
+		}
 		s.cryptoWorkers = append(s.cryptoWorkers, w)
 	}
 
@@ -410,14 +422,24 @@ func New(cfg *config.Config) (*Server, error) {
 
 	// Bring the listener(s) online.
 	s.listeners = make([]glue.Listener, 0, len(s.cfg.Server.Addresses))
-	for i, addr := range s.cfg.Server.Addresses {
-		l, err := incoming.New(goo, s.inboundPackets.In(), i, addr)
+	for _, addr := range s.cfg.Server.Addresses {
+		l, err := incoming.New(goo, s.inboundPackets.In(), len(s.listeners), cpki.TransportTCP, addr)
 		if err != nil {
 			s.log.Errorf("Failed to spawn listener on address: %v (%v).", addr, err)
 			return nil, err
 		}
 		s.listeners = append(s.listeners, l)
 	}
+	for t, addrs := range s.cfg.Server.TransportAddresses {
+		for _, addr := range addrs {
+			l, err := incoming.New(goo, s.inboundPackets.In(), len(s.listeners), cpki.Transport(strings.ToLower(t)), addr)
+			if err != nil {
+				s.log.Errorf("Failed to spawn %v listener on address: %v (%v).", t, addr, err)
+				return nil, err
+			}
+			s.listeners = append(s.listeners, l)
+		}
+	}
 
 	s.pki.StartWorker()
 
@@ -459,6 +481,10 @@ func (g *serverGlue) LinkKey() wire.PrivateKey {
 	return g.s.linkKey
 }
 
+func (g *serverGlue) KeyRotation() []byte {
+	return g.s.keyRotation
+}
+
 func (g *serverGlue) Management() *thwack.Server {
 	return g.s.management
 }
@@ -0,0 +1,116 @@
+// bolt.go - Katzenpost service storage bolt backend.
+// Copyright (C) 2022  David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package storage
+
+import (
+	"bytes"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+type boltStorage struct {
+	db *bolt.DB
+}
+
+func (s *boltStorage) Get(bucket string, key []byte) ([]byte, error) {
+	var value []byte
+	err := s.db.View(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket([]byte(bucket))
+		if bkt == nil {
+			return ErrNotFound
+		}
+		v := bkt.Get(key)
+		if v == nil {
+			return ErrNotFound
+		}
+		// values are only valid for the life of the transaction
+		value = make([]byte, len(v))
+		copy(value, v)
+		return nil
+	})
+	return value, err
+}
+
+func (s *boltStorage) ForEach(bucket string, prefix []byte, fn func(key, value []byte) error) error {
+	return s.ForEachFrom(bucket, prefix, nil, fn)
+}
+
+func (s *boltStorage) ForEachFrom(bucket string, prefix, start []byte, fn func(key, value []byte) error) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket([]byte(bucket))
+		if bkt == nil {
+			return nil
+		}
+		cur := bkt.Cursor()
+		for k, v := cur.Seek(seekKey(prefix, start)); k != nil && bytes.HasPrefix(k, prefix); k, v = cur.Next() {
+			if err := fn(k, v); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *boltStorage) Put(bucket string, key, value []byte) error {
+	b := new(Batch)
+	b.Put(bucket, key, value)
+	return s.Write(b)
+}
+
+func (s *boltStorage) Delete(bucket string, key []byte) error {
+	b := new(Batch)
+	b.Delete(bucket, key)
+	return s.Write(b)
+}
+
+func (s *boltStorage) Write(b *Batch) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		for _, op := range b.ops {
+			if op.value == nil {
+				bkt := tx.Bucket([]byte(op.bucket))
+				if bkt == nil {
+					continue
+				}
+				if err := bkt.Delete(op.key); err != nil {
+					return err
+				}
+				continue
+			}
+			bkt, err := tx.CreateBucketIfNotExists([]byte(op.bucket))
+			if err != nil {
+				return err
+			}
+			if err := bkt.Put(op.key, op.value); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *boltStorage) Close() error {
+	s.db.Sync()
+	return s.db.Close()
+}
+
+func newBoltStorage(path string) (*boltStorage, error) {
+	db, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &boltStorage{db: db}, nil
+}
@@ -0,0 +1,116 @@
+// mem.go - Katzenpost service storage in-memory backend.
+// Copyright (C) 2022  David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package storage
+
+import (
+	"sort"
+	"strings"
+	"sync"
+)
+
+type memStorage struct {
+	sync.RWMutex
+
+	buckets map[string]map[string][]byte
+}
+
+func (s *memStorage) Get(bucket string, key []byte) ([]byte, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	v, ok := s.buckets[bucket][string(key)]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	value := make([]byte, len(v))
+	copy(value, v)
+	return value, nil
+}
+
+func (s *memStorage) ForEach(bucket string, prefix []byte, fn func(key, value []byte) error) error {
+	return s.ForEachFrom(bucket, prefix, nil, fn)
+}
+
+func (s *memStorage) ForEachFrom(bucket string, prefix, start []byte, fn func(key, value []byte) error) error {
+	// Iterate over a snapshot, so that fn is called without the lock.
+	s.RLock()
+	keys := []string{}
+	values := make(map[string][]byte)
+	for k, v := range s.buckets[bucket] {
+		if strings.HasPrefix(k, string(prefix)) && k >= string(start) {
+			keys = append(keys, k)
+			values[k] = v
+		}
+	}
+	s.RUnlock()
+
+	sort.Strings(keys)
+	for _, k := range keys {
+		if err := fn([]byte(k), values[k]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *memStorage) Put(bucket string, key, value []byte) error {
+	b := new(Batch)
+	b.Put(bucket, key, value)
+	return s.Write(b)
+}
+
+func (s *memStorage) Delete(bucket string, key []byte) error {
+	b := new(Batch)
+	b.Delete(bucket, key)
+	return s.Write(b)
+}
+
+func (s *memStorage) Write(b *Batch) error {
+	s.Lock()
+	defer s.Unlock()
+
+	for _, op := range b.ops {
+		bkt, ok := s.buckets[op.bucket]
+		if op.value == nil {
+			if ok {
+				delete(bkt, string(op.key))
+				if len(bkt) == 0 {
+					delete(s.buckets, op.bucket)
+				}
+			}
+			continue
+		}
+		if !ok {
+			bkt = make(map[string][]byte)
+			s.buckets[op.bucket] = bkt
+		}
+		value := make([]byte, len(op.value))
+		copy(value, op.value)
+		bkt[string(op.key)] = value
+	}
+	return nil
+}
+
+func (s *memStorage) Close() error {
+	return nil
+}
+
+func newMemStorage() *memStorage {
+	return &memStorage{
+		buckets: make(map[string]map[string][]byte),
+	}
+}
@@ -0,0 +1,241 @@
+// pgx.go - Katzenpost service storage SQL backend.
+// Copyright (C) 2022  David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package storage
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/jackc/pgx"
+	"gopkg.in/op/go-logging.v1"
+)
+
+const (
+	pgxTagGet           = "storage_get"
+	pgxTagForEach       = "storage_for_each"
+	pgxTagForEachPrefix = "storage_for_each_prefix"
+	pgxTagPut           = "storage_put"
+	pgxTagDelete        = "storage_delete"
+
+	pgxMaxConns = 5
+)
+
+// PgxLogger is a pgx.Logger which logs to a go-logging Logger.
+type PgxLogger struct {
+	log *logging.Logger
+}
+
+// Log implements pgx.Logger.
+func (l *PgxLogger) Log(level pgx.LogLevel, msg string, data map[string]interface{}) {
+	if level == pgx.LogLevelNone {
+		return
+	}
+
+	argVec := make([]interface{}, 0, 1+len(data))
+	argVec = append(argVec, msg+" ")
+	for k, v := range data {
+		argVec = append(argVec, fmt.Sprintf("%s=%v ", k, v))
+	}
+	mStr := strings.TrimSpace(fmt.Sprint(argVec...))
+
+	switch level {
+	case pgx.LogLevelDebug:
+		l.log.Debug(mStr)
+	case pgx.LogLevelInfo:
+		l.log.Info(mStr)
+	case pgx.LogLevelWarn:
+		l.log.Warning(mStr)
+	case pgx.LogLevelError:
+		l.log.Error(mStr)
+	}
+}
+
+// NewPgxLogger returns a PgxLogger which logs to log.
+func NewPgxLogger(log *logging.Logger) *PgxLogger {
+	return &PgxLogger{log: log}
+}
+
+// PgxLogLevel returns the pgx log level corresponding to the logging
+// level of a configuration.
+func PgxLogLevel(cfgLevel string) pgx.LogLevel {
+	switch cfgLevel {
+	case "ERROR":
+		return pgx.LogLevelError
+	case "WARNING", "NOTICE", "INFO":
+		// pgx.LogLevelInfo is unsafe for user privacy, so don't expose that
+		// unless debugging is enabled.
+		return pgx.LogLevelWarn
+	case "DEBUG":
+		return pgx.LogLevelDebug
+	default:
+		panic("BUG: Invalid log level in PgxLogLevel()")
+	}
+}
+
+// NewPgxConnPool connects to the database with up to numConns connections.
+func NewPgxConnPool(dataSourceName string, numConns int, log *logging.Logger, logLevel string) (*pgx.ConnPool, error) {
+	connCfg, err := pgx.ParseConnectionString(dataSourceName)
+	if err != nil {
+		return nil, err
+	}
+	connCfg.Logger = NewPgxLogger(log)
+	connCfg.LogLevel = PgxLogLevel(logLevel)
+	poolCfg := pgx.ConnPoolConfig{
+		ConnConfig:     connCfg,
+		MaxConnections: numConns,
+	}
+	return pgx.NewConnPool(poolCfg)
+}
+
+type pgxStorage struct {
+	pool      *pgx.ConnPool
+	namespace string
+}
+
+func (s *pgxStorage) Get(bucket string, key []byte) ([]byte, error) {
+	var value []byte
+	err := s.pool.QueryRow(pgxTagGet, s.namespace, bucket, key).Scan(&value)
+	if err == pgx.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	return value, err
+}
+
+func (s *pgxStorage) ForEach(bucket string, prefix []byte, fn func(key, value []byte) error) error {
+	return s.ForEachFrom(bucket, prefix, nil, fn)
+}
+
+func (s *pgxStorage) ForEachFrom(bucket string, prefix, start []byte, fn func(key, value []byte) error) error {
+	// pgx binds a nil []byte as NULL, which no key compares to
+	from := seekKey(prefix, start)
+	if from == nil {
+		from = []byte{}
+	}
+	// the keys with the prefix are the range up to its successor, so that
+	// the primary key index is used
+	var rows *pgx.Rows
+	var err error
+	if end := prefixSuccessor(prefix); end != nil {
+		rows, err = s.pool.Query(pgxTagForEachPrefix, s.namespace, bucket, from, end)
+	} else {
+		rows, err = s.pool.Query(pgxTagForEach, s.namespace, bucket, from)
+	}
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var key, value []byte
+		if err := rows.Scan(&key, &value); err != nil {
+			return err
+		}
+		if err := fn(key, value); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// prefixSuccessor returns the least key greater than every key with the
+// prefix, or nil if there is none because the prefix is empty or all 0xff.
+func prefixSuccessor(prefix []byte) []byte {
+	for i := len(prefix) - 1; i >= 0; i-- {
+		if prefix[i] != 0xff {
+			end := append([]byte{}, prefix[:i+1]...)
+			end[i]++
+			return end
+		}
+	}
+	return nil
+}
+
+func (s *pgxStorage) Put(bucket string, key, value []byte) error {
+	b := new(Batch)
+	b.Put(bucket, key, value)
+	return s.Write(b)
+}
+
+func (s *pgxStorage) Delete(bucket string, key []byte) error {
+	b := new(Batch)
+	b.Delete(bucket, key)
+	return s.Write(b)
+}
+
+func (s *pgxStorage) Write(b *Batch) error {
+	tx, err := s.pool.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, op := range b.ops {
+		if op.value == nil {
+			_, err = tx.Exec(pgxTagDelete, s.namespace, op.bucket, op.key)
+		} else {
+			_, err = tx.Exec(pgxTagPut, s.namespace, op.bucket, op.key, op.value)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *pgxStorage) Close() error {
+	s.pool.Close()
+	return nil
+}
+
+func newPgxStorage(dataSourceName, namespace string, log *logging.Logger) (*pgxStorage, error) {
+	// Query parameters are unsafe for user privacy, so are never logged.
+	pool, err := NewPgxConnPool(dataSourceName, pgxMaxConns, log, "WARNING")
+	if err != nil {
+		return nil, err
+	}
+	s := &pgxStorage{
+		pool:      pool,
+		namespace: namespace,
+	}
+
+	const createTable = `CREATE TABLE IF NOT EXISTS storage (
+  namespace text NOT NULL,
+  bucket    text NOT NULL,
+  key       bytea NOT NULL,
+  value     bytea NOT NULL,
+  PRIMARY KEY (namespace, bucket, key)
+);`
+	if _, err = pool.Exec(createTable); err != nil {
+		pool.Close()
+		return nil, fmt.Errorf("storage/pgx: failed to create table: %v", err)
+	}
+
+	stmts := []struct {
+		tag, query string
+	}{
+		{pgxTagGet, "SELECT value FROM storage WHERE namespace = $1 AND bucket = $2 AND key = $3;"},
+		{pgxTagForEach, "SELECT key, value FROM storage WHERE namespace = $1 AND bucket = $2 AND key >= $3::bytea ORDER BY key;"},
+		{pgxTagForEachPrefix, "SELECT key, value FROM storage WHERE namespace = $1 AND bucket = $2 AND key >= $3::bytea AND key < $4::bytea ORDER BY key;"},
+		{pgxTagPut, "INSERT INTO storage(namespace, bucket, key, value) VALUES ($1, $2, $3, $4) ON CONFLICT (namespace, bucket, key) DO UPDATE SET value = EXCLUDED.value;"},
+		{pgxTagDelete, "DELETE FROM storage WHERE namespace = $1 AND bucket = $2 AND key = $3;"},
+	}
+	for _, v := range stmts {
+		if _, err := pool.Prepare(v.tag, v.query); err != nil {
+			pool.Close()
+			return nil, fmt.Errorf("storage/pgx: failed to prepare statement %v: %v", v.tag, err)
+		}
+	}
+	return s, nil
+}
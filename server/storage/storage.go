@@ -0,0 +1,164 @@
+// storage.go - Katzenpost service storage.
+// Copyright (C) 2022  David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package storage provides the key value stores used to persist the state
+// of the services run as CBOR plugins, such as memspool, PANDA and Reunion,
+// with bolt, SQL and in-memory backends.
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"gopkg.in/op/go-logging.v1"
+)
+
+const (
+	// BackendBolt is the backend which stores the data in a bolt database
+	// file, where each bucket is a top level bolt bucket.
+	BackendBolt = "bolt"
+
+	// BackendSQL is the backend which stores the data in a PostgreSQL
+	// database, which may be shared by several services.
+	BackendSQL = "sql"
+
+	// BackendMem is the backend which holds the data in memory only.
+	BackendMem = "mem"
+)
+
+// ErrNotFound is the error returned when a key is not present.
+var ErrNotFound = errors.New("storage: key not found")
+
+// Storage is the interface provided by all storage implementations. The
+// keys of each bucket are ordered lexicographically, and buckets exist as
+// long as they have keys.
+type Storage interface {
+	// Get returns the value of the key in the bucket, or ErrNotFound.
+	Get(bucket string, key []byte) ([]byte, error)
+
+	// ForEach calls fn for each key in the bucket with the given prefix
+	// in order, until fn returns an error which ForEach then returns.
+	// fn must not modify the Storage.
+	ForEach(bucket string, prefix []byte, fn func(key, value []byte) error) error
+
+	// ForEachFrom is like ForEach, but starts at the first key with the
+	// prefix which is not less than start, without visiting the keys
+	// before it.
+	ForEachFrom(bucket string, prefix, start []byte, fn func(key, value []byte) error) error
+
+	// Put sets the value of the key in the bucket.
+	Put(bucket string, key, value []byte) error
+
+	// Delete removes the key from the bucket, if present.
+	Delete(bucket string, key []byte) error
+
+	// Write applies the writes of the batch atomically.
+	Write(b *Batch) error
+
+	// Close closes the Storage instance.
+	Close() error
+}
+
+type batchOp struct {
+	bucket string
+	key    []byte
+	value  []byte // nil for a delete
+}
+
+// Batch is a sequence of writes applied atomically by Storage.Write.
+type Batch struct {
+	ops []batchOp
+}
+
+// Put adds a write of the value of the key in the bucket to the batch.
+func (b *Batch) Put(bucket string, key, value []byte) {
+	if value == nil {
+		value = []byte{}
+	}
+	b.ops = append(b.ops, batchOp{bucket: bucket, key: key, value: value})
+}
+
+// Delete adds the removal of the key from the bucket to the batch.
+func (b *Batch) Delete(bucket string, key []byte) {
+	b.ops = append(b.ops, batchOp{bucket: bucket, key: key})
+}
+
+// Len returns the number of writes in the batch.
+func (b *Batch) Len() int {
+	return len(b.ops)
+}
+
+// seekKey returns the first key ForEachFrom may visit: start, unless it
+// is less than every key with the prefix.
+func seekKey(prefix, start []byte) []byte {
+	if bytes.Compare(start, prefix) < 0 {
+		return prefix
+	}
+	return start
+}
+
+// Config is the configuration of a Storage.
+type Config struct {
+	// Backend is the storage backend, one of BackendBolt, BackendSQL and
+	// BackendMem.
+	Backend string
+
+	// Path is the file path of the bolt database.
+	Path string
+
+	// DataSourceName is the connection string of the SQL database.
+	DataSourceName string
+
+	// Namespace separates the data of the services sharing a SQL
+	// database.
+	Namespace string
+}
+
+func (cfg *Config) validate() error {
+	switch cfg.Backend {
+	case BackendBolt:
+		if cfg.Path == "" {
+			return errors.New("storage: no bolt database path specified")
+		}
+	case BackendSQL:
+		if cfg.DataSourceName == "" {
+			return errors.New("storage: no SQL data source name specified")
+		}
+		if cfg.Namespace == "" {
+			return errors.New("storage: no SQL namespace specified")
+		}
+	case BackendMem:
+	default:
+		return fmt.Errorf("storage: invalid backend: '%v'", cfg.Backend)
+	}
+	return nil
+}
+
+// New opens the Storage of the configuration.
+func New(cfg *Config, log *logging.Logger) (Storage, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	switch cfg.Backend {
+	case BackendBolt:
+		return newBoltStorage(cfg.Path)
+	case BackendSQL:
+		return newPgxStorage(cfg.DataSourceName, cfg.Namespace, log)
+	default:
+		return newMemStorage(), nil
+	}
+}
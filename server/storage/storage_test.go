@@ -0,0 +1,170 @@
+// storage_test.go - Katzenpost service storage tests.
+// Copyright (C) 2022  David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/katzenpost/katzenpost/core/log"
+)
+
+// sqlDSNEnv names the environment variable holding the connection string
+// of the PostgreSQL database the SQL backend is tested against, which is
+// skipped when it is not set.
+const sqlDSNEnv = "KATZENPOST_STORAGE_TEST_DSN"
+
+func TestStorage(t *testing.T) {
+	logBackend, err := log.New("", "DEBUG", false)
+	require.NoError(t, err)
+
+	cfgs := []*Config{
+		{Backend: BackendMem},
+		{Backend: BackendBolt, Path: filepath.Join(t.TempDir(), "storage.db")},
+	}
+	if dsn := os.Getenv(sqlDSNEnv); dsn != "" {
+		namespace := fmt.Sprintf("test_%d", time.Now().UnixNano())
+		cfgs = append(cfgs, &Config{Backend: BackendSQL, DataSourceName: dsn, Namespace: namespace})
+	} else {
+		t.Logf("%s is not set, skipping the %s backend", sqlDSNEnv, BackendSQL)
+	}
+	for _, cfg := range cfgs {
+		t.Run(cfg.Backend, func(t *testing.T) {
+			s, err := New(cfg, logBackend.GetLogger("storage"))
+			require.NoError(t, err)
+			defer s.Close()
+			testStorage(t, s)
+		})
+	}
+}
+
+// testStorage runs the same operations against every backend.
+func testStorage(t *testing.T, s Storage) {
+	require := require.New(t)
+
+	_, err := s.Get("a", []byte("missing"))
+	require.Equal(ErrNotFound, err)
+	require.NoError(s.Delete("a", []byte("missing")))
+
+	require.NoError(s.Put("a", []byte("k2"), []byte("v2")))
+	require.NoError(s.Put("a", []byte("k1"), []byte("v1")))
+	require.NoError(s.Put("a", []byte("j1"), []byte("w1")))
+	require.NoError(s.Put("b", []byte("k1"), []byte("x1")))
+	require.NoError(s.Put("a", []byte("k2"), []byte("v2'")))
+	value, err := s.Get("a", []byte("k2"))
+	require.NoError(err)
+	require.Equal([]byte("v2'"), value)
+
+	// keys are iterated over in order, and only within the bucket
+	keys, values := []string{}, []string{}
+	err = s.ForEach("a", []byte("k"), func(k, v []byte) error {
+		keys = append(keys, string(k))
+		values = append(values, string(v))
+		return nil
+	})
+	require.NoError(err)
+	require.Equal([]string{"k1", "k2"}, keys)
+	require.Equal([]string{"v1", "v2'"}, values)
+	keys = []string{}
+	require.NoError(s.ForEach("a", nil, func(k, v []byte) error {
+		keys = append(keys, string(k))
+		return nil
+	}))
+	require.Equal([]string{"j1", "k1", "k2"}, keys)
+	keys = []string{}
+	require.NoError(s.ForEachFrom("a", []byte("k"), []byte("k10"), func(k, v []byte) error {
+		keys = append(keys, string(k))
+		return nil
+	}))
+	require.Equal([]string{"k2"}, keys)
+	keys = []string{}
+	require.NoError(s.ForEachFrom("a", []byte("k"), []byte("a"), func(k, v []byte) error {
+		keys = append(keys, string(k))
+		return nil
+	}))
+	require.Equal([]string{"k1", "k2"}, keys)
+	require.NoError(s.ForEach("c", nil, func(k, v []byte) error {
+		return errors.New("empty bucket iterated over")
+	}))
+	errStop := errors.New("stop")
+	n := 0
+	require.Equal(errStop, s.ForEach("a", nil, func(k, v []byte) error {
+		n++
+		return errStop
+	}))
+	require.Equal(1, n)
+
+	b := new(Batch)
+	b.Delete("a", []byte("k1"))
+	b.Put("b", []byte("k2"), []byte("x2"))
+	require.Equal(2, b.Len())
+	require.NoError(s.Write(b))
+	_, err = s.Get("a", []byte("k1"))
+	require.Equal(ErrNotFound, err)
+	value, err = s.Get("b", []byte("k2"))
+	require.NoError(err)
+	require.Equal([]byte("x2"), value)
+
+	// a nil prefix iterates over the whole bucket from the start key
+	keys = []string{}
+	require.NoError(s.ForEachFrom("a", nil, []byte("k"), func(k, v []byte) error {
+		keys = append(keys, string(k))
+		return nil
+	}))
+	require.Equal([]string{"k2"}, keys)
+	// a start key past the keys with the prefix visits none of them
+	require.NoError(s.ForEachFrom("a", []byte("j"), []byte("k"), func(k, v []byte) error {
+		return errors.New("key past the prefix iterated over")
+	}))
+	// the keys with a prefix ending in 0xff are bounded by the next prefix
+	require.NoError(s.Put("a", []byte{'k', 0xff, 1}, []byte("v3")))
+	require.NoError(s.Put("a", []byte{'l'}, []byte("v4")))
+	keys = []string{}
+	require.NoError(s.ForEach("a", []byte{'k', 0xff}, func(k, v []byte) error {
+		keys = append(keys, string(k))
+		return nil
+	}))
+	require.Equal([]string{string([]byte{'k', 0xff, 1})}, keys)
+}
+
+func TestConfig(t *testing.T) {
+	require := require.New(t)
+
+	require.Error((&Config{Backend: "invalid"}).validate())
+	require.Error((&Config{Backend: BackendBolt}).validate())
+	require.Error((&Config{Backend: BackendSQL, DataSourceName: "postgres://"}).validate())
+	require.NoError((&Config{Backend: BackendSQL, DataSourceName: "postgres://", Namespace: "test"}).validate())
+	require.NoError((&Config{Backend: BackendMem}).validate())
+}
+
+func TestPrefixSuccessor(t *testing.T) {
+	require := require.New(t)
+
+	require.Nil(prefixSuccessor(nil))
+	require.Nil(prefixSuccessor([]byte{0xff, 0xff}))
+	require.Equal([]byte("l"), prefixSuccessor([]byte("k")))
+	require.Equal([]byte{'l'}, prefixSuccessor([]byte{'k', 0xff}))
+	prefix := []byte{1, 2}
+	require.Equal([]byte{1, 3}, prefixSuccessor(prefix))
+	require.Equal([]byte{1, 2}, prefix)
+}